@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AbBucketHeader = "X-Ab-Bucket"
+
+	abCookieMaxAge = 30 * 24 * time.Hour
+)
+
+// AbBuckets assigns sticky A/B experiment bucket to clients.
+// The bucket is stored in a cookie and forwarded to PHP as X-Ab-Bucket header (HTTP_X_AB_BUCKET param).
+type AbBuckets struct {
+	names   []string
+	weights []int
+	total   int
+
+	config *Config
+}
+
+func NewAbBuckets(config *Config) (*AbBuckets, error) {
+	ab := &AbBuckets{config: config}
+	for _, definition := range config.AbBuckets {
+		name, weight, found := strings.Cut(definition, ":")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid A/B bucket definition: %s", definition)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid A/B bucket weight %q: %s", weight, definition)
+		}
+		ab.names = append(ab.names, name)
+		ab.weights = append(ab.weights, w)
+		ab.total += w
+	}
+	return ab, nil
+}
+
+// Enabled reports whether any buckets are configured
+func (ab *AbBuckets) Enabled() bool {
+	return len(ab.names) > 0
+}
+
+// Middleware keeps bucket of returning clients and assigns a new one to others
+func (ab *AbBuckets) Middleware(next http.Handler) http.Handler {
+	if !ab.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket := ""
+		if cookie, err := r.Cookie(ab.config.AbCookie); err == nil && ab.valid(cookie.Value) {
+			bucket = cookie.Value
+		} else {
+			bucket = ab.assign()
+			http.SetCookie(w, &http.Cookie{
+				Name:     ab.config.AbCookie,
+				Value:    bucket,
+				Path:     "/",
+				MaxAge:   int(abCookieMaxAge.Seconds()),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		// replaces value sent by the client
+		r.Header.Set(AbBucketHeader, bucket)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ab *AbBuckets) valid(bucket string) bool {
+	return containsString(ab.names, bucket)
+}
+
+// assign picks bucket randomly according to weights
+func (ab *AbBuckets) assign() string {
+	n := rand.Intn(ab.total)
+	for i, weight := range ab.weights {
+		if n < weight {
+			return ab.names[i]
+		}
+		n -= weight
+	}
+	return ab.names[len(ab.names)-1]
+}
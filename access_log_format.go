@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+// access log timestamp formats
+const (
+	AccessTimeFormatRfc3339   = "rfc3339"
+	AccessTimeFormatRfc3339Ms = "rfc3339_ms"
+	AccessTimeFormatEpochMs   = "epoch_ms"
+	AccessTimeFormatClf       = "clf" // Apache Common Log Format, e.g. 10/Oct/2000:13:55:36 -0700
+)
+
+var accessTimeLayouts = map[string]string{
+	AccessTimeFormatRfc3339:   time.RFC3339,
+	AccessTimeFormatRfc3339Ms: "2006-01-02T15:04:05.000Z07:00",
+	AccessTimeFormatClf:       "02/Jan/2006:15:04:05 -0700",
+}
+
+// validateAccessTimeFormat checks the format is known, empty format keeps the timestamp of other logs
+func validateAccessTimeFormat(format string) error {
+	if _, found := accessTimeLayouts[format]; found || format == "" || format == AccessTimeFormatEpochMs {
+		return nil
+	}
+	return fmt.Errorf("invalid access log time format %q, use %s, %s, %s or %s",
+		format, AccessTimeFormatRfc3339, AccessTimeFormatRfc3339Ms, AccessTimeFormatEpochMs, AccessTimeFormatClf)
+}
+
+// newAccessLogOutput returns logger writing access log entries with their own timestamp format,
+// entries go to the same output and hooks as other logs
+func newAccessLogOutput(logger *logrus.Logger, config *Config) *logrus.Logger {
+	if config.AccessLogTimeFormat == "" {
+		return logger
+	}
+	return &logrus.Logger{
+		Out:       logger.Out,
+		Hooks:     logger.Hooks,
+		Formatter: newAccessLogFormatter(config.LogFormat, config.AccessLogTimeFormat),
+		Level:     logrus.InfoLevel,
+		ExitFunc:  logger.ExitFunc,
+	}
+}
+
+func newAccessLogFormatter(logFormat string, timeFormat string) logrus.Formatter {
+	layout, isLayout := accessTimeLayouts[timeFormat]
+	if logFormat == LogFormatText {
+		if isLayout {
+			return &logrus.TextFormatter{FullTimestamp: true, TimestampFormat: layout}
+		}
+		return &epochMsFormatter{next: &logrus.TextFormatter{DisableTimestamp: true}, prefix: "time=", separator: " "}
+	}
+	if isLayout {
+		return &logrus.JSONFormatter{TimestampFormat: layout}
+	}
+	return &epochMsFormatter{next: &logrus.JSONFormatter{DisableTimestamp: true}, prefix: `{"time":`, separator: ","}
+}
+
+// epochMsFormatter puts milliseconds since epoch in front of the entry formatted without timestamp,
+// logrus formatters support only time layouts
+type epochMsFormatter struct {
+	next      logrus.Formatter
+	prefix    string
+	separator string
+}
+
+func (f *epochMsFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	formatted, err := f.next.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	if f.prefix[0] == '{' {
+		formatted = bytes.TrimPrefix(formatted, []byte("{")) // JSON object is opened by the prefix
+	}
+
+	out := make([]byte, 0, len(f.prefix)+16+len(formatted))
+	out = append(out, f.prefix...)
+	out = strconv.AppendInt(out, entry.Time.UnixMilli(), 10)
+	out = append(out, f.separator...)
+	return append(out, formatted...), nil
+}
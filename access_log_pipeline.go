@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogFields are fields of access log entries, pipelines may select a subset of them
+var accessLogFields = []string{
+	"app", "method", "query", "status", "route", "size", "full_url", "user_agent", "request_id", "tenant",
+	"fpm_pool", "fpm_pid", "fpm_active_processes",
+}
+
+// AccessPipeline writes access log entries in its own format to its own output, e.g. concise text to stdout
+// for humans and complete JSON to a file or socket for ingestion. Each pipeline samples entries independently.
+// Pipeline is defined by semicolon separated settings:
+//
+//	output=stdout|stderr|/path/to/file|udp://host:port|tcp://host:port|unix:///path (default stdout)
+//	format=text|json (default json)
+//	sample=0-1 fraction of logged requests (default 1)
+//	fields=method,status,full_url (default all fields)
+type AccessPipeline struct {
+	output *logrus.Logger
+	sample float64
+	fields map[string]bool // nil means all fields
+	closer io.Closer
+}
+
+func NewAccessPipeline(definition string, config *Config) (*AccessPipeline, error) {
+	pipeline := &AccessPipeline{sample: 1}
+	target, format := LogOutputStdout, LogFormatJson
+	for _, setting := range strings.Split(definition, ";") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		key, value, found := strings.Cut(setting, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid access log pipeline %q, use key=value settings separated by semicolons", definition)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "output":
+			target = value
+		case "format":
+			if value != LogFormatJson && value != LogFormatText {
+				return nil, fmt.Errorf("invalid access log pipeline %q: format must be %s or %s", definition, LogFormatJson, LogFormatText)
+			}
+			format = value
+		case "sample":
+			sample, err := strconv.ParseFloat(value, 64)
+			if err != nil || sample <= 0 || sample > 1 {
+				return nil, fmt.Errorf("invalid access log pipeline %q: sample must be between 0 and 1", definition)
+			}
+			pipeline.sample = sample
+		case "fields":
+			pipeline.fields = map[string]bool{}
+			for _, field := range strings.Split(value, ",") {
+				field = strings.TrimSpace(field)
+				if !containsString(accessLogFields, field) {
+					return nil, fmt.Errorf("invalid access log pipeline %q: unknown field %q, known fields: %s", definition, field, strings.Join(accessLogFields, ", "))
+				}
+				pipeline.fields[field] = true
+			}
+		default:
+			return nil, fmt.Errorf("invalid access log pipeline %q: unknown setting %q", definition, key)
+		}
+	}
+
+	writer, err := openAccessLogOutput(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log pipeline %q: %w", definition, err)
+	}
+	if closer, ok := writer.(io.Closer); ok && writer != os.Stdout && writer != os.Stderr {
+		pipeline.closer = closer
+	}
+	pipeline.output = &logrus.Logger{
+		Out:       writer,
+		Hooks:     logrus.LevelHooks{},
+		Formatter: pipelineFormatter(format, config.AccessLogTimeFormat),
+		Level:     logrus.InfoLevel,
+		ExitFunc:  os.Exit,
+	}
+	return pipeline, nil
+}
+
+// pipelineFormatter returns formatter of the pipeline, --access-log-time-format applies to all pipelines
+func pipelineFormatter(format string, timeFormat string) logrus.Formatter {
+	if timeFormat != "" {
+		return newAccessLogFormatter(format, timeFormat)
+	}
+	if format == LogFormatText {
+		return &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}
+	}
+	return &logrus.JSONFormatter{}
+}
+
+// openAccessLogOutput opens standard output, file (appended) or socket
+func openAccessLogOutput(target string) (io.Writer, error) {
+	switch target {
+	case LogOutputStdout:
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	if !strings.Contains(target, "://") {
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open access log file: %w", err)
+		}
+		return file, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output %q: %w", target, err)
+	}
+	writer := &socketWriter{}
+	switch u.Scheme {
+	case "udp", "tcp":
+		writer.network, writer.address = u.Scheme, u.Host
+	case "unix":
+		writer.network, writer.address = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("invalid output %q, use stdout, stderr, file path, udp://, tcp:// or unix://", target)
+	}
+	if err := writer.connect(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Log writes the record when it's sampled
+func (p *AccessPipeline) Log(record AccessRecord) {
+	if p.sample < 1 && rand.Float64() >= p.sample {
+		return
+	}
+	fields := accessRecordFields(record)
+	if p.fields != nil {
+		for name := range fields {
+			if !p.fields[name] {
+				delete(fields, name)
+			}
+		}
+	}
+	p.output.WithFields(fields).WithTime(record.Time).Info("access")
+}
+
+// Close closes file or socket of the pipeline
+func (p *AccessPipeline) Close() {
+	if p.closer != nil {
+		_ = p.closer.Close()
+	}
+}
+
+// accessRecordFields returns all fields of the record, empty optional fields are left out
+func accessRecordFields(record AccessRecord) logrus.Fields {
+	fields := logrus.Fields{
+		"app":        record.App,
+		"method":     record.Method,
+		"query":      record.Query,
+		"status":     record.Status,
+		"route":      record.Route,
+		"size":       record.Size,
+		"full_url":   record.FullUrl,
+		"user_agent": record.UserAgent,
+		"request_id": record.RequestId,
+	}
+	if record.Tenant != "" {
+		fields["tenant"] = record.Tenant
+	}
+	if record.FpmPool != "" {
+		fields["fpm_pool"] = record.FpmPool
+		fields["fpm_active_processes"] = record.FpmActiveProcesses
+	}
+	if record.FpmPid != 0 {
+		fields["fpm_pid"] = record.FpmPid
+	}
+	return fields
+}
+
+// socketWriter writes entries to UDP, TCP or unix datagram socket, each entry is written at once
+type socketWriter struct {
+	mu      sync.Mutex
+	network string
+	address string
+	conn    net.Conn
+}
+
+func (w *socketWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn != nil {
+		if n, err := w.conn.Write(p); err == nil {
+			return n, nil
+		}
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	// reconnect once, e.g. after log collector restart
+	if err := w.connect(); err != nil {
+		return 0, err
+	}
+	return w.conn.Write(p)
+}
+
+// connect dials the socket, caller must hold the lock (or be the constructor)
+func (w *socketWriter) connect() error {
+	conn, err := net.DialTimeout(w.network, w.address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s %s: %w", w.network, w.address, err)
+	}
+	w.conn = conn
+	return nil
+}
+
+func (w *socketWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
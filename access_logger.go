@@ -3,22 +3,55 @@ package main
 import (
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type AccessLogger struct {
-	config *Config
-	logger *logrus.Logger
+	sink      *AccessSink
+	fpmStatus *FpmStatusReader
+	output    *logrus.Logger // access log entries, it has its own timestamp format when configured
+	pipelines []*AccessPipeline
+	enabled   atomic.Bool // --access-log, it can be toggled by SIGHUP reload
+	config    *Config
+	logger    *logrus.Logger
 }
 
-func NewAccessLogger(config *Config, logger *logrus.Logger) *AccessLogger {
-	return &AccessLogger{
-		config: config,
-		logger: logger,
+func NewAccessLogger(config *Config, sink *AccessSink, fpmStatus *FpmStatusReader, logger *logrus.Logger) (*AccessLogger, error) {
+	pipelines := make([]*AccessPipeline, 0, len(config.AccessLogPipelines))
+	for _, definition := range config.AccessLogPipelines {
+		pipeline, err := NewAccessPipeline(definition, config)
+		if err != nil {
+			return nil, err
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	accessLogger := &AccessLogger{
+		sink:      sink,
+		fpmStatus: fpmStatus,
+		output:    newAccessLogOutput(logger, config),
+		pipelines: pipelines,
+		config:    config,
+		logger:    logger,
+	}
+	accessLogger.enabled.Store(config.AccessLog)
+	return accessLogger, nil
+}
+
+// SetEnabled turns logging of access log entries to the log output on or off, pipelines and sink are not affected
+func (accessLogger *AccessLogger) SetEnabled(enabled bool) {
+	accessLogger.enabled.Store(enabled)
+}
+
+// Close closes files and sockets of access log pipelines
+func (accessLogger *AccessLogger) Close() {
+	for _, pipeline := range accessLogger.pipelines {
+		pipeline.Close()
 	}
 }
 
 func (accessLogger *AccessLogger) LogFpm(request *http.Request, response *ResponseData) {
-	if !accessLogger.config.AccessLog {
+	if !accessLogger.enabled.Load() && !accessLogger.sink.Enabled() && len(accessLogger.pipelines) == 0 {
 		return // do not log access logs
 	}
 
@@ -37,13 +70,79 @@ func (accessLogger *AccessLogger) LogFpm(request *http.Request, response *Respon
 		return
 	}
 
-	accessLogger.logger.WithFields(logrus.Fields{
-		"method":     request.Method,
-		"query":      request.URL.Query(),
-		"status":     response.Status,
-		"route":      response.Route,
-		"size":       len(response.Body),
-		"full_url":   request.URL.String(),
-		"user_agent": request.Header.Get("User-Agent"),
-	}).Info("access")
+	size := len(response.Body)
+	if response.Stream != nil {
+		size = int(response.StreamedSize)
+	}
+
+	record := AccessRecord{
+		Time:      time.Now().In(accessLogger.config.AccessLogLocation),
+		App:       accessLogger.config.App,
+		Method:    request.Method,
+		Query:     request.URL.Query(),
+		Status:    response.Status,
+		Route:     response.Route,
+		Size:      size,
+		FullUrl:   request.URL.String(),
+		UserAgent: request.Header.Get("User-Agent"),
+		RequestId: request.Header.Get(RequestIdHeader),
+		Tenant:    tenantOf(request),
+	}
+
+	slow := response.FpmDuration >= accessLogger.config.SlowRequestThreshold
+	if accessLogger.fpmStatus.Enabled() && response.FpmDuration > 0 && (slow || response.Status >= 500) {
+		// FPM status is read without delaying the response
+		query := request.URL.RawQuery
+		go func() {
+			accessLogger.correlate(&record, query, response.FpmDuration)
+			accessLogger.emit(record)
+		}()
+		return
+	}
+	accessLogger.emit(record)
+}
+
+// correlate adds FPM pool name, worker PID (when it can be derived) and number of active workers to the record
+func (accessLogger *AccessLogger) correlate(record *AccessRecord, query string, duration time.Duration) {
+	status, err := accessLogger.fpmStatus.Fetch()
+	if err != nil {
+		accessLogger.logger.Warnf("could not read FPM status: %s", err)
+		return
+	}
+	record.FpmPool = status.Pool
+	record.FpmActiveProcesses = status.ActiveProcesses
+	if pid, found := status.FindWorker(record.Method, query, duration); found {
+		record.FpmPid = pid
+	}
+}
+
+func (accessLogger *AccessLogger) emit(record AccessRecord) {
+	accessLogger.sink.Send(record)
+	for _, pipeline := range accessLogger.pipelines {
+		pipeline.Log(record)
+	}
+
+	if !accessLogger.enabled.Load() {
+		return
+	}
+	fields := logrus.Fields{
+		"method":     record.Method,
+		"query":      record.Query,
+		"status":     record.Status,
+		"route":      record.Route,
+		"size":       record.Size,
+		"full_url":   record.FullUrl,
+		"user_agent": record.UserAgent,
+	}
+	if record.FpmPool != "" {
+		fields["fpm_pool"] = record.FpmPool
+		fields["fpm_active_processes"] = record.FpmActiveProcesses
+	}
+	if record.FpmPid != 0 {
+		fields["fpm_pid"] = record.FpmPid
+	}
+	if record.Tenant != "" {
+		fields["tenant"] = record.Tenant
+	}
+	accessLogger.output.WithFields(fields).WithTime(record.Time).Info("access")
 }
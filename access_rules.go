@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// actions of access rule decisions, used as metrics label
+const (
+	AccessActionAllow    = "allow"
+	AccessActionDeny     = "deny"
+	AccessActionRewrite  = "rewrite"
+	AccessActionRedirect = "redirect"
+)
+
+// AccessDecision is the result of an access rule
+type AccessDecision struct {
+	Action string
+	Status int
+	Target string // rewritten uri or redirect location
+}
+
+// AccessRules evaluate expressions (https://expr-lang.org) before the request reaches PHP, for edge cases
+// without a built-in middleware. Rules are evaluated in order, each returns allow() (or true, nil) to continue
+// with the next rule, deny(status) (or false), rewrite(uri) to change the uri seen by PHP and continue,
+// or redirect(url, status). Request fields available to rules are listed in accessRuleEnv.
+type AccessRules struct {
+	programs []*vm.Program
+
+	config  *Config
+	monitor *Monitor
+}
+
+func NewAccessRules(config *Config, monitor *Monitor) (*AccessRules, error) {
+	programs := make([]*vm.Program, 0, len(config.AccessRules))
+	for _, rule := range config.AccessRules {
+		program, err := expr.Compile(rule, expr.Env(accessRuleEnv(accessRuleSampleRequest())))
+		if err != nil {
+			return nil, fmt.Errorf("invalid access rule %q: %w", rule, err)
+		}
+		programs = append(programs, program)
+	}
+	return &AccessRules{
+		programs: programs,
+		config:   config,
+		monitor:  monitor,
+	}, nil
+}
+
+// Enabled reports whether any access rule is configured
+func (ar *AccessRules) Enabled() bool {
+	return len(ar.programs) > 0
+}
+
+// accessRuleEnv returns request fields and decision functions available to rules, header and cookie names
+// are lower-cased
+func accessRuleEnv(request *http.Request) map[string]any {
+	headers := make(map[string]string, len(request.Header))
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	cookies := map[string]string{}
+	for _, cookie := range request.Cookies() {
+		cookies[strings.ToLower(cookie.Name)] = cookie.Value
+	}
+	remoteAddr := request.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+
+	return map[string]any{
+		"method":      request.Method,
+		"path":        request.URL.Path,
+		"query":       request.URL.RawQuery,
+		"args":        request.URL.Query(),
+		"uri":         request.URL.RequestURI(),
+		"host":        hostWithoutPort(request.Host),
+		"remote_addr": remoteAddr,
+		"tls":         request.TLS != nil,
+		"headers":     headers,
+		"cookies":     cookies,
+
+		"allow": func() AccessDecision {
+			return AccessDecision{Action: AccessActionAllow}
+		},
+		"deny": func(status int) AccessDecision {
+			return AccessDecision{Action: AccessActionDeny, Status: status}
+		},
+		"rewrite": func(uri string) AccessDecision {
+			return AccessDecision{Action: AccessActionRewrite, Target: uri}
+		},
+		"redirect": func(location string, status int) AccessDecision {
+			return AccessDecision{Action: AccessActionRedirect, Status: status, Target: location}
+		},
+	}
+}
+
+// accessRuleSampleRequest provides env used to type-check rules at startup
+func accessRuleSampleRequest() *http.Request {
+	return &http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/"}, Header: http.Header{}}
+}
+
+// Evaluate runs the rules in order and returns the first decision other than allow. Rewrites change
+// the request and the evaluation continues, so later rules see the rewritten uri.
+func (ar *AccessRules) Evaluate(request *http.Request) (AccessDecision, error) {
+	for i, program := range ar.programs {
+		result, err := expr.Run(program, accessRuleEnv(request))
+		if err != nil {
+			return AccessDecision{}, fmt.Errorf("access rule %d failed: %w", i+1, err)
+		}
+		decision, err := accessDecision(result)
+		if err != nil {
+			return AccessDecision{}, fmt.Errorf("access rule %d: %w", i+1, err)
+		}
+		ar.monitor.AccessRuleDecisionsCounter.WithLabelValues(ar.config.App, strconv.Itoa(i+1), decision.Action).Inc()
+
+		switch decision.Action {
+		case AccessActionAllow:
+			continue
+		case AccessActionRewrite:
+			if err := rewriteRequestUri(request, decision.Target); err != nil {
+				return AccessDecision{}, fmt.Errorf("access rule %d: %w", i+1, err)
+			}
+		default:
+			return decision, nil
+		}
+	}
+	return AccessDecision{Action: AccessActionAllow}, nil
+}
+
+// accessDecision converts result of a rule, booleans are shortcuts of allow() and deny(403)
+func accessDecision(result any) (AccessDecision, error) {
+	switch result := result.(type) {
+	case nil:
+		return AccessDecision{Action: AccessActionAllow}, nil
+	case bool:
+		if result {
+			return AccessDecision{Action: AccessActionAllow}, nil
+		}
+		return AccessDecision{Action: AccessActionDeny, Status: http.StatusForbidden}, nil
+	case AccessDecision:
+		switch result.Action {
+		case AccessActionDeny:
+			if result.Status < 400 || result.Status > 599 {
+				return AccessDecision{}, fmt.Errorf("deny status must be 4xx or 5xx, got %d", result.Status)
+			}
+		case AccessActionRedirect:
+			if result.Status < 300 || result.Status > 399 {
+				return AccessDecision{}, fmt.Errorf("redirect status must be 3xx, got %d", result.Status)
+			}
+		}
+		return result, nil
+	default:
+		return AccessDecision{}, fmt.Errorf("unexpected result %v, return allow(), deny(), rewrite(), redirect() or bool", result)
+	}
+}
+
+// rewriteRequestUri replaces path and query of the request, PHP sees the new REQUEST_URI
+func rewriteRequestUri(request *http.Request, uri string) error {
+	parsed, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return fmt.Errorf("invalid rewrite uri %q: %w", uri, err)
+	}
+	request.URL.Path = parsed.Path
+	request.URL.RawPath = parsed.RawPath
+	request.URL.RawQuery = parsed.RawQuery
+	request.RequestURI = request.URL.RequestURI()
+	return nil
+}
+
+// accessRulesMiddleware applies decisions of access rules, failing rule rejects the request
+func (hs *HttpServer) accessRulesMiddleware(next http.Handler) http.Handler {
+	if !hs.accessRules.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		decision, err := hs.accessRules.Evaluate(r)
+		if err != nil {
+			hs.WriteError(w, r, err, start)
+			return
+		}
+
+		switch decision.Action {
+		case AccessActionDeny:
+			hs.writeProxyError(w, r, decision.Status, start)
+		case AccessActionRedirect:
+			http.Redirect(w, r, decision.Target, decision.Status)
+			hs.observeProxyError(r, decision.Status, start)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
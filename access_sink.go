@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DropReasonBufferFull = "buffer_full"
+	DropReasonSendFailed = "send_failed"
+)
+
+// AccessRecord is a structured access event, the same data as access log
+type AccessRecord struct {
+	Time      time.Time           `json:"time"`
+	App       string              `json:"app"`
+	Method    string              `json:"method"`
+	Query     map[string][]string `json:"query"`
+	Status    int                 `json:"status"`
+	Route     string              `json:"route"`
+	Size      int                 `json:"size"`
+	FullUrl   string              `json:"full_url"`
+	UserAgent string              `json:"user_agent"`
+	RequestId string              `json:"request_id"`
+	Tenant    string              `json:"tenant,omitempty"`
+
+	// set for slow and failed requests when FPM status is available
+	FpmPool            string `json:"fpm_pool,omitempty"`
+	FpmPid             int    `json:"fpm_pid,omitempty"`
+	FpmActiveProcesses int    `json:"fpm_active_processes,omitempty"`
+}
+
+// accessEventWriter delivers one batch of access events
+type accessEventWriter interface {
+	WriteEvents(ctx context.Context, records []AccessRecord) error
+	Close() error
+}
+
+// AccessSink asynchronously sends access events to Kafka or HTTP webhook in batches.
+// Buffer is bounded, events are dropped (and counted) rather than slowing down requests.
+type AccessSink struct {
+	events chan AccessRecord
+	writer accessEventWriter
+
+	config  *Config
+	monitor *Monitor
+	logger  *logrus.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewAccessSink(config *Config, monitor *Monitor, logger *logrus.Logger) (*AccessSink, error) {
+	sink := &AccessSink{
+		config:  config,
+		monitor: monitor,
+		logger:  logger,
+		stop:    make(chan struct{}),
+	}
+	if config.AccessSink == "" {
+		return sink, nil
+	}
+
+	u, err := url.Parse(config.AccessSink)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access sink %q: %w", config.AccessSink, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		sink.writer = &webhookWriter{
+			url:    config.AccessSink,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+	case "kafka":
+		topic := strings.Trim(u.Path, "/")
+		if u.Host == "" || topic == "" {
+			return nil, fmt.Errorf("invalid access sink %q, use kafka://broker1,broker2/topic", config.AccessSink)
+		}
+		sink.writer = &kafkaWriter{
+			writer: &kafka.Writer{
+				Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+				Topic:        topic,
+				Balancer:     &kafka.LeastBytes{},
+				BatchTimeout: 10 * time.Millisecond,
+			},
+		}
+	default:
+		return nil, fmt.Errorf("invalid access sink %q, use http(s):// webhook or kafka://", config.AccessSink)
+	}
+	sink.events = make(chan AccessRecord, config.AccessSinkBuffer)
+
+	return sink, nil
+}
+
+// Enabled reports whether access events are sent anywhere
+func (s *AccessSink) Enabled() bool {
+	return s.writer != nil
+}
+
+// Send queues the record, it never blocks
+func (s *AccessSink) Send(record AccessRecord) {
+	if !s.Enabled() {
+		return
+	}
+	select {
+	case s.events <- record:
+	default:
+		s.monitor.AccessEventsDroppedCounter.WithLabelValues(s.config.App, DropReasonBufferFull).Inc()
+	}
+}
+
+// Start runs the goroutine sending batches
+func (s *AccessSink) Start() {
+	if !s.Enabled() {
+		return
+	}
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Stop flushes buffered events and closes the writer
+func (s *AccessSink) Stop() {
+	if !s.Enabled() {
+		return
+	}
+	close(s.stop)
+	s.wg.Wait()
+	if err := s.writer.Close(); err != nil {
+		s.logger.Errorf("could not close access sink: %s", err)
+	}
+}
+
+func (s *AccessSink) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.AccessSinkFlush)
+	defer ticker.Stop()
+
+	batch := make([]AccessRecord, 0, s.config.AccessSinkBatch)
+	for {
+		select {
+		case record := <-s.events:
+			batch = append(batch, record)
+			if len(batch) >= s.config.AccessSinkBatch {
+				batch = s.flush(batch)
+			}
+		case <-ticker.C:
+			batch = s.flush(batch)
+		case <-s.stop:
+			for {
+				select {
+				case record := <-s.events:
+					batch = append(batch, record)
+				default:
+					s.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes the batch and returns empty batch for reuse
+func (s *AccessSink) flush(batch []AccessRecord) []AccessRecord {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.writer.WriteEvents(ctx, batch); err != nil {
+		s.monitor.AccessEventsDroppedCounter.WithLabelValues(s.config.App, DropReasonSendFailed).Add(float64(len(batch)))
+		s.logger.Errorf("could not send %d access events: %s", len(batch), err)
+	}
+	return batch[:0]
+}
+
+// webhookWriter posts batch as JSON array
+type webhookWriter struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookWriter) WriteEvents(ctx context.Context, records []AccessRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("could not encode events: %w", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create webhook request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (w *webhookWriter) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// kafkaWriter produces one JSON message per event
+type kafkaWriter struct {
+	writer *kafka.Writer
+}
+
+func (w *kafkaWriter) WriteEvents(ctx context.Context, records []AccessRecord) error {
+	messages := make([]kafka.Message, 0, len(records))
+	for _, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("could not encode event: %w", err)
+		}
+		messages = append(messages, kafka.Message{Key: []byte(record.RequestId), Value: value})
+	}
+	return w.writer.WriteMessages(ctx, messages...)
+}
+
+func (w *kafkaWriter) Close() error {
+	return w.writer.Close()
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminServer serves internal endpoints on a separate port which should never be exposed publicly
+type AdminServer struct {
+	router        *http.ServeMux
+	srv           *http.Server
+	fpmClient     *FpmClient
+	paramsBuilder *ParamsBuilder
+	cache         *ResponseCache
+	costSampler   *CostSampler
+	faultInjector *FaultInjector
+	timeouts      *TimeoutPolicy
+	drain         *DrainTracker
+	monitor       *Monitor
+	config        *Config
+	logger        *logrus.Logger
+}
+
+// ScriptRequest describes internal request to a configured PHP script
+type ScriptRequest struct {
+	Script  string            `json:"script"`
+	Method  string            `json:"method"`
+	Uri     string            `json:"uri"`
+	Headers map[string]string `json:"headers"`
+	Params  map[string]string `json:"params"`
+	Body    string            `json:"body"`
+}
+
+// scriptSelectingParams can't be set by ScriptRequest.Params, they would run other script than the allowed one
+var scriptSelectingParams = map[string]bool{
+	"SCRIPT_FILENAME": true,
+	"SCRIPT_NAME":     true,
+	"DOCUMENT_ROOT":   true,
+	"PATH_TRANSLATED": true,
+}
+
+// CachePurgeRequest describes cache entries to purge
+type CachePurgeRequest struct {
+	Tags []string `json:"tags"`
+	Uris []string `json:"uris"`
+}
+
+// ScriptResponse is the result of ScriptRequest
+type ScriptResponse struct {
+	Status   int                 `json:"status"`
+	Headers  map[string][]string `json:"headers"`
+	Body     string              `json:"body"`
+	Duration string              `json:"duration"`
+}
+
+func NewAdminServer(
+	config *Config,
+	fpmClient *FpmClient,
+	paramsBuilder *ParamsBuilder,
+	cache *ResponseCache,
+	costSampler *CostSampler,
+	faultInjector *FaultInjector,
+	timeouts *TimeoutPolicy,
+	drain *DrainTracker,
+	monitor *Monitor,
+	logger *logrus.Logger,
+) *AdminServer {
+	router := http.NewServeMux()
+
+	return &AdminServer{
+		router: router,
+		srv: &http.Server{
+			Addr:    config.AdminAddress(),
+			Handler: router,
+		},
+		fpmClient:     fpmClient,
+		paramsBuilder: paramsBuilder,
+		cache:         cache,
+		costSampler:   costSampler,
+		faultInjector: faultInjector,
+		timeouts:      timeouts,
+		drain:         drain,
+		monitor:       monitor,
+		config:        config,
+		logger:        logger,
+	}
+}
+
+// Enabled reports whether the admin server should be started
+func (as *AdminServer) Enabled() bool {
+	return as.config.AdminPort > 0
+}
+
+func (as *AdminServer) PrepareServer() {
+	as.router.Handle("/admin/script", as.authMiddleware(http.HandlerFunc(as.handleScript)))
+	as.router.Handle("/admin/cache/purge", as.authMiddleware(http.HandlerFunc(as.handleCachePurge)))
+	as.router.Handle("/admin/routes", as.authMiddleware(http.HandlerFunc(as.handleRoutes)))
+	as.router.Handle("/admin/chaos", as.authMiddleware(http.HandlerFunc(as.handleChaos)))
+	as.router.Handle("/admin/timeouts", as.authMiddleware(http.HandlerFunc(as.handleTimeouts)))
+	as.router.Handle("/admin/profile", as.authMiddleware(http.HandlerFunc(as.handleProfile)))
+	as.router.Handle("/admin/pool/restart", as.authMiddleware(http.HandlerFunc(as.handlePoolRestart)))
+	as.router.Handle("/admin/evaluate", as.authMiddleware(http.HandlerFunc(as.handleEvaluate)))
+	as.router.HandleFunc("/admin/dashboard", as.handleDashboard) // page itself is public, stats require the token
+	as.router.Handle("/admin/dashboard/stats", as.authMiddleware(http.HandlerFunc(as.handleDashboardStats)))
+	as.router.Handle("/admin/cost", as.authMiddleware(http.HandlerFunc(as.handleCost)))
+	as.router.Handle("/admin/drain", as.authMiddleware(http.HandlerFunc(as.handleDrain)))
+	as.router.Handle("/admin/info", as.authMiddleware(http.HandlerFunc(as.handleInfo)))
+
+	// metrics are served here too, the main port stops answering when the drain window starts
+	as.router.Handle("/metrics", promhttp.HandlerFor(
+		as.monitor.Registry,
+		promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+			Registry:          as.monitor.Registry,
+		},
+	))
+}
+
+func (as *AdminServer) Start() {
+	go func() {
+		if err := as.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			as.logger.Errorf("admin listen: %s\n", err)
+		}
+	}()
+	as.logger.Infof("Admin server started on %s", as.config.AdminAddress())
+}
+
+func (as *AdminServer) Shutdown(ctx context.Context) error {
+	return as.srv.Shutdown(ctx)
+}
+
+// authMiddleware checks bearer token when admin token is configured, the server without the token is allowed
+// only on loopback (see Config.Validate)
+func (as *AdminServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if as.config.AdminToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(as.config.AdminToken)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleScript executes one of configured scripts through the FPM pool
+func (as *AdminServer) handleScript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	if as.config.AdminToken == "" {
+		// never allow script execution without authentication
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin token is not configured"})
+		return
+	}
+
+	var scriptRequest ScriptRequest
+	if err := json.NewDecoder(r.Body).Decode(&scriptRequest); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+
+	if !containsString(as.config.AdminScripts, scriptRequest.Script) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "script is not allowed"})
+		return
+	}
+
+	if scriptRequest.Method == "" {
+		scriptRequest.Method = http.MethodGet
+	}
+	if scriptRequest.Uri == "" {
+		scriptRequest.Uri = "/"
+	}
+
+	fpmRequest, err := http.NewRequest(scriptRequest.Method, scriptRequest.Uri, nil)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+	fpmRequest.Host = "localhost"
+	fpmRequest.RemoteAddr = r.RemoteAddr
+	for name, value := range scriptRequest.Headers {
+		fpmRequest.Header.Set(name, value)
+	}
+
+	overrides := map[string]string{}
+	for name, value := range scriptRequest.Params {
+		if _, found := scriptSelectingParams[strings.ToUpper(name)]; found {
+			// the script is selected only by the allowlist
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("param %s can't be set", name)})
+			return
+		}
+		overrides[name] = value
+	}
+	overrides["SCRIPT_FILENAME"] = scriptRequest.Script
+
+	body := []byte(scriptRequest.Body)
+	params := as.paramsBuilder.Build(fpmRequest, len(body), overrides)
+
+	as.logger.Infof("admin: executing script %s %s %s", scriptRequest.Script, scriptRequest.Method, scriptRequest.Uri)
+
+	start := time.Now()
+	fpmReq := as.fpmClient.NewRequest(params, body)
+	fpmReq.Priority = PriorityHigh
+	fpmReq.Context = r.Context()
+	response, err := as.fpmClient.Execute(fpmReq)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("could not call FPM: %s", err)})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ScriptResponse{
+		Status:   response.Status,
+		Headers:  response.Headers,
+		Body:     string(response.Body),
+		Duration: time.Since(start).String(),
+	})
+}
+
+// handleCachePurge removes cached responses by tags or uris
+func (as *AdminServer) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var purgeRequest CachePurgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&purgeRequest); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+
+	purged := 0
+	for _, tag := range purgeRequest.Tags {
+		count, err := as.cache.PurgeTag(tag)
+		purged += count
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]any{"error": fmt.Sprintf("could not purge tag %s: %s", tag, err), "purged": purged})
+			return
+		}
+	}
+	for _, uri := range purgeRequest.Uris {
+		count, err := as.cache.PurgeUri(uri)
+		purged += count
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]any{"error": fmt.Sprintf("could not purge uri %s: %s", uri, err), "purged": purged})
+			return
+		}
+	}
+
+	as.logger.Infof("admin: purged %d cache entries", purged)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+// handleRoutes returns the resolved routing table
+func (as *AdminServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	routes, err := BuildRoutingTable(as.config)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// handleChaos shows (GET), replaces (PUT) or removes (DELETE) injected faults
+func (as *AdminServer) handleChaos(w http.ResponseWriter, r *http.Request) {
+	if !as.faultInjector.Allowed() {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("fault injection is not allowed, use --%s", Chaos)})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, as.faultInjector.Settings())
+	case http.MethodPut:
+		var settings ChaosSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request: %s", err)})
+			return
+		}
+		if err := as.faultInjector.Configure(settings); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		as.logger.Warnf("Fault injection configured: %+v", as.faultInjector.Settings())
+		writeJSON(w, http.StatusOK, as.faultInjector.Settings())
+	case http.MethodDelete:
+		as.faultInjector.Reset()
+		as.logger.Infof("Fault injection disabled")
+		writeJSON(w, http.StatusOK, as.faultInjector.Settings())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleTimeouts shows the effective timeout policy and manages runtime overrides of route timeouts
+func (as *AdminServer) handleTimeouts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, as.timeouts.Snapshot())
+	case http.MethodPut:
+		var override TimeoutOverride
+		if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request: %s", err)})
+			return
+		}
+		applied, err := as.timeouts.Override(override)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		as.logger.Warnf("Timeout of %s overridden to %s (ttl: %s)", applied.Prefix, applied.Timeout, applied.Ttl)
+		writeJSON(w, http.StatusOK, as.timeouts.Snapshot())
+	case http.MethodDelete:
+		prefix := r.URL.Query().Get("prefix")
+		if !as.timeouts.RemoveOverride(prefix) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("no timeout override of %q", prefix)})
+			return
+		}
+		as.logger.Infof("Timeout override of %q removed", prefix)
+		writeJSON(w, http.StatusOK, as.timeouts.Snapshot())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleProfile captures profile report, it takes the requested duration
+func (as *AdminServer) handleProfile(w http.ResponseWriter, r *http.Request) {
+	duration := 30 * time.Second
+	if value := r.URL.Query().Get("duration"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > maxProfileDuration {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid duration %q, maximum is %s", value, maxProfileDuration)})
+			return
+		}
+		duration = parsed
+	}
+
+	// archive is buffered, so errors can still be reported as JSON
+	var report bytes.Buffer
+	if err := writeProfileReport(&report, duration, as.fpmClient.fCgiClient, as.monitor); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="gophpfpm-profile.tar.gz"`)
+	_, _ = w.Write(report.Bytes())
+}
+
+// handlePoolRestart replaces all FPM connections, progress is streamed as JSON lines
+func (as *AdminServer) handlePoolRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	timeout := time.Minute
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid timeout %q", value)})
+			return
+		}
+		timeout = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	as.logger.Infof("Restarting FPM pool")
+	err := as.fpmClient.fCgiClient.Restart(time.Now().Add(timeout), func(progress RestartProgress) {
+		_ = encoder.Encode(progress)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		as.logger.Errorf("could not restart FPM pool: %s", err)
+		_ = encoder.Encode(map[string]string{"result": "failed", "error": err.Error()})
+		return
+	}
+	_ = encoder.Encode(map[string]string{"result": "restarted"})
+}
+
+// handleEvaluate returns which handler would serve the described request without executing it
+func (as *AdminServer) handleEvaluate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var evaluateRequest EvaluateRequest
+	if err := json.NewDecoder(r.Body).Decode(&evaluateRequest); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+
+	evaluation, err := EvaluateRoute(as.config, as.paramsBuilder, as.fpmClient.priorities, as.timeouts, evaluateRequest)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, evaluation)
+}
+
+// handleDashboard serves self-contained status dashboard
+func (as *AdminServer) handleDashboard(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(dashboardPage))
+}
+
+// handleDashboardStats returns current counters polled by the dashboard
+func (as *AdminServer) handleDashboardStats(w http.ResponseWriter, _ *http.Request) {
+	stats, err := collectDashboardStats(as.monitor, as.fpmClient.fCgiClient)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleCost returns report of sampled proxy cost per route, DELETE resets collected samples
+func (as *AdminServer) handleCost(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{
+			"sample_rate": as.config.CostSampleRate,
+			"routes":      as.costSampler.Report(),
+		})
+	case http.MethodDelete:
+		as.costSampler.Reset()
+		writeJSON(w, http.StatusOK, map[string]string{"result": "reset"})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleDrain returns progress of the graceful shutdown, deployment tooling polls it until in_flight is zero
+func (as *AdminServer) handleDrain(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, as.drain.Status())
+}
+
+// handleInfo returns version, configuration summary and uptime of the proxy
+func (as *AdminServer) handleInfo(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, collectRuntimeInfo(as.config, as.fpmClient.fCgiClient))
+}
+
+// writeJSON writes value as JSON response
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value) // client is gone - nothing to do
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminScriptParams(t *testing.T) {
+	fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+		w.Stdout("Content-Type: text/plain\r\n\r\n" + request.params["SCRIPT_FILENAME"] + " " + request.params["APP_TASK"])
+		w.End(0, FCGI_REQUEST_COMPLETE)
+	})
+	svr := newTestHttpServer(t, fpm, "--"+AdminToken, "secret", "--"+AdminScripts, "/app/bin/warmup.php")
+
+	cases := []struct {
+		name   string
+		params string
+		status int
+		body   string // body of PHP response
+	}{
+		{name: "custom param", params: `{"APP_TASK": "cache"}`, status: http.StatusOK, body: "/app/bin/warmup.php cache"},
+		{name: "script filename", params: `{"SCRIPT_FILENAME": "/app/bin/drop-database.php"}`, status: http.StatusBadRequest},
+		{name: "lower-cased script filename", params: `{"script_filename": "/app/bin/drop-database.php"}`, status: http.StatusBadRequest},
+		{name: "script name", params: `{"SCRIPT_NAME": "/drop-database.php"}`, status: http.StatusBadRequest},
+		{name: "document root", params: `{"DOCUMENT_ROOT": "/tmp"}`, status: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body := `{"script": "/app/bin/warmup.php", "params": ` + c.params + `}`
+			request := httptest.NewRequest(http.MethodPost, "/admin/script", strings.NewReader(body))
+			request.Header.Set("Authorization", "Bearer secret")
+			recorder := httptest.NewRecorder()
+			svr.adminServer.router.ServeHTTP(recorder, request)
+
+			if recorder.Code != c.status {
+				t.Fatalf("status = %d, want %d (%s)", recorder.Code, c.status, recorder.Body)
+			}
+			if c.status != http.StatusOK {
+				return
+			}
+			var response ScriptResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid response: %s", err)
+			}
+			if response.Body != c.body {
+				t.Errorf("PHP response = %q, want %q", response.Body, c.body)
+			}
+		})
+	}
+	if got := fpm.requests.Load(); got != 1 {
+		t.Errorf("FPM got %d requests, want 1", got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	immutableCacheControl   = "public, max-age=31536000, immutable"
+	revalidateCacheControl  = "no-cache"
+	viteManifestEntryFileId = "file"
+)
+
+// AssetManifest integrates build-time manifests of fingerprinted assets (Laravel Mix mix-manifest.json, Vite manifest.json).
+// Fingerprinted URLs are served with immutable caching, un-fingerprinted paths are transparently mapped
+// to the current fingerprinted file and must be revalidated by browsers.
+type AssetManifest struct {
+	fingerprinted map[string]bool   // request uri of fingerprinted asset
+	aliases       map[string]string // un-fingerprinted path -> fingerprinted request uri
+}
+
+func NewAssetManifest(config *Config) (*AssetManifest, error) {
+	am := &AssetManifest{
+		fingerprinted: map[string]bool{},
+		aliases:       map[string]string{},
+	}
+	for _, definition := range config.AssetManifests {
+		file, prefix, found := strings.Cut(definition, ":")
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid asset manifest definition: %s", definition)
+		}
+		if err := am.load(file, strings.TrimSuffix(prefix, "/")); err != nil {
+			return nil, fmt.Errorf("could not load asset manifest %s: %w", file, err)
+		}
+	}
+	return am, nil
+}
+
+// load reads manifest, entries are either strings (Mix) or objects with file (Vite)
+func (am *AssetManifest) load(file string, prefix string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+
+	for name, raw := range manifest {
+		var fingerprinted string
+		if err := json.Unmarshal(raw, &fingerprinted); err != nil {
+			var entry map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return fmt.Errorf("invalid entry %q", name)
+			}
+			if err := json.Unmarshal(entry[viteManifestEntryFileId], &fingerprinted); err != nil {
+				return fmt.Errorf("invalid entry %q: missing file", name)
+			}
+		}
+
+		logical := path.Join(prefix, "/", name)
+		uri := path.Join(prefix, "/", fingerprinted)
+		if _, query, found := strings.Cut(fingerprinted, "?"); found {
+			uri = path.Join(prefix, "/", strings.TrimSuffix(fingerprinted, "?"+query)) + "?" + query
+		}
+		am.fingerprinted[uri] = true
+		if logical != uri {
+			am.aliases[logical] = uri
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether any manifest is loaded
+func (am *AssetManifest) Enabled() bool {
+	return len(am.fingerprinted) > 0
+}
+
+// Middleware sets cache headers of assets and maps un-fingerprinted paths to fingerprinted files
+func (am *AssetManifest) Middleware(next http.Handler) http.Handler {
+	if !am.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if am.fingerprinted[r.URL.RequestURI()] {
+			w.Header().Set("Cache-Control", immutableCacheControl)
+		} else if target, found := am.aliases[r.URL.Path]; found {
+			w.Header().Set("Cache-Control", revalidateCacheControl)
+			targetPath, _, _ := strings.Cut(target, "?")
+			r.URL.Path = targetPath
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// BackpressureState describes limiter state announced to clients whose requests were shed,
+// so well-behaved clients can back off correctly
+type BackpressureState struct {
+	Limit      int           // maximum number of requests served concurrently or per window
+	Remaining  int           // requests which can be served right now
+	RetryAfter time.Duration // when the client should try again
+}
+
+// WriteHeaders sets Retry-After and X-RateLimit-* headers
+func (bs BackpressureState) WriteHeaders(header http.Header) {
+	seconds := int(math.Ceil(bs.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	header.Set("Retry-After", fmt.Sprintf("%d", seconds))
+	header.Set("X-RateLimit-Limit", fmt.Sprintf("%d", bs.Limit))
+	header.Set("X-RateLimit-Remaining", fmt.Sprintf("%d", bs.Remaining))
+	header.Set("X-RateLimit-Reset", fmt.Sprintf("%d", seconds))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minBandwidthChunk is the smallest write of a throttled response, tiny writes would cost more than they save
+const minBandwidthChunk = 512
+
+// BandwidthShaper limits download speed of responses, so large downloads served by PHP or static folders
+// can't saturate the egress and starve latency of other requests. The limit applies to each response,
+// a route limit (the longest matching prefix) wins over the global --bandwidth-limit.
+type BandwidthShaper struct {
+	defaultLimit int64
+	routes       map[string]int64
+	prefixes     []string
+}
+
+func NewBandwidthShaper(config *Config) (*BandwidthShaper, error) {
+	if config.BandwidthLimit < 0 {
+		return nil, fmt.Errorf("%s must not be negative", BandwidthLimit)
+	}
+	bs := &BandwidthShaper{
+		defaultLimit: config.BandwidthLimit,
+		routes:       map[string]int64{},
+	}
+	for _, definition := range config.RouteBandwidths {
+		value, prefix, found := strings.Cut(definition, ":")
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid route bandwidth definition: %s", definition)
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid route bandwidth definition %s: limit must be bytes per second, 0 means unlimited", definition)
+		}
+		bs.routes[prefix] = limit
+		bs.prefixes = append(bs.prefixes, prefix)
+	}
+	return bs, nil
+}
+
+// Enabled reports whether any limit is configured
+func (bs *BandwidthShaper) Enabled() bool {
+	return bs.defaultLimit > 0 || len(bs.routes) > 0
+}
+
+// Limit returns bytes per second allowed for response of the path, 0 means unlimited
+func (bs *BandwidthShaper) Limit(path string) int64 {
+	if prefix, found := matchPrefix(path, bs.prefixes); found {
+		return bs.routes[prefix]
+	}
+	return bs.defaultLimit
+}
+
+// Middleware throttles writes of responses with a limit
+func (bs *BandwidthShaper) Middleware(next http.Handler) http.Handler {
+	if !bs.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := bs.Limit(r.URL.Path)
+		if limit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(newThrottledWriter(r.Context(), w, limit), r)
+	})
+}
+
+// throttledWriter is a token bucket on writes, the bucket holds tokens for 100ms of data so the speed is smooth
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+
+	rate   float64 // bytes per second
+	chunk  int
+	tokens float64
+	last   time.Time
+}
+
+func newThrottledWriter(ctx context.Context, w http.ResponseWriter, limit int64) *throttledWriter {
+	chunk := int(limit / 10)
+	if chunk < minBandwidthChunk {
+		chunk = minBandwidthChunk
+	}
+	return &throttledWriter{
+		ResponseWriter: w,
+		ctx:            ctx,
+		rate:           float64(limit),
+		chunk:          chunk,
+		tokens:         float64(chunk),
+		last:           time.Now(),
+	}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > tw.chunk {
+			chunk = chunk[:tw.chunk]
+		}
+		if err := tw.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// wait takes tokens for n bytes and sleeps till the bucket is not in debt, it stops when the client is gone
+func (tw *throttledWriter) wait(n int) error {
+	now := time.Now()
+	tw.tokens += now.Sub(tw.last).Seconds() * tw.rate
+	if tw.tokens > float64(tw.chunk) {
+		tw.tokens = float64(tw.chunk)
+	}
+	tw.last = now
+	tw.tokens -= float64(n)
+	if tw.tokens >= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(-tw.tokens / tw.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-tw.ctx.Done():
+		return tw.ctx.Err()
+	}
+}
+
+// Flush sends buffered data to the client, streamed responses depend on it
+func (tw *throttledWriter) Flush() {
+	if flusher, ok := tw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const ForwardedPrefixHeader = "X-Forwarded-Prefix"
+
+// normalizeBasePath returns base path with leading and without trailing slash, empty when not set
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// basePathMiddleware strips the mount prefix when the app is deployed under a sub-path of a larger ingress.
+// PHP receives the prefix in X-Forwarded-Prefix header, so it can generate absolute URLs.
+// Requests outside the base path (e.g. metrics scraped directly) are passed unchanged.
+func basePathMiddleware(basePath string, next http.Handler) http.Handler {
+	basePath = normalizeBasePath(basePath)
+	if basePath == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(ForwardedPrefixHeader)
+		if pathHasPrefix(r.URL.Path, basePath) {
+			r.URL.Path = stripBasePath(r.URL.Path, basePath)
+			if r.URL.RawPath != "" {
+				r.URL.RawPath = stripBasePath(r.URL.RawPath, basePath)
+			}
+			r.Header.Set(ForwardedPrefixHeader, basePath)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func stripBasePath(path string, basePath string) string {
+	path = strings.TrimPrefix(path, basePath)
+	if path == "" {
+		return "/"
+	}
+	return path
+}
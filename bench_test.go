@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	benchHeaders  = 40      // request and response headers of the many-headers benchmark
+	benchBodySize = 1 << 20 // body of the large POST request and the streaming response
+)
+
+var (
+	benchSmallBody = strings.Repeat("gophpfpm ", 16)
+	benchLargeBody = strings.Repeat("0123456789abcdef", benchBodySize/16)
+)
+
+// benchFpm answers requests of the benchmarks by path, the request body is dropped
+func benchFpm(w *mockFpmWriter, request mockFpmRequest) {
+	var head strings.Builder
+	head.WriteString("Content-Type: text/plain\r\n")
+	body := benchSmallBody
+	switch path, _, _ := strings.Cut(request.params["REQUEST_URI"], "?"); {
+	case path == "/headers":
+		for i := 0; i < benchHeaders; i++ {
+			fmt.Fprintf(&head, "X-Bench-%d: %s\r\n", i, benchSmallBody[:32])
+		}
+	case strings.HasPrefix(path, "/stream/"):
+		body = benchLargeBody
+	}
+	head.WriteString("\r\n")
+	w.Stdout(head.String() + body)
+	w.End(0, FCGI_REQUEST_COMPLETE)
+}
+
+// benchPipeline measures the complete request pipeline against mock FPM, allocations include the client and mock FPM
+// running in the same process, they are constant, so differences come from the proxy
+func benchPipeline(b *testing.B, method string, path string, body string, headers int, args ...string) {
+	fpm := startMockFpm(b, benchFpm)
+	server := newTestServer(b, fpm, append([]string{"--" + StreamPrefixes, "/stream"}, args...)...)
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+
+	send := func() error {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		request, err := http.NewRequest(method, server.URL+path, reader)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < headers; i++ {
+			request.Header.Set(fmt.Sprintf("X-Bench-%d", i), benchSmallBody[:32])
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if _, err := io.Copy(io.Discard, response.Body); err != nil {
+			return err
+		}
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s responded with %d", path, response.StatusCode)
+		}
+		return nil
+	}
+	if err := send(); err != nil {
+		b.Fatalf("warm-up failed: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := send(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSmallGet(b *testing.B) {
+	benchPipeline(b, http.MethodGet, "/small", "", 0)
+}
+
+func BenchmarkLargePost(b *testing.B) {
+	b.SetBytes(benchBodySize)
+	benchPipeline(b, http.MethodPost, "/upload", benchLargeBody, 0)
+}
+
+func BenchmarkManyHeaders(b *testing.B) {
+	benchPipeline(b, http.MethodGet, "/headers", "", benchHeaders)
+}
+
+func BenchmarkStreaming(b *testing.B) {
+	b.SetBytes(benchBodySize)
+	benchPipeline(b, http.MethodGet, "/stream/download", "", 0)
+}
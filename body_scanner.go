@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// results of body scans, used as metrics label
+const (
+	ScanResultClean    = "clean"
+	ScanResultRejected = "rejected"
+	ScanResultError    = "error"
+	ScanResultSkipped  = "skipped"
+
+	defaultIcapPort = "1344"
+)
+
+var (
+	// ErrBodyRejected means the scanner found the body infected or otherwise not allowed
+	ErrBodyRejected = errors.New("request body rejected by scanner")
+	// ErrBodyTooLarge means the body exceeds --scan-max-size, so it can't be scanned
+	ErrBodyTooLarge = errors.New("request body too large to be scanned")
+)
+
+// BodyScanner sends request bodies (uploads) to an external scanner, e.g. ClamAV, before they reach PHP.
+// HTTP scanner gets the body in POST request with the original Content-Type and X-Forwarded-Method/Host/Uri/For,
+// 2xx means clean body and 4xx rejected one. ICAP server (c-icap, squidclamav, ...) gets REQMOD request,
+// 204 means clean body and 200 (modified request, usually an error page) rejected one.
+type BodyScanner struct {
+	url    *url.URL
+	client *http.Client
+
+	config  *Config
+	monitor *Monitor
+}
+
+func NewBodyScanner(config *Config, monitor *Monitor) (*BodyScanner, error) {
+	scanner := &BodyScanner{
+		client:  &http.Client{Timeout: config.ScanTimeout},
+		config:  config,
+		monitor: monitor,
+	}
+	if config.ScanUrl == "" {
+		return scanner, nil
+	}
+	parsed, err := url.Parse(config.ScanUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "icap") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid %s %q, use http(s)://host/path or icap://host:port/service", ScanUrl, config.ScanUrl)
+	}
+	if parsed.Scheme == "icap" && parsed.Port() == "" {
+		parsed.Host = net.JoinHostPort(parsed.Hostname(), defaultIcapPort)
+	}
+	scanner.url = parsed
+	return scanner, nil
+}
+
+// Enabled reports whether scanner is configured
+func (bs *BodyScanner) Enabled() bool {
+	return bs.url != nil
+}
+
+// Protects reports whether body of the request must be scanned, all paths are scanned without --scan-prefix
+func (bs *BodyScanner) Protects(request *http.Request) bool {
+	if request.Body == nil || request.Body == http.NoBody || request.ContentLength == 0 {
+		return false
+	}
+	if len(bs.config.ScanPrefixes) == 0 {
+		return true
+	}
+	_, found := matchPrefix(request.URL.Path, bs.config.ScanPrefixes)
+	return found
+}
+
+// Scan returns nil for clean body, ErrBodyRejected when the scanner rejected it and other error when it failed
+func (bs *BodyScanner) Scan(request *http.Request, body []byte) error {
+	if bs.url.Scheme == "icap" {
+		return bs.scanIcap(request, body)
+	}
+	return bs.scanHttp(request, body)
+}
+
+func (bs *BodyScanner) scanHttp(request *http.Request, body []byte) error {
+	scanRequest, err := http.NewRequestWithContext(request.Context(), http.MethodPost, bs.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	scanRequest.Header.Set("Content-Type", request.Header.Get("Content-Type"))
+	scanRequest.Header.Set("X-Forwarded-Method", request.Method)
+	scanRequest.Header.Set("X-Forwarded-Host", request.Host)
+	scanRequest.Header.Set("X-Forwarded-Uri", request.URL.RequestURI())
+	if ip, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		scanRequest.Header.Set("X-Forwarded-For", ip)
+	}
+
+	response, err := bs.client.Do(scanRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxAuthBodySize))
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode >= 400 && response.StatusCode < 500:
+		return fmt.Errorf("%w: scanner responded with %d", ErrBodyRejected, response.StatusCode)
+	default:
+		return fmt.Errorf("scanner responded with %d", response.StatusCode)
+	}
+}
+
+// scanIcap sends REQMOD request (RFC 3507) with the request line, Host, Content-Type and the body
+func (bs *BodyScanner) scanIcap(request *http.Request, body []byte) error {
+	ctx, cancel := context.WithTimeout(request.Context(), bs.config.ScanTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", bs.url.Host)
+	if err != nil {
+		return fmt.Errorf("could not connect to ICAP server: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var httpHeader bytes.Buffer
+	fmt.Fprintf(&httpHeader, "%s %s HTTP/1.1\r\nHost: %s\r\n", request.Method, request.URL.RequestURI(), request.Host)
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		fmt.Fprintf(&httpHeader, "Content-Type: %s\r\n", contentType)
+	}
+	fmt.Fprintf(&httpHeader, "Content-Length: %d\r\n\r\n", len(body))
+
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "REQMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: req-hdr=0, req-body=%d\r\n\r\n",
+		bs.url.String(), bs.url.Hostname(), httpHeader.Len())
+	_, _ = writer.Write(httpHeader.Bytes())
+	fmt.Fprintf(writer, "%x\r\n", len(body))
+	_, _ = writer.Write(body)
+	_, _ = writer.WriteString("\r\n0\r\n\r\n")
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("could not send ICAP request: %w", err)
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	statusLine, err := reader.ReadLine()
+	if err != nil {
+		return fmt.Errorf("could not read ICAP response: %w", err)
+	}
+	proto, rest, _ := strings.Cut(statusLine, " ")
+	code, _, _ := strings.Cut(rest, " ")
+	status, err := strconv.Atoi(code)
+	if !strings.HasPrefix(proto, "ICAP/") || err != nil {
+		return fmt.Errorf("invalid ICAP response %q", statusLine)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return fmt.Errorf("could not read ICAP response: %w", err)
+	}
+
+	switch status {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusOK:
+		reason := header.Get("X-Infection-Found")
+		if reason == "" {
+			reason = header.Get("X-Violations-Found")
+		}
+		return fmt.Errorf("%w: %s", ErrBodyRejected, strings.TrimSpace(reason))
+	default:
+		return fmt.Errorf("ICAP server responded with %q", statusLine)
+	}
+}
+
+// bodyScanMiddleware passes only bodies accepted by the scanner to PHP. The body is read to memory (at most
+// --scan-max-size), scanned and handed over to FPM. Bodies which can't be scanned are rejected, or passed
+// with --scan-fail-open.
+func (hs *HttpServer) bodyScanMiddleware(next http.Handler) http.Handler {
+	if !hs.bodyScanner.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hs.bodyScanner.Protects(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		// the scanner must see what PHP gets, not the gzip encoded body
+		if err := decompressRequestBody(r, hs.config.MaxDecompressedSize); err != nil {
+			hs.WriteStatus(w, r, decompressionErrorStatus(err), err, start)
+			return
+		}
+		// other encodings are passed to PHP as they are, but the scanner couldn't see the content
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+			hs.WriteStatus(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", ErrUnsupportedContentEncoding, encoding), start)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(hs.config.ScanMaxSize)+1))
+		if err != nil {
+			hs.WriteStatus(w, r, http.StatusBadRequest, fmt.Errorf("could not read request body: %w", err), start)
+			return
+		}
+		rest := r.Body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), rest), rest}
+
+		if len(body) > hs.config.ScanMaxSize {
+			err = fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, hs.config.ScanMaxSize)
+		} else {
+			err = hs.bodyScanner.Scan(r, body)
+		}
+
+		switch {
+		case err == nil:
+			hs.monitor.BodyScansCounter.WithLabelValues(hs.config.App, ScanResultClean).Inc()
+			next.ServeHTTP(w, r)
+		case errors.Is(err, ErrBodyRejected):
+			hs.monitor.BodyScansCounter.WithLabelValues(hs.config.App, ScanResultRejected).Inc()
+			hs.logger.Infof("request body of %s rejected: %s", r.URL.Path, err)
+			hs.WriteStatus(w, r, http.StatusForbidden, err, start)
+		case hs.config.ScanFailOpen:
+			hs.monitor.BodyScansCounter.WithLabelValues(hs.config.App, ScanResultSkipped).Inc()
+			hs.logger.Warnf("request body of %s passed without scan: %s", r.URL.Path, err)
+			next.ServeHTTP(w, r)
+		case errors.Is(err, ErrBodyTooLarge):
+			hs.monitor.BodyScansCounter.WithLabelValues(hs.config.App, ScanResultError).Inc()
+			hs.WriteStatus(w, r, http.StatusRequestEntityTooLarge, err, start)
+		default:
+			hs.monitor.BodyScansCounter.WithLabelValues(hs.config.App, ScanResultError).Inc()
+			hs.logger.Errorf("body scan failed: %s", err)
+			hs.WriteStatus(w, r, http.StatusServiceUnavailable, err, start)
+		}
+	})
+}
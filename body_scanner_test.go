@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// eicar is the standard antivirus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func TestBodyScanDecompressed(t *testing.T) {
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(scanner.Close)
+	fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+		w.Stdout("Content-Type: text/plain\r\n\r\n" + string(request.stdin))
+		w.End(0, FCGI_REQUEST_COMPLETE)
+	})
+
+	// padding makes gzip compress the file instead of storing it as is
+	infected := eicar + strings.Repeat("\n", 1024)
+	cases := []struct {
+		name   string
+		args   []string
+		body   string
+		status int
+	}{
+		{name: "infected", body: infected, status: http.StatusForbidden},
+		{name: "clean", body: "hello", status: http.StatusOK},
+		{name: "infected streamed", args: []string{"--" + Streaming}, body: infected, status: http.StatusForbidden},
+		{name: "clean streamed", args: []string{"--" + Streaming}, body: "hello", status: http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := newTestServer(t, fpm, append([]string{"--" + ScanUrl, scanner.URL}, c.args...)...)
+			before := fpm.requests.Load()
+
+			var compressed bytes.Buffer
+			gz := gzip.NewWriter(&compressed)
+			_, _ = gz.Write([]byte(c.body))
+			_ = gz.Close()
+			if bytes.Contains(compressed.Bytes(), []byte("EICAR")) {
+				t.Fatalf("compressed body contains the plain file")
+			}
+			request := must(http.NewRequest(http.MethodPost, server.URL+"/upload.php", &compressed))
+			request.Header.Set("Content-Encoding", "gzip")
+			response := must(http.DefaultClient.Do(request))
+			body, _ := io.ReadAll(response.Body)
+			_ = response.Body.Close()
+
+			if response.StatusCode != c.status {
+				t.Fatalf("status = %d, want %d", response.StatusCode, c.status)
+			}
+			if c.status != http.StatusOK {
+				if fpm.requests.Load() != before {
+					t.Errorf("rejected body was passed to FPM")
+				}
+				return
+			}
+			if string(body) != c.body {
+				t.Errorf("PHP got %q, want %q", body, c.body)
+			}
+		})
+	}
+}
+
+func TestBodyScanUnknownEncoding(t *testing.T) {
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(scanner.Close)
+	fpm := startMockFpm(t, mockFpmStdout("Content-Type: text/plain\r\n\r\nok"))
+	server := newTestServer(t, fpm, "--"+ScanUrl, scanner.URL, "--"+ScanPrefix, "/upload")
+
+	for path, status := range map[string]int{"/upload/avatar": http.StatusUnsupportedMediaType, "/api": http.StatusOK} {
+		request := must(http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader("compressed")))
+		request.Header.Set("Content-Encoding", "zstd")
+		response := must(http.DefaultClient.Do(request))
+		_ = response.Body.Close()
+		if response.StatusCode != status {
+			t.Errorf("%s: status = %d, want %d", path, response.StatusCode, status)
+		}
+	}
+}
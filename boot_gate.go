@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// BootGate runs one-off startup work (e.g. database migrations) before the server starts accepting requests.
+// It enables "run migrations then serve" single-container deploys without wrapper scripts.
+type BootGate struct {
+	fpmClient     *FpmClient
+	paramsBuilder *ParamsBuilder
+	config        *Config
+	logger        *logrus.Logger
+}
+
+func NewBootGate(fpmClient *FpmClient, paramsBuilder *ParamsBuilder, config *Config, logger *logrus.Logger) *BootGate {
+	return &BootGate{
+		fpmClient:     fpmClient,
+		paramsBuilder: paramsBuilder,
+		config:        config,
+		logger:        logger,
+	}
+}
+
+// Enabled reports whether there is any boot work configured
+func (bg *BootGate) Enabled() bool {
+	return bg.config.BootCommand != "" || bg.config.BootUri != ""
+}
+
+// Run executes the boot command and then the boot request, the first failure is returned
+func (bg *BootGate) Run() error {
+	ctx, cancel := context.WithTimeout(context.Background(), bg.config.BootTimeout)
+	defer cancel()
+
+	if bg.config.BootCommand != "" {
+		start := time.Now()
+		if err := bg.runCommand(ctx); err != nil {
+			return fmt.Errorf("boot command failed: %w", err)
+		}
+		bg.logger.WithField("duration", time.Since(start).String()).Infof("Boot command %q finished", bg.config.BootCommand)
+	}
+
+	if bg.config.BootUri != "" {
+		start := time.Now()
+		status, err := bg.runRequest(ctx)
+		if err != nil {
+			return fmt.Errorf("boot request %s failed: %w", bg.config.BootUri, err)
+		}
+		bg.logger.WithFields(logrus.Fields{
+			"status":   status,
+			"duration": time.Since(start).String(),
+		}).Infof("Boot request %s finished", bg.config.BootUri)
+	}
+
+	return nil
+}
+
+func (bg *BootGate) runCommand(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", bg.config.BootCommand)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timeout after %s", bg.config.BootTimeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// runRequest sends internal request to PHP, any status other than 2xx fails the boot
+func (bg *BootGate) runRequest(ctx context.Context) (int, error) {
+	request, err := http.NewRequest(http.MethodGet, bg.config.BootUri, nil)
+	if err != nil {
+		return 0, fmt.Errorf("invalid uri: %w", err)
+	}
+	request.Host = "localhost"
+
+	// params can't be spoofed by clients unlike headers
+	params := bg.paramsBuilder.Build(request, 0, map[string]string{"GOPHPFPM_BOOT": "1"})
+	fpmReq := bg.fpmClient.NewRequest(params, nil)
+	fpmReq.Priority = PriorityHigh
+	fpmReq.Context = ctx // the connection is replaced when the request times out
+
+	type result struct {
+		response *ResponseData
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := bg.fpmClient.Execute(fpmReq)
+		done <- result{response, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return 0, fmt.Errorf("timeout after %s", bg.config.BootTimeout)
+	case res := <-done:
+		if res.err != nil {
+			return 0, res.err
+		}
+		if res.response.Status < 200 || res.response.Status >= 300 {
+			if len(res.response.Body) > 0 {
+				bg.logger.Errorf("Boot request response: %s", res.response.Body)
+			}
+			return res.response.Status, fmt.Errorf("unexpected status %d", res.response.Status)
+		}
+		return res.response.Status, nil
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCacheStorage keeps every entry in its own file, so cached pages survive restarts.
+// The index (LRU order, tags, uris) is in memory and it's rebuilt from the files on start.
+type diskCacheStorage struct {
+	dir string
+
+	mu    sync.Mutex
+	index *cacheIndex // entries without response, the response is read from the file
+
+	logger *logrus.Logger
+}
+
+func newDiskCacheStorage(dir string, maxEntries int, logger *logrus.Logger) (*diskCacheStorage, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("%s storage requires --%s", CacheStorageDisk, CacheDir)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+
+	ds := &diskCacheStorage{
+		dir:    dir,
+		index:  newCacheIndex(maxEntries),
+		logger: logger,
+	}
+	if err := ds.load(); err != nil {
+		return nil, fmt.Errorf("could not load cache directory: %w", err)
+	}
+	return ds, nil
+}
+
+// load indexes valid entries from the directory, the least recently modified are evicted first
+func (ds *diskCacheStorage) load() error {
+	files, err := filepath.Glob(filepath.Join(ds.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	type loaded struct {
+		entry    *CacheEntry
+		modified time.Time
+	}
+	var entries []loaded
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		entry, err := readCacheEntry(file)
+		if err != nil || time.Now().After(entry.Expires) || ds.file(entry.Key) != file {
+			_ = os.Remove(file)
+			continue
+		}
+		entry.Response = nil
+		entries = append(entries, loaded{entry: entry, modified: info.ModTime()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modified.Before(entries[j].modified)
+	})
+	for _, e := range entries {
+		for _, key := range ds.index.add(e.entry) {
+			_ = os.Remove(ds.file(key))
+		}
+	}
+	ds.logger.Infof("Loaded %d cached responses from %s", ds.index.lru.Len(), ds.dir)
+	return nil
+}
+
+// file returns path of the entry file, keys are hashed to get safe file names
+func (ds *diskCacheStorage) file(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(ds.dir, hex.EncodeToString(hash[:])+".json")
+}
+
+func (ds *diskCacheStorage) Get(key string) (*CacheEntry, error) {
+	ds.mu.Lock()
+	_, found := ds.index.get(key)
+	ds.mu.Unlock()
+	if !found {
+		return nil, nil
+	}
+
+	entry, err := readCacheEntry(ds.file(key))
+	if os.IsNotExist(err) {
+		ds.mu.Lock()
+		ds.index.remove(key)
+		ds.mu.Unlock()
+		return nil, nil
+	}
+	return entry, err
+}
+
+func (ds *diskCacheStorage) Set(entry *CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// written to a temporary file first, readers never see a partial entry
+	file := ds.file(entry.Key)
+	tmp, err := os.CreateTemp(ds.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	metadata := *entry
+	metadata.Response = nil
+	for _, key := range ds.index.add(&metadata) {
+		_ = os.Remove(ds.file(key))
+	}
+	return nil
+}
+
+func (ds *diskCacheStorage) Delete(key string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.index.remove(key)
+	return removeIfExists(ds.file(key))
+}
+
+func (ds *diskCacheStorage) PurgeTag(tag string) (int, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.purge(ds.index.tagged(tag))
+}
+
+func (ds *diskCacheStorage) PurgeUri(uri string) (int, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.purge(ds.index.byUri(uri))
+}
+
+// purge removes the keys, caller must hold the lock
+func (ds *diskCacheStorage) purge(keys []string) (int, error) {
+	purged := 0
+	var errs []string
+	for _, key := range keys {
+		if !ds.index.remove(key) {
+			continue
+		}
+		purged++
+		if err := removeIfExists(ds.file(key)); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return purged, fmt.Errorf("could not remove cache files: %s", strings.Join(errs, "; "))
+	}
+	return purged, nil
+}
+
+func (ds *diskCacheStorage) Len() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.index.lru.Len()
+}
+
+func readCacheEntry(file string) (*CacheEntry, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("invalid cache file %s: %w", file, err)
+	}
+	if entry.Response == nil {
+		return nil, fmt.Errorf("invalid cache file %s: response is missing", file)
+	}
+	return &entry, nil
+}
+
+func removeIfExists(file string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	errRedisUnavailable = errors.New("redis is unavailable")
+
+	// redisCacheSet stores the entry and adds it to its tag and uri sets, sets live as long as their longest entry.
+	// KEYS[1] is the entry, other keys are the sets, ARGV[1] the entry and ARGV[2] its ttl in milliseconds.
+	redisCacheSet = redis.NewScript(`
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+for i = 2, #KEYS do
+	redis.call('SADD', KEYS[i], KEYS[1])
+	if redis.call('PTTL', KEYS[i]) < tonumber(ARGV[2]) then
+		redis.call('PEXPIRE', KEYS[i], ARGV[2])
+	end
+end
+return 1
+`)
+
+	// redisCachePurge deletes all entries of the set KEYS[1] and the set itself, returns number of deleted entries
+	redisCachePurge = redis.NewScript(`
+local purged = 0
+for _, key in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	purged = purged + redis.call('DEL', key)
+end
+redis.call('DEL', KEYS[1])
+return purged
+`)
+)
+
+// redisCacheStorage shares cached responses between replicas, entries expire in Redis on their own.
+// While Redis is unavailable every lookup is a miss.
+type redisCacheStorage struct {
+	redis *RedisStore
+}
+
+func newRedisCacheStorage(redisStore *RedisStore) *redisCacheStorage {
+	return &redisCacheStorage{redis: redisStore}
+}
+
+func (rs *redisCacheStorage) entryKey(key string) string {
+	return rs.redis.Key("cache", key)
+}
+
+// call runs the operation when Redis is available and switches to the fallback on failure
+func (rs *redisCacheStorage) call(operation func() error) error {
+	if !rs.redis.Available() {
+		return errRedisUnavailable
+	}
+	err := operation()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		rs.redis.Failed(RedisStateCache, err)
+	}
+	return err
+}
+
+func (rs *redisCacheStorage) Get(key string) (*CacheEntry, error) {
+	var data []byte
+	err := rs.call(func() error {
+		ctx, cancel := rs.redis.Context()
+		defer cancel()
+		var err error
+		data, err = rs.redis.client.Get(ctx, rs.entryKey(key)).Bytes()
+		return err
+	})
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Response == nil {
+		return nil, fmt.Errorf("invalid cache entry %s", key)
+	}
+	return &entry, nil
+}
+
+func (rs *redisCacheStorage) Set(entry *CacheEntry) error {
+	ttl := time.Until(entry.Expires)
+	if ttl < time.Millisecond {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{rs.entryKey(entry.Key), rs.redis.Key("cache-uri", entry.Uri)}
+	for _, tag := range entry.Tags {
+		keys = append(keys, rs.redis.Key("cache-tag", tag))
+	}
+	return rs.call(func() error {
+		ctx, cancel := rs.redis.Context()
+		defer cancel()
+		return redisCacheSet.Run(ctx, rs.redis.client, keys, data, ttl.Milliseconds()).Err()
+	})
+}
+
+func (rs *redisCacheStorage) Delete(key string) error {
+	return rs.call(func() error {
+		ctx, cancel := rs.redis.Context()
+		defer cancel()
+		return rs.redis.client.Del(ctx, rs.entryKey(key)).Err()
+	})
+}
+
+func (rs *redisCacheStorage) PurgeTag(tag string) (int, error) {
+	return rs.purge(rs.redis.Key("cache-tag", tag))
+}
+
+func (rs *redisCacheStorage) PurgeUri(uri string) (int, error) {
+	return rs.purge(rs.redis.Key("cache-uri", uri))
+}
+
+func (rs *redisCacheStorage) purge(set string) (int, error) {
+	purged := 0
+	err := rs.call(func() error {
+		ctx, cancel := rs.redis.Context()
+		defer cancel()
+		var err error
+		purged, err = redisCachePurge.Run(ctx, rs.redis.client, []string{set}).Int()
+		return err
+	})
+	return purged, err
+}
+
+// Len counts entries with SCAN, it's meant for occasional admin use
+func (rs *redisCacheStorage) Len() int {
+	count := 0
+	_ = rs.call(func() error {
+		ctx, cancel := rs.redis.Context()
+		defer cancel()
+		iter := rs.redis.client.Scan(ctx, 0, rs.entryKey("*"), 1000).Iterator()
+		for iter.Next(ctx) {
+			count++
+		}
+		return iter.Err()
+	})
+	return count
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+const (
+	CacheStorageMemory = "memory"
+	CacheStorageDisk   = "disk"
+	CacheStorageRedis  = "redis"
+)
+
+// CacheStorage keeps cache entries, ResponseCache decides what is cacheable and for how long.
+// Get returns nil entry on miss, expired entries may be returned and are deleted by the caller.
+type CacheStorage interface {
+	Get(key string) (*CacheEntry, error)
+	Set(entry *CacheEntry) error
+	Delete(key string) error
+	PurgeTag(tag string) (int, error)
+	PurgeUri(uri string) (int, error)
+	Len() int
+}
+
+// NewCacheStorage creates storage selected by --cache-storage
+func NewCacheStorage(config *Config, redisStore *RedisStore, logger *logrus.Logger) (CacheStorage, error) {
+	if !config.Cache && config.NegativeCacheTtl <= 0 {
+		return newMemoryCacheStorage(config.CacheMaxEntries), nil // never used
+	}
+
+	switch config.CacheStorage {
+	case CacheStorageMemory:
+		return newMemoryCacheStorage(config.CacheMaxEntries), nil
+	case CacheStorageDisk:
+		return newDiskCacheStorage(config.CacheDir, config.CacheMaxEntries, logger)
+	case CacheStorageRedis:
+		if redisStore == nil {
+			return nil, fmt.Errorf("%s storage requires --%s", CacheStorageRedis, RedisAddress)
+		}
+		return newRedisCacheStorage(redisStore), nil
+	}
+	return nil, fmt.Errorf("unknown cache storage %q, use %s, %s or %s", config.CacheStorage, CacheStorageMemory, CacheStorageDisk, CacheStorageRedis)
+}
+
+// cacheIndex keeps entries in LRU order with tag and uri lookups, it's not safe for concurrent use
+type cacheIndex struct {
+	entries    map[string]*list.Element // key -> element with *CacheEntry
+	lru        *list.List               // most recently used at front
+	tags       map[string]map[string]struct{}
+	maxEntries int
+}
+
+func newCacheIndex(maxEntries int) *cacheIndex {
+	return &cacheIndex{
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		tags:       map[string]map[string]struct{}{},
+		maxEntries: maxEntries,
+	}
+}
+
+// get returns the entry and marks it as recently used
+func (ci *cacheIndex) get(key string) (*CacheEntry, bool) {
+	element, found := ci.entries[key]
+	if !found {
+		return nil, false
+	}
+	ci.lru.MoveToFront(element)
+	return element.Value.(*CacheEntry), true
+}
+
+// add inserts or replaces the entry, returns keys evicted to make room for it
+func (ci *cacheIndex) add(entry *CacheEntry) []string {
+	ci.remove(entry.Key)
+
+	var evicted []string
+	for ci.lru.Len() >= ci.maxEntries && ci.lru.Len() > 0 {
+		key := ci.lru.Back().Value.(*CacheEntry).Key // evict least recently used
+		ci.remove(key)
+		evicted = append(evicted, key)
+	}
+
+	ci.entries[entry.Key] = ci.lru.PushFront(entry)
+	for _, tag := range entry.Tags {
+		if ci.tags[tag] == nil {
+			ci.tags[tag] = map[string]struct{}{}
+		}
+		ci.tags[tag][entry.Key] = struct{}{}
+	}
+	return evicted
+}
+
+// remove deletes the entry from all indexes
+func (ci *cacheIndex) remove(key string) bool {
+	element, found := ci.entries[key]
+	if !found {
+		return false
+	}
+	entry := element.Value.(*CacheEntry)
+	ci.lru.Remove(element)
+	delete(ci.entries, key)
+	for _, tag := range entry.Tags {
+		delete(ci.tags[tag], key)
+		if len(ci.tags[tag]) == 0 {
+			delete(ci.tags, tag)
+		}
+	}
+	return true
+}
+
+// tagged returns keys of entries tagged by the tag
+func (ci *cacheIndex) tagged(tag string) []string {
+	keys := make([]string, 0, len(ci.tags[tag]))
+	for key := range ci.tags[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// byUri returns keys of entries of the uri regardless of host
+func (ci *cacheIndex) byUri(uri string) []string {
+	var keys []string
+	for key, element := range ci.entries {
+		if element.Value.(*CacheEntry).Uri == uri {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// memoryCacheStorage is an in-memory LRU, entries are lost on restart
+type memoryCacheStorage struct {
+	mu    sync.Mutex
+	index *cacheIndex
+}
+
+func newMemoryCacheStorage(maxEntries int) *memoryCacheStorage {
+	return &memoryCacheStorage{index: newCacheIndex(maxEntries)}
+}
+
+func (ms *memoryCacheStorage) Get(key string) (*CacheEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, _ := ms.index.get(key)
+	return entry, nil
+}
+
+func (ms *memoryCacheStorage) Set(entry *CacheEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.index.add(entry)
+	return nil
+}
+
+func (ms *memoryCacheStorage) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.index.remove(key)
+	return nil
+}
+
+func (ms *memoryCacheStorage) PurgeTag(tag string) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.purge(ms.index.tagged(tag)), nil
+}
+
+func (ms *memoryCacheStorage) PurgeUri(uri string) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.purge(ms.index.byUri(uri)), nil
+}
+
+// purge removes the keys, caller must hold the lock
+func (ms *memoryCacheStorage) purge(keys []string) int {
+	purged := 0
+	for _, key := range keys {
+		if ms.index.remove(key) {
+			purged++
+		}
+	}
+	return purged
+}
+
+func (ms *memoryCacheStorage) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.index.lru.Len()
+}
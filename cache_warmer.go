@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheWarmJob is a URL whose cached response is refreshed on an interval
+type CacheWarmJob struct {
+	Interval time.Duration
+	Url      *url.URL
+}
+
+// CacheWarmer refreshes configured URLs in the response cache before their TTL expires,
+// so hot pages stay warm and FPM load doesn't spike when entries expire
+type CacheWarmer struct {
+	jobs []CacheWarmJob
+
+	fpmClient     *FpmClient
+	paramsBuilder *ParamsBuilder
+	cache         *ResponseCache
+	config        *Config
+	monitor       *Monitor
+	logger        *logrus.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewCacheWarmer(
+	config *Config,
+	fpmClient *FpmClient,
+	paramsBuilder *ParamsBuilder,
+	cache *ResponseCache,
+	monitor *Monitor,
+	logger *logrus.Logger,
+) (*CacheWarmer, error) {
+	var jobs []CacheWarmJob
+	for _, definition := range config.CacheWarm {
+		interval, rawUrl, found := strings.Cut(definition, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid cache warm definition: %s", definition)
+		}
+		duration, err := time.ParseDuration(interval)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid cache warm interval %q: %s", interval, definition)
+		}
+		target, err := url.Parse(rawUrl)
+		if err != nil || !strings.HasPrefix(target.Path, "/") {
+			return nil, fmt.Errorf("invalid cache warm url %q: %s", rawUrl, definition)
+		}
+		if target.Host == "" {
+			target.Host = "localhost"
+		}
+		jobs = append(jobs, CacheWarmJob{
+			Interval: duration,
+			Url:      target,
+		})
+	}
+	if len(jobs) > 0 && !config.Cache {
+		return nil, fmt.Errorf("cache warming requires --%s", Cache)
+	}
+
+	return &CacheWarmer{
+		jobs: jobs,
+
+		fpmClient:     fpmClient,
+		paramsBuilder: paramsBuilder,
+		cache:         cache,
+		config:        config,
+		monitor:       monitor,
+		logger:        logger,
+
+		stop: make(chan struct{}),
+	}, nil
+}
+
+// Start warms every URL immediately and then refreshes it on its interval
+func (cw *CacheWarmer) Start() {
+	for _, job := range cw.jobs {
+		cw.wg.Add(1)
+		go cw.run(job)
+	}
+	if len(cw.jobs) > 0 {
+		cw.logger.Debugf("Cache warmer started with %d urls", len(cw.jobs))
+	}
+}
+
+// Stop stops refreshing and waits for running requests to finish
+func (cw *CacheWarmer) Stop() {
+	close(cw.stop)
+	cw.wg.Wait()
+}
+
+func (cw *CacheWarmer) run(job CacheWarmJob) {
+	defer cw.wg.Done()
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	cw.refresh(job)
+	for {
+		select {
+		case <-cw.stop:
+			return
+		case <-ticker.C:
+			cw.refresh(job)
+		}
+	}
+}
+
+func (cw *CacheWarmer) refresh(job CacheWarmJob) {
+	request, err := http.NewRequest(http.MethodGet, job.Url.RequestURI(), nil)
+	if err != nil {
+		cw.logger.Errorf("cache warmer: could not create request %s: %s", job.Url, err)
+		return
+	}
+	request.Host = job.Url.Host // part of the cache key
+
+	params := cw.paramsBuilder.Build(request, 0, map[string]string{"GOPHPFPM_CACHE_WARM": "1"})
+	if job.Url.Scheme == "https" {
+		// the response must be the same as for real visitors
+		params["HTTPS"] = "on"
+		params["REQUEST_SCHEME"] = "https"
+	}
+
+	uri := job.Url.RequestURI()
+	response, err := cw.fpmClient.Execute(cw.fpmClient.NewRequest(params, nil))
+	if err != nil {
+		cw.monitor.ScheduledRequestsCounter.WithLabelValues(cw.config.App, uri, "error").Inc()
+		cw.logger.WithField("url", job.Url.String()).Errorf("cache warmer: request failed: %s", err)
+		return
+	}
+	cw.monitor.ScheduledRequestsCounter.WithLabelValues(cw.config.App, uri, fmt.Sprintf("%d", response.Status)).Inc()
+
+	if !cw.cache.Store(request, response) {
+		cw.logger.WithFields(logrus.Fields{
+			"url":    job.Url.String(),
+			"status": response.Status,
+		}).Warn("cache warmer: response is not cacheable")
+		return
+	}
+	cw.logger.WithField("url", job.Url.String()).Debug("cache warmer: refreshed")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CGI redirect policies for responses with Location header (RFC 3875, section 6.2)
+const (
+	RedirectPolicyClient      = "client"      // Location without Status is sent as 302 redirect
+	RedirectPolicyLocal       = "local"       // local redirects are processed internally, others as client
+	RedirectPolicyPassthrough = "passthrough" // status is never changed by the proxy
+)
+
+// maxLocalRedirects protects against local redirect loops
+const maxLocalRedirects = 10
+
+func validateRedirectPolicy(policy string) error {
+	switch policy {
+	case RedirectPolicyClient, RedirectPolicyLocal, RedirectPolicyPassthrough:
+		return nil
+	}
+	return fmt.Errorf(
+		"invalid redirect policy %q, use %q, %q or %q",
+		policy, RedirectPolicyClient, RedirectPolicyLocal, RedirectPolicyPassthrough,
+	)
+}
+
+// applyRedirectPolicy resolves CGI response type of the response.
+// It returns the target of a local redirect which must be processed internally by the proxy.
+//
+//   - document response (no Location) is kept as it is
+//   - client redirect with document (Location + Status) is kept as it is
+//   - client redirect (Location with absolute URI, no Status) gets 302 status
+//   - local redirect (Location with absolute path, no Status, no body) is processed internally
+//     with "local" policy, otherwise it's handled as a client redirect
+func applyRedirectPolicy(policy string, response *ResponseData) (string, bool) {
+	headers := http.Header(response.Headers)
+	location := headers.Get("Location")
+	if location == "" || headers.Get("Status") != "" || policy == RedirectPolicyPassthrough {
+		return "", false
+	}
+
+	localRedirect := strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") && len(response.Body) == 0
+	if localRedirect && policy == RedirectPolicyLocal {
+		return location, true
+	}
+
+	response.Status = http.StatusFound
+	return "", false
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyRedirectPolicy(t *testing.T) {
+	// status of the response and target of the local redirect for client, local and passthrough policy
+	type result struct {
+		status int
+		target string
+	}
+	cases := []struct {
+		name        string
+		location    string
+		status      string // Status header set by PHP
+		body        string
+		client      result
+		local       result
+		passthrough result
+	}{
+		{
+			name:        "document",
+			client:      result{status: 200},
+			local:       result{status: 200},
+			passthrough: result{status: 200},
+		},
+		{
+			name:        "client redirect",
+			location:    "https://example.com/login",
+			client:      result{status: 302},
+			local:       result{status: 302},
+			passthrough: result{status: 200},
+		},
+		{
+			name:        "local redirect",
+			location:    "/login?next=%2F",
+			client:      result{status: 302},
+			local:       result{status: 200, target: "/login?next=%2F"},
+			passthrough: result{status: 200},
+		},
+		{
+			name:        "network path is not local",
+			location:    "//evil.example.com/",
+			client:      result{status: 302},
+			local:       result{status: 302},
+			passthrough: result{status: 200},
+		},
+		{
+			name:        "relative path is not local",
+			location:    "login",
+			client:      result{status: 302},
+			local:       result{status: 302},
+			passthrough: result{status: 200},
+		},
+		{
+			name:        "local redirect with document",
+			location:    "/login",
+			body:        "<a href=\"/login\">login</a>",
+			client:      result{status: 302},
+			local:       result{status: 302},
+			passthrough: result{status: 200},
+		},
+		{
+			name:        "client redirect with status",
+			location:    "https://example.com/",
+			status:      "301 Moved Permanently",
+			client:      result{status: 301},
+			local:       result{status: 301},
+			passthrough: result{status: 301},
+		},
+		{
+			name:        "local path with status",
+			location:    "/new",
+			status:      "303",
+			client:      result{status: 303},
+			local:       result{status: 303},
+			passthrough: result{status: 303},
+		},
+		{
+			name:        "created with location",
+			location:    "/items/1",
+			status:      "201 Created",
+			body:        `{"id":1}`,
+			client:      result{status: 201},
+			local:       result{status: 201},
+			passthrough: result{status: 201},
+		},
+	}
+
+	for _, c := range cases {
+		for policy, want := range map[string]result{
+			RedirectPolicyClient:      c.client,
+			RedirectPolicyLocal:       c.local,
+			RedirectPolicyPassthrough: c.passthrough,
+		} {
+			t.Run(policy+"/"+c.name, func(t *testing.T) {
+				stdout := "Content-Type: text/html\r\n"
+				if c.location != "" {
+					stdout += "Location: " + c.location + "\r\n"
+				}
+				if c.status != "" {
+					stdout += "Status: " + c.status + "\r\n"
+				}
+				httpResponse, err := parseCgiHeaders([]byte(stdout + "\r\n"))
+				if err != nil {
+					t.Fatalf("could not parse headers: %s", err)
+				}
+				response := &ResponseData{Status: httpResponse.StatusCode, Headers: httpResponse.Header, Body: []byte(c.body)}
+
+				target, local := applyRedirectPolicy(policy, response)
+				if target != want.target || local != (want.target != "") {
+					t.Errorf("local redirect = %q (%t), want %q", target, local, want.target)
+				}
+				if !local && response.Status != want.status {
+					t.Errorf("status = %d, want %d", response.Status, want.status)
+				}
+				if got := http.Header(response.Headers).Get("Location"); got != c.location {
+					t.Errorf("Location = %q, want %q", got, c.location)
+				}
+			})
+		}
+	}
+}
+
+// redirectFpm answers by REQUEST_URI, targets of local redirects print params of the internal request
+func redirectFpm(w *mockFpmWriter, request mockFpmRequest) {
+	switch uri := request.params["REQUEST_URI"]; uri {
+	case "/login":
+		w.Stdout("Location: /dashboard?from=login\r\n\r\n")
+	case "/chain":
+		w.Stdout("Location: /login\r\n\r\n")
+	case "/loop":
+		w.Stdout("Location: /loop\r\n\r\n")
+	case "/external":
+		w.Stdout("Location: https://example.com/\r\n\r\n")
+	case "/moved":
+		w.Stdout("Status: 301 Moved Permanently\r\nLocation: /new\r\n\r\n")
+	case "/document":
+		w.Stdout("Location: /dashboard\r\nContent-Type: text/html\r\n\r\n<a href=\"/dashboard\">dashboard</a>")
+	default:
+		w.Stdout(fmt.Sprintf(
+			"Content-Type: text/plain\r\n\r\n%s %s query=%s redirect=%s length=%s",
+			request.params["REQUEST_METHOD"], uri, request.params["QUERY_STRING"],
+			request.params["REDIRECT_URL"], request.params["CONTENT_LENGTH"],
+		))
+	}
+	w.End(0, FCGI_REQUEST_COMPLETE)
+}
+
+func TestRedirectPolicyServer(t *testing.T) {
+	cases := []struct {
+		policy   string
+		method   string
+		path     string
+		status   int
+		location string
+		body     string
+	}{
+		{policy: RedirectPolicyLocal, method: http.MethodGet, path: "/login", status: 200, body: "GET /dashboard?from=login query=from=login redirect=/login length="},
+		{policy: RedirectPolicyLocal, method: http.MethodPost, path: "/login", status: 200, body: "GET /dashboard?from=login query=from=login redirect=/login length="},
+		{policy: RedirectPolicyLocal, method: http.MethodGet, path: "/chain", status: 200, body: "GET /dashboard?from=login query=from=login redirect=/chain length="},
+		{policy: RedirectPolicyLocal, method: http.MethodGet, path: "/loop", status: 500},
+		{policy: RedirectPolicyLocal, method: http.MethodGet, path: "/external", status: 302, location: "https://example.com/"},
+		{policy: RedirectPolicyLocal, method: http.MethodGet, path: "/moved", status: 301, location: "/new"},
+		{policy: RedirectPolicyLocal, method: http.MethodGet, path: "/document", status: 302, location: "/dashboard", body: `<a href="/dashboard">dashboard</a>`},
+		{policy: RedirectPolicyClient, method: http.MethodGet, path: "/login", status: 302, location: "/dashboard?from=login"},
+		{policy: RedirectPolicyClient, method: http.MethodGet, path: "/moved", status: 301, location: "/new"},
+		{policy: RedirectPolicyPassthrough, method: http.MethodGet, path: "/login", status: 200, location: "/dashboard?from=login"},
+		{policy: RedirectPolicyPassthrough, method: http.MethodGet, path: "/moved", status: 301, location: "/new"},
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, c := range cases {
+		t.Run(c.policy+"/"+c.method+c.path, func(t *testing.T) {
+			server := newTestServer(t, startMockFpm(t, redirectFpm), "--"+RedirectPolicy, c.policy)
+
+			request, _ := http.NewRequest(c.method, server.URL+c.path, strings.NewReader("user=admin"))
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+
+			if response.StatusCode != c.status {
+				t.Errorf("status = %d, want %d (%s)", response.StatusCode, c.status, body)
+			}
+			if got := response.Header.Get("Location"); got != c.location {
+				t.Errorf("Location = %q, want %q", got, c.location)
+			}
+			if c.body != "" && string(body) != c.body {
+				t.Errorf("body = %q, want %q", body, c.body)
+			}
+		})
+	}
+}
+
+func TestLocalRedirectDeadline(t *testing.T) {
+	fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+		if request.params["REQUEST_URI"] == "/login" {
+			w.Stdout("Location: /slow\r\n\r\n")
+		} else {
+			w.Stdout("Content-Type: text/plain\r\n\r\nslow ")
+			time.Sleep(300 * time.Millisecond) // the rest of the response comes after the deadline
+			w.Stdout("response")
+		}
+		w.End(0, FCGI_REQUEST_COMPLETE)
+	})
+	svr := newTestHttpServer(t, fpm, "--"+RedirectPolicy, RedirectPolicyLocal, "--"+FpmFirstByteTimeout, "5s")
+
+	request := httptest.NewRequest(http.MethodGet, "/login", nil)
+	_, err := svr.fpmClient.Call(request, time.Now().Add(100*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("error = %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	FaultLatency = "latency"
+	FaultDrop    = "drop"
+	FaultError   = "error"
+)
+
+var errInjectedFault = errors.New("injected fault")
+
+// ChaosSettings describes faults injected to a percentage of requests
+type ChaosSettings struct {
+	Latency        string  `json:"latency"`
+	LatencyPercent float64 `json:"latency_percent"`
+	DropPercent    float64 `json:"drop_percent"`
+	ErrorPercent   float64 `json:"error_percent"`
+	ErrorStatus    int     `json:"error_status"`
+
+	latency time.Duration
+}
+
+// Fault is the decision made for one request
+type Fault struct {
+	Latency     time.Duration
+	Drop        bool
+	ErrorStatus int
+}
+
+// FaultInjector introduces artificial FPM latency, dropped connections and 5xx responses.
+// It's meant for staging, so teams can validate retry and alerting configuration against proxy failure modes.
+// Faults are configured via admin API and only when the injector is allowed by --chaos flag.
+type FaultInjector struct {
+	mu       sync.RWMutex
+	settings ChaosSettings
+
+	config  *Config
+	monitor *Monitor
+}
+
+func NewFaultInjector(config *Config, monitor *Monitor) *FaultInjector {
+	return &FaultInjector{
+		config:  config,
+		monitor: monitor,
+	}
+}
+
+// Allowed reports whether faults can be configured at all
+func (fi *FaultInjector) Allowed() bool {
+	return fi.config.Chaos
+}
+
+// Settings returns currently injected faults
+func (fi *FaultInjector) Settings() ChaosSettings {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	return fi.settings
+}
+
+// Configure validates and replaces injected faults
+func (fi *FaultInjector) Configure(settings ChaosSettings) error {
+	if settings.Latency != "" {
+		latency, err := time.ParseDuration(settings.Latency)
+		if err != nil || latency < 0 {
+			return fmt.Errorf("invalid latency %q", settings.Latency)
+		}
+		settings.latency = latency
+	}
+	for _, percent := range []float64{settings.LatencyPercent, settings.DropPercent, settings.ErrorPercent} {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("percentage must be between 0 and 100")
+		}
+	}
+	if settings.ErrorStatus == 0 {
+		settings.ErrorStatus = http.StatusInternalServerError
+	}
+	if settings.ErrorStatus < 500 || settings.ErrorStatus > 599 {
+		return fmt.Errorf("error status must be 5xx")
+	}
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.settings = settings
+	return nil
+}
+
+// Reset stops injecting any faults
+func (fi *FaultInjector) Reset() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.settings = ChaosSettings{}
+}
+
+// Decide draws faults for one request
+func (fi *FaultInjector) Decide() Fault {
+	if !fi.Allowed() {
+		return Fault{}
+	}
+	settings := fi.Settings()
+
+	var fault Fault
+	if settings.latency > 0 && chance(settings.LatencyPercent) {
+		fault.Latency = settings.latency
+		fi.monitor.ChaosFaultsCounter.WithLabelValues(fi.config.App, FaultLatency).Inc()
+	}
+	if chance(settings.DropPercent) {
+		fault.Drop = true
+		fi.monitor.ChaosFaultsCounter.WithLabelValues(fi.config.App, FaultDrop).Inc()
+		return fault
+	}
+	if chance(settings.ErrorPercent) {
+		fault.ErrorStatus = settings.ErrorStatus
+		fi.monitor.ChaosFaultsCounter.WithLabelValues(fi.config.App, FaultError).Inc()
+	}
+	return fault
+}
+
+func chance(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
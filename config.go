@@ -5,25 +5,194 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	ParamPort          = "port"
-	ParamSocket        = "socket"
-	ParamIndex         = "index-file"
-	ParamApp           = "app"
-	ParamStaticFolders = "static-folder"
-	FpmPoolSize        = "fpm-pool-size"
-	Timeout            = "timeout"
-	AccessLog          = "access-log"
-	ParamVerbose       = "verbose"
+	ParamPort              = "port"
+	ParamSocket            = "socket"
+	FpmAddress             = "fpm-address"
+	ParamIndex             = "index-file"
+	ParamApp               = "app"
+	ParamStaticFolders     = "static-folder"
+	FpmPoolSize            = "fpm-pool-size"
+	Timeout                = "timeout"
+	AccessLog              = "access-log"
+	ParamVerbose           = "verbose"
+	MaxDecompressedSize    = "max-decompressed-size"
+	Compression            = "compression"
+	CompressionTypes       = "compression-type"
+	CompressionMinSize     = "compression-min-size"
+	OptionsPrefixes        = "options-prefix"
+	OptionsAllow           = "options-allow"
+	CorsOrigins            = "cors-origin"
+	CorsCredentials        = "cors-credentials"
+	CorsMaxAge             = "cors-max-age"
+	DropHeaders            = "drop-header"
+	RenameHeaders          = "rename-header"
+	AllowUnderscores       = "allow-underscores-in-headers"
+	AdminPort              = "admin-port"
+	AdminToken             = "admin-token"
+	AdminScripts           = "admin-script"
+	AdminBind              = "admin-bind"
+	Schedules              = "schedule"
+	SaturationThreshold    = "saturation-threshold"
+	SaturationDuration     = "saturation-duration"
+	Priorities             = "priority"
+	LowPriorityMaxWait     = "low-priority-max-wait"
+	FairQueueKey           = "fair-queue-key"
+	RetryAfter             = "retry-after"
+	Preflight              = "preflight"
+	PreflightUri           = "preflight-uri"
+	Cache                  = "cache"
+	CacheMaxEntries        = "cache-max-entries"
+	CacheMaxBodySize       = "cache-max-body-size"
+	NegativeCacheTtl       = "negative-cache-ttl"
+	DumpDir                = "dump-dir"
+	DumpPrefixes           = "dump-prefix"
+	RedirectPolicy         = "redirect-policy"
+	BootCommand            = "boot-command"
+	BootUri                = "boot-uri"
+	BootTimeout            = "boot-timeout"
+	BindAddresses          = "bind"
+	CostSampleRate         = "cost-sample-rate"
+	LogOutput              = "log-output"
+	SyslogAddress          = "syslog-address"
+	AccessSinkAddress      = "access-sink"
+	AccessSinkBuffer       = "access-sink-buffer"
+	AccessSinkBatch        = "access-sink-batch"
+	AccessSinkFlush        = "access-sink-flush"
+	Profile                = "profile"
+	LogFormat              = "log-format"
+	SecurityHeaders        = "security-headers"
+	Chaos                  = "chaos"
+	Forwarded              = "forwarded"
+	TrustedProxies         = "trusted-proxy"
+	AbBucket               = "ab-bucket"
+	AbCookie               = "ab-cookie"
+	SubFilters             = "sub-filter"
+	SubFilterTypes         = "sub-filter-type"
+	SubFilterMaxSize       = "sub-filter-max-size"
+	BasePath               = "base-path"
+	JsonMinify             = "json-minify"
+	DefaultCharset         = "default-charset"
+	AssetManifests         = "asset-manifest"
+	DefaultType            = "default-type"
+	StrictContentType      = "strict-content-type"
+	SshHost                = "ssh-host"
+	SshKey                 = "ssh-key"
+	SshKnownHosts          = "ssh-known-hosts"
+	CsrfPrefixes           = "csrf-prefix"
+	CsrfCookie             = "csrf-cookie"
+	CsrfHeader             = "csrf-header"
+	CsrfField              = "csrf-field"
+	Etag                   = "etag"
+	EtagMaxSize            = "etag-max-size"
+	FpmReservedConnections = "fpm-reserved-connections"
+	IdempotencyPrefixes    = "idempotency-prefix"
+	IdempotencyTtl         = "idempotency-ttl"
+	CacheWarm              = "cache-warm"
+	DeadlineHint           = "deadline-hint"
+	FpmStatusPath          = "fpm-status-path"
+	SlowRequestThreshold   = "slow-request-threshold"
+	Streaming              = "streaming"
+	StreamBufferSize       = "stream-buffer-size"
+	StreamThreshold        = "stream-threshold"
+	StreamSpoolMaxSize     = "stream-spool-max-size"
+	StreamPrefixes         = "stream-prefix"
+	TlsCert                = "tls-cert"
+	TlsKey                 = "tls-key"
+	TlsMinVersion          = "tls-min-version"
+	TlsCipherSuites        = "tls-cipher-suites"
+	TlsCurves              = "tls-curves"
+	TlsSessionTickets      = "tls-session-tickets"
+	TlsAlpn                = "tls-alpn"
+	TlsReloadInterval      = "tls-reload-interval"
+	TlsClientAuth          = "tls-client-auth"
+	TlsClientCa            = "tls-client-ca"
+	RouteTimeouts          = "route-timeout"
+	MethodTimeoutFactors   = "method-timeout-factor"
+	RateLimit              = "rate-limit"
+	RateLimitKey           = "rate-limit-key"
+	RateLimitOverrides     = "rate-limit-override"
+	RateLimitMaxKeys       = "rate-limit-max-keys"
+	RedisAddress           = "redis-address"
+	RedisPassword          = "redis-password"
+	RedisDb                = "redis-db"
+	RedisPrefix            = "redis-prefix"
+	RedisTimeout           = "redis-timeout"
+	ParamCacheStorage      = "cache-storage"
+	CacheDir               = "cache-dir"
+	FeatureFlags           = "feature"
+	AccessLogTimeFormat    = "access-log-time-format"
+	AccessLogTimezone      = "access-log-timezone"
+	RequestStreamThreshold = "request-stream-threshold"
+	TenantSource           = "tenant-source"
+	TenantMaxLabels        = "tenant-max-labels"
+	IndexCheckInterval     = "index-check-interval"
+	ReadinessPath          = "readiness-path"
+	TimeoutStatus          = "timeout-status"
+	TimeoutBodyFile        = "timeout-body-file"
+	StderrInResponse       = "stderr-in-response"
+	AuthUrl                = "auth-url"
+	AuthResponseHeader     = "auth-response-header"
+	AuthPrefix             = "auth-prefix"
+	AuthTimeout            = "auth-timeout"
+	FpmPoolAuto            = "fpm-pool-auto"
+	Http10Compat           = "http10-compat"
+	Http10StripHeader      = "http10-strip-header"
+	ResponseHeaderBudget   = "response-header-budget"
+	ShutdownTimeout        = "shutdown-timeout"
+	SslHeaders             = "ssl-header"
+	AccessRule             = "access-rule"
+	FpmConnMaxRequests     = "fpm-conn-max-requests"
+	FpmWait                = "fpm-wait"
+	BandwidthLimit         = "bandwidth-limit"
+	RouteBandwidths        = "route-bandwidth"
+	FpmQueueTimeout        = "fpm-queue-timeout"
+	FpmQueueDepth          = "fpm-queue-depth"
+	FpmPoolBurst           = "fpm-pool-burst"
+	FpmOverflowMax         = "fpm-overflow-max"
+	AccessLogPipeline      = "access-log-pipeline"
+	FpmHealthInterval      = "fpm-health-interval"
+	ConfigFile             = "config"
+	FpmFirstByteTimeout    = "fpm-first-byte-timeout"
+	InformationalStatus    = "informational-status"
+	StatusReasonHeader     = "status-reason-header"
+	ScanUrl                = "scan-url"
+	ScanPrefix             = "scan-prefix"
+	ScanMaxSize            = "scan-max-size"
+	ScanTimeout            = "scan-timeout"
+	ScanFailOpen           = "scan-fail-open"
+	FallbackPage           = "fallback-page"
+	Listen                 = "listen"
+	ListenSocketMode       = "listen-socket-mode"
+)
+
+var (
+	defaultCompressionTypes = []string{
+		"text/html",
+		"text/plain",
+		"text/css",
+		"text/xml",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"image/svg+xml",
+	}
 )
 
 type Config struct {
 	Port          int           // port to listen on
 	Socket        string        // path to php-fpm socket
+	FpmAddress    string        // host:port of php-fpm listening on TCP, used instead of Socket
 	IndexFile     string        // index.php file path
 	App           string        // application name
 	StaticFolders []string      // list of static folders
@@ -32,12 +201,233 @@ type Config struct {
 	AccessLog     bool          // enable access logging
 	Verbose       bool          // print debug output
 
+	MaxDecompressedSize int64 // limit for decompressed request body size in bytes
+
+	Compression        bool     // enable response compression
+	CompressionTypes   []string // compressible mime types with optional encodings
+	CompressionMinSize int      // minimal response body size to compress
+
+	OptionsPrefixes []string      // prefixes where OPTIONS requests are answered by proxy
+	OptionsAllow    string        // value of Allow header for OPTIONS responses
+	CorsOrigins     []string      // origins allowed for CORS preflight requests
+	CorsCredentials bool          // allow credentials in CORS requests
+	CorsMaxAge      time.Duration // how long the preflight response can be cached
+
+	DropHeaders            []string // inbound header patterns not passed to PHP
+	RenameHeaders          []string // inbound headers renamed before passing to PHP
+	AllowUnderscoreHeaders bool     // pass headers with underscores in name to PHP
+
+	AdminPort    int      // port of the admin server, 0 disables it
+	AdminToken   string   // bearer token required by admin endpoints
+	AdminScripts []string // scripts allowed to be executed via admin API
+	AdminBind    string   // address the admin server listens on, loopback by default
+
+	Schedules []string // periodic internal requests
+
+	SaturationThreshold float64       // saturation which triggers warning, 0 disables warnings
+	SaturationDuration  time.Duration // how long saturation must be sustained before warning
+
+	Priorities         []string      // priority classes of route prefixes
+	LowPriorityMaxWait time.Duration // how long low priority request waits for connection before it's shed
+	FairQueueKey       string        // client key for fair queuing (ip, header:<name>), empty disables it
+	RetryAfter         time.Duration // base Retry-After announced to clients whose requests were shed
+
+	Preflight    bool   // send preflight request to FPM at startup
+	PreflightUri string // uri of the preflight request
+
+	Cache            bool // enable response cache
+	CacheMaxEntries  int  // maximum number of cached responses
+	CacheMaxBodySize int  // maximum size of cached response body in bytes
+
+	NegativeCacheTtl time.Duration // how long 404/410 responses are cached, 0 disables negative cache
+
+	DumpDir      string   // directory where FastCGI exchanges are recorded, empty disables recording
+	DumpPrefixes []string // record only requests matching these prefixes
+
+	RedirectPolicy string // handling of CGI redirects (client, local, passthrough)
+
+	BootCommand string        // command executed once before the server starts
+	BootUri     string        // internal request sent once before the server starts
+	BootTimeout time.Duration // how long boot work can take
+
+	BindAddresses []string // addresses the server listens on, empty means all interfaces
+
+	CostSampleRate float64 // fraction of requests whose proxy cost is sampled, 0 disables sampling
+
+	LogOutput     string // where access and error logs are sent (stdout, syslog, journald)
+	SyslogAddress string // syslog server address (udp://, tcp:// or unix://)
+
+	AccessSink       string        // webhook url or kafka://brokers/topic where access events are sent
+	AccessSinkBuffer int           // maximum number of buffered access events
+	AccessSinkBatch  int           // maximum number of access events sent at once
+	AccessSinkFlush  time.Duration // how often buffered access events are sent
+
+	Profile         string // preset of settings (dev, prod)
+	LogFormat       string // format of logs (json, text)
+	SecurityHeaders bool   // add default security headers missing in PHP responses
+
+	Chaos bool // allow fault injection configured via admin API
+
+	Forwarded      string   // style of forwarded headers generated for PHP
+	TrustedProxies []string // proxies whose forwarded headers are trusted (IP or CIDR)
+
+	AbBuckets []string // A/B experiment buckets with weights
+	AbCookie  string   // name of the cookie storing assigned bucket
+
+	SubFilters       []string // replacements in response bodies
+	SubFilterTypes   []string // mime types where replacements are applied
+	SubFilterMaxSize int      // maximum size of response body where replacements are applied
+
+	BasePath string // mount prefix stripped from request paths
+
+	JsonMinify     bool   // strip whitespace from JSON responses
+	DefaultCharset string // charset added to textual responses without one, empty disables it
+
+	AssetManifests []string // build-time manifests of fingerprinted assets
+
+	DefaultType       string // Content-Type of PHP responses without one, empty lets Go sniff the body
+	StrictContentType bool   // log a warning for PHP responses without Content-Type
+
+	SshHost       string // user@host[:port] of SSH server where FPM socket is, empty connects locally
+	SshKey        string // private key used for the SSH tunnel
+	SshKnownHosts string // known_hosts file verifying the SSH server
+
+	CsrfPrefixes []string // path prefixes where unsafe requests require CSRF token
+	CsrfCookie   string   // cookie holding CSRF token
+	CsrfHeader   string   // header repeating CSRF token
+	CsrfField    string   // form field repeating CSRF token
+
+	Etag        bool // generate ETag for PHP responses and answer If-None-Match with 304
+	EtagMaxSize int  // maximum size of response body where ETag is generated
+
+	FpmReservedConnections int // FPM connections reserved for high priority requests
+
+	IdempotencyPrefixes []string      // path prefixes where POST requests honor Idempotency-Key
+	IdempotencyTtl      time.Duration // how long responses are replayed to retries
+
+	CacheWarm []string // URLs refreshed in the response cache on an interval
+
+	DeadlineHint bool // pass request deadline derived from the timeout to PHP
+
+	FpmStatusPath        string        // pm.status_path of the FPM pool, empty disables status scraping
+	SlowRequestThreshold time.Duration // access entries of slower requests are correlated with FPM status
+
+	Streaming        bool     // stream request and response bodies with fixed-size buffers
+	StreamBufferSize int      // size of buffers used in streaming mode
+	StreamThreshold  int      // bodies up to this size are buffered in streaming mode, 0 streams all bodies
+	StreamPrefixes   []string // path prefixes streamed even when streaming mode is off
+
+	StreamSpoolMaxSize int64 // maximum size of request body of unknown length spooled to disk in streaming mode
+
+	TlsCert           string        // certificate of the main server, TLS is disabled when empty
+	TlsKey            string        // private key of the certificate
+	TlsMinVersion     string        // minimal accepted TLS version
+	TlsCipherSuites   []string      // allowed TLS 1.0-1.2 cipher suites, empty means Go defaults
+	TlsCurves         []string      // curve preferences, empty means Go defaults
+	TlsSessionTickets bool          // session resumption with tickets
+	TlsAlpn           []string      // protocols offered via ALPN
+	TlsReloadInterval time.Duration // how often certificate files are checked for changes, 0 disables the check
+	TlsClientAuth     string        // client certificate policy (none, optional, require)
+	TlsClientCa       string        // PEM bundle of CAs client certificates are verified against
+
+	RouteTimeouts        []string // timeout:prefix overrides of the global timeout
+	MethodTimeoutFactors []string // METHOD:factor multipliers of route timeouts
+
+	RateLimit          string   // requests/period allowed for one key, empty disables rate limiting
+	RateLimitKey       string   // request attributes the rate limit key is built from
+	RateLimitOverrides []string // key=requests/period rates of specific keys
+	RateLimitMaxKeys   int      // number of keys tracked in LRU
+
+	RedisAddress  string        // host:port of Redis sharing state between replicas, empty means local state
+	RedisPassword string        // password of Redis
+	RedisDb       int           // Redis database
+	RedisPrefix   string        // prefix of all Redis keys
+	RedisTimeout  time.Duration // timeout of one Redis operation before the local fallback is used
+
+	CacheStorage string // where cached responses are kept (memory, disk, redis)
+	CacheDir     string // directory of the disk cache storage
+
+	Features Features // state of features shipped dark, see knownFeatures
+
+	AccessLogTimeFormat string         // timestamp format of access log entries, empty keeps the format of other logs
+	AccessLogLocation   *time.Location // timezone of access log and access event timestamps
+
+	RequestStreamThreshold int64 // larger request bodies are streamed to FPM in buffered mode, 0 buffers all
+
+	TenantSource    string // where tenant of the request is taken from (header:Name, subdomain, path:N)
+	TenantMaxLabels int    // number of tenants with own metrics label
+
+	IndexCheckInterval time.Duration // how often the index file existence is checked, 0 disables the check
+	ReadinessPath      string        // path of the readiness endpoint, empty disables it
+
+	TimeoutStatus int    // status of responses to requests which hit their timeout
+	TimeoutBody   []byte // body of timeout responses, nil means the default error page
+
+	StderrInResponse bool // append PHP stderr to 5xx responses
+
+	AuthUrl             string        // forward auth service, empty disables forward auth
+	AuthResponseHeaders []string      // headers of auth response passed to PHP
+	AuthPrefixes        []string      // path prefixes protected by forward auth, empty means all
+	AuthTimeout         time.Duration // timeout of the auth request
+
+	FpmPoolAuto bool // size the pool by FCGI_MAX_CONNS announced by FPM
+
+	Http10Compat         bool     // buffer responses to HTTP/1.0 clients and always send Content-Length
+	Http10StripHeaders   []string // response headers removed for HTTP/1.0 clients
+	ResponseHeaderBudget int      // maximum size of response headers in bytes, 0 means unlimited
+
+	ShutdownTimeout time.Duration // how long in-flight requests may finish after SIGTERM
+
+	SslHeaders []string // SSL_* params filled from headers of TLS terminating load balancer (PARAM:Header)
+
+	AccessRules []string // expressions evaluated before the request reaches PHP
+
+	Hash string // hash of all flag values, see configHash
+
+	FpmConnMaxRequests int // FPM connection is replaced after this number of requests, 0 means never
+
+	FpmWait time.Duration // how long to wait for FPM to accept connections at startup
+
+	BandwidthLimit  int64    // download speed of a response in bytes per second, 0 means unlimited
+	RouteBandwidths []string // limit:prefix overrides of the bandwidth limit
+
+	FpmQueueTimeout time.Duration // how long normal priority request waits for connection before it's shed, 0 means forever
+	FpmQueueDepth   int           // maximum number of requests waiting for connection, 0 means unlimited
+
+	FpmPoolBurst   int // extra FPM connections dialed when all pooled ones are busy, 0 disables bursting
+	FpmOverflowMax int // ephemeral FPM connections dialed for requests close to their wait deadline, 0 disables them
+
+	AccessLogPipelines []string // access log sinks with own output, format, sampling and fields
+
+	FpmHealthInterval time.Duration // how often idle FPM connections are checked, 0 disables health checks
+
+	FpmFirstByteTimeout time.Duration // maximum time till PHP produces the first output, 0 means only the total timeout applies
+
+	InformationalStatus int    // status sent instead of a final 1xx status of PHP
+	StatusReasonHeader  string // header carrying custom reason phrase of PHP, empty drops it
+
+	ScanUrl      string        // body scanner (http(s):// callout or icap://), empty disables scanning
+	ScanPrefixes []string      // path prefixes with scanned bodies, empty means all
+	ScanMaxSize  int           // maximum size of scanned body in bytes
+	ScanTimeout  time.Duration // timeout of the scan
+	ScanFailOpen bool          // pass bodies which could not be scanned instead of rejecting them
+
+	FallbackPages []string // static pages served when FPM is unavailable in format file:/prefix[:status]
+
+	Listen    []string   // host:port[=handlers] or unix:/path[=handlers] addresses, they replace --port and --bind
+	Listeners []Listener // addresses from --listen, or --bind and --port
+
+	ListenSocketMode os.FileMode // permissions of unix sockets the server listens on
+
+	reloaded *atomic.Pointer[ReloadableConfig] // values applied by SIGHUP reload, see Config.Reloadable
+
 	logger *log.Logger
 }
 
 func DefineParams(cmd *cobra.Command) {
 	cmd.PersistentFlags().IntP(ParamPort, "p", 8080, "Go FPM proxy port")
 	cmd.PersistentFlags().StringP(ParamSocket, "s", "", "Path to PHP-FPM UNIX Socket")
+	cmd.PersistentFlags().String(FpmAddress, "", fmt.Sprintf("PHP-FPM TCP address (host:port), used instead of --%s", ParamSocket))
 	cmd.PersistentFlags().StringP(ParamIndex, "i", "", "Path to index.php script in the PHP-FPM container")
 	cmd.PersistentFlags().String(ParamApp, "php-app", "Application name")
 	cmd.PersistentFlags().StringArrayP(ParamStaticFolders, "f", []string{}, fmt.Sprintf("Static folder in format %q", "/home/path/to/folder:/endpoint/prefix"))
@@ -45,20 +435,373 @@ func DefineParams(cmd *cobra.Command) {
 	cmd.PersistentFlags().Duration("timeout", 30*time.Second, "Timeout for connection [10s, 30s, 1m]")
 	cmd.PersistentFlags().Bool(AccessLog, false, "Enable access logging")
 	cmd.PersistentFlags().BoolP(ParamVerbose, "v", false, "Print debug output")
-
-	_ = cmd.MarkPersistentFlagRequired(ParamSocket)
-	_ = cmd.MarkPersistentFlagRequired(ParamIndex)
+	cmd.PersistentFlags().Int64(MaxDecompressedSize, 32<<20, "Maximum size of gzip decompressed request body in bytes")
+	cmd.PersistentFlags().Bool(Compression, false, "Enable response compression (br, gzip)")
+	cmd.PersistentFlags().StringArray(CompressionTypes, defaultCompressionTypes, fmt.Sprintf("Compressible mime type with optional encodings in format %q", "application/json:br,gzip"))
+	cmd.PersistentFlags().Int(CompressionMinSize, 1024, "Minimal response body size in bytes to compress")
+	cmd.PersistentFlags().StringArray(OptionsPrefixes, []string{}, "Path prefix where OPTIONS requests are answered without calling FPM")
+	cmd.PersistentFlags().String(OptionsAllow, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS", "Allowed methods announced in OPTIONS responses")
+	cmd.PersistentFlags().StringArray(CorsOrigins, []string{}, fmt.Sprintf("Origin allowed in CORS preflight responses (%q for any)", "*"))
+	cmd.PersistentFlags().Bool(CorsCredentials, false, "Allow credentials in CORS preflight responses")
+	cmd.PersistentFlags().Duration(CorsMaxAge, 0, "How long browsers can cache CORS preflight responses")
+	cmd.PersistentFlags().StringArray(DropHeaders, []string{}, fmt.Sprintf("Inbound header not passed to PHP, wildcards allowed (%q)", "X-Internal-*"))
+	cmd.PersistentFlags().StringArray(RenameHeaders, []string{}, fmt.Sprintf("Inbound header renamed before passing to PHP in format %q", "X-Old-Name:X-New-Name"))
+	cmd.PersistentFlags().Bool(AllowUnderscores, false, "Pass inbound headers with underscores in name to PHP")
+	cmd.PersistentFlags().Int(AdminPort, 0, "Admin server port (0 disables admin server)")
+	cmd.PersistentFlags().String(AdminToken, "", "Bearer token required by admin endpoints")
+	cmd.PersistentFlags().StringArray(AdminScripts, []string{}, "Path to PHP script which can be executed via admin API")
+	cmd.PersistentFlags().String(AdminBind, "127.0.0.1", fmt.Sprintf("Address the admin server listens on, other than loopback requires --%s", AdminToken))
+	cmd.PersistentFlags().StringArray(Schedules, []string{}, fmt.Sprintf("Periodic internal request in format %q", "1m:/cron/run"))
+	cmd.PersistentFlags().Float64(SaturationThreshold, 1.0, "FPM pool saturation which triggers warning when sustained (0 disables warnings)")
+	cmd.PersistentFlags().Duration(SaturationDuration, 30*time.Second, "How long saturation must be sustained before warning")
+	cmd.PersistentFlags().StringArray(Priorities, []string{}, fmt.Sprintf("Priority class (high, normal, low) of route prefix in format %q", "high:/checkout"))
+	cmd.PersistentFlags().Duration(LowPriorityMaxWait, 0, "How long low priority request waits for a free FPM connection before it's shed")
+	cmd.PersistentFlags().Duration(RetryAfter, 1*time.Second, "Base Retry-After announced to clients whose requests were shed")
+	cmd.PersistentFlags().Bool(Preflight, false, "Send one request to FPM at startup and log what PHP reported")
+	cmd.PersistentFlags().String(PreflightUri, "/", "Uri of the preflight request")
+	cmd.PersistentFlags().Bool(Cache, false, "Enable cache of responses marked by PHP as public")
+	cmd.PersistentFlags().Int(CacheMaxEntries, 10000, "Maximum number of cached responses")
+	cmd.PersistentFlags().Int(CacheMaxBodySize, 1<<20, "Maximum size of cached response body in bytes")
+	cmd.PersistentFlags().Duration(NegativeCacheTtl, 0, "How long 404 and 410 responses are cached (0 disables negative cache)")
+	cmd.PersistentFlags().String(DumpDir, "", "Debug: directory where complete FastCGI exchanges are recorded")
+	cmd.PersistentFlags().StringArray(DumpPrefixes, []string{}, "Debug: record only requests matching the path prefix")
+	cmd.PersistentFlags().String(RedirectPolicy, RedirectPolicyClient, fmt.Sprintf("Handling of CGI responses with Location header without Status (%s, %s, %s)", RedirectPolicyClient, RedirectPolicyLocal, RedirectPolicyPassthrough))
+	cmd.PersistentFlags().String(BootCommand, "", "Command which must succeed before the server starts accepting requests (e.g. migrations)")
+	cmd.PersistentFlags().String(BootUri, "", "Uri of internal request which must return 2xx before the server starts accepting requests")
+	cmd.PersistentFlags().Duration(BootTimeout, 5*time.Minute, "How long boot command and boot request can take")
+	cmd.PersistentFlags().StringArray(BindAddresses, []string{}, fmt.Sprintf("Address (IPv4 or IPv6) the server listens on with --%s, can be repeated (default all interfaces)", ParamPort))
+	cmd.PersistentFlags().Float64(CostSampleRate, 0, "Fraction of requests (0-1) whose proxy cost is sampled into admin report")
+	cmd.PersistentFlags().String(LogOutput, LogOutputStdout, fmt.Sprintf("Where access and error logs are sent (%s, %s, %s)", LogOutputStdout, LogOutputSyslog, LogOutputJournald))
+	cmd.PersistentFlags().String(SyslogAddress, "unix:///dev/log", "Syslog server address in format udp://host:port, tcp://host:port or unix:///path")
+	cmd.PersistentFlags().String(AccessSinkAddress, "", "Send access events to HTTP webhook (https://...) or Kafka topic (kafka://broker1,broker2/topic)")
+	cmd.PersistentFlags().Int(AccessSinkBuffer, 10000, "Maximum number of buffered access events, newer events are dropped when full")
+	cmd.PersistentFlags().Int(AccessSinkBatch, 100, "Maximum number of access events sent at once")
+	cmd.PersistentFlags().Duration(AccessSinkFlush, 1*time.Second, "How often buffered access events are sent")
+	cmd.PersistentFlags().String(Profile, "", fmt.Sprintf("Preset of settings (%s), explicitly set flags override the profile", strings.Join(profileNames(), ", ")))
+	cmd.PersistentFlags().String(LogFormat, LogFormatJson, fmt.Sprintf("Format of logs (%s, %s)", LogFormatJson, LogFormatText))
+	cmd.PersistentFlags().Bool(SecurityHeaders, false, "Add default security headers (X-Content-Type-Options, X-Frame-Options, Referrer-Policy) missing in PHP responses")
+	cmd.PersistentFlags().Bool(Chaos, false, "Allow fault injection (latency, dropped connections, 5xx) configured via admin API, never use in production")
+	cmd.PersistentFlags().String(Forwarded, ForwardedXForwarded, fmt.Sprintf("Forwarded headers generated for PHP (%s, %s, %s, %s)", ForwardedXForwarded, ForwardedRfc7239, ForwardedBoth, ForwardedOff))
+	cmd.PersistentFlags().StringArray(TrustedProxies, []string{}, "Proxy (IP, CIDR or unix for peers of unix socket listeners) whose forwarded headers are trusted and extended instead of replaced")
+	cmd.PersistentFlags().StringArray(AbBucket, []string{}, fmt.Sprintf("A/B experiment bucket with weight in format %q, assigned bucket is sent to PHP in %s header", "variant-a:50", AbBucketHeader))
+	cmd.PersistentFlags().String(AbCookie, "gophpfpm_ab", "Name of the cookie storing assigned A/B bucket")
+	cmd.PersistentFlags().StringArray(SubFilters, []string{}, fmt.Sprintf("Replace string in response bodies in format %q", "</body>"+subFilterSeparator+"<script src=/a.js></script></body>"))
+	cmd.PersistentFlags().StringArray(SubFilterTypes, []string{"text/html"}, "Mime type of responses where sub filters are applied")
+	cmd.PersistentFlags().Int(SubFilterMaxSize, 1<<20, "Maximum size of response body in bytes where sub filters are applied")
+	cmd.PersistentFlags().String(BasePath, "", "Mount prefix stripped from request paths when the app is deployed under a sub-path")
+	cmd.PersistentFlags().Bool(JsonMinify, false, "Strip insignificant whitespace from JSON responses")
+	cmd.PersistentFlags().String(DefaultCharset, "", fmt.Sprintf("Charset added to textual responses without one (e.g. %q)", "utf-8"))
+	cmd.PersistentFlags().StringArray(AssetManifests, []string{}, fmt.Sprintf("Manifest of fingerprinted assets (Mix or Vite) with url prefix in format %q", "/app/public/build/manifest.json:/build"))
+	cmd.PersistentFlags().String(DefaultType, "text/html; charset=UTF-8", "Content-Type of PHP responses without one, empty value lets the body be sniffed")
+	cmd.PersistentFlags().Bool(StrictContentType, false, "Log a warning for PHP responses without Content-Type")
+	cmd.PersistentFlags().String(SshHost, "", fmt.Sprintf("Reach FPM socket (--%s is the remote path) over SSH tunnel, format %q", ParamSocket, "user@host:22"))
+	cmd.PersistentFlags().String(SshKey, "", "Private key file for the SSH tunnel")
+	cmd.PersistentFlags().String(SshKnownHosts, "", "known_hosts file verifying host key of the SSH server")
+	cmd.PersistentFlags().StringArray(CsrfPrefixes, []string{}, "Path prefix where POST/PUT/PATCH/DELETE requests require double-submit CSRF token (e.g. /admin)")
+	cmd.PersistentFlags().String(CsrfCookie, "XSRF-TOKEN", "Cookie holding CSRF token")
+	cmd.PersistentFlags().String(CsrfHeader, "X-XSRF-TOKEN", "Header repeating CSRF token")
+	cmd.PersistentFlags().String(CsrfField, "_token", "Form field repeating CSRF token")
+	cmd.PersistentFlags().Bool(Etag, false, "Generate ETag for successful GET responses and answer If-None-Match with 304")
+	cmd.PersistentFlags().Int(EtagMaxSize, 1024*1024, "Maximum size of response body where ETag is generated (bytes)")
+	cmd.PersistentFlags().Int(FpmReservedConnections, 0, fmt.Sprintf("Number of FPM connections reserved for high priority requests (see --%s)", Priorities))
+	cmd.PersistentFlags().StringArray(IdempotencyPrefixes, []string{}, "Path prefix where POST requests with Idempotency-Key header are processed only once (e.g. /payments)")
+	cmd.PersistentFlags().Duration(IdempotencyTtl, 24*time.Hour, "How long the first response is replayed to retries with the same Idempotency-Key")
+	cmd.PersistentFlags().StringArray(CacheWarm, []string{}, fmt.Sprintf("URL kept warm in the response cache, refreshed on interval, in format %q", "1m:https://example.com/landing"))
+	cmd.PersistentFlags().Bool(DeadlineHint, false, fmt.Sprintf("Pass time when the proxy stops waiting (--%s) to PHP in %s header", Timeout, RequestDeadlineHeader))
+	cmd.PersistentFlags().String(FpmStatusPath, "", "Status page of the FPM pool (pm.status_path), enables correlation of slow and failed requests with FPM workers")
+	cmd.PersistentFlags().Duration(SlowRequestThreshold, time.Second, "Requests slower than this are correlated with FPM status in access log")
+	cmd.PersistentFlags().Bool(Streaming, false, "Stream request and response bodies with fixed-size buffers, memory used by a request doesn't depend on body sizes")
+	cmd.PersistentFlags().Int(StreamBufferSize, 16<<10, "Size of buffers used in streaming mode in bytes")
+	cmd.PersistentFlags().Int(StreamThreshold, 0, "Request and response bodies up to this size in bytes are buffered in streaming mode, larger are streamed (0 streams all)")
+	cmd.PersistentFlags().Int64(StreamSpoolMaxSize, 1<<30, "Maximum size in bytes of request body of unknown length (chunked, gzip encoded) spooled to a temporary file in streaming mode, larger are answered with 413")
+	cmd.PersistentFlags().StringArray(StreamPrefixes, []string{}, fmt.Sprintf("Path prefix streamed like with --%s, other paths are buffered (e.g. /download)", Streaming))
+	cmd.PersistentFlags().String(TlsCert, "", "Path to PEM certificate (chain), enables TLS on the main server")
+	cmd.PersistentFlags().String(TlsKey, "", "Path to PEM private key of the TLS certificate")
+	cmd.PersistentFlags().String(TlsMinVersion, "1.2", "Minimal accepted TLS version (1.0, 1.1, 1.2, 1.3)")
+	cmd.PersistentFlags().StringSlice(TlsCipherSuites, []string{}, "Allowed TLS 1.0-1.2 cipher suites by IANA name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (empty uses secure Go defaults, TLS 1.3 suites are not configurable)")
+	cmd.PersistentFlags().StringSlice(TlsCurves, []string{}, "TLS curve preferences in order (X25519, P256, P384, P521), empty uses Go defaults")
+	cmd.PersistentFlags().Bool(TlsSessionTickets, true, "Allow TLS session resumption with session tickets")
+	cmd.PersistentFlags().StringSlice(TlsAlpn, []string{"h2", "http/1.1"}, "Protocols offered via TLS ALPN in order of preference (h2, http/1.1)")
+	cmd.PersistentFlags().Duration(TlsReloadInterval, 10*time.Second, "Check TLS certificate and key files on this interval and reload them when they change, SIGHUP reloads them too (0 disables the check)")
+	cmd.PersistentFlags().String(TlsClientAuth, ClientAuthNone, fmt.Sprintf("Client certificate policy (%s, %s - verified when presented, %s), verified certificates are passed to PHP as SSL_CLIENT_* params", ClientAuthNone, ClientAuthOptional, ClientAuthRequire))
+	cmd.PersistentFlags().String(TlsClientCa, "", fmt.Sprintf("Path to PEM bundle of CAs client certificates are verified against, required by --%s", TlsClientAuth))
+	cmd.PersistentFlags().StringSlice(RouteTimeouts, []string{}, fmt.Sprintf("Timeout of a route prefix overriding --%s, longest prefix wins [2m:/export]", Timeout))
+	cmd.PersistentFlags().StringSlice(MethodTimeoutFactors, []string{}, "Multiplier of the route timeout for a request method [POST:2]")
+	cmd.PersistentFlags().String(RateLimit, "", "Rate limit of one key in format requests/period, e.g. 100/m, 10/s or 500/10m (empty disables rate limiting)")
+	cmd.PersistentFlags().String(RateLimitKey, RateLimitKeyIp, fmt.Sprintf("Rate limit key built from %q, %q, %q and %q joined with +, e.g. header:X-Tenant-Id+path:1", RateLimitKeyIp, RateLimitKeyHeader+"Name", RateLimitKeyCookie+"name", RateLimitKeyPath+"segments"))
+	cmd.PersistentFlags().StringSlice(RateLimitOverrides, []string{}, "Rate limit of a specific key [key=requests/period]")
+	cmd.PersistentFlags().Int(RateLimitMaxKeys, 10000, "Maximum number of rate limit keys tracked, least recently used keys are forgotten")
+	cmd.PersistentFlags().String(RedisAddress, "", "Redis host:port sharing rate limit and idempotency state between replicas (empty keeps the state local)")
+	cmd.PersistentFlags().String(RedisPassword, "", "Redis password")
+	cmd.PersistentFlags().Int(RedisDb, 0, "Redis database")
+	cmd.PersistentFlags().String(RedisPrefix, "gophpfpm:", "Prefix of Redis keys")
+	cmd.PersistentFlags().Duration(RedisTimeout, 100*time.Millisecond, "Timeout of a Redis operation, local state is used when Redis fails")
+	cmd.PersistentFlags().String(ParamCacheStorage, CacheStorageMemory, fmt.Sprintf("Storage of cached responses (%s, %s shared by restarts, %s shared by replicas)", CacheStorageMemory, CacheStorageDisk, CacheStorageRedis))
+	cmd.PersistentFlags().String(CacheDir, "", "Directory of the disk cache storage")
+	cmd.PersistentFlags().StringArray(FeatureFlags, []string{}, fmt.Sprintf("Enable or disable a feature (name=true|false), known features: %s", strings.Join(featureNames(), ", ")))
+	cmd.PersistentFlags().String(AccessLogTimeFormat, "", fmt.Sprintf("Timestamp format of access log entries (%s, %s, %s, %s), empty keeps the format of other logs", AccessTimeFormatRfc3339, AccessTimeFormatRfc3339Ms, AccessTimeFormatEpochMs, AccessTimeFormatClf))
+	cmd.PersistentFlags().String(AccessLogTimezone, "", "Timezone of access log timestamps (e.g. UTC, Europe/Prague), empty means local time")
+	cmd.PersistentFlags().Int64(RequestStreamThreshold, 0, "Request bodies larger than this in bytes are streamed to FPM instead of read to memory (0 reads all bodies to memory)")
+	cmd.PersistentFlags().String(TenantSource, "", fmt.Sprintf("Tenant of the request for metrics and access log (%sX-Tenant, %s, %s1)", TenantSourceHeader, TenantSourceSubdomain, TenantSourcePath))
+	cmd.PersistentFlags().Int(TenantMaxLabels, 100, fmt.Sprintf("Number of tenants with own metrics label, others are reported as %q", TenantOther))
+	cmd.PersistentFlags().Duration(IndexCheckInterval, 0, "Check the index file exists on this interval and reject requests with 503 while it's missing, the proxy must see the file under the same path as FPM (0 disables)")
+	cmd.PersistentFlags().String(ReadinessPath, "/ready", "Path of the readiness endpoint answering 503 while the proxy can't serve requests, empty disables it")
+	cmd.PersistentFlags().Int(TimeoutStatus, http.StatusGatewayTimeout, "Status of responses to requests which hit their timeout, 504 tells load balancers the upstream was slow, 408 blames the client")
+	cmd.PersistentFlags().String(TimeoutBodyFile, "", "File with body of timeout responses, content type is detected from the content (default error page when empty)")
+	cmd.PersistentFlags().Bool(StderrInResponse, false, "Debug: append PHP stderr to bodies of 5xx responses, never use in production")
+	cmd.PersistentFlags().String(AuthUrl, "", "Forward auth service (e.g. oauth2-proxy) asked before every request is passed to PHP, 2xx allows the request, other responses are returned to the client")
+	cmd.PersistentFlags().StringArray(AuthResponseHeader, nil, "Header of 2xx auth response passed to PHP (e.g. X-Auth-Request-User), the client can't send it itself")
+	cmd.PersistentFlags().StringArray(AuthPrefix, nil, "Path prefix protected by forward auth (default all paths)")
+	cmd.PersistentFlags().Duration(AuthTimeout, 5*time.Second, "Timeout of the forward auth request")
+	cmd.PersistentFlags().Bool(FpmPoolAuto, false, fmt.Sprintf("Size the FPM pool by FCGI_MAX_CONNS announced by FPM (pm.max_children), --%s is used when FPM doesn't announce it", FpmPoolSize))
+	cmd.PersistentFlags().Bool(Http10Compat, false, "Compatibility mode for HTTP/1.0 clients, their responses are never streamed and always have Content-Length")
+	cmd.PersistentFlags().StringArray(Http10StripHeader, nil, fmt.Sprintf("Response header removed for HTTP/1.0 clients in --%s (e.g. Vary)", Http10Compat))
+	cmd.PersistentFlags().Int(ResponseHeaderBudget, 0, "Maximum size of response headers in bytes, larger responses are replaced by 502 (0 means unlimited)")
+	cmd.PersistentFlags().Duration(ShutdownTimeout, 5*time.Second, "Drain window, how long in-flight requests may finish after SIGTERM before the proxy exits")
+	cmd.PersistentFlags().StringArray(SslHeaders, []string{}, fmt.Sprintf("SSL_* param filled from header of TLS terminating load balancer in format %q, accepted only from --%s", "SSL_CLIENT_CERT:X-SSL-Client-Cert", TrustedProxies))
+	cmd.PersistentFlags().StringArray(AccessRule, []string{}, fmt.Sprintf("Expression evaluated in order before the request reaches PHP, returns allow(), deny(status), rewrite(uri) or redirect(url, status), e.g. %q", `path startsWith "/internal" && remote_addr != "10.0.0.1" ? deny(404) : allow()`))
+	cmd.PersistentFlags().Int(FpmConnMaxRequests, 0, "Replace FPM connection after this number of requests, set it lower than pm.max_requests so FPM doesn't recycle the worker in the middle of a request (0 means never)")
+	cmd.PersistentFlags().Duration(FpmWait, 0, "Wait up to this long for FPM to accept connections at startup, retrying with exponential backoff (e.g. FPM sidecar starting later than the proxy, 0 fails immediately)")
+	cmd.PersistentFlags().Int64(BandwidthLimit, 0, "Download speed of each response in bytes per second, applies to PHP and static folders (0 means unlimited)")
+	cmd.PersistentFlags().StringSlice(RouteBandwidths, []string{}, fmt.Sprintf("Download speed of a route prefix in bytes per second overriding --%s, longest prefix wins, 0 means unlimited [1048576:/downloads]", BandwidthLimit))
+	cmd.PersistentFlags().Duration(FpmQueueTimeout, 0, fmt.Sprintf("How long normal priority request waits for a free FPM connection before it's shed with 503, low priority requests use --%s (0 waits forever)", LowPriorityMaxWait))
+	cmd.PersistentFlags().Int(FpmQueueDepth, 0, "Maximum number of requests waiting for a free FPM connection, more requests are shed with 503 right away, high priority requests are never shed (0 means unlimited)")
+	cmd.PersistentFlags().Int(FpmPoolBurst, 0, "Maximum number of extra FPM connections dialed when all pooled connections are busy, they serve waiting requests and are closed once no request waits (0 disables bursting)")
+	cmd.PersistentFlags().Int(FpmOverflowMax, 0, fmt.Sprintf("Maximum number of ephemeral FPM connections dialed for requests which are about to be shed after waiting (see --%s), each serves a single request (0 disables them)", FpmQueueTimeout))
+	cmd.PersistentFlags().StringArray(AccessLogPipeline, []string{}, fmt.Sprintf("Additional access log with own output, format, sampling and fields, can be repeated, e.g. %q", "output=/var/log/access.json;format=json;sample=0.5;fields=method,status,full_url"))
+	cmd.PersistentFlags().Duration(FpmHealthInterval, 0, "How often idle FPM connections are checked for being closed by FPM and dead ones replaced before a request hits them (0 disables health checks)")
+	cmd.PersistentFlags().String(ConfigFile, "", "Config file (YAML, TOML or JSON) with flag names as keys, flags set explicitly override the file")
+	cmd.PersistentFlags().Duration(FpmFirstByteTimeout, 0, fmt.Sprintf("Maximum time till PHP produces the first output once the request is sent, a hung worker is answered with 504 while the total --%s may be much longer (0 disables it)", Timeout))
+	cmd.PersistentFlags().Int(InformationalStatus, http.StatusBadGateway, "Status sent instead of 1xx status set by PHP, FastCGI can't carry interim responses nor upgrade the connection")
+	cmd.PersistentFlags().String(StatusReasonHeader, "", "Response header carrying custom reason phrase set by PHP (e.g. X-Status-Reason), the status line always has the standard one (empty drops custom phrases)")
+	cmd.PersistentFlags().String(ScanUrl, "", "Scanner of request bodies (e.g. ClamAV), http(s)://host/path gets the body in POST and allows it with 2xx, icap://host:1344/service is asked with REQMOD")
+	cmd.PersistentFlags().StringArray(ScanPrefix, nil, "Path prefix with scanned request bodies (default all paths)")
+	cmd.PersistentFlags().Int(ScanMaxSize, 32<<20, "Maximum size of scanned request body in bytes, larger bodies are handled as scanner failure")
+	cmd.PersistentFlags().Duration(ScanTimeout, 30*time.Second, "Timeout of the body scan")
+	cmd.PersistentFlags().Bool(ScanFailOpen, false, "Pass bodies to PHP when the scanner fails or the body is too large (default reject them)")
+	cmd.PersistentFlags().StringArray(FallbackPage, []string{}, fmt.Sprintf("Static page served instead of error page when FPM is unavailable, per route prefix with optional status (default 503) in format %q", "/app/public/landing.html:/:200"))
+	cmd.PersistentFlags().StringArray(Listen, []string{}, fmt.Sprintf("Address with port or unix socket the server listens on and optional handler set (%s, %s or %s), can be repeated, e.g. %q, %q or %q (can't be combined with --%s and --%s)", HandlersAll, HandlersPublic, HandlersInternal, "[::1]:8080", "unix:/run/gophpfpm.sock", "127.0.0.1:9090=internal", ParamPort, BindAddresses))
+	cmd.PersistentFlags().String(ListenSocketMode, "0660", fmt.Sprintf("Permissions of unix sockets from --%s, the proxy in front of gophpfpm must be able to connect", Listen))
+	cmd.PersistentFlags().String(FairQueueKey, "", fmt.Sprintf("Share FPM connections fairly between clients identified by %q or %q", FairQueueKeyIp, FairQueueKeyHeader+"<name>"))
 }
 
 func LoadConfig(set *pflag.FlagSet, logger *log.Logger) (*Config, error) {
+	if err := applyConfigFile(set); err != nil {
+		return nil, err
+	}
+	if err := applyProfile(set); err != nil {
+		return nil, err
+	}
+
 	timeout, err := set.GetDuration("timeout")
 	if err != nil {
 		return nil, fmt.Errorf("could not load %q: %s", Timeout, err)
 	}
 
+	corsMaxAge, err := set.GetDuration(CorsMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", CorsMaxAge, err)
+	}
+
+	saturationDuration, err := set.GetDuration(SaturationDuration)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", SaturationDuration, err)
+	}
+
+	lowPriorityMaxWait, err := set.GetDuration(LowPriorityMaxWait)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", LowPriorityMaxWait, err)
+	}
+
+	retryAfter, err := set.GetDuration(RetryAfter)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", RetryAfter, err)
+	}
+
+	negativeCacheTtl, err := set.GetDuration(NegativeCacheTtl)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", NegativeCacheTtl, err)
+	}
+
+	fairQueueKey := ignoreError(set.GetString(FairQueueKey))
+	if err := validateFairQueueKey(fairQueueKey); err != nil {
+		return nil, err
+	}
+
+	redirectPolicy := ignoreError(set.GetString(RedirectPolicy))
+	if err := validateRedirectPolicy(redirectPolicy); err != nil {
+		return nil, err
+	}
+
+	bootTimeout, err := set.GetDuration(BootTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", BootTimeout, err)
+	}
+
+	accessSinkFlush, err := set.GetDuration(AccessSinkFlush)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", AccessSinkFlush, err)
+	}
+	if accessSinkFlush <= 0 {
+		return nil, fmt.Errorf("%q must be positive", AccessSinkFlush)
+	}
+
+	logFormat := ignoreError(set.GetString(LogFormat))
+	if logFormat != LogFormatJson && logFormat != LogFormatText {
+		return nil, fmt.Errorf("invalid log format %q, use %q or %q", logFormat, LogFormatJson, LogFormatText)
+	}
+
+	forwarded := ignoreError(set.GetString(Forwarded))
+	if err := validateForwardedStyle(forwarded); err != nil {
+		return nil, err
+	}
+
+	idempotencyTtl, err := set.GetDuration(IdempotencyTtl)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", IdempotencyTtl, err)
+	}
+
+	slowRequestThreshold, err := set.GetDuration(SlowRequestThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", SlowRequestThreshold, err)
+	}
+
+	redisTimeout, err := set.GetDuration(RedisTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", RedisTimeout, err)
+	}
+
+	features, err := ParseFeatures(ignoreError(set.GetStringArray(FeatureFlags)))
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", FeatureFlags, err)
+	}
+
+	accessLogTimeFormat := ignoreError(set.GetString(AccessLogTimeFormat))
+	if err := validateAccessTimeFormat(accessLogTimeFormat); err != nil {
+		return nil, err
+	}
+	accessLogLocation := time.Local
+	if timezone := ignoreError(set.GetString(AccessLogTimezone)); timezone != "" {
+		if accessLogLocation, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", AccessLogTimezone, err)
+		}
+	}
+
+	indexCheckInterval, err := set.GetDuration(IndexCheckInterval)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", IndexCheckInterval, err)
+	}
+	if indexCheckInterval < 0 {
+		return nil, fmt.Errorf("%s must not be negative", IndexCheckInterval)
+	}
+
+	tlsReloadInterval, err := set.GetDuration(TlsReloadInterval)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", TlsReloadInterval, err)
+	}
+	if tlsReloadInterval < 0 {
+		return nil, fmt.Errorf("%s must not be negative", TlsReloadInterval)
+	}
+
+	timeoutStatus := ignoreError(set.GetInt(TimeoutStatus))
+	if timeoutStatus < 400 || timeoutStatus > 599 {
+		return nil, fmt.Errorf("%s must be 4xx or 5xx status, got %d", TimeoutStatus, timeoutStatus)
+	}
+	var timeoutBody []byte
+	if path := ignoreError(set.GetString(TimeoutBodyFile)); path != "" {
+		if timeoutBody, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("could not load %q: %s", TimeoutBodyFile, err)
+		}
+	}
+
+	authTimeout, err := set.GetDuration(AuthTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", AuthTimeout, err)
+	}
+
+	shutdownTimeout, err := set.GetDuration(ShutdownTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", ShutdownTimeout, err)
+	}
+	if shutdownTimeout <= 0 {
+		return nil, fmt.Errorf("%s must be positive", ShutdownTimeout)
+	}
+
+	fpmWait, err := set.GetDuration(FpmWait)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", FpmWait, err)
+	}
+	if fpmWait < 0 {
+		return nil, fmt.Errorf("%s must not be negative", FpmWait)
+	}
+
+	fpmQueueTimeout, err := set.GetDuration(FpmQueueTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", FpmQueueTimeout, err)
+	}
+	if fpmQueueTimeout < 0 {
+		return nil, fmt.Errorf("%s must not be negative", FpmQueueTimeout)
+	}
+
+	fpmHealthInterval, err := set.GetDuration(FpmHealthInterval)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", FpmHealthInterval, err)
+	}
+	if fpmHealthInterval < 0 {
+		return nil, fmt.Errorf("%s must not be negative", FpmHealthInterval)
+	}
+
+	fpmFirstByteTimeout, err := set.GetDuration(FpmFirstByteTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", FpmFirstByteTimeout, err)
+	}
+	if fpmFirstByteTimeout < 0 {
+		return nil, fmt.Errorf("%s must not be negative", FpmFirstByteTimeout)
+	}
+
+	scanTimeout, err := set.GetDuration(ScanTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %s", ScanTimeout, err)
+	}
+	if scanTimeout < 0 {
+		return nil, fmt.Errorf("%s can't be negative", ScanTimeout)
+	}
+
+	// --bind and --port are a shorthand of --listen addresses serving all handlers, they can't be combined with it
+	port := ignoreError(set.GetInt(ParamPort))
+	var listeners []Listener
+	publicPort := 0
+	if set.Changed(Listen) && (set.Changed(BindAddresses) || set.Changed(ParamPort)) {
+		return nil, fmt.Errorf("%s can't be combined with %s and %s, put the addresses with ports to %s", Listen, BindAddresses, ParamPort, Listen)
+	}
+	for _, definition := range ignoreError(set.GetStringArray(Listen)) {
+		listener, number, err := parseListener(definition)
+		if err != nil {
+			return nil, err
+		}
+		if publicPort == 0 && number > 0 && listener.Handlers != HandlersInternal {
+			publicPort = number // SERVER_PORT of internal requests
+		}
+		listeners = append(listeners, listener)
+	}
+	if publicPort > 0 {
+		port = publicPort
+	}
+	if len(listeners) == 0 {
+		for _, address := range listenAddresses(ignoreError(set.GetStringArray(BindAddresses)), port) {
+			listeners = append(listeners, Listener{Network: "tcp", Address: address, Handlers: HandlersAll})
+		}
+	}
+
+	socketMode, err := strconv.ParseUint(ignoreError(set.GetString(ListenSocketMode)), 8, 32)
+	if err != nil || socketMode > 0o777 {
+		return nil, fmt.Errorf("invalid %s, use octal permissions, e.g. 0660", ListenSocketMode)
+	}
+
 	return &Config{
-		Port:          ignoreError(set.GetInt(ParamPort)),
+		Port:          port,
 		Socket:        ignoreError(set.GetString(ParamSocket)),
+		FpmAddress:    ignoreError(set.GetString(FpmAddress)),
 		IndexFile:     ignoreError(set.GetString(ParamIndex)),
 		App:           ignoreError(set.GetString(ParamApp)),
 		StaticFolders: ignoreError(set.GetStringArray(ParamStaticFolders)),
@@ -67,13 +810,385 @@ func LoadConfig(set *pflag.FlagSet, logger *log.Logger) (*Config, error) {
 		AccessLog:     ignoreError(set.GetBool(AccessLog)),
 		Verbose:       ignoreError(set.GetBool(ParamVerbose)),
 
+		MaxDecompressedSize: ignoreError(set.GetInt64(MaxDecompressedSize)),
+
+		Compression:        ignoreError(set.GetBool(Compression)),
+		CompressionTypes:   ignoreError(set.GetStringArray(CompressionTypes)),
+		CompressionMinSize: ignoreError(set.GetInt(CompressionMinSize)),
+
+		OptionsPrefixes: ignoreError(set.GetStringArray(OptionsPrefixes)),
+		OptionsAllow:    ignoreError(set.GetString(OptionsAllow)),
+		CorsOrigins:     ignoreError(set.GetStringArray(CorsOrigins)),
+		CorsCredentials: ignoreError(set.GetBool(CorsCredentials)),
+		CorsMaxAge:      corsMaxAge,
+
+		DropHeaders:            ignoreError(set.GetStringArray(DropHeaders)),
+		RenameHeaders:          ignoreError(set.GetStringArray(RenameHeaders)),
+		AllowUnderscoreHeaders: ignoreError(set.GetBool(AllowUnderscores)),
+
+		AdminPort:    ignoreError(set.GetInt(AdminPort)),
+		AdminToken:   ignoreError(set.GetString(AdminToken)),
+		AdminScripts: ignoreError(set.GetStringArray(AdminScripts)),
+		AdminBind:    ignoreError(set.GetString(AdminBind)),
+
+		Schedules: ignoreError(set.GetStringArray(Schedules)),
+
+		SaturationThreshold: ignoreError(set.GetFloat64(SaturationThreshold)),
+		SaturationDuration:  saturationDuration,
+
+		Priorities:         ignoreError(set.GetStringArray(Priorities)),
+		LowPriorityMaxWait: lowPriorityMaxWait,
+		FairQueueKey:       fairQueueKey,
+		RetryAfter:         retryAfter,
+
+		Preflight:    ignoreError(set.GetBool(Preflight)),
+		PreflightUri: ignoreError(set.GetString(PreflightUri)),
+
+		Cache:            ignoreError(set.GetBool(Cache)),
+		CacheMaxEntries:  ignoreError(set.GetInt(CacheMaxEntries)),
+		CacheMaxBodySize: ignoreError(set.GetInt(CacheMaxBodySize)),
+
+		NegativeCacheTtl: negativeCacheTtl,
+
+		DumpDir:      ignoreError(set.GetString(DumpDir)),
+		DumpPrefixes: ignoreError(set.GetStringArray(DumpPrefixes)),
+
+		RedirectPolicy: redirectPolicy,
+
+		BootCommand: ignoreError(set.GetString(BootCommand)),
+		BootUri:     ignoreError(set.GetString(BootUri)),
+		BootTimeout: bootTimeout,
+
+		BindAddresses: ignoreError(set.GetStringArray(BindAddresses)),
+
+		CostSampleRate: ignoreError(set.GetFloat64(CostSampleRate)),
+
+		LogOutput:     ignoreError(set.GetString(LogOutput)),
+		SyslogAddress: ignoreError(set.GetString(SyslogAddress)),
+
+		AccessSink:       ignoreError(set.GetString(AccessSinkAddress)),
+		AccessSinkBuffer: ignoreError(set.GetInt(AccessSinkBuffer)),
+		AccessSinkBatch:  ignoreError(set.GetInt(AccessSinkBatch)),
+		AccessSinkFlush:  accessSinkFlush,
+
+		Profile:         ignoreError(set.GetString(Profile)),
+		LogFormat:       logFormat,
+		SecurityHeaders: ignoreError(set.GetBool(SecurityHeaders)),
+
+		Chaos: ignoreError(set.GetBool(Chaos)),
+
+		Forwarded:      forwarded,
+		TrustedProxies: ignoreError(set.GetStringArray(TrustedProxies)),
+
+		AbBuckets: ignoreError(set.GetStringArray(AbBucket)),
+		AbCookie:  ignoreError(set.GetString(AbCookie)),
+
+		SubFilters:       ignoreError(set.GetStringArray(SubFilters)),
+		SubFilterTypes:   ignoreError(set.GetStringArray(SubFilterTypes)),
+		SubFilterMaxSize: ignoreError(set.GetInt(SubFilterMaxSize)),
+
+		BasePath: normalizeBasePath(ignoreError(set.GetString(BasePath))),
+
+		JsonMinify:     ignoreError(set.GetBool(JsonMinify)),
+		DefaultCharset: ignoreError(set.GetString(DefaultCharset)),
+
+		AssetManifests: ignoreError(set.GetStringArray(AssetManifests)),
+
+		DefaultType:       ignoreError(set.GetString(DefaultType)),
+		StrictContentType: ignoreError(set.GetBool(StrictContentType)),
+
+		SshHost:       ignoreError(set.GetString(SshHost)),
+		SshKey:        ignoreError(set.GetString(SshKey)),
+		SshKnownHosts: ignoreError(set.GetString(SshKnownHosts)),
+
+		CsrfPrefixes: ignoreError(set.GetStringArray(CsrfPrefixes)),
+		CsrfCookie:   ignoreError(set.GetString(CsrfCookie)),
+		CsrfHeader:   ignoreError(set.GetString(CsrfHeader)),
+		CsrfField:    ignoreError(set.GetString(CsrfField)),
+
+		Etag:        ignoreError(set.GetBool(Etag)),
+		EtagMaxSize: ignoreError(set.GetInt(EtagMaxSize)),
+
+		FpmReservedConnections: ignoreError(set.GetInt(FpmReservedConnections)),
+
+		IdempotencyPrefixes: ignoreError(set.GetStringArray(IdempotencyPrefixes)),
+		IdempotencyTtl:      idempotencyTtl,
+
+		CacheWarm: ignoreError(set.GetStringArray(CacheWarm)),
+
+		DeadlineHint: ignoreError(set.GetBool(DeadlineHint)),
+
+		FpmStatusPath:        ignoreError(set.GetString(FpmStatusPath)),
+		SlowRequestThreshold: slowRequestThreshold,
+
+		Streaming:        ignoreError(set.GetBool(Streaming)) || features.Enabled(FeatureStreaming),
+		StreamBufferSize: ignoreError(set.GetInt(StreamBufferSize)),
+		StreamThreshold:  ignoreError(set.GetInt(StreamThreshold)),
+		StreamPrefixes:   ignoreError(set.GetStringArray(StreamPrefixes)),
+
+		StreamSpoolMaxSize: ignoreError(set.GetInt64(StreamSpoolMaxSize)),
+
+		TlsCert:           ignoreError(set.GetString(TlsCert)),
+		TlsKey:            ignoreError(set.GetString(TlsKey)),
+		TlsMinVersion:     ignoreError(set.GetString(TlsMinVersion)),
+		TlsCipherSuites:   ignoreError(set.GetStringSlice(TlsCipherSuites)),
+		TlsCurves:         ignoreError(set.GetStringSlice(TlsCurves)),
+		TlsSessionTickets: ignoreError(set.GetBool(TlsSessionTickets)),
+		TlsAlpn:           ignoreError(set.GetStringSlice(TlsAlpn)),
+		TlsReloadInterval: tlsReloadInterval,
+		TlsClientAuth:     ignoreError(set.GetString(TlsClientAuth)),
+		TlsClientCa:       ignoreError(set.GetString(TlsClientCa)),
+
+		RouteTimeouts:        ignoreError(set.GetStringSlice(RouteTimeouts)),
+		MethodTimeoutFactors: ignoreError(set.GetStringSlice(MethodTimeoutFactors)),
+
+		RateLimit:          ignoreError(set.GetString(RateLimit)),
+		RateLimitKey:       ignoreError(set.GetString(RateLimitKey)),
+		RateLimitOverrides: ignoreError(set.GetStringSlice(RateLimitOverrides)),
+		RateLimitMaxKeys:   ignoreError(set.GetInt(RateLimitMaxKeys)),
+
+		RedisAddress:  ignoreError(set.GetString(RedisAddress)),
+		RedisPassword: ignoreError(set.GetString(RedisPassword)),
+		RedisDb:       ignoreError(set.GetInt(RedisDb)),
+		RedisPrefix:   ignoreError(set.GetString(RedisPrefix)),
+		RedisTimeout:  redisTimeout,
+
+		CacheStorage: ignoreError(set.GetString(ParamCacheStorage)),
+		CacheDir:     ignoreError(set.GetString(CacheDir)),
+
+		Features: features,
+
+		AccessLogTimeFormat: accessLogTimeFormat,
+		AccessLogLocation:   accessLogLocation,
+
+		RequestStreamThreshold: ignoreError(set.GetInt64(RequestStreamThreshold)),
+
+		TenantSource:    ignoreError(set.GetString(TenantSource)),
+		TenantMaxLabels: ignoreError(set.GetInt(TenantMaxLabels)),
+
+		IndexCheckInterval: indexCheckInterval,
+		ReadinessPath:      ignoreError(set.GetString(ReadinessPath)),
+
+		TimeoutStatus: timeoutStatus,
+		TimeoutBody:   timeoutBody,
+
+		StderrInResponse: ignoreError(set.GetBool(StderrInResponse)),
+
+		AuthUrl:             ignoreError(set.GetString(AuthUrl)),
+		AuthResponseHeaders: ignoreError(set.GetStringArray(AuthResponseHeader)),
+		AuthPrefixes:        ignoreError(set.GetStringArray(AuthPrefix)),
+		AuthTimeout:         authTimeout,
+
+		FpmPoolAuto: ignoreError(set.GetBool(FpmPoolAuto)),
+
+		Http10Compat:         ignoreError(set.GetBool(Http10Compat)),
+		Http10StripHeaders:   ignoreError(set.GetStringArray(Http10StripHeader)),
+		ResponseHeaderBudget: ignoreError(set.GetInt(ResponseHeaderBudget)),
+
+		ShutdownTimeout: shutdownTimeout,
+
+		SslHeaders: ignoreError(set.GetStringArray(SslHeaders)),
+
+		AccessRules: ignoreError(set.GetStringArray(AccessRule)),
+
+		Hash: configHash(set),
+
+		FpmConnMaxRequests: ignoreError(set.GetInt(FpmConnMaxRequests)),
+
+		FpmWait: fpmWait,
+
+		BandwidthLimit:  ignoreError(set.GetInt64(BandwidthLimit)),
+		RouteBandwidths: ignoreError(set.GetStringSlice(RouteBandwidths)),
+
+		FpmQueueTimeout: fpmQueueTimeout,
+		FpmQueueDepth:   ignoreError(set.GetInt(FpmQueueDepth)),
+
+		FpmPoolBurst:   ignoreError(set.GetInt(FpmPoolBurst)),
+		FpmOverflowMax: ignoreError(set.GetInt(FpmOverflowMax)),
+
+		AccessLogPipelines: ignoreError(set.GetStringArray(AccessLogPipeline)),
+
+		FpmHealthInterval: fpmHealthInterval,
+
+		FpmFirstByteTimeout: fpmFirstByteTimeout,
+
+		InformationalStatus: ignoreError(set.GetInt(InformationalStatus)),
+		StatusReasonHeader:  ignoreError(set.GetString(StatusReasonHeader)),
+
+		ScanUrl:      ignoreError(set.GetString(ScanUrl)),
+		ScanPrefixes: ignoreError(set.GetStringArray(ScanPrefix)),
+		ScanMaxSize:  ignoreError(set.GetInt(ScanMaxSize)),
+		ScanTimeout:  scanTimeout,
+		ScanFailOpen: ignoreError(set.GetBool(ScanFailOpen)),
+
+		FallbackPages: ignoreError(set.GetStringArray(FallbackPage)),
+
+		Listen:    ignoreError(set.GetStringArray(Listen)),
+		Listeners: listeners,
+
+		ListenSocketMode: os.FileMode(socketMode),
+
+		reloaded: &atomic.Pointer[ReloadableConfig]{},
+
 		logger: logger,
 	}, nil
 }
 
+// Validate checks config required by the server
+// Required flags are not enforced by cobra, so subcommands can use only the flags they need
+func (c *Config) Validate() error {
+	if err := c.ValidateFpm(); err != nil {
+		return err
+	}
+	if c.IndexFile == "" {
+		return fmt.Errorf("required flag(s) %q not set", ParamIndex)
+	}
+	if c.FpmReservedConnections < 0 || c.FpmReservedConnections >= c.FpmPoolSize {
+		return fmt.Errorf("%s must be between 0 and %s - 1", FpmReservedConnections, FpmPoolSize)
+	}
+	if c.FpmQueueDepth < 0 {
+		return fmt.Errorf("%s must not be negative", FpmQueueDepth)
+	}
+	if c.FpmPoolBurst < 0 {
+		return fmt.Errorf("%s must not be negative", FpmPoolBurst)
+	}
+	if c.FpmOverflowMax < 0 {
+		return fmt.Errorf("%s must not be negative", FpmOverflowMax)
+	}
+	if c.InformationalStatus < 200 || c.InformationalStatus > 599 {
+		return fmt.Errorf("%s must be between 200 and 599", InformationalStatus)
+	}
+	// admin endpoints purge caches, restart the pool, ... anyone reaching them must authenticate
+	if c.AdminPort > 0 && c.AdminToken == "" && !isLoopback(c.AdminBind) {
+		return fmt.Errorf("admin server on %s requires %s, set it or bind the admin server to loopback", c.AdminAddress(), AdminToken)
+	}
+	for _, listener := range c.Listeners {
+		if listener.Handlers == HandlersInternal && listener.Network == "tcp" && c.AdminToken == "" && !isLoopback(hostOf(listener.Address)) {
+			return fmt.Errorf("%s listener %s serves admin endpoints and requires %s, set it or listen on loopback", HandlersInternal, listener.Address, AdminToken)
+		}
+	}
+	if !c.servesPublic() {
+		return fmt.Errorf("%s has only %s listeners, at least one must serve requests", Listen, HandlersInternal)
+	}
+	if c.ScanUrl != "" && c.ScanMaxSize <= 0 {
+		return fmt.Errorf("%s must be positive", ScanMaxSize)
+	}
+	if c.FpmConnMaxRequests < 0 {
+		return fmt.Errorf("%s must not be negative", FpmConnMaxRequests)
+	}
+	if c.RequestStreamThreshold < 0 {
+		return fmt.Errorf("%s can't be negative", RequestStreamThreshold)
+	}
+	if c.Streaming || len(c.StreamPrefixes) > 0 {
+		if c.StreamBufferSize <= 0 {
+			return fmt.Errorf("%s must be positive", StreamBufferSize)
+		}
+		if c.StreamThreshold < 0 {
+			return fmt.Errorf("%s can't be negative", StreamThreshold)
+		}
+		if c.StreamSpoolMaxSize <= 0 {
+			return fmt.Errorf("%s must be positive", StreamSpoolMaxSize)
+		}
+	}
+	// Idempotency-Key needs the complete response, streamed routes would silently skip it
+	for _, prefix := range c.StreamPrefixes {
+		for _, idempotencyPrefix := range c.IdempotencyPrefixes {
+			if strings.HasPrefix(prefix, idempotencyPrefix) || strings.HasPrefix(idempotencyPrefix, prefix) {
+				return fmt.Errorf("%s %q overlaps %s %q", StreamPrefixes, prefix, IdempotencyPrefixes, idempotencyPrefix)
+			}
+		}
+	}
+	if c.Streaming {
+		// these features need the complete body in memory
+		buffered := []struct {
+			name    string
+			enabled bool
+		}{
+			{Cache, c.Cache || c.NegativeCacheTtl > 0},
+			{CacheWarm, len(c.CacheWarm) > 0},
+			{SubFilters, len(c.SubFilters) > 0},
+			{JsonMinify, c.JsonMinify},
+			{Etag, c.Etag},
+			{IdempotencyPrefixes, len(c.IdempotencyPrefixes) > 0},
+			{DumpDir, c.DumpDir != ""},
+		}
+		for _, feature := range buffered {
+			if feature.enabled {
+				return fmt.Errorf("%s can't be used with %s", feature.name, Streaming)
+			}
+		}
+	}
+	if !c.Streaming && len(c.StreamPrefixes) == 0 && c.StreamThreshold > 0 {
+		return fmt.Errorf("%s requires %s or %s", StreamThreshold, Streaming, StreamPrefixes)
+	}
+	if c.DefaultType != "" {
+		if _, _, err := mime.ParseMediaType(c.DefaultType); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", DefaultType, c.DefaultType, err)
+		}
+	}
+	return nil
+}
+
+// ValidateFpm checks exactly one of FPM socket and TCP address is set
+func (c *Config) ValidateFpm() error {
+	if c.Socket == "" && c.FpmAddress == "" {
+		return fmt.Errorf("required flag(s) %q or %q not set", ParamSocket, FpmAddress)
+	}
+	if c.Socket != "" && c.FpmAddress != "" {
+		return fmt.Errorf("%s and %s can't be used together", ParamSocket, FpmAddress)
+	}
+	if c.FpmAddress != "" {
+		if _, _, err := net.SplitHostPort(c.FpmAddress); err != nil {
+			return fmt.Errorf("invalid %s: %w", FpmAddress, err)
+		}
+	}
+	return nil
+}
+
+// AdminAddress returns address the admin server listens on
+func (c *Config) AdminAddress() string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(c.AdminBind, "["), "]"), strconv.Itoa(c.AdminPort))
+}
+
+// AdminDialAddress returns address local commands connect to the admin server at
+func (c *Config) AdminDialAddress() string {
+	host := strings.TrimSuffix(strings.TrimPrefix(c.AdminBind, "["), "]")
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.AdminPort))
+}
+
+// ListenAddresses returns addresses the server listens on
+func (c *Config) ListenAddresses() []string {
+	addresses := make([]string, 0, len(c.Listeners))
+	for _, listener := range c.Listeners {
+		addresses = append(addresses, listener.String())
+	}
+	return addresses
+}
+
+func (c *Config) servesPublic() bool {
+	for _, listener := range c.Listeners {
+		if listener.Handlers != HandlersInternal {
+			return true
+		}
+	}
+	return false
+}
+
+// FpmNetwork returns network and address FPM listens on
+func (c *Config) FpmNetwork() (string, string) {
+	if c.FpmAddress != "" {
+		return "tcp", c.FpmAddress
+	}
+	return "unix", c.Socket
+}
+
 func (c *Config) LogConfig() {
 	c.logger.Infof("[CONFIG] Port: %d", c.Port)
 	c.logger.Infof("[CONFIG] Socket: %s", c.Socket)
+	c.logger.Infof("[CONFIG] FPM address: %s", c.FpmAddress)
 	c.logger.Infof("[CONFIG] Index file %s", c.IndexFile)
 	c.logger.Infof("[CONFIG] App: %s", c.App)
 	c.logger.Infof("[CONFIG] Static folders: %s", strings.Join(c.StaticFolders, ","))
@@ -81,8 +1196,152 @@ func (c *Config) LogConfig() {
 	c.logger.Infof("[CONFIG] FPM pool size: %d", c.FpmPoolSize)
 	c.logger.Infof("[CONFIG] Access logging: %t", c.AccessLog)
 	c.logger.Infof("[CONFIG] Verbose: %t", c.Verbose)
+	c.logger.Infof("[CONFIG] Max decompressed size: %d", c.MaxDecompressedSize)
+	c.logger.Infof("[CONFIG] Compression: %t", c.Compression)
+	c.logger.Infof("[CONFIG] Compression types: %s", strings.Join(c.CompressionTypes, ","))
+	c.logger.Infof("[CONFIG] Compression min size: %d", c.CompressionMinSize)
+	c.logger.Infof("[CONFIG] OPTIONS prefixes: %s", strings.Join(c.OptionsPrefixes, ","))
+	c.logger.Infof("[CONFIG] OPTIONS allow: %s", c.OptionsAllow)
+	c.logger.Infof("[CONFIG] CORS origins: %s", strings.Join(c.CorsOrigins, ","))
+	c.logger.Infof("[CONFIG] CORS credentials: %t", c.CorsCredentials)
+	c.logger.Infof("[CONFIG] CORS max age: %s", c.CorsMaxAge)
+	c.logger.Infof("[CONFIG] Drop headers: %s", strings.Join(c.DropHeaders, ","))
+	c.logger.Infof("[CONFIG] Rename headers: %s", strings.Join(c.RenameHeaders, ","))
+	c.logger.Infof("[CONFIG] Allow underscores in headers: %t", c.AllowUnderscoreHeaders)
+	c.logger.Infof("[CONFIG] Admin port: %d", c.AdminPort)
+	c.logger.Infof("[CONFIG] Admin token set: %t", c.AdminToken != "")
+	c.logger.Infof("[CONFIG] Admin scripts: %s", strings.Join(c.AdminScripts, ","))
+	c.logger.Infof("[CONFIG] Admin bind: %s", c.AdminBind)
+	c.logger.Infof("[CONFIG] Schedules: %s", strings.Join(c.Schedules, ","))
+	c.logger.Infof("[CONFIG] Saturation threshold: %.2f", c.SaturationThreshold)
+	c.logger.Infof("[CONFIG] Saturation duration: %s", c.SaturationDuration)
+	c.logger.Infof("[CONFIG] Priorities: %s", strings.Join(c.Priorities, ","))
+	c.logger.Infof("[CONFIG] Low priority max wait: %s", c.LowPriorityMaxWait)
+	c.logger.Infof("[CONFIG] Fair queue key: %s", c.FairQueueKey)
+	c.logger.Infof("[CONFIG] Retry after: %s", c.RetryAfter)
+	c.logger.Infof("[CONFIG] Preflight: %t", c.Preflight)
+	c.logger.Infof("[CONFIG] Preflight uri: %s", c.PreflightUri)
+	c.logger.Infof("[CONFIG] Cache: %t", c.Cache)
+	c.logger.Infof("[CONFIG] Cache max entries: %d", c.CacheMaxEntries)
+	c.logger.Infof("[CONFIG] Cache max body size: %d", c.CacheMaxBodySize)
+	c.logger.Infof("[CONFIG] Negative cache TTL: %s", c.NegativeCacheTtl)
+	c.logger.Infof("[CONFIG] Dump dir: %s", c.DumpDir)
+	c.logger.Infof("[CONFIG] Dump prefixes: %s", strings.Join(c.DumpPrefixes, ","))
+	c.logger.Infof("[CONFIG] Redirect policy: %s", c.RedirectPolicy)
+	c.logger.Infof("[CONFIG] Boot command: %s", c.BootCommand)
+	c.logger.Infof("[CONFIG] Boot uri: %s", c.BootUri)
+	c.logger.Infof("[CONFIG] Boot timeout: %s", c.BootTimeout)
+	c.logger.Infof("[CONFIG] Bind addresses: %s", strings.Join(c.BindAddresses, ","))
+	c.logger.Infof("[CONFIG] Cost sample rate: %.3f", c.CostSampleRate)
+	c.logger.Infof("[CONFIG] Log output: %s", c.LogOutput)
+	c.logger.Infof("[CONFIG] Syslog address: %s", c.SyslogAddress)
+	c.logger.Infof("[CONFIG] Access sink: %s", c.AccessSink)
+	c.logger.Infof("[CONFIG] Access sink buffer: %d", c.AccessSinkBuffer)
+	c.logger.Infof("[CONFIG] Access sink batch: %d", c.AccessSinkBatch)
+	c.logger.Infof("[CONFIG] Access sink flush: %s", c.AccessSinkFlush)
+	c.logger.Infof("[CONFIG] Profile: %s", c.Profile)
+	c.logger.Infof("[CONFIG] Log format: %s", c.LogFormat)
+	c.logger.Infof("[CONFIG] Security headers: %t", c.SecurityHeaders)
+	c.logger.Infof("[CONFIG] Chaos: %t", c.Chaos)
+	c.logger.Infof("[CONFIG] Forwarded: %s", c.Forwarded)
+	c.logger.Infof("[CONFIG] Trusted proxies: %s", strings.Join(c.TrustedProxies, ","))
+	c.logger.Infof("[CONFIG] A/B buckets: %s", strings.Join(c.AbBuckets, ","))
+	c.logger.Infof("[CONFIG] A/B cookie: %s", c.AbCookie)
+	c.logger.Infof("[CONFIG] Sub filters: %s", strings.Join(c.SubFilters, ","))
+	c.logger.Infof("[CONFIG] Sub filter types: %s", strings.Join(c.SubFilterTypes, ","))
+	c.logger.Infof("[CONFIG] Sub filter max size: %d", c.SubFilterMaxSize)
+	c.logger.Infof("[CONFIG] Base path: %s", c.BasePath)
+	c.logger.Infof("[CONFIG] JSON minify: %t", c.JsonMinify)
+	c.logger.Infof("[CONFIG] Default charset: %s", c.DefaultCharset)
+	c.logger.Infof("[CONFIG] Asset manifests: %s", strings.Join(c.AssetManifests, ","))
+	c.logger.Infof("[CONFIG] Default type: %s", c.DefaultType)
+	c.logger.Infof("[CONFIG] Strict content type: %t", c.StrictContentType)
+	c.logger.Infof("[CONFIG] SSH host: %s", c.SshHost)
+	c.logger.Infof("[CONFIG] SSH key: %s", c.SshKey)
+	c.logger.Infof("[CONFIG] SSH known hosts: %s", c.SshKnownHosts)
+	c.logger.Infof("[CONFIG] CSRF prefixes: %s", strings.Join(c.CsrfPrefixes, ","))
+	c.logger.Infof("[CONFIG] CSRF cookie: %s, header: %s, field: %s", c.CsrfCookie, c.CsrfHeader, c.CsrfField)
+	c.logger.Infof("[CONFIG] ETag: %t", c.Etag)
+	c.logger.Infof("[CONFIG] ETag max size: %d", c.EtagMaxSize)
+	c.logger.Infof("[CONFIG] FPM reserved connections: %d", c.FpmReservedConnections)
+	c.logger.Infof("[CONFIG] Idempotency prefixes: %s", strings.Join(c.IdempotencyPrefixes, ","))
+	c.logger.Infof("[CONFIG] Idempotency TTL: %s", c.IdempotencyTtl)
+	c.logger.Infof("[CONFIG] Cache warm: %s", strings.Join(c.CacheWarm, ","))
+	c.logger.Infof("[CONFIG] Deadline hint: %t", c.DeadlineHint)
+	c.logger.Infof("[CONFIG] FPM status path: %s", c.FpmStatusPath)
+	c.logger.Infof("[CONFIG] Slow request threshold: %s", c.SlowRequestThreshold)
+	c.logger.Infof("[CONFIG] Streaming: %t", c.Streaming)
+	c.logger.Infof("[CONFIG] Stream buffer size: %d", c.StreamBufferSize)
+	c.logger.Infof("[CONFIG] Stream threshold: %d", c.StreamThreshold)
+	c.logger.Infof("[CONFIG] Stream prefixes: %s", strings.Join(c.StreamPrefixes, ","))
+	c.logger.Infof("[CONFIG] Stream spool max size: %d", c.StreamSpoolMaxSize)
+	c.logger.Infof("[CONFIG] TLS cert: %s", c.TlsCert)
+	c.logger.Infof("[CONFIG] TLS min version: %s", c.TlsMinVersion)
+	c.logger.Infof("[CONFIG] TLS cipher suites: %s", strings.Join(c.TlsCipherSuites, ","))
+	c.logger.Infof("[CONFIG] TLS curves: %s", strings.Join(c.TlsCurves, ","))
+	c.logger.Infof("[CONFIG] TLS session tickets: %t", c.TlsSessionTickets)
+	c.logger.Infof("[CONFIG] TLS ALPN: %s", strings.Join(c.TlsAlpn, ","))
+	c.logger.Infof("[CONFIG] TLS reload interval: %s", c.TlsReloadInterval)
+	c.logger.Infof("[CONFIG] TLS client auth: %s", c.TlsClientAuth)
+	c.logger.Infof("[CONFIG] TLS client CA: %s", c.TlsClientCa)
+	c.logger.Infof("[CONFIG] Route timeouts: %s", strings.Join(c.RouteTimeouts, ","))
+	c.logger.Infof("[CONFIG] Method timeout factors: %s", strings.Join(c.MethodTimeoutFactors, ","))
+	c.logger.Infof("[CONFIG] Rate limit: %s", c.RateLimit)
+	c.logger.Infof("[CONFIG] Rate limit key: %s", c.RateLimitKey)
+	c.logger.Infof("[CONFIG] Rate limit overrides: %d", len(c.RateLimitOverrides))
+	c.logger.Infof("[CONFIG] Rate limit max keys: %d", c.RateLimitMaxKeys)
+	c.logger.Infof("[CONFIG] Redis address: %s", c.RedisAddress)
+	c.logger.Infof("[CONFIG] Redis db: %d", c.RedisDb)
+	c.logger.Infof("[CONFIG] Redis prefix: %s", c.RedisPrefix)
+	c.logger.Infof("[CONFIG] Redis timeout: %s", c.RedisTimeout)
+	c.logger.Infof("[CONFIG] Cache storage: %s", c.CacheStorage)
+	c.logger.Infof("[CONFIG] Cache dir: %s", c.CacheDir)
+	c.logger.Infof("[CONFIG] Features: %s", c.Features)
+	c.logger.Infof("[CONFIG] Access log time format: %s", c.AccessLogTimeFormat)
+	c.logger.Infof("[CONFIG] Access log timezone: %s", c.AccessLogLocation)
+	c.logger.Infof("[CONFIG] Request stream threshold: %d", c.RequestStreamThreshold)
+	c.logger.Infof("[CONFIG] Tenant source: %s", c.TenantSource)
+	c.logger.Infof("[CONFIG] Tenant max labels: %d", c.TenantMaxLabels)
+	c.logger.Infof("[CONFIG] Index check interval: %s", c.IndexCheckInterval)
+	c.logger.Infof("[CONFIG] Readiness path: %s", c.ReadinessPath)
+	c.logger.Infof("[CONFIG] Timeout status: %d", c.TimeoutStatus)
+	c.logger.Infof("[CONFIG] Timeout body: %d bytes", len(c.TimeoutBody))
+	c.logger.Infof("[CONFIG] Stderr in response: %t", c.StderrInResponse)
+	c.logger.Infof("[CONFIG] Auth url: %s", c.AuthUrl)
+	c.logger.Infof("[CONFIG] Auth response headers: %v", c.AuthResponseHeaders)
+	c.logger.Infof("[CONFIG] Auth prefixes: %v", c.AuthPrefixes)
+	c.logger.Infof("[CONFIG] Auth timeout: %s", c.AuthTimeout)
+	c.logger.Infof("[CONFIG] FPM pool auto: %t", c.FpmPoolAuto)
+	c.logger.Infof("[CONFIG] HTTP/1.0 compat: %t", c.Http10Compat)
+	c.logger.Infof("[CONFIG] HTTP/1.0 strip headers: %v", c.Http10StripHeaders)
+	c.logger.Infof("[CONFIG] Response header budget: %d", c.ResponseHeaderBudget)
+	c.logger.Infof("[CONFIG] Shutdown timeout: %s", c.ShutdownTimeout)
+	c.logger.Infof("[CONFIG] SSL headers: %s", strings.Join(c.SslHeaders, ","))
+	c.logger.Infof("[CONFIG] Access rules: %d", len(c.AccessRules))
+	c.logger.Infof("[CONFIG] Hash: %s", c.Hash)
+	c.logger.Infof("[CONFIG] FPM connection max requests: %d", c.FpmConnMaxRequests)
+	c.logger.Infof("[CONFIG] FPM wait: %s", c.FpmWait)
+	c.logger.Infof("[CONFIG] Bandwidth limit: %d", c.BandwidthLimit)
+	c.logger.Infof("[CONFIG] Route bandwidths: %s", strings.Join(c.RouteBandwidths, ","))
+	c.logger.Infof("[CONFIG] FPM queue timeout: %s", c.FpmQueueTimeout)
+	c.logger.Infof("[CONFIG] FPM queue depth: %d", c.FpmQueueDepth)
+	c.logger.Infof("[CONFIG] FPM pool burst: %d", c.FpmPoolBurst)
+	c.logger.Infof("[CONFIG] FPM overflow max: %d", c.FpmOverflowMax)
+	c.logger.Infof("[CONFIG] Access log pipelines: %s", strings.Join(c.AccessLogPipelines, " | "))
+	c.logger.Infof("[CONFIG] FPM health interval: %s", c.FpmHealthInterval)
+	c.logger.Infof("[CONFIG] FPM first byte timeout: %s", c.FpmFirstByteTimeout)
+	c.logger.Infof("[CONFIG] Informational status: %d", c.InformationalStatus)
+	c.logger.Infof("[CONFIG] Status reason header: %s", c.StatusReasonHeader)
+	c.logger.Infof("[CONFIG] Scan url: %s", c.ScanUrl)
+	c.logger.Infof("[CONFIG] Scan prefixes: %v", c.ScanPrefixes)
+	c.logger.Infof("[CONFIG] Scan max size: %d", c.ScanMaxSize)
+	c.logger.Infof("[CONFIG] Scan timeout: %s", c.ScanTimeout)
+	c.logger.Infof("[CONFIG] Scan fail open: %t", c.ScanFailOpen)
+	c.logger.Infof("[CONFIG] Fallback pages: %v", c.FallbackPages)
+	c.logger.Infof("[CONFIG] Listen: %v", c.Listen)
+	c.logger.Infof("[CONFIG] Listen socket mode: %s", c.ListenSocketMode)
 }
 
-func ignoreError[K string | bool | int | []string](value K, _ error) K {
+func ignoreError[K string | bool | int | int64 | float64 | []string](value K, _ error) K {
 	return value
 }
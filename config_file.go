@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configPosition is location of a key in the config file, zero line means unknown
+type configPosition struct {
+	line   int
+	column int
+}
+
+// configPositions maps key paths of the config file (e.g. "static-folder[1]") to their locations
+type configPositions map[string]configPosition
+
+// position of the key path, list items without own position get the one of their key
+func (p configPositions) position(path string) configPosition {
+	position, found := p[path]
+	if !found {
+		key, _, _ := strings.Cut(path, "[")
+		position = p[key]
+	}
+	return position
+}
+
+// location formats file:line:column of the key path
+func (p configPositions) location(file string, path string) string {
+	position := p.position(path)
+	if position.line == 0 {
+		return file
+	}
+	return fmt.Sprintf("%s:%d:%d", file, position.line, position.column)
+}
+
+// applyConfigFile sets values of --config file to flags which were not set explicitly. Keys of the file are
+// the flag names (see "gophpfpm config schema"), repeatable flags take a list. YAML, TOML and JSON files are
+// supported, the format is detected by the extension. The file is validated against the schema first.
+func applyConfigFile(set *pflag.FlagSet) error {
+	path := ignoreError(set.GetString(ConfigFile))
+	if path == "" {
+		return nil
+	}
+	values, positions, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := validateConfigFile(BuildConfigSchema(set), path, values, positions); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if set.Changed(name) {
+			continue // flags override the file
+		}
+		if err := setFlagValue(set, set.Lookup(name), values[name]); err != nil {
+			return fmt.Errorf("%s: key %q: %w", positions.location(path, name), name, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile decodes the file and finds positions of its keys
+func readConfigFile(path string) (map[string]any, configPositions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read config file: %w", err)
+	}
+
+	values := map[string]any{}
+	positions := configPositions{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		var document yaml.Node
+		if err = yaml.Unmarshal(data, &document); err == nil && len(document.Content) > 0 {
+			err = document.Decode(&values)
+			positions = yamlPositions(document.Content[0])
+		}
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+		positions = tomlPositions(data)
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			position := offsetPosition(data, parseErr.Position.Start)
+			return nil, nil, fmt.Errorf("could not parse config file %s:%d:%d: %s", path, position.line, position.column, parseErr.Message)
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber() // integers above 2^53 and their exact form are kept
+		if err = decoder.Decode(&values); err == nil {
+			if _, extra := decoder.Token(); extra != io.EOF {
+				err = fmt.Errorf("unexpected data after the top-level object")
+			}
+		}
+		positions = jsonPositions(data)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			position := offsetPosition(data, int(syntaxErr.Offset)-1) // the offset is after the invalid character
+			return nil, nil, fmt.Errorf("could not parse config file %s:%d:%d: %w", path, position.line, position.column, err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown format of config file %s, use .yaml, .yml, .toml or .json", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return values, positions, nil
+}
+
+// yamlPositions reads positions of the top-level keys and their list items from the document node
+func yamlPositions(root *yaml.Node) configPositions {
+	positions := configPositions{}
+	if root.Kind != yaml.MappingNode {
+		return positions
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		positions[key.Value] = configPosition{line: key.Line, column: key.Column}
+		if value.Kind == yaml.SequenceNode {
+			for j, item := range value.Content {
+				positions[fmt.Sprintf("%s[%d]", key.Value, j)] = configPosition{line: item.Line, column: item.Column}
+			}
+		}
+	}
+	return positions
+}
+
+// tomlPositions finds the top-level keys by scanning lines, the TOML decoder doesn't expose positions of keys
+func tomlPositions(data []byte) configPositions {
+	positions := configPositions{}
+	inTable := false
+	for number, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		column := len(line) - len(trimmed) + 1
+		if header, isHeader := strings.CutPrefix(trimmed, "["); isHeader {
+			// keys of tables are not flags, only the table itself is
+			inTable = true
+			name, _, _ := strings.Cut(strings.TrimLeft(header, "["), "]")
+			name, _, _ = strings.Cut(name, ".")
+			if name = strings.Trim(strings.TrimSpace(name), `"'`); name != "" {
+				if _, seen := positions[name]; !seen {
+					positions[name] = configPosition{line: number + 1, column: column}
+				}
+			}
+			continue
+		}
+		if inTable {
+			continue
+		}
+		key, _, found := strings.Cut(trimmed, "=")
+		key = strings.TrimSpace(key)
+		if quoted := strings.Trim(key, `"'`); quoted != key {
+			if len(key) < 2 || key[0] != key[len(key)-1] {
+				continue // part of a string value
+			}
+			key = quoted
+		}
+		if !found || key == "" || strings.ContainsAny(key, " \t\"'#,[]{}") {
+			continue
+		}
+		if _, seen := positions[key]; !seen {
+			positions[key] = configPosition{line: number + 1, column: column}
+		}
+	}
+	return positions
+}
+
+// jsonPositions finds the top-level keys with the tokenizer, encoding/json reports only offsets
+func jsonPositions(data []byte) configPositions {
+	positions := configPositions{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return positions
+	}
+	for decoder.More() {
+		// the offset is after the previous value, the key follows the comma and whitespace
+		start := int(decoder.InputOffset())
+		for start < len(data) && strings.IndexByte(" \t\r\n,", data[start]) >= 0 {
+			start++
+		}
+		token, err := decoder.Token()
+		key, isKey := token.(string)
+		if err != nil || !isKey {
+			break
+		}
+		positions[key] = offsetPosition(data, start)
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			break
+		}
+	}
+	return positions
+}
+
+// offsetPosition converts byte offset to line and column, both starting at 1
+func offsetPosition(data []byte, offset int) configPosition {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	return configPosition{
+		line:   bytes.Count(before, []byte("\n")) + 1,
+		column: offset - bytes.LastIndexByte(before, '\n'),
+	}
+}
+
+// setFlagValue sets scalar or list value, list replaces default of a repeatable flag
+func setFlagValue(set *pflag.FlagSet, flag *pflag.Flag, value any) error {
+	list, isList := value.([]any)
+	if !isList {
+		scalar, err := configScalar(value)
+		if err != nil {
+			return err
+		}
+		return set.Set(flag.Name, scalar)
+	}
+
+	sliceValue, ok := flag.Value.(pflag.SliceValue)
+	if !ok {
+		return fmt.Errorf("list given to a flag which can't be repeated")
+	}
+	items := make([]string, 0, len(list))
+	for _, item := range list {
+		scalar, err := configScalar(item)
+		if err != nil {
+			return err
+		}
+		items = append(items, scalar)
+	}
+	if err := sliceValue.Replace(items); err != nil {
+		return err
+	}
+	flag.Changed = true
+	return nil
+}
+
+// configScalar converts value of the file to the flag string form
+func configScalar(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(value), nil
+	case time.Time:
+		return value.Format(time.RFC3339), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v, use string, number, boolean or list of them", value)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// applyTestConfigFile writes the config file and applies it to flags of the root command
+func applyTestConfigFile(t *testing.T, name string, content string, args ...string) (*pflag.FlagSet, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+	cmd := &cobra.Command{}
+	DefineParams(cmd)
+	set := cmd.PersistentFlags()
+	if err := set.Parse(append([]string{"--" + ConfigFile, path}, args...)); err != nil {
+		t.Fatalf("could not parse flags: %s", err)
+	}
+	return set, applyConfigFile(set)
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+fpm-pool-size: 16
+timeout: 30s
+compression: true
+cost-sample-rate: 1
+static-folder:
+  - /app/public/build:/build
+  - /app/public/images:/images
+`,
+		"config.toml": `
+fpm-pool-size = 16
+timeout = "30s"
+compression = true
+cost-sample-rate = 1
+static-folder = [
+  "/app/public/build:/build",
+  "/app/public/images:/images",
+]
+`,
+		"config.json": `{
+  "fpm-pool-size": 16,
+  "timeout": "30s",
+  "compression": true,
+  "cost-sample-rate": 1,
+  "static-folder": ["/app/public/build:/build", "/app/public/images:/images"]
+}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			set, err := applyTestConfigFile(t, name, content, "--"+FpmPoolSize, "2")
+			if err != nil {
+				t.Fatalf("could not apply config file: %s", err)
+			}
+			if got := ignoreError(set.GetInt(FpmPoolSize)); got != 2 {
+				t.Errorf("%s = %d, the flag must override the file", FpmPoolSize, got)
+			}
+			if got, _ := set.GetDuration(Timeout); got != 30*time.Second {
+				t.Errorf("%s = %s, want 30s", Timeout, got)
+			}
+			if got := ignoreError(set.GetBool(Compression)); !got {
+				t.Errorf("%s is not enabled", Compression)
+			}
+			if got := ignoreError(set.GetFloat64(CostSampleRate)); got != 1 {
+				t.Errorf("%s = %f, want 1", CostSampleRate, got)
+			}
+			want := []string{"/app/public/build:/build", "/app/public/images:/images"}
+			if got := ignoreError(set.GetStringArray(ParamStaticFolders)); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s = %q, want %q", ParamStaticFolders, got, want)
+			}
+		})
+	}
+}
+
+func TestConfigFileSchemaViolations(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		errors  []string // expected lines of the error, file name is prepended
+	}{
+		{
+			name:    "config.yaml",
+			content: "fpm-pool-size: many\ntimeout: 30 seconds\nstatic-folder:\n  - /app:/\n  - 5\ncompression: yes please\nunknown-key: 1\nverbose: true\n",
+			errors: []string{
+				`:1:1: key "fpm-pool-size": expected integer, got string`,
+				`:2:1: key "timeout": expected duration (e.g. 30s or 1m30s), got "30 seconds"`,
+				`:5:5: key "static-folder[1]": expected string, got integer`,
+				`:6:1: key "compression": expected boolean, got string`,
+				`:7:1: key "unknown-key": unknown key`,
+			},
+		},
+		{
+			name:    "config.yaml",
+			content: "static-folder: /app:/\nfpm-pool-size:\n  value: 4\n",
+			errors: []string{
+				`:1:1: key "static-folder": expected array, got string`,
+				`:2:1: key "fpm-pool-size": expected integer, got object`,
+			},
+		},
+		{
+			name:    "config.toml",
+			content: "# comment\nfpm-pool-size = \"many\"\n  timeout = 30\n\"compression\" = 1\nstatic-folder = [\n  \"a=b\",\n  5,\n]\n\n[table]\nkey = 1\n",
+			errors: []string{
+				`:2:1: key "fpm-pool-size": expected integer, got string`,
+				`:3:3: key "timeout": expected string, got integer`,
+				`:4:1: key "compression": expected boolean, got integer`,
+				`:5:1: key "static-folder[1]": expected string, got integer`,
+				`:10:1: key "table": unknown key`,
+			},
+		},
+		{
+			name:    "config.json",
+			content: "{\n  \"fpm-pool-size\": 1.5,\n  \"cost-sample-rate\": \"1\",\n    \"config\": \"other.json\", \"static-folder\": [1]\n}",
+			errors: []string{
+				`:2:3: key "fpm-pool-size": expected integer, got number`,
+				`:3:3: key "cost-sample-rate": expected number, got string`,
+				`:4:5: key "config": unknown key`,
+				`:4:29: key "static-folder[0]": expected string, got integer`,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			set, err := applyTestConfigFile(t, c.name, c.content)
+			if err == nil {
+				t.Fatalf("invalid config file was accepted")
+			}
+			path := ignoreError(set.GetString(ConfigFile))
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(c.errors) {
+				t.Fatalf("got %d errors, want %d:\n%s", len(lines), len(c.errors), err)
+			}
+			for i, want := range c.errors {
+				if lines[i] != path+want {
+					t.Errorf("error %d = %q, want %q", i, strings.TrimPrefix(lines[i], path), want)
+				}
+			}
+			if set.Changed(FpmPoolSize) || set.Changed(ParamVerbose) {
+				t.Errorf("invalid file was partially applied")
+			}
+		})
+	}
+}
+
+func TestConfigFileParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"config.toml": "fpm-pool-size = 4\ntimeout = \"30s\nverbose = true\n",
+		"config.json": "{\n  \"fpm-pool-size\": 4,\n  \"timeout\" \"30s\"\n}",
+		"config.yaml": "fpm-pool-size: 4\n timeout: 30s\n",
+	}
+	want := map[string]string{
+		"config.toml": ":2:",
+		"config.json": ":3:13: ",
+		"config.yaml": "line 2",
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := applyTestConfigFile(t, name, content)
+			if err == nil || !strings.Contains(err.Error(), want[name]) {
+				t.Errorf("error = %v, want position %q", err, want[name])
+			}
+		})
+	}
+}
+
+func TestConfigFileFlagValueError(t *testing.T) {
+	// the value matches the schema, the flag rejects it
+	_, err := applyTestConfigFile(t, "config.yaml", "verbose: true\nport: 99999999999999999999\n")
+	if err == nil || !strings.Contains(err.Error(), `.yaml:2:1: key "port": `) {
+		t.Errorf("error = %v, want position of the key", err)
+	}
+}
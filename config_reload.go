@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// results of config reloads, used as metrics label
+const (
+	ReloadResultSuccess = "success"
+	ReloadResultError   = "error"
+)
+
+// ReloadableConfig holds values of the flags ConfigReloader applies at runtime
+type ReloadableConfig struct {
+	Verbose       bool
+	AccessLog     bool
+	StaticFolders []string
+	FpmPoolSize   int
+}
+
+// Reloadable returns the values currently in use, the loaded ones until a reload applies new values. Code running
+// while serving (admin endpoints, runtime info) reads them here instead of the fields of the config.
+func (c *Config) Reloadable() ReloadableConfig {
+	if c.reloaded != nil {
+		if reloaded := c.reloaded.Load(); reloaded != nil {
+			return *reloaded
+		}
+	}
+	return ReloadableConfig{
+		Verbose:       c.Verbose,
+		AccessLog:     c.AccessLog,
+		StaticFolders: c.StaticFolders,
+		FpmPoolSize:   c.FpmPoolSize,
+	}
+}
+
+// ConfigReloader re-reads flags and --config file on SIGHUP and applies changes which are safe at runtime:
+// log level (--verbose), --access-log, static folders and FPM pool size. TLS certificate files are re-read too.
+// The listener and requests in flight are not affected. Changes of other flags are logged, they need a restart.
+// Applied values are published by Config.Reloadable of the shared config, its other fields keep startup values.
+type ConfigReloader struct {
+	args  []string
+	flags *pflag.FlagSet // flags of the applied config
+
+	server       *HttpServer
+	fCgiClient   *FCgiClient
+	accessLogger *AccessLogger
+	certificates *CertificateReloader
+	config       *Config
+	monitor      *Monitor
+	logger       *logrus.Logger
+
+	signals chan os.Signal
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewConfigReloader(args []string, flags *pflag.FlagSet, server *HttpServer, fCgiClient *FCgiClient, accessLogger *AccessLogger, certificates *CertificateReloader, config *Config, monitor *Monitor, logger *logrus.Logger) *ConfigReloader {
+	return &ConfigReloader{
+		args:  args,
+		flags: flags,
+
+		server:       server,
+		fCgiClient:   fCgiClient,
+		accessLogger: accessLogger,
+		certificates: certificates,
+		config:       config,
+		monitor:      monitor,
+		logger:       logger,
+
+		signals: make(chan os.Signal, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (cr *ConfigReloader) Start() {
+	signal.Notify(cr.signals, syscall.SIGHUP)
+	go cr.run()
+}
+
+func (cr *ConfigReloader) Stop() {
+	signal.Stop(cr.signals)
+	close(cr.stop)
+	<-cr.done
+}
+
+func (cr *ConfigReloader) run() {
+	defer close(cr.done)
+
+	for {
+		select {
+		case <-cr.stop:
+			return
+		case <-cr.signals:
+		}
+
+		cr.logger.Info("SIGHUP received, reloading config")
+		if err := cr.Reload(); err != nil {
+			cr.monitor.ConfigReloadsCounter.WithLabelValues(cr.config.App, ReloadResultError).Inc()
+			cr.logger.Errorf("could not reload config: %s", err)
+			continue
+		}
+		cr.monitor.ConfigReloadsCounter.WithLabelValues(cr.config.App, ReloadResultSuccess).Inc()
+	}
+}
+
+// Reload loads the config the same way as at startup and applies changed flags. Invalid config is not applied
+// at all, the current one is kept. Flags which couldn't be applied are tried again by the next reload.
+// The certificate is reloaded from the files the server was started with, --tls-cert and --tls-key need a restart.
+func (cr *ConfigReloader) Reload() error {
+	if cr.certificates.Enabled() {
+		if err := cr.certificates.Reload(); err != nil {
+			cr.logger.Errorf("could not reload TLS certificate, the current one is served: %s", err)
+		}
+	}
+
+	cmd := &cobra.Command{}
+	DefineParams(cmd)
+	set := cmd.PersistentFlags()
+	if err := set.Parse(cr.args); err != nil {
+		return fmt.Errorf("could not parse flags: %w", err)
+	}
+	config, err := LoadConfig(set, cr.logger)
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	applied := cr.config.Reloadable()
+	var errs []error
+	for _, name := range changedFlags(cr.flags, set) {
+		var err error
+		switch name {
+		case ParamVerbose:
+			level := logrus.InfoLevel
+			if config.Verbose {
+				level = logrus.DebugLevel
+			}
+			cr.logger.SetLevel(level)
+			applied.Verbose = config.Verbose
+		case AccessLog:
+			cr.accessLogger.SetEnabled(config.AccessLog)
+			applied.AccessLog = config.AccessLog
+		case ParamStaticFolders:
+			if err = cr.server.SetStaticFolders(config.StaticFolders); err == nil {
+				applied.StaticFolders = config.StaticFolders
+			}
+		case FpmPoolSize:
+			if config.FpmPoolAuto {
+				cr.logger.Warnf("%s changed, it's ignored with --%s", FpmPoolSize, FpmPoolAuto)
+				break
+			}
+			if err = cr.fCgiClient.Resize(config.FpmPoolSize); err == nil {
+				applied.FpmPoolSize = config.FpmPoolSize
+			}
+		default:
+			cr.logger.Warnf("%s changed, restart to apply it", name)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not apply %s: %w", name, err))
+			set.Lookup(name).Value = cr.flags.Lookup(name).Value // keeps the flag changed for the next reload
+			continue
+		}
+		cr.logger.Infof("%s reloaded: %s", name, set.Lookup(name).Value.String())
+	}
+
+	cr.config.reloaded.Store(&applied)
+	cr.flags = set
+	return errors.Join(errs...)
+}
+
+// changedFlags returns names of flags whose values differ
+func changedFlags(current *pflag.FlagSet, loaded *pflag.FlagSet) []string {
+	var changed []string
+	loaded.VisitAll(func(flag *pflag.Flag) {
+		if previous := current.Lookup(flag.Name); previous == nil || previous.Value.String() != flag.Value.String() {
+			changed = append(changed, flag.Name)
+		}
+	})
+	return changed
+}
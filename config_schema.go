@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// durationPattern matches values accepted by time.ParseDuration
+const durationPattern = `^-?([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$|^0$`
+
+// BuildConfigSchema describes configuration as JSON Schema, keys are the flag names
+func BuildConfigSchema(flags *pflag.FlagSet) map[string]any {
+	properties := map[string]any{}
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Name == "help" || flag.Name == ConfigFile {
+			return
+		}
+		properties[flag.Name] = flagSchema(flag)
+	})
+
+	return map[string]any{
+		"$schema":              jsonSchemaDraft,
+		"title":                "gophpfpm configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// flagSchema maps pflag value type to JSON Schema type, default value is converted from its string form
+func flagSchema(flag *pflag.Flag) map[string]any {
+	schema := map[string]any{"description": flag.Usage}
+	switch flag.Value.Type() {
+	case "bool":
+		schema["type"] = "boolean"
+		if value, err := strconv.ParseBool(flag.DefValue); err == nil {
+			schema["default"] = value
+		}
+	case "int", "int64", "int32", "uint", "uint64", "uint32":
+		schema["type"] = "integer"
+		if value, err := strconv.ParseInt(flag.DefValue, 10, 64); err == nil {
+			schema["default"] = value
+		}
+	case "float64", "float32":
+		schema["type"] = "number"
+		if value, err := strconv.ParseFloat(flag.DefValue, 64); err == nil {
+			schema["default"] = value
+		}
+	case "duration":
+		schema["type"] = "string"
+		schema["pattern"] = durationPattern
+		schema["default"] = flag.DefValue
+	case "stringArray", "stringSlice":
+		schema["type"] = "array"
+		schema["items"] = map[string]any{"type": "string"}
+		if values := strings.Trim(flag.DefValue, "[]"); values != "" {
+			schema["default"] = strings.Split(values, ",")
+		}
+	default:
+		schema["type"] = "string"
+		if flag.DefValue != "" {
+			schema["default"] = flag.DefValue
+		}
+	}
+	return schema
+}
+
+// configViolation is value of the config file not matching the schema
+type configViolation struct {
+	path    string // key path, e.g. "static-folder[1]"
+	message string
+}
+
+// validateConfigFile checks values of the config file against the schema, every violation is reported with its key
+// path and location in the file
+func validateConfigFile(schema map[string]any, file string, values map[string]any, positions configPositions) error {
+	properties, _ := schema["properties"].(map[string]any)
+	var violations []configViolation
+	for name, value := range values {
+		property, known := properties[name].(map[string]any)
+		if !known {
+			violations = append(violations, configViolation{path: name, message: "unknown key"})
+			continue
+		}
+		violations = append(violations, schemaViolations(property, name, value)...)
+	}
+
+	// in the order of the file, keys without known position last
+	sort.Slice(violations, func(i, j int) bool {
+		a, b := positions.position(violations[i].path), positions.position(violations[j].path)
+		if a.line != b.line {
+			return b.line == 0 || (a.line != 0 && a.line < b.line)
+		}
+		if a.column != b.column {
+			return a.column < b.column
+		}
+		return violations[i].path < violations[j].path
+	})
+	errs := make([]error, 0, len(violations))
+	for _, violation := range violations {
+		errs = append(errs, fmt.Errorf("%s: key %q: %s", positions.location(file, violation.path), violation.path, violation.message))
+	}
+	return errors.Join(errs...)
+}
+
+// schemaViolations checks the value against the flag schema, items of lists are checked one by one
+func schemaViolations(schema map[string]any, path string, value any) []configViolation {
+	expected, _ := schema["type"].(string)
+	actual := schemaType(value)
+	if actual != expected && !(expected == "number" && actual == "integer") {
+		return []configViolation{{path: path, message: fmt.Sprintf("expected %s, got %s", expected, actual)}}
+	}
+
+	switch value := value.(type) {
+	case []any:
+		items, _ := schema["items"].(map[string]any)
+		var violations []configViolation
+		for i, item := range value {
+			violations = append(violations, schemaViolations(items, fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+		return violations
+	case string:
+		pattern, _ := schema["pattern"].(string)
+		if pattern == "" || regexp.MustCompile(pattern).MatchString(value) {
+			return nil
+		}
+		if pattern == durationPattern {
+			return []configViolation{{path: path, message: fmt.Sprintf("expected duration (e.g. 30s or 1m30s), got %q", value)}}
+		}
+		return []configViolation{{path: path, message: fmt.Sprintf("%q doesn't match %s", value, pattern)}}
+	}
+	return nil
+}
+
+// schemaType names JSON Schema type of value decoded from YAML, TOML or JSON
+func schemaType(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string, time.Time:
+		return "string"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// NewConfigCommand creates command grouping configuration tools
+func NewConfigCommand(logger *log.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Configuration tools",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "schema",
+		Short: "Print JSON Schema of the configuration",
+		Long:  `Print JSON Schema of the configuration for IDE validation and CI linting of deployment configs. Keys are the flag names.`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.SetEscapeHTML(false)
+			if err := encoder.Encode(BuildConfigSchema(cmd.Root().PersistentFlags())); err != nil {
+				logger.Fatalf("could not write schema: %s", err)
+			}
+		},
+	})
+	return cmd
+}
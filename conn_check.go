@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// peerClosed reports whether idle connection was closed by FPM, e.g. its worker exited after pm.max_requests.
+// It peeks at the socket without blocking, data pending on an idle connection makes it unusable too.
+func peerClosed(conn net.Conn) bool {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return false // SSH tunnel, the request itself finds out
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	closed := false
+	_ = rawConn.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		closed = err == nil || errors.Is(err, syscall.ECONNRESET)
+		return true
+	})
+	return closed
+}
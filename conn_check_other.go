@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import "net"
+
+// peerClosed can't check the connection on this platform, closed connection is found by the request using it
+func peerClosed(net.Conn) bool {
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	stdlog "log"
+	"net"
+	"net/http"
+)
+
+// trackConnState exports number of open client connections and new connections,
+// connection churn usually means keep-alive is misconfigured on the load balancer
+func (hs *HttpServer) trackConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		hs.monitor.ConnectionsCounter.WithLabelValues(hs.config.App).Inc()
+		hs.monitor.OpenConnectionsGauge.WithLabelValues(hs.config.App).Inc()
+	case http.StateClosed, http.StateHijacked:
+		hs.monitor.OpenConnectionsGauge.WithLabelValues(hs.config.App).Dec()
+	}
+}
+
+// serverErrorLog returns logger for internal errors of http.Server, TLS handshake errors are counted
+func (hs *HttpServer) serverErrorLog() *stdlog.Logger {
+	return stdlog.New(&serverErrorWriter{
+		app:     hs.config.App,
+		monitor: hs.monitor,
+		logger:  hs.logger,
+	}, "", 0)
+}
+
+type serverErrorWriter struct {
+	app     string
+	monitor *Monitor
+	logger  *logrus.Logger
+}
+
+func (w *serverErrorWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		w.monitor.TlsHandshakeErrorsCounter.WithLabelValues(w.app).Inc()
+		w.logger.Debugf("%s", bytes.TrimSpace(p))
+		return len(p), nil
+	}
+	w.logger.Warnf("%s", bytes.TrimSpace(p))
+	return len(p), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math/rand"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+const heapAllocsMetric = "/gc/heap/allocs:bytes"
+
+// CostSample is a measurement of one sampled request
+type CostSample struct {
+	start  time.Time
+	allocs uint64
+}
+
+// RouteCost is aggregated cost of sampled requests of one route
+type RouteCost struct {
+	Route          string  `json:"route"`
+	Samples        int     `json:"samples"`
+	AvgTotalMs     float64 `json:"avg_total_ms"`
+	AvgFpmMs       float64 `json:"avg_fpm_ms"`
+	AvgProxyMs     float64 `json:"avg_proxy_ms"`
+	AvgAllocBytes  float64 `json:"avg_alloc_bytes"`
+	ProxyTimeShare float64 `json:"proxy_time_share"`
+
+	totalTime  time.Duration
+	fpmTime    time.Duration
+	allocBytes uint64
+}
+
+// CostSampler records Go-side cost of a sample of requests per route.
+// It helps to distinguish proxy overhead from time spent in PHP.
+// Allocations are read from process-wide runtime metrics, so they include concurrent requests and are approximate.
+type CostSampler struct {
+	mu     sync.Mutex
+	routes map[string]*RouteCost
+
+	config *Config
+}
+
+func NewCostSampler(config *Config) *CostSampler {
+	return &CostSampler{
+		routes: map[string]*RouteCost{},
+		config: config,
+	}
+}
+
+// Start decides whether the request is sampled, nil is returned for requests which are not
+func (cs *CostSampler) Start() *CostSample {
+	if cs.config.CostSampleRate <= 0 || rand.Float64() >= cs.config.CostSampleRate {
+		return nil
+	}
+	return &CostSample{
+		start:  time.Now(),
+		allocs: heapAllocs(),
+	}
+}
+
+// Record adds finished sampled request to the report of its route
+func (cs *CostSampler) Record(sample *CostSample, response *ResponseData) {
+	if sample == nil {
+		return
+	}
+	total := time.Since(sample.start)
+	allocs := heapAllocs() - sample.allocs
+
+	route := response.Route
+	if route == "" {
+		route = "-"
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cost, found := cs.routes[route]
+	if !found {
+		cost = &RouteCost{Route: route}
+		cs.routes[route] = cost
+	}
+	cost.Samples++
+	cost.totalTime += total
+	cost.fpmTime += response.FpmDuration
+	cost.allocBytes += allocs
+}
+
+// Report returns averages per route, routes with most samples first
+func (cs *CostSampler) Report() []RouteCost {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	report := make([]RouteCost, 0, len(cs.routes))
+	for _, cost := range cs.routes {
+		samples := float64(cost.Samples)
+		proxyTime := cost.totalTime - cost.fpmTime
+		item := *cost
+		item.AvgTotalMs = durationMs(cost.totalTime) / samples
+		item.AvgFpmMs = durationMs(cost.fpmTime) / samples
+		item.AvgProxyMs = durationMs(proxyTime) / samples
+		item.AvgAllocBytes = float64(cost.allocBytes) / samples
+		if cost.totalTime > 0 {
+			item.ProxyTimeShare = float64(proxyTime) / float64(cost.totalTime)
+		}
+		report = append(report, item)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Samples != report[j].Samples {
+			return report[i].Samples > report[j].Samples
+		}
+		return report[i].Route < report[j].Route
+	})
+	return report
+}
+
+// Reset drops all collected samples
+func (cs *CostSampler) Reset() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.routes = map[string]*RouteCost{}
+}
+
+func heapAllocs() uint64 {
+	sample := []metrics.Sample{{Name: heapAllocsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	csrfTokenBytes  = 32
+	csrfMaxFormSize = 64 << 10 // form read to memory while looking for the token field
+)
+
+// errCsrfFormTooLarge means the token field was not found in the first csrfMaxFormSize bytes of the form
+var errCsrfFormTooLarge = fmt.Errorf("CSRF token not found in the first %d bytes of the form, send it in the header or before file fields", csrfMaxFormSize)
+
+// csrfMiddleware validates double-submit CSRF token for unsafe requests to configured prefixes.
+// Token from the cookie must be repeated in the header or in the form field, otherwise 403 is returned
+// before PHP is invoked. Clients without the cookie get a new random token.
+func (hs *HttpServer) csrfMiddleware(next http.Handler) http.Handler {
+	if len(hs.config.CsrfPrefixes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(hs.config.CsrfCookie)
+		if err != nil || cookie.Value == "" {
+			issueCsrfCookie(w, hs.config.CsrfCookie)
+		}
+
+		if _, found := matchPrefix(r.URL.Path, hs.config.CsrfPrefixes); !found || isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		if err != nil || cookie.Value == "" {
+			hs.WriteStatus(w, r, http.StatusForbidden, errors.New("CSRF cookie missing"), start)
+			return
+		}
+
+		submitted := r.Header.Get(hs.config.CsrfHeader)
+		if submitted == "" {
+			submitted, err = csrfFormField(r, hs.config.CsrfField)
+			if errors.Is(err, errCsrfFormTooLarge) {
+				hs.WriteStatus(w, r, http.StatusRequestEntityTooLarge, err, start)
+				return
+			}
+			if err != nil {
+				hs.WriteStatus(w, r, http.StatusBadRequest, err, start)
+				return
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(submitted), []byte(cookie.Value)) != 1 {
+			hs.WriteStatus(w, r, http.StatusForbidden, errors.New("CSRF token mismatch"), start)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isSafeMethod reports whether the method must not change state (RFC 9110)
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// issueCsrfCookie sets a new random token, the cookie is readable by JavaScript so it can be copied to the header
+func issueCsrfCookie(w http.ResponseWriter, name string) {
+	token := make([]byte, csrfTokenBytes)
+	if _, err := rand.Read(token); err != nil {
+		return // request is rejected later as the cookie is missing
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    hex.EncodeToString(token),
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// csrfFormField reads the token from url-encoded or multipart form, the body is restored for FPM.
+// At most csrfMaxFormSize bytes are read, multipart forms only up to the token field, so uploads following
+// the token (HTML forms put hidden fields first) are streamed to FPM.
+func csrfFormField(r *http.Request, field string) (string, error) {
+	if r.Body == nil || r.Header.Get("Content-Encoding") != "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil
+	}
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return "", nil
+	}
+
+	// bytes read from the body are passed to FPM before the rest of it
+	var read bytes.Buffer
+	limited := &io.LimitedReader{R: r.Body, N: csrfMaxFormSize + 1}
+	rest := r.Body
+	defer func() {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(read.Bytes()), rest), rest}
+	}()
+	body := io.TeeReader(limited, &read)
+
+	if mediaType == "application/x-www-form-urlencoded" {
+		form, err := io.ReadAll(body)
+		if err != nil {
+			return "", err
+		}
+		if limited.N == 0 {
+			return "", errCsrfFormTooLarge
+		}
+		values, err := url.ParseQuery(string(form))
+		if err != nil {
+			return "", err
+		}
+		return values.Get(field), nil
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == nil && part.FormName() == field && part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, 1024))
+			return string(value), err
+		}
+		if limited.N == 0 {
+			return "", errCsrfFormTooLarge
+		}
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
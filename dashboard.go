@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const recentErrorsSize = 50
+
+// RecentError is one error kept for the dashboard
+type RecentError struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Status  int       `json:"status"`
+	Message string    `json:"message"`
+}
+
+// RecentErrors is a fixed size ring buffer of the latest errors
+type RecentErrors struct {
+	mu      sync.Mutex
+	entries []RecentError
+	next    int
+}
+
+func NewRecentErrors(size int) *RecentErrors {
+	return &RecentErrors{entries: make([]RecentError, 0, size)}
+}
+
+// Add stores the error, the oldest one is overwritten when the buffer is full
+func (re *RecentErrors) Add(request *http.Request, status int, message string) {
+	entry := RecentError{
+		Time:    time.Now(),
+		Method:  request.Method,
+		Path:    request.URL.Path,
+		Status:  status,
+		Message: message,
+	}
+
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if len(re.entries) < cap(re.entries) {
+		re.entries = append(re.entries, entry)
+		return
+	}
+	re.entries[re.next] = entry
+	re.next = (re.next + 1) % len(re.entries)
+}
+
+// List returns stored errors, the newest first
+func (re *RecentErrors) List() []RecentError {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	list := make([]RecentError, 0, len(re.entries))
+	for i := len(re.entries) - 1; i >= 0; i-- {
+		list = append(list, re.entries[(re.next+i)%len(re.entries)])
+	}
+	return list
+}
+
+// DashboardBucket is a cumulative bucket of request durations
+type DashboardBucket struct {
+	Le    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+// DashboardStats is a snapshot polled by the dashboard, rates and percentiles are computed from differences
+// between two snapshots
+type DashboardStats struct {
+	Time        time.Time         `json:"time"`
+	Requests    uint64            `json:"requests"`
+	StatusCodes map[string]uint64 `json:"status_codes"`
+	Buckets     []DashboardBucket `json:"buckets"`
+	PoolSize    int               `json:"pool_size"`
+	PoolBusy    int               `json:"pool_busy"`
+	PoolWaiting int               `json:"pool_waiting"`
+	Errors      []RecentError     `json:"errors"`
+}
+
+// collectDashboardStats sums HTTP request durations over all label values
+func collectDashboardStats(monitor *Monitor, fCgiClient *FCgiClient) (*DashboardStats, error) {
+	stats := &DashboardStats{
+		Time:        time.Now(),
+		StatusCodes: map[string]uint64{},
+		PoolSize:    fCgiClient.pool.Size(),
+		PoolBusy:    fCgiClient.Busy(),
+		PoolWaiting: fCgiClient.Waiting(),
+		Errors:      monitor.RecentErrors.List(),
+	}
+	for _, le := range buckets {
+		stats.Buckets = append(stats.Buckets, DashboardBucket{Le: le})
+	}
+
+	families, err := monitor.Registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range families {
+		if family.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			code := ""
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "http_code" {
+					code = label.GetValue()
+				}
+			}
+			histogram := metric.GetHistogram()
+			stats.Requests += histogram.GetSampleCount()
+			stats.StatusCodes[code] += histogram.GetSampleCount()
+			for i, bucket := range histogram.GetBucket() {
+				if i < len(stats.Buckets) {
+					stats.Buckets[i].Count += bucket.GetCumulativeCount()
+				}
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// dashboardPage is self-contained, it polls the stats endpoint with admin token taken from the url fragment
+// (/admin/dashboard#token=...), so the token is never sent in the url
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gophpfpm</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+.tiles { display: flex; gap: 1em; flex-wrap: wrap; }
+.tile { border: 1px solid #ddd; border-radius: 4px; padding: 1em; min-width: 10em; }
+.tile b { display: block; font-size: 1.8em; }
+.bar { background: #eee; height: 1em; width: 20em; }
+.bar div { background: #4a90d9; height: 100%; }
+table { border-collapse: collapse; margin-top: 1em; }
+td, th { border-bottom: 1px solid #eee; padding: 0.3em 0.8em; text-align: left; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>gophpfpm</h1>
+<div class="tiles">
+<div class="tile">Requests/s<b id="rps">-</b><svg id="spark" width="160" height="30"></svg></div>
+<div class="tile">p50<b id="p50">-</b></div>
+<div class="tile">p95<b id="p95">-</b></div>
+<div class="tile">p99<b id="p99">-</b></div>
+<div class="tile">Pool<b id="pool">-</b><div class="bar"><div id="poolbar" style="width: 0"></div></div></div>
+</div>
+<h2>Status codes</h2>
+<table id="codes"></table>
+<h2>Recent errors</h2>
+<table id="errors"></table>
+<p id="status" class="error"></p>
+<script>
+var token = new URLSearchParams(location.hash.substring(1)).get("token");
+var previous = null, rates = [];
+
+function percentile(current, q) {
+	var total = current.requests - previous.requests;
+	if (total <= 0) return "-";
+	for (var i = 0; i < current.buckets.length; i++) {
+		var count = current.buckets[i].count - previous.buckets[i].count;
+		if (count >= q * total) return "≤ " + current.buckets[i].le * 1000 + " ms";
+	}
+	return "> " + current.buckets[current.buckets.length - 1].le + " s";
+}
+
+function cell(row, text) {
+	var td = row.insertCell();
+	td.textContent = text;
+}
+
+function render(current) {
+	var seconds = (new Date(current.time) - new Date(previous.time)) / 1000;
+	var rps = seconds > 0 ? (current.requests - previous.requests) / seconds : 0;
+	rates.push(rps);
+	if (rates.length > 60) rates.shift();
+	var max = Math.max.apply(null, rates.concat([1]));
+	document.getElementById("spark").innerHTML = '<polyline fill="none" stroke="#4a90d9" points="' +
+		rates.map(function (v, i) { return (i * 160 / 59) + "," + (30 - v * 28 / max); }).join(" ") + '"/>';
+	document.getElementById("rps").textContent = rps.toFixed(1);
+	document.getElementById("p50").textContent = percentile(current, 0.5);
+	document.getElementById("p95").textContent = percentile(current, 0.95);
+	document.getElementById("p99").textContent = percentile(current, 0.99);
+	document.getElementById("pool").textContent = current.pool_busy + " / " + current.pool_size +
+		(current.pool_waiting ? " (+" + current.pool_waiting + " waiting)" : "");
+	document.getElementById("poolbar").style.width = (100 * current.pool_busy / current.pool_size) + "%";
+
+	var codes = document.getElementById("codes");
+	codes.innerHTML = "<tr><th>Code</th><th>Last interval</th><th>Total</th></tr>";
+	Object.keys(current.status_codes).sort().forEach(function (code) {
+		var row = codes.insertRow();
+		cell(row, code);
+		cell(row, current.status_codes[code] - (previous.status_codes[code] || 0));
+		cell(row, current.status_codes[code]);
+	});
+
+	var errors = document.getElementById("errors");
+	errors.innerHTML = "<tr><th>Time</th><th>Request</th><th>Status</th><th>Message</th></tr>";
+	current.errors.forEach(function (e) {
+		var row = errors.insertRow();
+		cell(row, new Date(e.time).toLocaleTimeString());
+		cell(row, e.method + " " + e.path);
+		cell(row, e.status);
+		cell(row, e.message);
+	});
+}
+
+function poll() {
+	var headers = token ? {"Authorization": "Bearer " + token} : {};
+	fetch("/admin/dashboard/stats", {headers: headers}).then(function (response) {
+		if (!response.ok) throw new Error("stats returned " + response.status);
+		return response.json();
+	}).then(function (current) {
+		document.getElementById("status").textContent = "";
+		if (previous) render(current);
+		previous = current;
+	}).catch(function (err) {
+		document.getElementById("status").textContent = err.message;
+	});
+}
+
+poll();
+setInterval(poll, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	RequestDeadlineHeader = "X-Request-Deadline"
+)
+
+// setDeadlineHint tells PHP when the proxy stops waiting for the response, so it can bail out early.
+// The value is Unix time in seconds with milliseconds (comparable with PHP microtime(true)) and it's passed
+// as HTTP_X_REQUEST_DEADLINE param. An earlier deadline sent by the client or upstream proxy is kept -
+// it can only shorten the time PHP spends on its own request.
+func setDeadlineHint(request *http.Request, deadline time.Time) {
+	if upstream, err := strconv.ParseFloat(request.Header.Get(RequestDeadlineHeader), 64); err == nil {
+		upstreamDeadline := time.UnixMilli(int64(upstream * 1000))
+		if upstreamDeadline.Before(deadline) {
+			deadline = upstreamDeadline
+		}
+	}
+	request.Header.Set(RequestDeadlineHeader, strconv.FormatFloat(float64(deadline.UnixMilli())/1000, 'f', 3, 64))
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DoctorPass = "PASS"
+	DoctorWarn = "WARN"
+	DoctorFail = "FAIL"
+	DoctorSkip = "SKIP"
+)
+
+// DoctorCheck is the result of one self-test, hint explains how to fix a failure
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// Doctor runs startup self-tests against the configuration without starting the server
+type Doctor struct {
+	checks []DoctorCheck
+
+	config *Config
+	logger *log.Logger
+}
+
+func NewDoctor(config *Config, logger *log.Logger) *Doctor {
+	return &Doctor{
+		config: config,
+		logger: logger,
+	}
+}
+
+func (d *Doctor) report(name string, status string, detail string, hint string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: status, Detail: detail, Hint: hint})
+}
+
+// Run runs all checks, checks depending on a failed one are skipped
+func (d *Doctor) Run() []DoctorCheck {
+	d.checks = nil
+
+	if err := d.config.Validate(); err != nil {
+		d.report("config", DoctorFail, err.Error(), "fix the flag, see gophpfpm --help")
+		return d.checks
+	}
+	d.report("config", DoctorPass, "flags are valid", "")
+
+	d.checkClock()
+	d.checkFileLimit()
+	d.checkPorts()
+	d.checkStaticFolders()
+
+	fCgiClient := d.checkSocket()
+	if fCgiClient == nil {
+		d.report("fcgi handshake", DoctorSkip, "socket is not reachable", "")
+		d.report("index file", DoctorSkip, "socket is not reachable", "")
+		return d.checks
+	}
+	defer fCgiClient.Close()
+
+	if !d.checkHandshake(fCgiClient) {
+		d.report("index file", DoctorSkip, "FastCGI handshake failed", "")
+		return d.checks
+	}
+	d.checkIndexFile(fCgiClient)
+
+	return d.checks
+}
+
+// checkClock detects wall clocks which were obviously never synchronized
+func (d *Doctor) checkClock() {
+	now := time.Now()
+	minimum := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if now.Before(minimum) {
+		d.report("clock", DoctorFail, fmt.Sprintf("system time is %s", now.Format(time.RFC3339)),
+			"synchronize the clock (NTP), cache expiration, cookies and TLS certificates depend on it")
+		return
+	}
+	d.report("clock", DoctorPass, fmt.Sprintf("system time is %s", now.Format(time.RFC3339)), "")
+}
+
+// checkFileLimit verifies there are enough file descriptors for FPM connections and clients
+func (d *Doctor) checkFileLimit() {
+	limit, err := openFilesLimit()
+	if err != nil {
+		d.report("fd limit", DoctorSkip, err.Error(), "")
+		return
+	}
+
+	// every FPM connection, listener and a reasonable number of client connections needs a descriptor
+	required := uint64(d.config.FpmPoolSize) + 64
+	detail := fmt.Sprintf("open files limit %d, FPM pool size %d", limit, d.config.FpmPoolSize)
+	if limit < required {
+		d.report("fd limit", DoctorFail, detail,
+			fmt.Sprintf("raise the limit to at least %d (ulimit -n, LimitNOFILE in systemd) or lower --%s", required, FpmPoolSize))
+		return
+	}
+	if limit < required*4 {
+		d.report("fd limit", DoctorWarn, detail, "the limit leaves little room for client connections, consider raising it (ulimit -n)")
+		return
+	}
+	d.report("fd limit", DoctorPass, detail, "")
+}
+
+// checkPorts verifies listening ports and unix sockets are free
+func (d *Doctor) checkPorts() {
+	listeners := append([]Listener{}, d.config.Listeners...)
+	if d.config.AdminPort > 0 {
+		listeners = append(listeners, Listener{Network: "tcp", Address: d.config.AdminAddress()})
+	}
+	for _, listener := range listeners {
+		if listener.Network == "unix" {
+			d.checkListenSocket(listener.Address)
+			continue
+		}
+		l, err := net.Listen("tcp", listener.Address)
+		if err != nil {
+			d.report("port "+listener.Address, DoctorFail, err.Error(),
+				"stop the process using the port (ss -ltnp) or choose another port")
+			continue
+		}
+		_ = l.Close()
+		d.report("port "+listener.Address, DoctorPass, "available", "")
+	}
+}
+
+// checkListenSocket verifies the socket isn't used and its directory is writable
+func (d *Doctor) checkListenSocket(path string) {
+	name := "socket " + path
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			d.report(name, DoctorFail, "the path exists and is not a unix socket", "choose another path for the socket")
+			return
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = conn.Close()
+			d.report(name, DoctorFail, "another process listens on the socket", "stop the process using the socket or choose another path")
+			return
+		}
+	}
+	probe, err := os.CreateTemp(filepath.Dir(path), ".gophpfpm-doctor-*")
+	if err != nil {
+		d.report(name, DoctorFail, err.Error(), "create the directory and allow the proxy user to write to it")
+		return
+	}
+	_ = probe.Close()
+	_ = os.Remove(probe.Name())
+	d.report(name, DoctorPass, "available", "")
+}
+
+// checkStaticFolders verifies static mounts exist and are readable
+func (d *Doctor) checkStaticFolders() {
+	for _, staticFolder := range d.config.StaticFolders {
+		name := "static " + staticFolder
+		parts := strings.Split(staticFolder, ":")
+		if len(parts) != 2 {
+			d.report(name, DoctorFail, "invalid static folder definition", "use folder:prefix, e.g. ./public:/assets")
+			continue
+		}
+		info, err := os.Stat(parts[0])
+		if err != nil {
+			d.report(name, DoctorFail, err.Error(), "create the folder or fix the path, relative paths are resolved from the working directory")
+			continue
+		}
+		if !info.IsDir() {
+			d.report(name, DoctorFail, fmt.Sprintf("%s is not a directory", parts[0]), "static mount must point to a directory")
+			continue
+		}
+		folder, err := os.Open(parts[0])
+		if err == nil {
+			_, err = folder.Readdirnames(1)
+			_ = folder.Close()
+		}
+		if err != nil && err != io.EOF {
+			d.report(name, DoctorFail, err.Error(), "grant the proxy user read and execute permission on the folder")
+			continue
+		}
+		d.report(name, DoctorPass, "readable", "")
+	}
+}
+
+// checkSocket connects to FPM, the returned client has a single connection
+func (d *Doctor) checkSocket() *FCgiClient {
+	network, target := d.config.FpmNetwork()
+	if d.config.SshHost != "" {
+		target = fmt.Sprintf("%s via ssh %s", target, d.config.SshHost)
+	} else if network == "tcp" {
+		target = "tcp " + target // the address is checked by connecting
+	} else if info, err := os.Stat(d.config.Socket); err != nil {
+		d.report("socket", DoctorFail, err.Error(), "start PHP-FPM and check its listen directive matches --"+ParamSocket)
+		return nil
+	} else if info.Mode()&os.ModeSocket == 0 {
+		d.report("socket", DoctorFail, fmt.Sprintf("%s is not a unix socket", d.config.Socket), "point --"+ParamSocket+" to the FPM pool listen socket")
+		return nil
+	}
+
+	config := *d.config
+	config.FpmPoolSize = 1
+	config.FpmPoolAuto = false
+	config.FpmWait = 0
+	config.FpmReservedConnections = 0
+	fCgiClient, err := NewFCgiClient(&config, NewMonitor(d.logger), d.logger)
+	if err != nil {
+		hint := "check FPM is running and the proxy user may connect (listen.owner, listen.group, listen.mode in the pool config)"
+		if network == "tcp" {
+			hint = "check FPM listens on the address and allows the proxy (listen, listen.allowed_clients in the pool config)"
+		}
+		d.report("socket", DoctorFail, err.Error(), hint)
+		return nil
+	}
+	d.report("socket", DoctorPass, fmt.Sprintf("connected to %s", target), "")
+	return fCgiClient
+}
+
+// checkHandshake asks FPM for its limits with FCGI_GET_VALUES
+func (d *Doctor) checkHandshake(fCgiClient *FCgiClient) bool {
+	values, err := fCgiClient.GetValues(FCGI_MAX_CONNS, FCGI_MAX_REQS, FCGI_MPXS_CONNS)
+	if err != nil {
+		d.report("fcgi handshake", DoctorFail, err.Error(), "the socket doesn't speak FastCGI, make sure it belongs to PHP-FPM")
+		return false
+	}
+
+	detail := fmt.Sprintf("%s=%s %s=%s %s=%s", FCGI_MAX_CONNS, values[FCGI_MAX_CONNS], FCGI_MAX_REQS, values[FCGI_MAX_REQS], FCGI_MPXS_CONNS, values[FCGI_MPXS_CONNS])
+	if maxConns, err := strconv.Atoi(values[FCGI_MAX_CONNS]); err == nil && maxConns > 0 && maxConns < d.config.FpmPoolSize {
+		d.report("fcgi handshake", DoctorWarn, detail,
+			fmt.Sprintf("FPM accepts %d connections but --%s is %d, raise pm.max_children or lower the pool size", maxConns, FpmPoolSize, d.config.FpmPoolSize))
+		return true
+	}
+	d.report("fcgi handshake", DoctorPass, detail, "")
+	return true
+}
+
+// checkIndexFile executes the index file with the preflight uri
+func (d *Doctor) checkIndexFile(fCgiClient *FCgiClient) {
+	name := "index file"
+	paramsBuilder, err := NewParamsBuilder(d.config)
+	if err != nil {
+		d.report(name, DoctorFail, err.Error(), "")
+		return
+	}
+	priorities, err := NewPriorityClasses(d.config)
+	if err != nil {
+		d.report(name, DoctorFail, err.Error(), "")
+		return
+	}
+	monitor := NewMonitor(d.logger)
+	fpmClient := NewFpmClient(fCgiClient, paramsBuilder, priorities, NewExchangeDumper(d.config, d.logger), d.config, monitor, d.logger)
+
+	request, err := http.NewRequest(http.MethodGet, d.config.PreflightUri, nil)
+	if err != nil {
+		d.report(name, DoctorFail, fmt.Sprintf("invalid uri: %s", err), "fix --"+PreflightUri)
+		return
+	}
+	request.Host = "localhost"
+	params := paramsBuilder.Build(request, 0, map[string]string{"GOPHPFPM_PREFLIGHT": "1"})
+
+	type result struct {
+		response *ResponseData
+		err      error
+	}
+	results := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		response, err := fpmClient.Execute(fpmClient.NewRequest(params, nil))
+		results <- result{response, err}
+	}()
+
+	var fpm result
+	select {
+	case fpm = <-results:
+	case <-time.After(d.config.Timeout):
+		d.report(name, DoctorFail, fmt.Sprintf("no response within %s", d.config.Timeout),
+			"the script hangs or all FPM workers are busy, check the FPM slow log")
+		return
+	}
+	if fpm.err != nil {
+		d.report(name, DoctorFail, fpm.err.Error(), "check the FPM error log")
+		return
+	}
+
+	detail := fmt.Sprintf("%s %s responded %d in %s", d.config.IndexFile, d.config.PreflightUri, fpm.response.Status, time.Since(start).Round(time.Millisecond))
+	// FPM answers "File not found." when the script doesn't exist (Primary script unknown)
+	if fpm.response.Status == http.StatusNotFound && strings.HasPrefix(string(fpm.response.Body), "File not found.") {
+		d.report(name, DoctorFail, detail,
+			"FPM can't find the script, --"+ParamIndex+" must be the path as seen by FPM (containers, chroot)")
+		return
+	}
+	if fpm.response.Status >= http.StatusInternalServerError {
+		d.report(name, DoctorFail, detail, "the script fails, check the PHP error log")
+		return
+	}
+	d.report(name, DoctorPass, detail, "")
+}
+
+// NewDoctorCommand creates command printing self-test report, it exits with status 1 when any check fails
+func NewDoctorCommand(logger *log.Logger) *cobra.Command {
+	return &cobra.Command{
+		Use:   "doctor",
+		Short: "Run startup self-tests",
+		Long:  `Check the configuration, FPM socket, FastCGI handshake, index file execution, static mounts, ports, file descriptor limits and the clock, and print a report with hints how to fix failures.`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := LoadConfig(cmd.Flags(), logger)
+			if err != nil {
+				logger.Fatalf("could not load config: %s", err)
+			}
+			// connection errors are part of the report
+			logger.SetLevel(log.FatalLevel)
+
+			checks := NewDoctor(config, logger).Run()
+
+			if failed := printDoctorReport(checks); failed > 0 {
+				fmt.Printf("\n%d check(s) failed\n", failed)
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+// printDoctorReport prints checks as a table with hints and returns number of failed checks
+func printDoctorReport(checks []DoctorCheck) int {
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "STATUS\tCHECK\tDETAIL")
+	for _, check := range checks {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", check.Status, check.Name, check.Detail)
+		if check.Hint != "" {
+			_, _ = fmt.Fprintf(w, "\t\t-> %s\n", check.Hint)
+		}
+		if check.Status == DoctorFail {
+			failed++
+		}
+	}
+	_ = w.Flush()
+	return failed
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// openFilesLimit returns soft limit of open file descriptors
+func openFilesLimit() (uint64, error) {
+	return 0, errors.New("open files limit can't be checked on this platform")
+}
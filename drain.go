@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DrainTracker counts requests in progress and reports progress of the graceful shutdown.
+// Deployment tooling can wait until no request is in flight instead of sleeping for a fixed time.
+type DrainTracker struct {
+	inFlight atomic.Int64
+	deadline atomic.Int64 // end of the drain window in unix nanoseconds, zero while serving
+
+	config  *Config
+	monitor *Monitor
+}
+
+// DrainStatus is the shutdown progress returned by /admin/drain
+type DrainStatus struct {
+	Draining         bool    `json:"draining"`
+	InFlight         int64   `json:"in_flight"`
+	RemainingSeconds float64 `json:"remaining_seconds"`
+}
+
+func NewDrainTracker(config *Config, monitor *Monitor) *DrainTracker {
+	return &DrainTracker{
+		config:  config,
+		monitor: monitor,
+	}
+}
+
+// Middleware counts requests in flight, it wraps all handlers so static files and metrics are counted too
+func (dt *DrainTracker) Middleware(next http.Handler) http.Handler {
+	gauge := dt.monitor.InFlightRequestsGauge.WithLabelValues(dt.config.App)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dt.inFlight.Add(1)
+		gauge.Inc()
+		defer func() {
+			dt.inFlight.Add(-1)
+			gauge.Dec()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Begin marks start of the drain window, requests in flight have the given time to finish
+func (dt *DrainTracker) Begin(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	dt.deadline.Store(deadline.UnixNano())
+	dt.monitor.DrainDeadlineGauge.WithLabelValues(dt.config.App).Set(float64(deadline.UnixNano()) / float64(time.Second))
+}
+
+// InFlight returns number of requests in progress
+func (dt *DrainTracker) InFlight() int64 {
+	return dt.inFlight.Load()
+}
+
+func (dt *DrainTracker) Status() DrainStatus {
+	status := DrainStatus{InFlight: dt.inFlight.Load()}
+	deadline := dt.deadline.Load()
+	if deadline == 0 {
+		return status
+	}
+	status.Draining = true
+	if remaining := time.Until(time.Unix(0, deadline)); remaining > 0 {
+		status.RemainingSeconds = remaining.Seconds()
+	}
+	return status
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorResponse is the body of errors generated by the proxy itself for JSON clients
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	RequestId string `json:"request_id"`
+}
+
+// StatusClientClosedRequest is logged when the client disconnects before the response (nginx convention)
+const StatusClientClosedRequest = 499
+
+var (
+	errorCodes = map[int]string{
+		http.StatusBadRequest:            "bad_request",
+		http.StatusForbidden:             "forbidden",
+		http.StatusNotFound:              "not_found",
+		http.StatusRequestTimeout:        "request_timeout",
+		http.StatusRequestEntityTooLarge: "payload_too_large",
+		http.StatusUnsupportedMediaType:  "unsupported_media_type",
+		http.StatusTooManyRequests:       "too_many_requests",
+		http.StatusInternalServerError:   "internal_error",
+		http.StatusBadGateway:            "bad_gateway",
+		http.StatusServiceUnavailable:    "service_unavailable",
+		http.StatusGatewayTimeout:        "gateway_timeout",
+		StatusClientClosedRequest:        "client_closed_request",
+	}
+)
+
+// writeErrorBody writes error page in format preferred by the client - JSON for API clients, HTML otherwise
+func writeErrorBody(writer http.ResponseWriter, request *http.Request, status int) error {
+	requestId := request.Header.Get(RequestIdHeader)
+
+	var body []byte
+	if prefersJson(request.Header.Get("Accept")) {
+		writer.Header().Set("Content-Type", "application/json")
+		encoded, err := json.Marshal(ErrorResponse{
+			Error:     errorCode(status),
+			RequestId: requestId,
+		})
+		if err != nil {
+			return err
+		}
+		body = append(encoded, '\n')
+	} else {
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		title := html.EscapeString(fmt.Sprintf("%d %s", status, http.StatusText(status)))
+		body = []byte(fmt.Sprintf(
+			"<!DOCTYPE html>\n<html><head><title>%s</title></head><body><h1>%s</h1><p>Request ID: %s</p></body></html>\n",
+			title, title, html.EscapeString(requestId),
+		))
+	}
+
+	writer.Header().Del("Content-Encoding")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(status)
+	_, err := writer.Write(body)
+	return err
+}
+
+// writeStaticBody writes configured error body, its content type is detected from the content
+func writeStaticBody(writer http.ResponseWriter, status int, body []byte) error {
+	writer.Header().Set("Content-Type", http.DetectContentType(body))
+	writer.Header().Del("Content-Encoding")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(status)
+	_, err := writer.Write(body)
+	return err
+}
+
+// errorCode returns machine-readable code of the status, e.g. "gateway_timeout"
+func errorCode(status int) string {
+	if code, found := errorCodes[status]; found {
+		return code
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// prefersJson reports whether the client prefers JSON over HTML according to Accept header
+func prefersJson(accept string) bool {
+	jsonQ := 0.0
+	htmlQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(part, ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+		q := 1.0
+		if key, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(key) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+
+		switch {
+		case mediaRange == "application/json" || strings.HasSuffix(mediaRange, "+json"):
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case mediaRange == "text/html" || mediaRange == "text/*" || mediaRange == "*/*":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		}
+	}
+	return jsonQ > 0 && jsonQ >= htmlQ
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// setEtag adds strong ETag computed over the final (possibly compressed) body of successful responses to GET
+// requests, responses with their own ETag, cookies or no-store are left untouched. PHP-FPM sends no body
+// to HEAD requests, so their ETag would not match the one of GET.
+func setEtag(request *http.Request, response *ResponseData, maxSize int) {
+	if request.Method != http.MethodGet {
+		return
+	}
+	headers := http.Header(response.Headers)
+	if response.Status != http.StatusOK || len(response.Body) > maxSize || headers.Get("ETag") != "" {
+		return
+	}
+	if len(headers.Values("Set-Cookie")) > 0 || strings.Contains(strings.ToLower(headers.Get("Cache-Control")), "no-store") {
+		return
+	}
+
+	sum := sha256.Sum256(response.Body)
+	headers.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+}
+
+// notModified reports whether If-None-Match of GET or HEAD request matches ETag of the successful response
+// (weak comparison, RFC 9110 section 13.1.2), preconditions of other responses are ignored
+func notModified(request *http.Request, response *ResponseData) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	if response.Status < 200 || response.Status > 299 {
+		return false
+	}
+	ifNoneMatch := strings.TrimSpace(request.Header.Get("If-None-Match"))
+	if ifNoneMatch == "*" {
+		return true // the representation exists
+	}
+	etag := strings.TrimPrefix(http.Header(response.Headers).Get("ETag"), "W/")
+	if etag == "" || ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range entityTags(ifNoneMatch) {
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// entityTags splits the list of entity tags, commas inside of quoted tags don't separate them
+func entityTags(list string) []string {
+	var tags []string
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		weak := strings.HasPrefix(list, "W/")
+		start := 0
+		if weak {
+			start = 2
+		}
+		if !strings.HasPrefix(list[start:], `"`) {
+			// not quoted, invalid tag up to the next comma
+			tag, rest, _ := strings.Cut(list, ",")
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+			list = rest
+			continue
+		}
+		end := strings.IndexByte(list[start+1:], '"')
+		if end < 0 {
+			tags = append(tags, strings.TrimSpace(list))
+			break
+		}
+		end += start + 2
+		tags = append(tags, list[:end])
+		list = list[end:]
+	}
+	return tags
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEntityTags(t *testing.T) {
+	cases := map[string][]string{
+		`"a"`:                  {`"a"`},
+		`"a", "b"`:             {`"a"`, `"b"`},
+		`"a","b" ,W/"c"`:       {`"a"`, `"b"`, `W/"c"`},
+		`"a,b", "c"`:           {`"a,b"`, `"c"`},
+		`W/"a, b"`:             {`W/"a, b"`},
+		`abc, "d"`:             {`abc`, `"d"`},
+		`"unterminated, "x"`:   {`"unterminated, "`, `x"`},
+		` , "a" ,, `:           {`"a"`},
+		``:                     nil,
+		`"a" "b"`:              {`"a"`, `"b"`},
+		`W/`:                   {`W/`},
+		`"only-one-quote`:      {`"only-one-quote`},
+		`W/"weak", "strong"`:   {`W/"weak"`, `"strong"`},
+		`"x", *`:               {`"x"`, `*`},
+		`"with space inside" `: {`"with space inside"`},
+	}
+	for list, want := range cases {
+		if got := entityTags(list); !reflect.DeepEqual(got, want) {
+			t.Errorf("entityTags(%q) = %q, want %q", list, got, want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	cases := []struct {
+		name        string
+		method      string
+		status      int
+		etag        string
+		ifNoneMatch string
+		want        bool
+	}{
+		{name: "strong match", etag: `"abc"`, ifNoneMatch: `"abc"`, want: true},
+		{name: "no match", etag: `"abc"`, ifNoneMatch: `"abd"`},
+		{name: "without If-None-Match", etag: `"abc"`},
+		{name: "without ETag", ifNoneMatch: `"abc"`},
+		{name: "weak request tag", etag: `"abc"`, ifNoneMatch: `W/"abc"`, want: true},
+		{name: "weak response tag", etag: `W/"abc"`, ifNoneMatch: `"abc"`, want: true},
+		{name: "both weak", etag: `W/"abc"`, ifNoneMatch: `W/"abc"`, want: true},
+		{name: "unquoted tag", etag: `"abc"`, ifNoneMatch: `abc`},
+		{name: "case sensitive", etag: `"abc"`, ifNoneMatch: `"ABC"`},
+		{name: "list", etag: `"b"`, ifNoneMatch: `"a", W/"b", "c"`, want: true},
+		{name: "list without match", etag: `"d"`, ifNoneMatch: `"a", W/"b", "c"`},
+		{name: "comma in tag", etag: `"a,b"`, ifNoneMatch: `"x", "a,b"`, want: true},
+		{name: "part of tag with comma", etag: `"b"`, ifNoneMatch: `"a,b"`},
+		{name: "star", etag: `"abc"`, ifNoneMatch: `*`, want: true},
+		{name: "star without ETag", ifNoneMatch: `*`, want: true},
+		{name: "star in list is not star", etag: `"abc"`, ifNoneMatch: `"x", *`},
+		{name: "head", method: http.MethodHead, etag: `"abc"`, ifNoneMatch: `"abc"`, want: true},
+		{name: "post", method: http.MethodPost, etag: `"abc"`, ifNoneMatch: `"abc"`},
+		{name: "put with star", method: http.MethodPut, etag: `"abc"`, ifNoneMatch: `*`},
+		{name: "created", status: http.StatusCreated, etag: `"abc"`, ifNoneMatch: `"abc"`, want: true},
+		{name: "partial content", status: http.StatusPartialContent, etag: `"abc"`, ifNoneMatch: `"abc"`, want: true},
+		{name: "redirect", status: http.StatusFound, etag: `"abc"`, ifNoneMatch: `"abc"`},
+		{name: "not found", status: http.StatusNotFound, etag: `"abc"`, ifNoneMatch: `"abc"`},
+		{name: "not found with star", status: http.StatusNotFound, ifNoneMatch: `*`},
+		{name: "server error", status: http.StatusInternalServerError, etag: `"abc"`, ifNoneMatch: `"abc"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			method := c.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			status := c.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			request := httptest.NewRequest(method, "/", nil)
+			if c.ifNoneMatch != "" {
+				request.Header.Set("If-None-Match", c.ifNoneMatch)
+			}
+			response := &ResponseData{Status: status, Headers: map[string][]string{}}
+			if c.etag != "" {
+				response.Headers["Etag"] = []string{c.etag}
+			}
+			if got := notModified(request, response); got != c.want {
+				t.Errorf("notModified = %t, want %t", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSetEtag(t *testing.T) {
+	cases := []struct {
+		name    string
+		method  string
+		status  int
+		headers map[string][]string
+		size    int
+		want    bool
+	}{
+		{name: "generated", size: 100, want: true},
+		{name: "empty body", size: 0, want: true},
+		{name: "max size", size: 1000, want: true},
+		{name: "above max size", size: 1001},
+		{name: "head", method: http.MethodHead, size: 0},
+		{name: "post", method: http.MethodPost, size: 100},
+		{name: "created", status: http.StatusCreated, size: 100},
+		{name: "not found", status: http.StatusNotFound, size: 100},
+		{name: "own etag", headers: map[string][]string{"Etag": {`W/"php"`}}, size: 100},
+		{name: "cookie", headers: map[string][]string{"Set-Cookie": {"session=1"}}, size: 100},
+		{name: "no-store", headers: map[string][]string{"Cache-Control": {"private, No-Store"}}, size: 100},
+		{name: "no-cache", headers: map[string][]string{"Cache-Control": {"no-cache"}}, size: 100, want: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			method := c.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			status := c.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			headers := map[string][]string{}
+			for name, values := range c.headers {
+				headers[name] = values
+			}
+			ownEtag := http.Header(headers).Get("ETag")
+			response := &ResponseData{Status: status, Headers: headers, Body: []byte(strings.Repeat("a", c.size))}
+
+			setEtag(httptest.NewRequest(method, "/", nil), response, 1000)
+			etag := http.Header(response.Headers).Get("ETag")
+			if generated := etag != ownEtag; generated != c.want {
+				t.Errorf("ETag %q generated %t, want %t", etag, generated, c.want)
+			}
+			if c.want && (!strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) != 34) {
+				t.Errorf("ETag %q is not a strong tag of 32 hex characters", etag)
+			}
+		})
+	}
+
+	first := &ResponseData{Status: http.StatusOK, Headers: map[string][]string{}, Body: []byte("a")}
+	second := &ResponseData{Status: http.StatusOK, Headers: map[string][]string{}, Body: []byte("b")}
+	setEtag(httptest.NewRequest(http.MethodGet, "/", nil), first, 1000)
+	setEtag(httptest.NewRequest(http.MethodGet, "/", nil), second, 1000)
+	if http.Header(first.Headers).Get("ETag") == http.Header(second.Headers).Get("ETag") {
+		t.Errorf("different bodies have the same ETag")
+	}
+}
+
+// etagFpm answers by REQUEST_URI: /large has body over --etag-max-size, /php sets its own ETag, /missing is 404
+func etagFpm(w *mockFpmWriter, request mockFpmRequest) {
+	head := "Content-Type: text/plain\r\n"
+	body := "hello"
+	switch request.params["REQUEST_URI"] {
+	case "/large":
+		body = strings.Repeat("a", 2048)
+	case "/php":
+		head += "ETag: W/\"v1\"\r\n"
+	case "/missing":
+		head += "Status: 404 Not Found\r\n"
+	}
+	w.Stdout(head + "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+	w.End(0, FCGI_REQUEST_COMPLETE)
+}
+
+func TestEtagServer(t *testing.T) {
+	server := newTestServer(t, startMockFpm(t, etagFpm), "--"+Etag, "--"+EtagMaxSize, "1024")
+
+	get := func(method string, path string, ifNoneMatch string) (*http.Response, string) {
+		t.Helper()
+		request, _ := http.NewRequest(method, server.URL+path, nil)
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response, string(body)
+	}
+
+	response, body := get(http.MethodGet, "/", "")
+	etag := response.Header.Get("ETag")
+	if response.StatusCode != http.StatusOK || body != "hello" || etag == "" {
+		t.Fatalf("first response %d %q with ETag %q", response.StatusCode, body, etag)
+	}
+
+	cases := []struct {
+		name        string
+		method      string
+		path        string
+		ifNoneMatch string
+		status      int
+		etag        string // expected ETag, "-" means none
+	}{
+		{name: "match", method: http.MethodGet, path: "/", ifNoneMatch: etag, status: 304, etag: etag},
+		{name: "weak match", method: http.MethodGet, path: "/", ifNoneMatch: "W/" + etag, status: 304, etag: etag},
+		{name: "list", method: http.MethodGet, path: "/", ifNoneMatch: `"old", ` + etag, status: 304, etag: etag},
+		{name: "star", method: http.MethodGet, path: "/", ifNoneMatch: "*", status: 304, etag: etag},
+		{name: "changed", method: http.MethodGet, path: "/", ifNoneMatch: `"old"`, status: 200, etag: etag},
+		{name: "head with php etag", method: http.MethodHead, path: "/php", ifNoneMatch: `"v1"`, status: 304, etag: `W/"v1"`},
+		{name: "head without php etag", method: http.MethodHead, path: "/", ifNoneMatch: etag, status: 200, etag: "-"},
+		{name: "php etag", method: http.MethodGet, path: "/php", ifNoneMatch: `W/"v1"`, status: 304, etag: `W/"v1"`},
+		{name: "post", method: http.MethodPost, path: "/", ifNoneMatch: etag, status: 200, etag: "-"},
+		{name: "not found", method: http.MethodGet, path: "/missing", ifNoneMatch: "*", status: 404, etag: "-"},
+		{name: "above max size", method: http.MethodGet, path: "/large", ifNoneMatch: "*", status: 304, etag: "-"},
+		{name: "above max size without star", method: http.MethodGet, path: "/large", ifNoneMatch: etag, status: 200, etag: "-"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response, body := get(c.method, c.path, c.ifNoneMatch)
+			if response.StatusCode != c.status {
+				t.Errorf("status = %d, want %d", response.StatusCode, c.status)
+			}
+			if got := response.Header.Get("ETag"); (c.etag == "-" && got != "") || (c.etag != "-" && got != c.etag) {
+				t.Errorf("ETag = %q, want %q", got, c.etag)
+			}
+			if c.status == http.StatusNotModified && body != "" {
+				t.Errorf("304 has body %q", body)
+			}
+		})
+	}
+}
+
+// conditionalFpm answers 304 with a body when HTTP_IF_NONE_MATCH matches, /empty answers 204 with a body
+func conditionalFpm(w *mockFpmWriter, request mockFpmRequest) {
+	status := "200 OK"
+	if request.params["REQUEST_URI"] == "/empty" {
+		status = "204 No Content"
+	} else if request.params["HTTP_IF_NONE_MATCH"] == `"v1"` {
+		status = "304 Not Modified"
+	}
+	body := "hello"
+	w.Stdout("Status: " + status + "\r\nETag: \"v1\"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+	w.End(0, FCGI_REQUEST_COMPLETE)
+}
+
+func TestPhpNotModified(t *testing.T) {
+	server := newTestServer(t, startMockFpm(t, conditionalFpm), "--"+Compression, "--"+CompressionMinSize, "0")
+
+	cases := []struct {
+		name        string
+		path        string
+		ifNoneMatch string
+		status      int
+		body        string
+	}{
+		{name: "modified", path: "/", ifNoneMatch: `"v0"`, status: http.StatusOK, body: "hello"},
+		{name: "not modified", path: "/", ifNoneMatch: `"v1"`, status: http.StatusNotModified},
+		{name: "no content", path: "/empty", status: http.StatusNoContent},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodGet, server.URL+c.path, nil)
+			if c.ifNoneMatch != "" {
+				request.Header.Set("If-None-Match", c.ifNoneMatch)
+			}
+			if c.body == "" {
+				// set explicitly, the client would decompress the body and drop the header
+				request.Header.Set("Accept-Encoding", "gzip")
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+
+			if response.StatusCode != c.status {
+				t.Errorf("status = %d, want %d", response.StatusCode, c.status)
+			}
+			if string(body) != c.body {
+				t.Errorf("body = %q, want %q", body, c.body)
+			}
+			if got := response.Header.Get("ETag"); got != `"v1"` {
+				t.Errorf("ETag = %q, want the one set by PHP", got)
+			}
+			if c.body == "" && response.Header.Get("Content-Length") != "" {
+				t.Errorf("Content-Length %q of the dropped body was relayed", response.Header.Get("Content-Length"))
+			}
+			if c.body == "" && response.Header.Get("Content-Encoding") != "" {
+				t.Errorf("response without body has Content-Encoding %q", response.Header.Get("Content-Encoding"))
+			}
+		})
+	}
+}
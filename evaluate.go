@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// EvaluateRequest describes request whose routing is evaluated without executing it
+type EvaluateRequest struct {
+	Method     string            `json:"method"`
+	Uri        string            `json:"uri"`
+	Host       string            `json:"host"`
+	RemoteAddr string            `json:"remote_addr"`
+	Headers    map[string]string `json:"headers"`
+}
+
+// Evaluation describes which handler would serve the request and how
+type Evaluation struct {
+	Handler   string            `json:"handler"`
+	Match     string            `json:"match"`
+	Target    string            `json:"target"`
+	Path      string            `json:"path"`
+	Steps     []string          `json:"steps"`
+	Priority  string            `json:"priority,omitempty"`
+	Timeout   string            `json:"timeout,omitempty"`
+	ClientKey string            `json:"client_key,omitempty"`
+	Cacheable bool              `json:"cacheable"`
+	Params    map[string]string `json:"params,omitempty"`
+}
+
+// EvaluateRoute resolves the request through the same rules as the server (base path, static mounts, metrics,
+// OPTIONS prefixes, FPM priority classes, timeouts) and computes CGI params, nothing is executed
+func EvaluateRoute(
+	config *Config,
+	paramsBuilder *ParamsBuilder,
+	priorities *PriorityClasses,
+	timeouts *TimeoutPolicy,
+	evaluateRequest EvaluateRequest,
+) (*Evaluation, error) {
+	method := evaluateRequest.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !strings.HasPrefix(evaluateRequest.Uri, "/") {
+		return nil, fmt.Errorf("uri must start with /")
+	}
+	request, err := http.NewRequest(method, evaluateRequest.Uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	request.Host = evaluateRequest.Host
+	if request.Host == "" {
+		request.Host = "localhost"
+	}
+	request.RemoteAddr = evaluateRequest.RemoteAddr
+	if request.RemoteAddr == "" {
+		request.RemoteAddr = "127.0.0.1:50000"
+	}
+	for name, value := range evaluateRequest.Headers {
+		request.Header.Set(name, value)
+	}
+
+	evaluation := &Evaluation{}
+	step := func(format string, args ...any) {
+		evaluation.Steps = append(evaluation.Steps, fmt.Sprintf(format, args...))
+	}
+
+	if config.BasePath != "" {
+		request.Header.Del(ForwardedPrefixHeader)
+		if pathHasPrefix(request.URL.Path, config.BasePath) {
+			request.URL.Path = stripBasePath(request.URL.Path, config.BasePath)
+			request.Header.Set(ForwardedPrefixHeader, config.BasePath)
+			step("base path %s stripped", config.BasePath)
+		} else {
+			step("outside of base path %s, passed unchanged", config.BasePath)
+		}
+	}
+	evaluation.Path = request.URL.Path
+
+	// router - static mounts (subtrees) and metrics, the longest pattern wins
+	bestMount := ""
+	for _, staticFolder := range config.Reloadable().StaticFolders {
+		parts := strings.Split(staticFolder, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid static folder definition: %s", staticFolder)
+		}
+		if strings.HasPrefix(request.URL.Path, parts[1]+"/") && len(parts[1]) >= len(bestMount) {
+			bestMount = parts[1]
+			evaluation.Handler = "static"
+			evaluation.Match = parts[1] + "/*"
+			evaluation.Target = path.Join(parts[0], strings.TrimPrefix(request.URL.Path, parts[1]))
+		}
+		if request.URL.Path == parts[1] {
+			step("%s is redirected to %s/ by the router", parts[1], parts[1])
+		}
+	}
+	if evaluation.Handler != "" {
+		step("served from static folder")
+		return evaluation, nil
+	}
+	if request.URL.Path == "/metrics" {
+		evaluation.Handler = "metrics"
+		evaluation.Match = "/metrics"
+		evaluation.Target = "prometheus"
+		return evaluation, nil
+	}
+
+	if request.Method == http.MethodOptions {
+		if prefix, found := matchPrefix(request.URL.Path, config.OptionsPrefixes); found {
+			evaluation.Handler = "options"
+			evaluation.Match = "OPTIONS " + prefix
+			evaluation.Target = "proxy"
+			step("answered by the proxy with Allow: %s", config.OptionsAllow)
+			return evaluation, nil
+		}
+	}
+
+	evaluation.Handler = "fpm"
+	evaluation.Target = config.IndexFile
+	evaluation.Match = "/*"
+	if prefix, found := matchPrefix(request.URL.Path, priorities.prefixes); found {
+		evaluation.Match = prefix
+	}
+	if _, found := matchPrefix(request.URL.Path, config.CsrfPrefixes); found && !isSafeMethod(request.Method) {
+		step("CSRF token required (cookie %s repeated in header %s or field %s)", config.CsrfCookie, config.CsrfHeader, config.CsrfField)
+	}
+	if _, found := matchPrefix(request.URL.Path, config.IdempotencyPrefixes); found && request.Method == http.MethodPost {
+		step("%s header honored, responses replayed for %s", IdempotencyKeyHeader, config.IdempotencyTtl)
+	}
+	evaluation.Priority = priorities.Resolve(request.URL.Path).String()
+	timeout := timeouts.Resolve(request.Method, request.URL.Path)
+	evaluation.Timeout = timeout.Timeout.String()
+	step("timeout %s (%s route %s)", timeout.Timeout, timeout.Source, timeout.Route)
+	evaluation.ClientKey = fairQueueKey(request, config.FairQueueKey)
+	evaluation.Cacheable = (config.Cache || config.NegativeCacheTtl > 0) && cacheableRequest(request)
+	evaluation.Params = paramsBuilder.Build(request, 0, nil)
+
+	return evaluation, nil
+}
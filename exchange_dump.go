@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Exchange is a complete FastCGI exchange recorded for debugging.
+// Binary data (stdin, stdout, stderr) is base64 encoded in JSON.
+type Exchange struct {
+	Time      time.Time         `json:"time"`
+	RequestId string            `json:"request_id"`
+	Params    map[string]string `json:"params"`
+	Stdin     []byte            `json:"stdin"`
+	Stdout    []byte            `json:"stdout"`
+	Stderr    []byte            `json:"stderr"`
+}
+
+func NewExchange(requestId string) *Exchange {
+	return &Exchange{
+		Time:      time.Now(),
+		RequestId: requestId,
+	}
+}
+
+// Record stores data of the exchange, the last attempt wins when the request is retried
+func (e *Exchange) Record(params map[string]string, stdin []byte, stdout []byte, stderr []byte) {
+	e.Params = params
+	e.Stdin = stdin
+	e.Stdout = stdout
+	e.Stderr = stderr
+}
+
+// LoadExchange reads exchange previously written by ExchangeDumper
+func LoadExchange(path string) (*Exchange, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read exchange file: %w", err)
+	}
+
+	var exchange Exchange
+	if err := json.Unmarshal(data, &exchange); err != nil {
+		return nil, fmt.Errorf("could not parse exchange file: %w", err)
+	}
+
+	return &exchange, nil
+}
+
+// ExchangeDumper writes FastCGI exchanges of matching requests to disk,
+// so "works in curl, breaks via proxy" bugs can be reproduced with replay command
+type ExchangeDumper struct {
+	config *Config
+	logger *logrus.Logger
+}
+
+func NewExchangeDumper(config *Config, logger *logrus.Logger) *ExchangeDumper {
+	return &ExchangeDumper{
+		config: config,
+		logger: logger,
+	}
+}
+
+// Matches reports whether the request exchange should be recorded
+func (d *ExchangeDumper) Matches(request *http.Request) bool {
+	if d.config.DumpDir == "" {
+		return false
+	}
+	if len(d.config.DumpPrefixes) == 0 {
+		return true
+	}
+	_, found := matchPrefix(request.URL.Path, d.config.DumpPrefixes)
+	return found
+}
+
+// Write saves the exchange as JSON file to the dump directory
+func (d *ExchangeDumper) Write(exchange *Exchange) {
+	if exchange.Params == nil {
+		return // request didn't reach FPM
+	}
+
+	data, err := json.MarshalIndent(exchange, "", "  ")
+	if err != nil {
+		d.logger.Errorf("could not encode exchange: %s", err)
+		return
+	}
+
+	name := fmt.Sprintf("%d-%s.json", exchange.Time.UnixNano(), exchange.RequestId)
+	path := filepath.Join(d.config.DumpDir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		d.logger.Errorf("could not write exchange dump: %s", err)
+		return
+	}
+
+	d.logger.Debugf("exchange dumped to %s", path)
+}
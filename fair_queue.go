@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	FairQueueKeyIp     = "ip"
+	FairQueueKeyHeader = "header:"
+)
+
+// fairQueue is a queue of waiting requests grouped by client key.
+// Released connections are handed to clients in round-robin order, so a single client
+// flooding the proxy can't monopolize the FPM pool. Without keys it behaves like FIFO.
+type fairQueue struct {
+	keys    []string // round-robin order of clients with waiting requests
+	waiters map[string][]chan *FCgiConnection
+	size    int
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		waiters: map[string][]chan *FCgiConnection{},
+	}
+}
+
+func (q *fairQueue) push(key string, ch chan *FCgiConnection) {
+	if len(q.waiters[key]) == 0 {
+		q.keys = append(q.keys, key)
+	}
+	q.waiters[key] = append(q.waiters[key], ch)
+	q.size++
+}
+
+// pop returns the first waiter of the next client in round-robin order
+func (q *fairQueue) pop() (chan *FCgiConnection, bool) {
+	if len(q.keys) == 0 {
+		return nil, false
+	}
+
+	key := q.keys[0]
+	q.keys = q.keys[1:]
+	waiters := q.waiters[key]
+	ch := waiters[0]
+	if len(waiters) > 1 {
+		q.waiters[key] = waiters[1:]
+		q.keys = append(q.keys, key) // client goes to the end of the line
+	} else {
+		delete(q.waiters, key)
+	}
+	q.size--
+
+	return ch, true
+}
+
+func (q *fairQueue) remove(key string, ch chan *FCgiConnection) bool {
+	waiters := q.waiters[key]
+	for i, waiter := range waiters {
+		if waiter != ch {
+			continue
+		}
+		q.size--
+		if len(waiters) > 1 {
+			q.waiters[key] = append(waiters[:i:i], waiters[i+1:]...)
+			return true
+		}
+		delete(q.waiters, key)
+		for j, k := range q.keys {
+			if k == key {
+				q.keys = append(q.keys[:j:j], q.keys[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (q *fairQueue) len() int {
+	return q.size
+}
+
+// validateFairQueueKey checks the fair queue key configuration
+func validateFairQueueKey(key string) error {
+	if key == "" || key == FairQueueKeyIp {
+		return nil
+	}
+	if strings.HasPrefix(key, FairQueueKeyHeader) && len(key) > len(FairQueueKeyHeader) {
+		return nil
+	}
+	return fmt.Errorf("invalid fair queue key %q, use %q or %q", key, FairQueueKeyIp, FairQueueKeyHeader+"X-Api-Key")
+}
+
+// fairQueueKey returns the client key of the request used for fair queuing
+func fairQueueKey(request *http.Request, key string) string {
+	switch {
+	case key == FairQueueKeyIp:
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			return request.RemoteAddr
+		}
+		return host
+	case strings.HasPrefix(key, FairQueueKeyHeader):
+		return request.Header.Get(strings.TrimPrefix(key, FairQueueKeyHeader))
+	}
+	return "" // fair queuing disabled - all requests share one queue
+}
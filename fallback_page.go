@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fallbackPage is a static page with status it's served with
+type fallbackPage struct {
+	body        []byte
+	contentType string
+	status      int
+}
+
+// FallbackPages serve static pages per route prefix when FPM is unavailable - connection fails, the pool is
+// saturated, FPM rejects the request or the index file is missing. Clients get e.g. a cached landing page during
+// backend outage instead of an error page. Timeouts and aborted requests are not affected.
+type FallbackPages struct {
+	prefixes []string
+	pages    map[string]fallbackPage
+}
+
+func NewFallbackPages(config *Config) (*FallbackPages, error) {
+	fp := &FallbackPages{
+		pages: map[string]fallbackPage{},
+	}
+
+	for _, definition := range config.FallbackPages {
+		parts := strings.Split(definition, ":")
+		if len(parts) < 2 || len(parts) > 3 || !strings.HasPrefix(parts[1], "/") {
+			return nil, fmt.Errorf("invalid fallback page definition: %s", definition)
+		}
+		page := fallbackPage{status: http.StatusServiceUnavailable}
+		if len(parts) == 3 {
+			status, err := strconv.Atoi(parts[2])
+			if err != nil || status < 200 || status > 599 {
+				return nil, fmt.Errorf("invalid fallback page definition %s: status must be between 200 and 599", definition)
+			}
+			page.status = status
+		}
+
+		body, err := os.ReadFile(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not read fallback page: %w", err)
+		}
+		page.body = body
+		page.contentType = mime.TypeByExtension(filepath.Ext(parts[0]))
+		if page.contentType == "" {
+			page.contentType = http.DetectContentType(body)
+		}
+
+		fp.prefixes = append(fp.prefixes, parts[1])
+		fp.pages[parts[1]] = page
+	}
+
+	return fp, nil
+}
+
+// Resolve returns fallback page of the longest matching prefix
+func (fp *FallbackPages) Resolve(path string) (string, fallbackPage, bool) {
+	prefix, found := matchPrefix(path, fp.prefixes)
+	if !found {
+		return "", fallbackPage{}, false
+	}
+	return prefix, fp.pages[prefix], true
+}
+
+// fpmUnavailable reports whether the error means FPM couldn't handle the request at all
+func fpmUnavailable(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrRequestAborted),
+		errors.Is(err, ErrInformationalStatus),
+		errors.Is(err, ErrFirstByteTimeout),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, errInjectedFault):
+		return false
+	}
+	return true
+}
+
+// writeFallback writes fallback page of the route when FPM is unavailable, false means the error must be
+// handled by the caller
+func (hs *HttpServer) writeFallback(writer http.ResponseWriter, request *http.Request, err error, start time.Time) bool {
+	if !fpmUnavailable(err) {
+		return false
+	}
+	prefix, page, found := hs.fallbacks.Resolve(request.URL.Path)
+	if !found {
+		return false
+	}
+
+	hs.logger.Warnf("FPM unavailable, fallback page of %s served: %s", prefix, err)
+	hs.monitor.RecentErrors.Add(request, page.status, err.Error())
+	hs.monitor.FallbackResponsesCounter.WithLabelValues(hs.config.App, prefix).Inc()
+
+	writer.Header().Set("Content-Type", page.contentType)
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Del("Content-Encoding")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(page.body)))
+	writer.WriteHeader(page.status)
+	if _, err := writer.Write(page.body); err != nil {
+		hs.logger.Debugf("could not write fallback page: %s", err)
+	}
+	hs.observeProxyError(request, page.status, start)
+	return true
+}
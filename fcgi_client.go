@@ -4,17 +4,19 @@ package main
 // http://www.mit.edu/~yandros/doc/specs/fcgi-spec.html
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,11 +28,52 @@ const (
 	FCGI_RESPONDER = 1
 
 	FCGI_BEGIN_REQUEST = 1
+	FCGI_ABORT_REQUEST = 2
 	FCGI_END_REQUEST   = 3
 	FCGI_PARAMS        = 4
 	FCGI_STDIN         = 5
 	FCGI_STDOUT        = 6
 	FCGI_STDERR        = 7
+
+	FCGI_GET_VALUES        = 9
+	FCGI_GET_VALUES_RESULT = 10
+
+	FCGI_MAX_CONNS  = "FCGI_MAX_CONNS"
+	FCGI_MAX_REQS   = "FCGI_MAX_REQS"
+	FCGI_MPXS_CONNS = "FCGI_MPXS_CONNS"
+)
+
+// reasons of replacing healthy FPM connections, used as metrics label
+const (
+	ReconnectRecycled  = "recycled"  // closed by FPM while idle in the pool
+	ReconnectRotated   = "rotated"   // reached --fpm-conn-max-requests
+	ReconnectRetried   = "retried"   // request failed on a stale connection and was sent again
+	ReconnectUnhealthy = "unhealthy" // failed periodic health check while idle
+)
+
+const (
+	fpmDialTimeout = 5 * time.Second
+
+	fcgiAbortTimeout = time.Second // max time to write FCGI_ABORT_REQUEST
+
+	fcgiHeaderLength     = 8
+	fcgiMaxContentLength = 65535
+)
+
+var (
+	ErrFpmProtocol = errors.New("FastCGI protocol violation")
+
+	// errBodyConsumed means the streamed request body was (partially) read, so the request can't be sent again
+	errBodyConsumed = errors.New("request body was already sent")
+
+	// ErrRequestAborted means the request context was done (client disconnected, timeout) before FPM responded
+	ErrRequestAborted = errors.New("request aborted")
+
+	// ErrFirstByteTimeout means PHP didn't produce any output within --fpm-first-byte-timeout, the worker likely hangs
+	ErrFirstByteTimeout = errors.New("FPM did not respond within first byte timeout")
+
+	// recordPadding is shared by all records, padding is always zeros
+	recordPadding [7]byte
 )
 
 type FCgiRecord struct {
@@ -43,48 +86,111 @@ type FCgiRecord struct {
 }
 
 type FCgiRequest struct {
-	Params map[string]string
-	Body   []byte
+	Params    map[string]string
+	Body      []byte
+	Priority  Priority
+	ClientKey string    // key of the client for fair queuing
+	Exchange  *Exchange // records the complete exchange when set
+
+	BodyReader io.Reader // streamed body, used instead of Body by StreamRequest
+	Deadline   time.Time // deadline of the connection I/O, zero means no deadline
+
+	// FirstByteTimeout limits waiting for the first stdout once the request is sent, 0 means no limit
+	FirstByteTimeout time.Duration
+
+	// Context aborts the request when done, nil never aborts
+	Context context.Context
 
 	requestId uint16
 }
 
 type FCgiClient struct {
-	Pool chan *FCgiConnection
+	pool   *ConnectionPool
+	dial   func() (net.Conn, error)
+	tunnel *SshTunnel // nil when FPM socket is local
+
+	restartMu  sync.Mutex
+	generation int
 
-	config *Config
-	logger *log.Logger
+	config  *Config
+	monitor *Monitor
+	logger  *log.Logger
 }
 
 type FCgiConnection struct {
-	Conn       net.Conn
-	socketPath string
+	Conn net.Conn
+	dial func() (net.Conn, error)
+
+	// dirty connection was left in the middle of a request (timeout, abort, I/O error),
+	// it's replaced before it returns to the pool
+	dirty bool
+
+	requests   int // requests sent since the connection was opened
+	id         int
+	generation int  // incremented by every pool restart
+	overflow   bool // dialed above the pool size (--fpm-pool-burst), closed when no request waits
+	ephemeral  bool // dialed for a single request close to its wait deadline (--fpm-overflow-max)
+}
 
-	id int
+// RestartProgress reports result of restarting one connection
+type RestartProgress struct {
+	Connection int    `json:"connection"`
+	Restarted  int    `json:"restarted"`
+	Total      int    `json:"total"`
+	Duration   string `json:"duration"`
+	Error      string `json:"error,omitempty"`
 }
 
-func NewFCgiClient(config *Config, logger *log.Logger) (*FCgiClient, error) {
-	conns := make(chan *FCgiConnection, config.FpmPoolSize)
+func NewFCgiClient(config *Config, monitor *Monitor, logger *log.Logger) (*FCgiClient, error) {
+	network, address := config.FpmNetwork()
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout(network, address, fpmDialTimeout)
+	}
+	var tunnel *SshTunnel
+	if config.SshHost != "" {
+		var err error
+		if tunnel, err = NewSshTunnel(config, logger); err != nil {
+			return nil, err
+		}
+		dial = tunnel.Dial
+	}
+
+	if config.FpmWait > 0 {
+		if err := waitForFpm(dial, config, logger); err != nil {
+			return nil, err
+		}
+	}
+	if config.FpmPoolAuto {
+		if err := autoPoolSize(dial, config, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	conns := make([]*FCgiConnection, 0, config.FpmPoolSize)
 	for i := 0; i < config.FpmPoolSize; i++ {
-		netConn, err := net.Dial("unix", config.Socket)
+		netConn, err := dial()
 		if err != nil {
-			return nil, fmt.Errorf("could not connect to FPM socket: %w", err)
+			return nil, fmt.Errorf("could not connect to FPM %s: %w", address, err)
 		}
 		c := &FCgiConnection{
-			Conn:       netConn,
-			socketPath: config.Socket,
-			id:         i,
+			Conn: netConn,
+			dial: dial,
+			id:   i,
 		}
-		conns <- c
+		conns = append(conns, c)
 	}
 
 	logger.Debugf("Pool initiated with %d connections.", config.FpmPoolSize)
+	monitor.PoolSizeGauge.WithLabelValues(config.App).Set(float64(config.FpmPoolSize))
 
 	return &FCgiClient{
-		Pool: conns,
+		pool:   NewConnectionPool(conns, config.FpmReservedConnections, config.FpmQueueDepth, config.FpmPoolBurst, config.FpmOverflowMax, dial, logger),
+		dial:   dial,
+		tunnel: tunnel,
 
-		config: config,
-		logger: logger,
+		config:  config,
+		monitor: monitor,
+		logger:  logger,
 	}, nil
 }
 
@@ -107,37 +213,102 @@ func (client *FCgiClient) generateRequestId() uint16 {
 }
 
 // findConnection finds a free connection in the pool
-func (client *FCgiClient) findConnection() *FCgiConnection {
-	for {
-		timer := time.After(1 * time.Second)
-		select {
-		case _ = <-timer:
-			client.logger.Infof("It seems that all %q connections are busy", client.config.FpmPoolSize)
-		case conn := <-client.Pool:
-			return conn
+// Low priority requests wait at most --low-priority-max-wait, normal priority requests --fpm-queue-timeout
+// and high priority requests wait till a connection is free
+func (client *FCgiClient) findConnection(priority Priority, clientKey string) (*FCgiConnection, error) {
+	var deadline time.Time
+	switch {
+	case priority == PriorityLow:
+		deadline = time.Now().Add(client.config.LowPriorityMaxWait)
+	case priority == PriorityNormal && client.config.FpmQueueTimeout > 0:
+		deadline = time.Now().Add(client.config.FpmQueueTimeout)
+	}
+	start := time.Now()
+	waiting := client.monitor.PoolWaitingGauge.WithLabelValues(client.config.App)
+	waiting.Inc()
+	conn, err := client.pool.AcquireBurst(priority, clientKey, deadline)
+	waiting.Dec()
+	client.monitor.PoolWaitHistogram.WithLabelValues(client.config.App, priority.String()).Observe(time.Since(start).Seconds())
+	if err == ErrPoolSaturated && priority == PriorityNormal {
+		err = ErrQueueTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.monitor.PoolBusyGauge.WithLabelValues(client.config.App).Inc()
+	client.monitor.PoolOverflowGauge.WithLabelValues(client.config.App).Set(float64(client.pool.Overflow()))
+	if conn.ephemeral {
+		client.monitor.EphemeralConnsCounter.WithLabelValues(client.config.App, priority.String()).Inc()
+	}
+	if !conn.dirty && peerClosed(conn.Conn) {
+		// replaced silently, sending the request first would only find out it fails
+		if err := conn.reconnect(); err != nil {
+			client.logger.Debugf("could not replace FPM connection %d closed by FPM: %s", conn.id, err)
+		} else {
+			client.monitor.FpmReconnectsCounter.WithLabelValues(client.config.App, ReconnectRecycled).Inc()
 		}
 	}
+	conn.requests++
+	return conn, nil
+}
+
+// Busy returns number of connections currently used by requests
+func (client *FCgiClient) Busy() int {
+	return client.pool.Busy()
+}
+
+// Waiting returns number of requests waiting for a free connection
+func (client *FCgiClient) Waiting() int {
+	return client.pool.Waiting()
 }
 
 // SendRequest sends request to FPM server
 // It will try to reconnect if connection is lost
 // It might happen when FPM server is restarted
 func (client *FCgiClient) SendRequest(r FCgiRequest) (*http.Response, error) {
-	conn := client.findConnection()
+	conn, err := client.findConnection(r.Priority, r.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+	ended := true
 	defer func() {
-		client.Pool <- conn // return connection back to pool
+		if ended {
+			client.release(conn) // return connection back to pool
+		} else {
+			go client.finishRequest(conn, r.requestId, time.Now())
+		}
 	}()
 
-	response, err := conn.doRequest(r)
+	response, ended, err := conn.doRequest(r)
+	if errors.Is(err, ErrFpmProtocol) {
+		// stream is desynchronized, the connection can't be used anymore and retry is not safe
+		client.logger.Errorf("FPM connection %d replaced: %s", conn.id, err)
+		conn.dirty = true
+		return nil, err
+	}
+	var statusErr *ProtocolStatusError
+	if errors.As(err, &statusErr) {
+		// FPM ended the request properly, the connection is fine but retrying e.g. overloaded FPM makes it worse
+		return nil, err
+	}
+	if errors.Is(err, errBodyConsumed) || errors.Is(err, ErrRequestAborted) || errors.Is(err, ErrFirstByteTimeout) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// the request was interrupted in the middle, FPM must not receive the rest of it on this connection
+		// and a hung script must not run twice, neither after the request deadline passed
+		conn.dirty = true
+		return nil, err
+	}
 	if err != nil {
 		client.logger.Debugf("could not send request, reconnecting...: %v", err)
 		err := conn.reconnect()
 		if err != nil {
+			conn.dirty = true
 			return nil, fmt.Errorf("could not reconnect: %w", err)
 		}
 		client.logger.Debugf("successfully reconnected")
-		response, err = conn.doRequest(r)
+		client.monitor.FpmReconnectsCounter.WithLabelValues(client.config.App, ReconnectRetried).Inc()
+		response, ended, err = conn.doRequest(r)
 		if err != nil {
+			conn.dirty = true
 			return nil, fmt.Errorf("could not send the request %v: %w", r, err)
 		}
 	}
@@ -145,44 +316,325 @@ func (client *FCgiClient) SendRequest(r FCgiRequest) (*http.Response, error) {
 	return response, nil
 }
 
+// GetValues queries FPM management variables (FCGI_MAX_CONNS, FCGI_MAX_REQS, FCGI_MPXS_CONNS)
+// using a dedicated connection, so the pool is not affected
+func (client *FCgiClient) GetValues(names ...string) (map[string]string, error) {
+	return queryValues(client.dial, names)
+}
+
+func queryValues(dial func() (net.Conn, error), names []string) (map[string]string, error) {
+	netConn, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to FPM socket: %w", err)
+	}
+	defer func() {
+		_ = netConn.Close()
+	}()
+
+	// FPM might not support management records at all
+	_ = netConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &FCgiConnection{
+		Conn: netConn,
+		dial: dial,
+	}
+	return c.getValues(names)
+}
+
+// autoPoolSize sets pool size to FCGI_MAX_CONNS announced by FPM (pm.max_children of the pool),
+// --fpm-pool-size is kept when FPM doesn't announce it
+func autoPoolSize(dial func() (net.Conn, error), config *Config, logger *log.Logger) error {
+	values, err := queryValues(dial, []string{FCGI_MAX_CONNS, FCGI_MAX_REQS, FCGI_MPXS_CONNS})
+	maxConns := 0
+	if err == nil {
+		if maxConns, err = strconv.Atoi(values[FCGI_MAX_CONNS]); err != nil || maxConns < 1 {
+			err = fmt.Errorf("FPM announced invalid %s %q", FCGI_MAX_CONNS, values[FCGI_MAX_CONNS])
+		}
+	}
+	if err != nil {
+		logger.Warnf("could not size FPM pool automatically, using %s %d: %s", FpmPoolSize, config.FpmPoolSize, err)
+		return nil
+	}
+	if config.FpmReservedConnections >= maxConns {
+		return fmt.Errorf("%s %d must be lower than the pool size %d announced by FPM", FpmReservedConnections, config.FpmReservedConnections, maxConns)
+	}
+
+	logger.WithFields(log.Fields{
+		FCGI_MAX_REQS:   values[FCGI_MAX_REQS],
+		FCGI_MPXS_CONNS: values[FCGI_MPXS_CONNS],
+	}).Infof("FPM pool sized to %d connections announced in %s", maxConns, FCGI_MAX_CONNS)
+	config.FpmPoolSize = maxConns
+	return nil
+}
+
+// Restart replaces all connections with fresh ones without stopping traffic (e.g. after php-fpm reload).
+// Connections are restarted one by one as they become free, so busy connections are drained first.
+// ErrPoolSaturated is returned when a free connection is not available before the deadline.
+func (client *FCgiClient) Restart(deadline time.Time, progress func(RestartProgress)) error {
+	client.restartMu.Lock()
+	defer client.restartMu.Unlock()
+	client.generation++
+
+	total := client.pool.Size()
+	for restarted := 0; restarted < total; {
+		start := time.Now()
+		conn, err := client.pool.Acquire(PriorityHigh, "", deadline)
+		if err != nil {
+			return fmt.Errorf("%d of %d connections restarted: %w", restarted, total, err)
+		}
+		if conn.generation == client.generation {
+			// already restarted connection, wait for another one
+			client.pool.Release(conn)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		err = conn.reconnect()
+		conn.generation = client.generation
+		client.pool.Release(conn)
+		restarted++
+
+		result := RestartProgress{
+			Connection: conn.id,
+			Restarted:  restarted,
+			Total:      total,
+			Duration:   time.Since(start).String(),
+		}
+		if err != nil {
+			// connection is reconnected by the next request using it
+			result.Error = err.Error()
+		}
+		progress(result)
+	}
+
+	client.logger.Infof("FPM pool restarted, %d connections replaced", total)
+	return nil
+}
+
+// CheckIdle checks every idle connection and replaces dead ones, e.g. closed by FPM restart during a quiet period,
+// so the next request doesn't hit the reconnect path. Connections busy meanwhile are skipped.
+// Nothing is sent to the connections, FPM closes the connection after answering a management record
+// (FCGI_GET_VALUES) received between requests, so pinging would tear down the pool it's checking.
+func (client *FCgiClient) CheckIdle() (checked int, replaced int) {
+	for idle := client.pool.Idle(); checked < idle; checked++ {
+		conn, found := client.pool.TryAcquire()
+		if !found {
+			break
+		}
+		if err := conn.check(); err != nil {
+			client.logger.Debugf("FPM connection %d failed health check: %s", conn.id, err)
+			if err := conn.reconnect(); err != nil {
+				client.logger.Warnf("could not replace unhealthy FPM connection %d: %s", conn.id, err)
+				conn.dirty = true // the next request using it reconnects
+			} else {
+				client.monitor.FpmReconnectsCounter.WithLabelValues(client.config.App, ReconnectUnhealthy).Inc()
+				replaced++
+			}
+		}
+		client.pool.Release(conn)
+	}
+	return checked, replaced
+}
+
+// Resize changes the pool size at runtime (SIGHUP reload). New connections are dialed right away,
+// surplus connections are closed once requests using them finish.
+func (client *FCgiClient) Resize(size int) error {
+	client.restartMu.Lock()
+	defer client.restartMu.Unlock()
+
+	current := client.pool.Size()
+	switch {
+	case size > current:
+		conns := make([]*FCgiConnection, 0, size-current)
+		for i := current; i < size; i++ {
+			netConn, err := client.dial()
+			if err != nil {
+				for _, conn := range conns {
+					_ = conn.Conn.Close()
+				}
+				return fmt.Errorf("could not connect to FPM: %w", err)
+			}
+			conns = append(conns, &FCgiConnection{
+				Conn:       netConn,
+				dial:       client.dial,
+				id:         i,
+				generation: client.generation,
+			})
+		}
+		client.pool.Grow(conns)
+	case size < current:
+		client.pool.Shrink(current - size)
+	}
+
+	client.logger.Infof("FPM pool resized from %d to %d connections", current, size)
+	client.monitor.PoolSizeGauge.WithLabelValues(client.config.App).Set(float64(size))
+	return nil
+}
+
+// Size returns number of connections in the pool
+func (client *FCgiClient) Size() int {
+	return client.pool.Size()
+}
+
 // Close closes all connections in the pool
 func (client *FCgiClient) Close() {
-	for i := 0; i < client.config.FpmPoolSize; i++ {
-		conn := <-client.Pool
+	for i := 0; i < client.pool.Size(); i++ {
+		conn, _ := client.pool.Acquire(PriorityHigh, "", time.Time{}) // waits till request finishes
 		_ = conn.Conn.Close()
 	}
+	if client.tunnel != nil {
+		client.tunnel.Close()
+	}
+}
+
+// finishRequest reads the rest of the request after its stdout was closed and returns the connection to the pool.
+// PHP keeps running after fastcgi_finish_request() and FPM sends END_REQUEST when the script ends,
+// the worker and so the connection are busy till then.
+func (client *FCgiClient) finishRequest(conn *FCgiConnection, requestId uint16, start time.Time) {
+	defer client.release(conn)
+	_ = conn.Conn.SetDeadline(time.Time{}) // the script may run as long as FPM allows
+
+	for {
+		header := FCgiRecord{}
+		err := binary.Read(conn.Conn, binary.BigEndian, &header)
+		if err == nil {
+			err = validateRecord(header, requestId)
+		}
+		var content []byte
+		if err == nil {
+			content = make([]byte, int(header.ContentLength)+int(header.PaddingLength))
+			_, err = io.ReadFull(conn.Conn, content)
+		}
+		if err != nil {
+			client.logger.Errorf("FPM connection %d replaced, request did not end after its response: %s", conn.id, err)
+			conn.dirty = true
+			return
+		}
+
+		switch header.Type {
+		case FCGI_STDERR:
+			client.logger.Debugf("FPM stderr: %s", content[:header.ContentLength])
+		case FCGI_END_REQUEST:
+			if err := endRequestError(content[:header.ContentLength]); err != nil {
+				client.logger.Warnf("FPM connection %d: request ended after its response: %s", conn.id, err)
+			}
+			if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+				client.logger.Debugf("FPM connection %d: request ended %s after its response", conn.id, elapsed)
+			}
+			return
+		}
+		// stdout written after the stream was closed can't be delivered anymore
+	}
+}
+
+// release returns the connection to the pool, dirty connection is replaced first. When it can't be replaced,
+// it stays dirty and the next request using it reconnects.
+func (client *FCgiClient) release(conn *FCgiConnection) {
+	if conn.dirty {
+		if !conn.overflow && !conn.ephemeral { // dirty temporary connection is closed by the pool
+			if err := conn.reconnect(); err != nil {
+				client.logger.Errorf("could not replace FPM connection %d: %s", conn.id, err)
+			}
+		}
+	} else if maxRequests := client.config.FpmConnMaxRequests; maxRequests > 0 && conn.requests >= maxRequests {
+		// FPM worker exits after pm.max_requests, the connection is replaced before it happens in the middle of a request
+		if err := conn.reconnect(); err != nil {
+			client.logger.Errorf("could not replace FPM connection %d: %s", conn.id, err)
+		} else {
+			client.monitor.FpmReconnectsCounter.WithLabelValues(client.config.App, ReconnectRotated).Inc()
+		}
+	}
+	_ = conn.Conn.SetDeadline(time.Time{})
+	client.pool.Release(conn)
+	client.monitor.PoolBusyGauge.WithLabelValues(client.config.App).Dec()
+	client.monitor.PoolOverflowGauge.WithLabelValues(client.config.App).Set(float64(client.pool.Overflow()))
+}
+
+// check reports whether the idle connection was closed by FPM, the socket is only peeked at
+func (c *FCgiConnection) check() error {
+	if c.dirty || peerClosed(c.Conn) {
+		return fmt.Errorf("connection is closed")
+	}
+	return nil
 }
 
 func (c *FCgiConnection) reconnect() error {
 	_ = c.Conn.Close() // close old connection - error ignored
 
-	conn, err := net.Dial("unix", c.socketPath)
+	conn, err := c.dial()
 	if err != nil {
 		return fmt.Errorf("could not reconnect: %w", err)
 	}
 
 	c.Conn = conn
+	c.dirty = false
+	c.requests = 0
 	return nil // reconnect successful
 }
 
-func (c *FCgiConnection) doRequest(r FCgiRequest) (*http.Response, error) {
-	var err error
+// doRequest sends the request and reads its response, false is returned when the response was complete
+// before END_REQUEST and the rest of the request must be read by finishRequest
+func (c *FCgiConnection) doRequest(r FCgiRequest) (resp *http.Response, ended bool, err error) {
+	stop := c.watchAbort(r.Context, r.requestId)
+	defer func() {
+		if stop() {
+			resp, ended, err = nil, true, fmt.Errorf("%w: %w", ErrRequestAborted, context.Cause(r.Context))
+		}
+	}()
+
 	if err = c.sendHeader(r); err != nil {
-		return nil, fmt.Errorf("could not send header: %w", err)
+		return nil, true, fmt.Errorf("could not send header: %w", err)
 	}
 	if err = c.sendParams(r); err != nil {
-		return nil, fmt.Errorf("could not send params: %w", err)
+		return nil, true, fmt.Errorf("could not send params: %w", err)
 	}
-	if err = c.sendBody(r); err != nil {
-		return nil, fmt.Errorf("could not send body: %w", err)
+	if r.BodyReader != nil {
+		if err = c.streamBody(r, fcgiMaxContentLength); err != nil {
+			return nil, true, fmt.Errorf("%w: %w", errBodyConsumed, err)
+		}
+	} else if err = c.sendBody(r); err != nil {
+		return nil, true, fmt.Errorf("could not send body: %w", err)
 	}
 
-	resp, err := c.readResponse(r)
+	resp, ended, err = c.readResponse(r)
+	if err != nil && r.BodyReader != nil && !errors.Is(err, ErrFpmProtocol) {
+		return nil, true, fmt.Errorf("%w: could not read response: %w", errBodyConsumed, err)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("could not read response: %w", err)
+		return nil, true, fmt.Errorf("could not read response: %w", err)
 	}
 
-	return resp, nil
+	return resp, ended, nil
+}
+
+// watchAbort sends FCGI_ABORT_REQUEST when ctx is done before stop is called and interrupts the pending I/O.
+// PHP-FPM doesn't act on the record, it stops the script (unless ignore_user_abort is set) once its output
+// fails because the connection is closed. stop reports whether the request was aborted, the connection must
+// be replaced then.
+func (c *FCgiConnection) watchAbort(ctx context.Context, requestId uint16) (stop func() bool) {
+	if ctx == nil || ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	conn := c.Conn
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			var header [fcgiHeaderLength]byte
+			record := appendRecord(make(net.Buffers, 0, 1), &header, requestId, FCGI_ABORT_REQUEST, nil)
+			_ = conn.SetWriteDeadline(time.Now().Add(fcgiAbortTimeout))
+			_, _ = record.WriteTo(conn)
+			_ = conn.Close() // interrupts the pending I/O, the caller replaces the connection
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-aborted
+	}
 }
 
 func (c *FCgiConnection) sendHeader(r FCgiRequest) error {
@@ -192,73 +644,94 @@ func (c *FCgiConnection) sendHeader(r FCgiRequest) error {
 	return c.writeRecord(r.requestId, FCGI_BEGIN_REQUEST, data[:]) // probably delete slicing
 }
 
+// sendParams packs name-value pairs into as few records as possible and sends them with one vectored write.
+// A pair is never split between records, PHP-FPM decodes every record on its own.
 func (c *FCgiConnection) sendParams(r FCgiRequest) error {
 	if len(r.Body) > 0 {
 		r.Params["CONTENT_LENGTH"] = strconv.Itoa(len(r.Body))
 	}
-	for name, value := range r.Params {
-		buf := bytes.NewBuffer([]byte{})
-
-		b := make([]byte, 8)
-		binary.BigEndian.PutUint32(b, uint32(len(name))|1<<31)
-		buf.Write(b[:4])
-
-		binary.BigEndian.PutUint32(b, uint32(len(value))|1<<31)
-		buf.Write(b[:4])
 
-		buf.WriteString(name)
-		buf.WriteString(value)
-
-		err := c.writeRecord(r.requestId, FCGI_PARAMS, buf.Bytes())
-		if err != nil {
-			return err
+	var records [][]byte
+	record := bytes.NewBuffer(make([]byte, 0, 4096))
+	pair := bytes.NewBuffer([]byte{})
+	for name, value := range r.Params {
+		pair.Reset()
+		writeNameValue(pair, name, value)
+		if pair.Len() > fcgiMaxContentLength {
+			return fmt.Errorf("param %s is too large (%d bytes)", name, pair.Len())
 		}
+		if record.Len()+pair.Len() > fcgiMaxContentLength {
+			records = append(records, record.Bytes())
+			record = bytes.NewBuffer(make([]byte, 0, 4096))
+		}
+		record.Write(pair.Bytes())
+	}
+	if record.Len() > 0 {
+		records = append(records, record.Bytes())
 	}
 
+	headers := make([][fcgiHeaderLength]byte, len(records)+1)
+	buffers := make(net.Buffers, 0, 3*len(headers))
+	for i, content := range records {
+		buffers = appendRecord(buffers, &headers[i], r.requestId, FCGI_PARAMS, content)
+	}
 	// end of parameters
-	return c.writeRecord(r.requestId, FCGI_PARAMS, []byte{})
+	buffers = appendRecord(buffers, &headers[len(records)], r.requestId, FCGI_PARAMS, nil)
+
+	return c.writeBuffers(buffers)
 }
 
-// contentData: Between 0 and 65535 bytes of data, interpreted according to the record type.
+// sendBody sends the body split to FCGI_STDIN records with one vectored write, the body is not copied
 func (c *FCgiConnection) sendBody(r FCgiRequest) error {
-	if len(r.Body) > 0 {
-		chunkSize := 65535
-		for i := 0; i < len(r.Body); i += chunkSize {
-			end := i + chunkSize
-			if end > len(r.Body) {
-				end = len(r.Body)
-			}
-			if err := c.writeRecord(r.requestId, FCGI_STDIN, r.Body[i:end]); err != nil {
-				return err
-			}
+	chunks := (len(r.Body) + fcgiMaxContentLength - 1) / fcgiMaxContentLength
+	headers := make([][fcgiHeaderLength]byte, chunks+1)
+	buffers := make(net.Buffers, 0, 3*len(headers))
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * fcgiMaxContentLength
+		if end > len(r.Body) {
+			end = len(r.Body)
 		}
+		buffers = appendRecord(buffers, &headers[i], r.requestId, FCGI_STDIN, r.Body[i*fcgiMaxContentLength:end])
 	}
-	return c.writeRecord(r.requestId, FCGI_STDIN, []byte{})
+	// end of body
+	buffers = appendRecord(buffers, &headers[chunks], r.requestId, FCGI_STDIN, nil)
+
+	return c.writeBuffers(buffers)
 }
 
-func (c *FCgiConnection) readResponse(req FCgiRequest) (*http.Response, error) {
+// readResponse reads records till the stdout stream is closed (empty FCGI_STDOUT record) or FCGI_END_REQUEST,
+// true is returned when FCGI_END_REQUEST was read
+func (c *FCgiConnection) readResponse(req FCgiRequest) (*http.Response, bool, error) {
 	var stdout []byte
 	var stderr []byte
+	ended := false
+	awaiting := c.awaitFirstByte(req)
 
-	// read records till we find FCGI_END_REQUEST record
-	for {
+	for !ended {
 		respHeader := FCgiRecord{}
 		err := binary.Read(c.Conn, binary.BigEndian, &respHeader)
 		if err != nil {
-			return nil, fmt.Errorf("could not read record header: %w", err)
+			return nil, false, firstByteError(awaiting, req.FirstByteTimeout, fmt.Errorf("could not read record header: %w", err))
 		}
-
-		if req.requestId != respHeader.RequestId {
-			continue
+		if err := validateRecord(respHeader, req.requestId); err != nil {
+			return nil, false, err
+		}
+		if awaiting && respHeader.Type == FCGI_STDOUT {
+			awaiting = false
+			_ = c.Conn.SetReadDeadline(req.Deadline)
 		}
 
-		b := make([]byte, respHeader.ContentLength+uint16(respHeader.PaddingLength))
-		err = binary.Read(c.Conn, binary.BigEndian, &b)
+		b := make([]byte, int(respHeader.ContentLength)+int(respHeader.PaddingLength))
+		_, err = io.ReadFull(c.Conn, b)
 		if err != nil {
-			return nil, fmt.Errorf("could not read record body: %w", err)
+			return nil, false, firstByteError(awaiting, req.FirstByteTimeout, fmt.Errorf("could not read record body: %w", err))
 		}
 
 		if respHeader.Type == FCGI_STDOUT {
+			if respHeader.ContentLength == 0 {
+				// the response is complete, PHP may keep running (fastcgi_finish_request)
+				break
+			}
 			stdout = append(stdout, b[:respHeader.ContentLength]...)
 		}
 
@@ -267,74 +740,183 @@ func (c *FCgiConnection) readResponse(req FCgiRequest) (*http.Response, error) {
 		}
 
 		if respHeader.Type == FCGI_END_REQUEST {
-			break
+			if err := endRequestError(b[:respHeader.ContentLength]); err != nil {
+				return nil, true, err
+			}
+			ended = true
 		}
 	}
 
-	stdout = append([]byte("HTTP/1.0 200 OK\r\n"), stdout...)
+	if req.Exchange != nil {
+		req.Exchange.Record(req.Params, req.Body, stdout, stderr)
+	}
 
-	httpResponse, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(stdout)), nil)
+	end, found := cgiHeadersEnd(stdout)
+	if !found {
+		end = len(stdout) // response without body
+	}
+	httpResponse, err := parseCgiHeaders(stdout[:end])
 	if err != nil {
-		return nil, fmt.Errorf("could not read response as http response: %w", err)
+		return nil, false, err
 	}
+	body := stdout[end:]
+	if httpResponse.ContentLength >= 0 && httpResponse.ContentLength < int64(len(body)) {
+		body = body[:httpResponse.ContentLength] // data over Content-Length set by the script is ignored
+	}
+	httpResponse.Body = bufferedBody{Reader: bytes.NewReader(body), data: body, stderr: stderr}
 
-	// parse status
-	status := httpResponse.Header.Get("Status")
-	if status != "" {
-		httpResponse.Status = status
-		s := strings.Split(status, " ")
-		if len(s) < 2 {
-			return nil, fmt.Errorf("could not parse status code: %w", err)
-		}
+	return httpResponse, ended, nil
+}
 
-		code, err := strconv.Atoi(s[0])
-		if err != nil {
-			return nil, fmt.Errorf("could not parse status code: %w", err)
+// awaitFirstByte sets read deadline of the first byte timeout when it's sooner than the request deadline,
+// true is returned when it was set and must be restored once stdout arrives. Otherwise the request deadline is set.
+func (c *FCgiConnection) awaitFirstByte(r FCgiRequest) bool {
+	deadline := time.Now().Add(r.FirstByteTimeout)
+	if r.FirstByteTimeout <= 0 || (!r.Deadline.IsZero() && !deadline.Before(r.Deadline)) {
+		if !r.Deadline.IsZero() {
+			_ = c.Conn.SetReadDeadline(r.Deadline)
 		}
-		httpResponse.StatusCode = code
+		return false
 	}
-
-	return httpResponse, nil
+	_ = c.Conn.SetReadDeadline(deadline) // not supported by all transports (e.g. SSH tunnel)
+	return true
 }
 
-func (c *FCgiConnection) writeRecord(requestId uint16, recordType byte, contentData []byte) error {
-	contentLength := len(contentData)
+// firstByteError reports deadline exceeded before the first stdout as ErrFirstByteTimeout
+func firstByteError(awaiting bool, timeout time.Duration, err error) error {
+	if awaiting && errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w (%s): %w", ErrFirstByteTimeout, timeout, err)
+	}
+	return err
+}
 
-	// prepare record header
-	header := &FCgiRecord{
-		Version:       FCGI_VERSION,
-		Type:          recordType,
-		RequestId:     requestId,
-		ContentLength: uint16(contentLength),
-		PaddingLength: byte(-contentLength & 7),
+// validateRecord checks header of a record received from FPM during a request,
+// any violation means the stream can't be trusted anymore
+func validateRecord(header FCgiRecord, requestId uint16) error {
+	if header.Version != FCGI_VERSION {
+		return fmt.Errorf("%w: unsupported version %d", ErrFpmProtocol, header.Version)
 	}
+	if header.RequestId != requestId {
+		return fmt.Errorf("%w: unexpected request id %d, expected %d", ErrFpmProtocol, header.RequestId, requestId)
+	}
+	switch header.Type {
+	case FCGI_STDOUT, FCGI_STDERR:
+		return nil
+	case FCGI_END_REQUEST:
+		if header.ContentLength != 8 {
+			return fmt.Errorf("%w: end request record with length %d", ErrFpmProtocol, header.ContentLength)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unexpected record type %d", ErrFpmProtocol, header.Type)
+	}
+}
 
-	// encode the header
+func (c *FCgiConnection) getValues(names []string) (map[string]string, error) {
 	buf := bytes.NewBuffer([]byte{})
-	err := binary.Write(buf, binary.BigEndian, header)
-	if err != nil {
-		// this should really never happen
-		return fmt.Errorf("could not write header: %w", err)
+	for _, name := range names {
+		writeNameValue(buf, name, "")
 	}
 
-	// write the header to the connection
-	_, err = io.Copy(c.Conn, buf)
-	if err != nil {
-		return fmt.Errorf("could not write header to connection: %w", err)
+	// management records always use request id 0
+	if err := c.writeRecord(0, FCGI_GET_VALUES, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("could not send get values record: %w", err)
 	}
 
-	// write data to the connection
-	_, err = c.Conn.Write(contentData)
-	if err != nil {
-		return fmt.Errorf("could not write data to connection: %w", err)
+	for {
+		header := FCgiRecord{}
+		if err := binary.Read(c.Conn, binary.BigEndian, &header); err != nil {
+			return nil, fmt.Errorf("could not read record header: %w", err)
+		}
+
+		b := make([]byte, int(header.ContentLength)+int(header.PaddingLength))
+		if _, err := io.ReadFull(c.Conn, b); err != nil {
+			return nil, fmt.Errorf("could not read record body: %w", err)
+		}
+
+		if header.Type == FCGI_GET_VALUES_RESULT {
+			return readNameValues(b[:header.ContentLength])
+		}
 	}
+}
 
-	// write padding to the connection
-	pad := make([]byte, header.PaddingLength)
-	_, err = c.Conn.Write(pad)
-	if err != nil {
-		return fmt.Errorf("could not write padding to connection: %w", err)
+// writeNameValue encodes name-value pair, lengths below 128 are encoded in one byte
+func writeNameValue(buf *bytes.Buffer, name string, value string) {
+	for _, length := range []int{len(name), len(value)} {
+		if length < 128 {
+			buf.WriteByte(byte(length))
+			continue
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(length)|1<<31)
+		buf.Write(b)
 	}
+	buf.WriteString(name)
+	buf.WriteString(value)
+}
 
+// readNameValues decodes name-value pairs
+func readNameValues(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	for len(data) > 0 {
+		var lengths [2]int
+		for i := range lengths {
+			if len(data) < 1 {
+				return nil, fmt.Errorf("truncated name-value pair")
+			}
+			if data[0]>>7 == 0 {
+				lengths[i] = int(data[0])
+				data = data[1:]
+				continue
+			}
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated name-value pair")
+			}
+			lengths[i] = int(binary.BigEndian.Uint32(data) & 0x7fffffff)
+			data = data[4:]
+		}
+		if len(data) < lengths[0]+lengths[1] {
+			return nil, fmt.Errorf("truncated name-value pair")
+		}
+		values[string(data[:lengths[0]])] = string(data[lengths[0] : lengths[0]+lengths[1]])
+		data = data[lengths[0]+lengths[1]:]
+	}
+	return values, nil
+}
+
+// contentData: Between 0 and 65535 bytes of data, interpreted according to the record type.
+func (c *FCgiConnection) writeRecord(requestId uint16, recordType byte, contentData []byte) error {
+	var header [fcgiHeaderLength]byte
+	return c.writeBuffers(appendRecord(make(net.Buffers, 0, 3), &header, requestId, recordType, contentData))
+}
+
+// writeBuffers writes records with a single writev syscall on unix and TCP connections
+func (c *FCgiConnection) writeBuffers(buffers net.Buffers) error {
+	if _, err := buffers.WriteTo(c.Conn); err != nil {
+		return fmt.Errorf("could not write record to connection: %w", err)
+	}
 	return nil
 }
+
+// appendRecord encodes record header to the header array and appends header, content and padding to the buffers.
+// Content is referenced, not copied, so it must not change until the buffers are written.
+func appendRecord(buffers net.Buffers, header *[fcgiHeaderLength]byte, requestId uint16, recordType byte, contentData []byte) net.Buffers {
+	contentLength := len(contentData)
+	paddingLength := -contentLength & 7
+
+	header[0] = FCGI_VERSION
+	header[1] = recordType
+	binary.BigEndian.PutUint16(header[2:4], requestId)
+	binary.BigEndian.PutUint16(header[4:6], uint16(contentLength))
+	header[6] = byte(paddingLength)
+	header[7] = 0 // reserved
+
+	buffers = append(buffers, header[:])
+	if contentLength > 0 {
+		buffers = append(buffers, contentData)
+	}
+	if paddingLength > 0 {
+		buffers = append(buffers, recordPadding[:paddingLength])
+	}
+	return buffers
+}
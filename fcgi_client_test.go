@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestFCgiClient creates client with pool of one connection to the mock FPM, so requests reuse it
+func newTestFCgiClient(t *testing.T, fpm *mockFpm, args ...string) (*FCgiClient, *Config, *Monitor) {
+	t.Helper()
+	config := newTestConfig(t, fpm, append([]string{"--" + FpmPoolSize, "1"}, args...)...)
+	monitor := NewMonitor(config.logger)
+	client := must(NewFCgiClient(config, monitor, config.logger))
+	t.Cleanup(client.Close)
+	return client, config, monitor
+}
+
+func sendTestRequest(client *FCgiClient, uri string, body string) (*http.Response, string, error) {
+	request := client.NewRequest(map[string]string{"REQUEST_URI": uri, "REQUEST_METHOD": http.MethodGet}, []byte(body))
+	response, err := client.SendRequest(request)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := io.ReadAll(response.Body)
+	return response, string(data), err
+}
+
+func TestFCgiClientResponse(t *testing.T) {
+	largeBody := strings.Repeat("0123456789", 20000) // several STDOUT records
+
+	cases := []struct {
+		name      string
+		responder mockFpmResponder
+		status    int
+		header    map[string]string
+		body      string
+		stderr    string
+	}{
+		{
+			name:      "single record",
+			responder: mockFpmStdout("Content-Type: text/plain\r\n\r\nhello"),
+			status:    http.StatusOK,
+			header:    map[string]string{"Content-Type": "text/plain"},
+			body:      "hello",
+		},
+		{
+			name:      "body split to records",
+			responder: mockFpmStdout("Content-Type: text/plain\r\n\r\n" + largeBody),
+			status:    http.StatusOK,
+			body:      largeBody,
+		},
+		{
+			name: "headers split between records",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.Stdout("Status: 201 Created\r\nX-Sp")
+				w.Stdout("lit: yes\r")
+				w.Stdout("\n\r\nbody")
+				w.End(0, FCGI_REQUEST_COMPLETE)
+			},
+			status: http.StatusCreated,
+			header: map[string]string{"X-Split": "yes"},
+			body:   "body",
+		},
+		{
+			name: "stderr interleaved",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.Stderr("PHP Notice: first")
+				w.Stdout("Content-Type: text/plain\r\n\r\nhel")
+				w.Stderr("; PHP Warning: second")
+				w.Stdout("lo")
+				w.End(0, FCGI_REQUEST_COMPLETE)
+			},
+			status: http.StatusOK,
+			body:   "hello",
+			stderr: "PHP Notice: first; PHP Warning: second",
+		},
+		{
+			name: "empty stdout",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.End(0, FCGI_REQUEST_COMPLETE)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "stderr only",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.Stderr("PHP Fatal error: out of memory")
+				w.End(255, FCGI_REQUEST_COMPLETE)
+			},
+			status: http.StatusOK,
+			stderr: "PHP Fatal error: out of memory",
+		},
+		{
+			name:      "headers without body",
+			responder: mockFpmStdout("Status: 204 No Content\r\nX-Empty: 1\r\n"),
+			status:    http.StatusNoContent,
+			header:    map[string]string{"X-Empty": "1"},
+		},
+		{
+			name:      "data over content length",
+			responder: mockFpmStdout("Content-Length: 5\r\n\r\nhello world"),
+			status:    http.StatusOK,
+			body:      "hello",
+		},
+		{
+			name: "end request without closing stdout",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.Stdout("Content-Type: text/plain\r\n\r\nok")
+				w.EndRequest(0, FCGI_REQUEST_COMPLETE)
+			},
+			status: http.StatusOK,
+			body:   "ok",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fpm := startMockFpm(t, c.responder)
+			client, _, _ := newTestFCgiClient(t, fpm)
+
+			// the second request checks the connection is left clean for the next one
+			for i := 0; i < 2; i++ {
+				response, body, err := sendTestRequest(client, "/", "")
+				if err != nil {
+					t.Fatalf("request %d failed: %s", i, err)
+				}
+				if response.StatusCode != c.status {
+					t.Errorf("status = %d, want %d", response.StatusCode, c.status)
+				}
+				for name, value := range c.header {
+					if got := response.Header.Get(name); got != value {
+						t.Errorf("header %s = %q, want %q", name, got, value)
+					}
+				}
+				if body != c.body {
+					t.Errorf("body = %q (%d bytes), want %d bytes", truncate(body, 64), len(body), len(c.body))
+				}
+				if stderr := string(response.Body.(bufferedBody).stderr); stderr != c.stderr {
+					t.Errorf("stderr = %q, want %q", stderr, c.stderr)
+				}
+			}
+			if accepted := fpm.accepted.Load(); accepted != 1 {
+				t.Errorf("FPM accepted %d connections, want the connection reused", accepted)
+			}
+		})
+	}
+}
+
+func TestFCgiClientRequest(t *testing.T) {
+	requests := make(chan mockFpmRequest, 1)
+	fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+		requests <- mockFpmRequest{id: request.id, params: request.params, stdin: append([]byte(nil), request.stdin...)}
+		w.Stdout("\r\n")
+		w.End(0, FCGI_REQUEST_COMPLETE)
+	})
+	client, _, _ := newTestFCgiClient(t, fpm)
+
+	body := strings.Repeat("x", 3*fcgiMaxContentLength+10)
+	request := client.NewRequest(map[string]string{
+		"REQUEST_URI": "/upload",
+		"LONG_PARAM":  strings.Repeat("v", 300), // length encoded in 4 bytes
+	}, []byte(body))
+	if _, err := client.SendRequest(request); err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	received := <-requests
+	if received.id != request.requestId {
+		t.Errorf("request id = %d, want %d", received.id, request.requestId)
+	}
+	if string(received.stdin) != body {
+		t.Errorf("FPM received %d bytes of body, want %d", len(received.stdin), len(body))
+	}
+	if received.params["CONTENT_LENGTH"] != strconv.Itoa(len(body)) {
+		t.Errorf("CONTENT_LENGTH = %q, want %d", received.params["CONTENT_LENGTH"], len(body))
+	}
+	if received.params["LONG_PARAM"] != strings.Repeat("v", 300) || received.params["REQUEST_URI"] != "/upload" {
+		t.Errorf("params were not received: %v", received.params)
+	}
+}
+
+func TestFCgiClientProtocolStatus(t *testing.T) {
+	cases := []struct {
+		name           string
+		protocolStatus byte
+		httpStatus     int
+	}{
+		{name: "overloaded", protocolStatus: FCGI_OVERLOADED, httpStatus: http.StatusServiceUnavailable},
+		{name: "can't multiplex", protocolStatus: FCGI_CANT_MPX_CONN, httpStatus: http.StatusBadGateway},
+		{name: "unknown role", protocolStatus: FCGI_UNKNOWN_ROLE, httpStatus: http.StatusBadGateway},
+		{name: "unknown status", protocolStatus: 9, httpStatus: http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+				if request.params["REQUEST_URI"] == "/rejected" {
+					w.EndRequest(7, c.protocolStatus)
+					return
+				}
+				w.Stdout("Content-Type: text/plain\r\n\r\nok")
+				w.End(0, FCGI_REQUEST_COMPLETE)
+			})
+			client, _, _ := newTestFCgiClient(t, fpm)
+
+			_, _, err := sendTestRequest(client, "/rejected", "")
+			var statusErr *ProtocolStatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("error = %v, want ProtocolStatusError", err)
+			}
+			if statusErr.ProtocolStatus != c.protocolStatus || statusErr.AppStatus != 7 {
+				t.Errorf("protocol status %d, app status %d, want %d and 7", statusErr.ProtocolStatus, statusErr.AppStatus, c.protocolStatus)
+			}
+			if statusErr.HttpStatus() != c.httpStatus {
+				t.Errorf("http status = %d, want %d", statusErr.HttpStatus(), c.httpStatus)
+			}
+			if requests := fpm.requests.Load(); requests != 1 {
+				t.Errorf("FPM received %d requests, rejected request must not be retried", requests)
+			}
+
+			// the request ended properly, the connection stays in the pool
+			if _, body, err := sendTestRequest(client, "/", ""); err != nil || body != "ok" {
+				t.Fatalf("next request = %q, %v", body, err)
+			}
+			if accepted := fpm.accepted.Load(); accepted != 1 {
+				t.Errorf("FPM accepted %d connections, want the connection reused", accepted)
+			}
+		})
+	}
+}
+
+func TestFCgiClientProtocolViolation(t *testing.T) {
+	cases := []struct {
+		name      string
+		responder func(w *mockFpmWriter, request mockFpmRequest)
+		delivered bool // the response is complete before the violation, it's found by finishRequest
+	}{
+		{
+			name: "record of another request",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.record(FCGI_STDOUT, request.id+1, []byte("Content-Type: text/plain\r\n\r\nother"))
+				w.End(0, FCGI_REQUEST_COMPLETE)
+			},
+		},
+		{
+			name: "management record",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.record(FCGI_GET_VALUES_RESULT, 0, nil)
+				w.End(0, FCGI_REQUEST_COMPLETE)
+			},
+		},
+		{
+			name: "unexpected record type",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.record(FCGI_PARAMS, request.id, []byte("x"))
+				w.End(0, FCGI_REQUEST_COMPLETE)
+			},
+		},
+		{
+			name: "short end request",
+			responder: func(w *mockFpmWriter, request mockFpmRequest) {
+				w.Stdout("Content-Type: text/plain\r\n\r\nok")
+				w.record(FCGI_STDOUT, request.id, nil)
+				w.record(FCGI_END_REQUEST, request.id, []byte{0, 0, 0, 0})
+			},
+			delivered: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var violated atomic.Bool
+			fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+				if violated.CompareAndSwap(false, true) {
+					c.responder(w, request)
+					return
+				}
+				w.Stdout("Content-Type: text/plain\r\n\r\nok")
+				w.End(0, FCGI_REQUEST_COMPLETE)
+			})
+			client, _, _ := newTestFCgiClient(t, fpm)
+
+			response, body, err := sendTestRequest(client, "/", "")
+			if c.delivered {
+				if err != nil || body != "ok" {
+					t.Fatalf("response = %q, %v, want ok", body, err)
+				}
+			} else if !errors.Is(err, ErrFpmProtocol) {
+				t.Fatalf("error = %v (response %v), want ErrFpmProtocol", err, response)
+			}
+			if requests := fpm.requests.Load(); requests != 1 {
+				t.Errorf("FPM received %d requests, desynchronized request must not be retried", requests)
+			}
+
+			// the connection is replaced, the next request must not read the rest of the broken one
+			if _, body, err := sendTestRequest(client, "/", ""); err != nil || body != "ok" {
+				t.Fatalf("next request = %q, %v", body, err)
+			}
+			if accepted := fpm.accepted.Load(); accepted != 2 {
+				t.Errorf("FPM accepted %d connections, want the broken one replaced", accepted)
+			}
+		})
+	}
+}
+
+func TestFCgiClientFinishRequest(t *testing.T) {
+	release := make(chan struct{})
+	fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+		if request.params["REQUEST_URI"] != "/finish" {
+			w.Stdout("Content-Type: text/plain\r\n\r\nnext")
+			w.End(0, FCGI_REQUEST_COMPLETE)
+			return
+		}
+		// fastcgi_finish_request(): the response is complete, the script keeps running
+		w.Stdout("Content-Type: text/plain\r\n\r\ndone")
+		w.record(FCGI_STDOUT, request.id, nil)
+		<-release
+		w.Stdout("output after the response is dropped")
+		w.Stderr("background job finished")
+		w.EndRequest(0, FCGI_REQUEST_COMPLETE)
+	})
+	client, _, _ := newTestFCgiClient(t, fpm)
+
+	finished := make(chan string, 1)
+	go func() {
+		_, body, err := sendTestRequest(client, "/finish", "")
+		if err != nil {
+			body = err.Error()
+		}
+		finished <- body
+	}()
+	select {
+	case body := <-finished:
+		if body != "done" {
+			t.Fatalf("body = %q, want done", body)
+		}
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("response was not delivered before END_REQUEST")
+	}
+
+	// the worker is still busy, the only connection returns to the pool after END_REQUEST
+	next := make(chan string, 1)
+	go func() {
+		_, body, err := sendTestRequest(client, "/next", "")
+		if err != nil {
+			body = err.Error()
+		}
+		next <- body
+	}()
+	select {
+	case body := <-next:
+		t.Fatalf("next request (%q) used the connection before END_REQUEST", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case body := <-next:
+		if body != "next" {
+			t.Fatalf("next body = %q, want next", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not returned to the pool after END_REQUEST")
+	}
+	if accepted := fpm.accepted.Load(); accepted != 1 {
+		t.Errorf("FPM accepted %d connections, want the connection reused", accepted)
+	}
+}
+
+func TestFCgiClientFinishRequestConnectionClosed(t *testing.T) {
+	fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+		w.Stdout("Content-Type: text/plain\r\n\r\n" + request.params["REQUEST_URI"])
+		if request.params["REQUEST_URI"] == "/finish" {
+			w.record(FCGI_STDOUT, request.id, nil)
+			w.Close() // the worker died before END_REQUEST
+			return
+		}
+		w.End(0, FCGI_REQUEST_COMPLETE)
+	})
+	client, _, _ := newTestFCgiClient(t, fpm)
+
+	if _, body, err := sendTestRequest(client, "/finish", ""); err != nil || body != "/finish" {
+		t.Fatalf("finished request = %q, %v", body, err)
+	}
+	if _, body, err := sendTestRequest(client, "/next", ""); err != nil || body != "/next" {
+		t.Fatalf("next request = %q, %v", body, err)
+	}
+	if accepted := fpm.accepted.Load(); accepted != 2 {
+		t.Errorf("FPM accepted %d connections, want the closed one replaced", accepted)
+	}
+}
+
+func TestFCgiClientStaleConnection(t *testing.T) {
+	t.Run("closed while idle", func(t *testing.T) {
+		fpm := startMockFpm(t, mockFpmStdout("Content-Type: text/plain\r\n\r\nok"))
+		client, config, monitor := newTestFCgiClient(t, fpm)
+
+		if _, _, err := sendTestRequest(client, "/", ""); err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		fpm.CloseConnections() // FPM restarted its workers
+		if _, body, err := sendTestRequest(client, "/", ""); err != nil || body != "ok" {
+			t.Fatalf("request on the closed connection = %q, %v", body, err)
+		}
+		if requests := fpm.requests.Load(); requests != 2 {
+			t.Errorf("FPM received %d requests, want 2", requests)
+		}
+		if recycled := testutil.ToFloat64(monitor.FpmReconnectsCounter.WithLabelValues(config.App, ReconnectRecycled)); recycled != 1 {
+			t.Errorf("recycled reconnects = %v, want 1", recycled)
+		}
+	})
+
+	t.Run("closed during request", func(t *testing.T) {
+		var closed atomic.Bool
+		fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+			if closed.CompareAndSwap(false, true) {
+				w.Close() // the worker died before responding
+				return
+			}
+			w.Stdout("Content-Type: text/plain\r\n\r\n" + string(request.stdin))
+			w.End(0, FCGI_REQUEST_COMPLETE)
+		})
+		client, config, monitor := newTestFCgiClient(t, fpm)
+
+		if _, body, err := sendTestRequest(client, "/", "payload"); err != nil || body != "payload" {
+			t.Fatalf("retried request = %q, %v", body, err)
+		}
+		if accepted := fpm.accepted.Load(); accepted != 2 {
+			t.Errorf("FPM accepted %d connections, want 2", accepted)
+		}
+		if retried := testutil.ToFloat64(monitor.FpmReconnectsCounter.WithLabelValues(config.App, ReconnectRetried)); retried != 1 {
+			t.Errorf("retried reconnects = %v, want 1", retried)
+		}
+	})
+
+	t.Run("fpm down", func(t *testing.T) {
+		fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+			w.Close()
+		})
+		client, _, _ := newTestFCgiClient(t, fpm)
+		fpm.Close()
+
+		if _, _, err := sendTestRequest(client, "/", ""); err == nil {
+			t.Fatal("request succeeded without FPM")
+		}
+	})
+}
+
+// truncate shortens long bodies in test failures
+func truncate(value string, length int) string {
+	if len(value) > length {
+		return value[:length] + "..."
+	}
+	return value
+}
+
+// benchUploadSizes are bodies of the upload benchmarks
+var benchUploadSizes = []struct {
+	name string
+	size int
+}{
+	{name: "64KiB", size: 64 << 10},
+	{name: "1MiB", size: 1 << 20},
+	{name: "16MiB", size: 16 << 20},
+}
+
+// newBenchConnection returns FastCGI connection whose peer reads and drops everything written to it
+func newBenchConnection(b *testing.B) *FCgiConnection {
+	b.Helper()
+	listener, err := net.Listen("unix", filepath.Join(b.TempDir(), "drain.sock"))
+	if err != nil {
+		b.Fatalf("could not listen: %s", err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, conn)
+		_ = conn.Close()
+	}()
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("could not connect: %s", err)
+	}
+	b.Cleanup(func() {
+		_ = conn.Close()
+		_ = listener.Close()
+	})
+	return &FCgiConnection{Conn: conn}
+}
+
+// copyRecords writes the body as records copied to one buffer each, like writes without net.Buffers
+func copyRecords(conn net.Conn, requestId uint16, body []byte) error {
+	var record bytes.Buffer
+	for len(body) > 0 {
+		chunk := body
+		if len(chunk) > fcgiMaxContentLength {
+			chunk = chunk[:fcgiMaxContentLength]
+		}
+		body = body[len(chunk):]
+
+		var header [fcgiHeaderLength]byte
+		record.Reset()
+		for _, buffer := range appendRecord(nil, &header, requestId, FCGI_STDIN, chunk) {
+			record.Write(buffer)
+		}
+		if _, err := conn.Write(record.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchmarkSendBody measures FCGI_STDIN records written by one vectored write, the body is not copied
+func BenchmarkSendBody(b *testing.B) {
+	for _, size := range benchUploadSizes {
+		b.Run(size.name, func(b *testing.B) {
+			conn := newBenchConnection(b)
+			request := FCgiRequest{Body: bytes.Repeat([]byte("x"), size.size), requestId: 1}
+			b.SetBytes(int64(size.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := conn.sendBody(request); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSendBodyCopied is the baseline of BenchmarkSendBody, every record is copied and written on its own
+func BenchmarkSendBodyCopied(b *testing.B) {
+	for _, size := range benchUploadSizes {
+		b.Run(size.name, func(b *testing.B) {
+			conn := newBenchConnection(b)
+			body := bytes.Repeat([]byte("x"), size.size)
+			b.SetBytes(int64(size.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := copyRecords(conn.Conn, 1, body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkStreamBody measures body read from the client while it's written to FPM (--request-stream-threshold)
+func BenchmarkStreamBody(b *testing.B) {
+	for _, size := range benchUploadSizes {
+		b.Run(size.name, func(b *testing.B) {
+			conn := newBenchConnection(b)
+			body := bytes.Repeat([]byte("x"), size.size)
+			b.SetBytes(int64(size.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				request := FCgiRequest{BodyReader: bytes.NewReader(body), requestId: 1}
+				if err := conn.streamBody(request, fcgiMaxContentLength); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkUpload measures complete request with a large body to mock FPM, which keeps the body in memory
+func BenchmarkUpload(b *testing.B) {
+	for _, size := range benchUploadSizes {
+		b.Run(size.name, func(b *testing.B) {
+			fpm := startMockFpm(b, mockFpmStdout("Content-Type: text/plain\r\n\r\nok"))
+			config := newTestConfig(b, fpm, "--"+FpmPoolSize, "1")
+			client := must(NewFCgiClient(config, NewMonitor(config.logger), config.logger))
+			b.Cleanup(client.Close)
+			body := bytes.Repeat([]byte("x"), size.size)
+
+			b.SetBytes(int64(size.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.SendRequest(client.NewRequest(map[string]string{"REQUEST_URI": "/upload"}, body)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
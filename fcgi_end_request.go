@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+)
+
+// protocol statuses of FCGI_END_REQUEST
+const (
+	FCGI_REQUEST_COMPLETE = 0
+	FCGI_CANT_MPX_CONN    = 1
+	FCGI_OVERLOADED       = 2
+	FCGI_UNKNOWN_ROLE     = 3
+)
+
+// protocolStatusNames are used in errors and as metrics label
+var protocolStatusNames = map[byte]string{
+	FCGI_REQUEST_COMPLETE: "request_complete",
+	FCGI_CANT_MPX_CONN:    "cant_mpx_conn",
+	FCGI_OVERLOADED:       "overloaded",
+	FCGI_UNKNOWN_ROLE:     "unknown_role",
+}
+
+// ProtocolStatusError means FPM ended the request with other protocol status than FCGI_REQUEST_COMPLETE,
+// the script was not run
+type ProtocolStatusError struct {
+	AppStatus      uint32
+	ProtocolStatus byte
+}
+
+func (e *ProtocolStatusError) Error() string {
+	return fmt.Sprintf("FPM rejected the request: %s (app status %d)", protocolStatusName(e.ProtocolStatus), e.AppStatus)
+}
+
+// HttpStatus returns status of the proxy response, overloaded FPM may accept the request later
+func (e *ProtocolStatusError) HttpStatus() int {
+	if e.ProtocolStatus == FCGI_OVERLOADED {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+func protocolStatusName(status byte) string {
+	if name, found := protocolStatusNames[status]; found {
+		return name
+	}
+	return "unknown"
+}
+
+// endRequestError parses body of FCGI_END_REQUEST (appStatus, protocolStatus, 3 reserved bytes),
+// nil is returned when the request is complete. Length of the body is checked by validateRecord.
+func endRequestError(content []byte) error {
+	status := &ProtocolStatusError{
+		AppStatus:      binary.BigEndian.Uint32(content[:4]),
+		ProtocolStatus: content[4],
+	}
+	if status.ProtocolStatus == FCGI_REQUEST_COMPLETE {
+		return nil
+	}
+	return status
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPoolSaturated = errors.New("all FPM connections are busy")
+
+	// ErrQueueFull means too many requests already wait for a connection
+	ErrQueueFull = fmt.Errorf("%w: request queue is full", ErrPoolSaturated)
+	// ErrQueueTimeout means normal priority request waited for a connection longer than --fpm-queue-timeout
+	ErrQueueTimeout = fmt.Errorf("%w: request waited too long", ErrPoolSaturated)
+)
+
+// ConnectionPool holds FPM connections and hands released connections to waiting requests by priority
+type ConnectionPool struct {
+	mu       sync.Mutex
+	idle     []*FCgiConnection       // FIFO of free connections
+	waiters  map[Priority]*fairQueue // waiting requests per priority
+	size     int
+	reserved int // connections available only to high priority requests
+	depth    int // maximum number of waiting requests except high priority ones, 0 means unlimited
+	burst    int // maximum number of overflow connections dialed when all connections are busy
+	overflow int // number of open overflow connections
+	retiring int // busy connections above the size, closed when released
+
+	ephemeralMax int // maximum number of single-use connections dialed for requests close to their deadline
+	ephemeral    int // number of open ephemeral connections
+
+	dial func() (net.Conn, error)
+
+	logger *log.Logger
+}
+
+func NewConnectionPool(conns []*FCgiConnection, reserved int, depth int, burst int, ephemeralMax int, dial func() (net.Conn, error), logger *log.Logger) *ConnectionPool {
+	return &ConnectionPool{
+		idle:         conns,
+		waiters:      map[Priority]*fairQueue{},
+		size:         len(conns),
+		reserved:     reserved,
+		depth:        depth,
+		burst:        burst,
+		ephemeralMax: ephemeralMax,
+		dial:         dial,
+
+		logger: logger,
+	}
+}
+
+// Acquire returns a free connection or waits for one.
+// Waiting requests are grouped by client key to share connections fairly between clients.
+// Zero deadline means waiting forever, otherwise ErrPoolSaturated is returned when the deadline passes.
+// Reserved connections are handed only to high priority requests. When the queue is full, ErrQueueFull is
+// returned right away to all but high priority requests. A request which waited 80 % of its wait time gets
+// an ephemeral connection when --fpm-overflow-max allows, rather than being shed at the deadline.
+func (p *ConnectionPool) Acquire(priority Priority, clientKey string, deadline time.Time) (*FCgiConnection, error) {
+	p.mu.Lock()
+	if len(p.idle) > p.keep(priority) {
+		conn := p.idle[0]
+		p.idle = p.idle[1:]
+		p.mu.Unlock()
+		return conn, nil
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		p.mu.Unlock()
+		return nil, ErrPoolSaturated
+	}
+	if p.depth > 0 && priority != PriorityHigh && p.waiting() >= p.depth {
+		p.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	ch := make(chan *FCgiConnection, 1)
+	if p.waiters[priority] == nil {
+		p.waiters[priority] = newFairQueue()
+	}
+	p.waiters[priority].push(clientKey, ch)
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var overflow <-chan time.Time
+	if !deadline.IsZero() && p.ephemeralMax > 0 {
+		timer := time.NewTimer(time.Until(deadline) * 4 / 5)
+		defer timer.Stop()
+		overflow = timer.C
+	}
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case conn := <-ch:
+			return conn, nil
+		case <-ticker.C:
+			p.logger.Infof("It seems that all %d connections are busy", p.size)
+		case <-overflow:
+			conn := p.dialEphemeral()
+			if conn == nil {
+				continue // keeps waiting till the deadline
+			}
+			p.mu.Lock()
+			removed := p.waiters[priority].remove(clientKey, ch)
+			p.mu.Unlock()
+			if !removed {
+				// connection was handed over concurrently, the ephemeral one is not needed
+				p.Release(conn)
+				return <-ch, nil
+			}
+			return conn, nil
+		case <-timeout:
+			p.mu.Lock()
+			removed := p.waiters[priority].remove(clientKey, ch)
+			p.mu.Unlock()
+			if !removed {
+				// connection was handed over concurrently
+				return <-ch, nil
+			}
+			return nil, ErrPoolSaturated
+		}
+	}
+}
+
+// AcquireBurst is Acquire for requests, when all connections are busy it dials an overflow connection
+// instead of waiting while the burst capacity lasts. Dial failure falls back to waiting. A request doesn't
+// overtake waiting requests of the same or higher priority, it waits behind them.
+func (p *ConnectionPool) AcquireBurst(priority Priority, clientKey string, deadline time.Time) (*FCgiConnection, error) {
+	p.mu.Lock()
+	if len(p.idle) > p.keep(priority) || p.overflow >= p.burst || p.waitingAbove(priority) > 0 {
+		p.mu.Unlock()
+		return p.Acquire(priority, clientKey, deadline)
+	}
+	p.overflow++
+	id := p.size + p.overflow - 1
+	p.mu.Unlock()
+
+	netConn, err := p.dial()
+	if err != nil {
+		p.mu.Lock()
+		p.overflow--
+		p.mu.Unlock()
+		p.logger.Warnf("could not dial overflow FPM connection: %s", err)
+		return p.Acquire(priority, clientKey, deadline)
+	}
+	p.logger.Debugf("All %d FPM connections are busy, overflow connection %d dialed", p.size, id)
+	return &FCgiConnection{
+		Conn:     netConn,
+		dial:     p.dial,
+		id:       id,
+		overflow: true,
+	}, nil
+}
+
+// dialEphemeral dials a single-use connection, nil is returned when --fpm-overflow-max is reached or dial fails
+func (p *ConnectionPool) dialEphemeral() *FCgiConnection {
+	p.mu.Lock()
+	if p.ephemeral >= p.ephemeralMax {
+		p.mu.Unlock()
+		return nil
+	}
+	p.ephemeral++
+	p.mu.Unlock()
+
+	netConn, err := p.dial()
+	if err != nil {
+		p.mu.Lock()
+		p.ephemeral--
+		p.mu.Unlock()
+		p.logger.Warnf("could not dial ephemeral FPM connection: %s", err)
+		return nil
+	}
+	return &FCgiConnection{
+		Conn:      netConn,
+		dial:      p.dial,
+		id:        -1,
+		ephemeral: true,
+	}
+}
+
+// TryAcquire returns the oldest idle connection without waiting, false is returned when none is idle.
+// Reserved connections are handed out too, the caller must release the connection right away.
+func (p *ConnectionPool) TryAcquire() (*FCgiConnection, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return nil, false
+	}
+	conn := p.idle[0]
+	p.idle = p.idle[1:]
+	return conn, true
+}
+
+// Release returns connection to the pool, the highest priority waiter gets it first.
+// Overflow connections are closed once no request waits, the spike is over then.
+// Ephemeral connections and connections above the shrunk size are always closed.
+func (p *ConnectionPool) Release(conn *FCgiConnection) {
+	p.mu.Lock()
+	if conn.ephemeral {
+		p.ephemeral--
+		p.mu.Unlock()
+		_ = conn.Conn.Close()
+		return
+	}
+	if p.retiring > 0 && !conn.overflow {
+		p.retiring--
+		p.mu.Unlock()
+		_ = conn.Conn.Close()
+		return
+	}
+	if conn.overflow && conn.dirty {
+		if p.waiting() == 0 {
+			p.closeOverflow(conn)
+			return
+		}
+		// the burst capacity goes to the highest priority waiter, not to the next incoming request
+		p.mu.Unlock()
+		if err := conn.reconnect(); err != nil {
+			p.logger.Warnf("could not redial overflow FPM connection %d: %s", conn.id, err)
+			p.mu.Lock()
+			p.closeOverflow(conn)
+			return
+		}
+		p.Release(conn)
+		return
+	}
+	for _, priority := range priorityOrder {
+		if len(p.idle) < p.keep(priority) {
+			break // the connection is kept for high priority requests
+		}
+		if waiters, found := p.waiters[priority]; found {
+			if ch, ok := waiters.pop(); ok {
+				p.mu.Unlock()
+				ch <- conn
+				return
+			}
+		}
+	}
+	if conn.overflow {
+		p.closeOverflow(conn)
+		return
+	}
+	p.idle = append(p.idle, conn)
+	p.mu.Unlock()
+}
+
+// closeOverflow closes overflow connection, caller must hold the lock which is released
+func (p *ConnectionPool) closeOverflow(conn *FCgiConnection) {
+	p.overflow--
+	p.mu.Unlock()
+	_ = conn.Conn.Close()
+}
+
+// keep returns number of idle connections which must remain free after handing one to the priority
+func (p *ConnectionPool) keep(priority Priority) int {
+	if priority == PriorityHigh {
+		return 0
+	}
+	return p.reserved
+}
+
+// Busy returns number of connections currently used by requests
+func (p *ConnectionPool) Busy() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size + p.retiring - len(p.idle) + p.overflow + p.ephemeral
+}
+
+// Idle returns number of free connections
+func (p *ConnectionPool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// Overflow returns number of open overflow connections
+func (p *ConnectionPool) Overflow() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.overflow
+}
+
+// Waiting returns number of requests waiting for a free connection
+func (p *ConnectionPool) Waiting() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waiting()
+}
+
+// waitingAbove returns number of waiting requests with the same or higher priority, caller must hold the lock
+func (p *ConnectionPool) waitingAbove(priority Priority) int {
+	waiting := 0
+	for _, waitingPriority := range priorityOrder {
+		if waiters, found := p.waiters[waitingPriority]; found {
+			waiting += waiters.len()
+		}
+		if waitingPriority == priority {
+			break
+		}
+	}
+	return waiting
+}
+
+// waiting returns number of waiting requests, caller must hold the lock
+func (p *ConnectionPool) waiting() int {
+	waiting := 0
+	for _, waiters := range p.waiters {
+		waiting += waiters.len()
+	}
+	return waiting
+}
+
+// Size returns number of connections managed by the pool, overflow connections are not included
+func (p *ConnectionPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// Grow adds connections to the pool, waiting requests get them right away
+func (p *ConnectionPool) Grow(conns []*FCgiConnection) {
+	p.mu.Lock()
+	p.size += len(conns)
+	p.mu.Unlock()
+	for _, conn := range conns {
+		p.Release(conn)
+	}
+}
+
+// Shrink removes n connections from the pool. Idle connections are closed right away, busy ones when they are
+// released, so requests using them finish first.
+func (p *ConnectionPool) Shrink(n int) {
+	p.mu.Lock()
+	p.size -= n
+	p.retiring += n
+	closed := make([]*FCgiConnection, 0, n)
+	for p.retiring > 0 && len(p.idle) > 0 {
+		closed = append(closed, p.idle[len(p.idle)-1])
+		p.idle = p.idle[:len(p.idle)-1]
+		p.retiring--
+	}
+	p.mu.Unlock()
+
+	for _, conn := range closed {
+		_ = conn.Conn.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPool creates pool of one connection with one overflow connection, dialing fails while failing is set
+func newTestPool(t *testing.T, failing *atomic.Bool) *ConnectionPool {
+	dial := func() (net.Conn, error) {
+		if failing.Load() {
+			return nil, errors.New("dial failed")
+		}
+		client, server := net.Pipe()
+		t.Cleanup(func() {
+			_ = server.Close()
+		})
+		return client, nil
+	}
+	conn := &FCgiConnection{Conn: must(dial()), dial: dial}
+	return NewConnectionPool([]*FCgiConnection{conn}, 0, 0, 1, 0, dial, log.New())
+}
+
+// acquireAsync waits for a connection in the background once the previous waiters are queued
+func acquireAsync(t *testing.T, pool *ConnectionPool, priority Priority) <-chan *FCgiConnection {
+	acquired := make(chan *FCgiConnection, 1)
+	waiting := pool.Waiting()
+	go func() {
+		conn, err := pool.AcquireBurst(priority, "", time.Now().Add(5*time.Second))
+		if err != nil {
+			t.Errorf("%s priority request: %s", priority, err)
+		}
+		acquired <- conn
+	}()
+	for pool.Waiting() == waiting {
+		time.Sleep(time.Millisecond)
+	}
+	return acquired
+}
+
+func TestPoolBurstPriority(t *testing.T) {
+	t.Run("waiting request is not overtaken", func(t *testing.T) {
+		var failing atomic.Bool
+		pool := newTestPool(t, &failing)
+		conn := must(pool.AcquireBurst(PriorityNormal, "", time.Time{}))
+
+		failing.Store(true) // the overflow connection can't be dialed, the request waits
+		high := acquireAsync(t, pool, PriorityHigh)
+		failing.Store(false)
+
+		if _, err := pool.AcquireBurst(PriorityLow, "", time.Now().Add(50*time.Millisecond)); !errors.Is(err, ErrPoolSaturated) {
+			t.Fatalf("low priority request got overflow connection before waiting high priority one, error = %v", err)
+		}
+		pool.Release(conn)
+		if got := <-high; got != conn {
+			t.Errorf("high priority request didn't get the released connection")
+		}
+	})
+
+	t.Run("overflow connection goes to the highest priority", func(t *testing.T) {
+		var failing atomic.Bool
+		pool := newTestPool(t, &failing)
+		_ = must(pool.AcquireBurst(PriorityNormal, "", time.Time{}))
+		overflow := must(pool.AcquireBurst(PriorityNormal, "", time.Time{}))
+		if !overflow.overflow {
+			t.Fatalf("second connection is not an overflow one")
+		}
+
+		low := acquireAsync(t, pool, PriorityLow)
+		high := acquireAsync(t, pool, PriorityHigh)
+
+		overflow.dirty = true // e.g. aborted request, it's redialed for the waiter
+		pool.Release(overflow)
+		var got *FCgiConnection
+		select {
+		case got = <-high:
+			if got != overflow || got.dirty {
+				t.Errorf("high priority request didn't get the redialed overflow connection")
+			}
+		case <-low:
+			t.Fatalf("low priority request got the connection before high priority one")
+		case <-time.After(time.Second):
+			t.Fatalf("overflow connection was closed while requests wait")
+		}
+		pool.Release(got)
+		if <-low != overflow {
+			t.Errorf("low priority request didn't get the overflow connection after high priority one")
+		}
+	})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStreamHeaderSize limits CGI headers read before the response body is streamed
+const maxStreamHeaderSize = 64 << 10
+
+// StreamRequest sends request with body read from BodyReader in fixed-size records and returns the response
+// as soon as its headers arrive. The response body is read directly from the connection, which is held
+// until the body is closed.
+func (client *FCgiClient) StreamRequest(r FCgiRequest, bufferSize int) (*http.Response, error) {
+	conn, err := client.findConnection(r.Priority, r.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Deadline.IsZero() {
+		_ = conn.Conn.SetDeadline(r.Deadline) // not supported by all transports (e.g. SSH tunnel)
+	}
+
+	stream := &fcgiStdoutReader{
+		client:    client,
+		conn:      conn,
+		requestId: r.requestId,
+	}
+
+	err = conn.startRequest(r)
+	if err != nil && !errors.Is(err, ErrFpmProtocol) {
+		// stale connection (e.g. FPM restarted), the body was not read yet so the request can be sent again
+		client.logger.Debugf("could not send request, reconnecting...: %v", err)
+		if err = conn.reconnect(); err == nil {
+			client.monitor.FpmReconnectsCounter.WithLabelValues(client.config.App, ReconnectRetried).Inc()
+			if !r.Deadline.IsZero() {
+				_ = conn.Conn.SetDeadline(r.Deadline)
+			}
+			err = conn.startRequest(r)
+		}
+	}
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+
+	stop := conn.watchAbort(r.Context, r.requestId)
+	var response *http.Response
+	if err = conn.streamBody(r, bufferSize); err == nil {
+		stream.awaiting = conn.awaitFirstByte(r)
+		stream.deadline, stream.firstByteTimeout = r.Deadline, r.FirstByteTimeout
+		response, err = stream.readHeaders()
+	}
+	if stop() {
+		response, err = nil, fmt.Errorf("%w: %w", ErrRequestAborted, context.Cause(r.Context))
+		stream.done, stream.finished = false, false // the connection was closed, Close replaces it
+	}
+	if err != nil {
+		if errors.Is(err, ErrFpmProtocol) {
+			client.logger.Errorf("FPM connection %d replaced: %s", conn.id, err)
+		}
+		_ = stream.Close()
+		return nil, err
+	}
+	return response, nil
+}
+
+// startRequest sends begin request record and params
+func (c *FCgiConnection) startRequest(r FCgiRequest) error {
+	if err := c.sendHeader(r); err != nil {
+		return fmt.Errorf("could not send header: %w", err)
+	}
+	if err := c.sendParams(r); err != nil {
+		return fmt.Errorf("could not send params: %w", err)
+	}
+	return nil
+}
+
+// streamBody copies the body to FCGI_STDIN records using one buffer
+func (c *FCgiConnection) streamBody(r FCgiRequest, bufferSize int) error {
+	if bufferSize > 65535 {
+		bufferSize = 65535
+	}
+	if r.BodyReader != nil {
+		buf := make([]byte, bufferSize)
+		for {
+			n, err := r.BodyReader.Read(buf)
+			if n > 0 {
+				if err := c.writeRecord(r.requestId, FCGI_STDIN, buf[:n]); err != nil {
+					return fmt.Errorf("could not send body: %w", err)
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("could not read request body: %w", err)
+			}
+		}
+	}
+	if err := c.writeRecord(r.requestId, FCGI_STDIN, []byte{}); err != nil {
+		return fmt.Errorf("could not send body: %w", err)
+	}
+	return nil
+}
+
+// fcgiStdoutReader reads FCGI_STDOUT records of one request directly from the connection.
+// Closing it before the end of stdout replaces the connection, as the rest of the response is never read.
+type fcgiStdoutReader struct {
+	client    *FCgiClient
+	conn      *FCgiConnection
+	requestId uint16
+
+	pending   []byte // stdout read together with headers
+	remaining int    // unread content of the current stdout record
+	padding   int    // padding of the current stdout record
+	done      bool   // END_REQUEST received
+	finished  bool   // stdout closed, END_REQUEST may follow much later (fastcgi_finish_request)
+	err       error
+	stderr    []byte // stderr up to maxStderrSize
+
+	idleTimeout time.Duration // maximum time without data once the body is streamed
+
+	awaiting         bool      // first byte timeout is set till the first stdout arrives
+	deadline         time.Time // request deadline restored after the first stdout
+	firstByteTimeout time.Duration
+
+	closeOnce sync.Once
+}
+
+// readHeaders reads stdout till the end of CGI headers and parses them
+func (sr *fcgiStdoutReader) readHeaders() (*http.Response, error) {
+	var head []byte
+	for {
+		if end, found := cgiHeadersEnd(head); found {
+			sr.pending = head[end:]
+			head = head[:end]
+			break
+		}
+		if len(head) > maxStreamHeaderSize {
+			return nil, fmt.Errorf("response headers are larger than %d bytes", maxStreamHeaderSize)
+		}
+		if sr.done || sr.finished {
+			break // response without body
+		}
+
+		chunk := make([]byte, 4096)
+		n, err := sr.Read(chunk)
+		head = append(head, chunk[:n]...)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, firstByteError(sr.awaiting, sr.firstByteTimeout, fmt.Errorf("could not read response: %w", err))
+		}
+	}
+
+	response, err := parseCgiHeaders(head)
+	if err != nil {
+		return nil, err
+	}
+	response.Body = sr
+	response.ContentLength = -1
+
+	// request deadline covers waiting for headers, the body may take longer as long as data keeps flowing
+	sr.idleTimeout = sr.client.config.Timeout
+	return response, nil
+}
+
+func (sr *fcgiStdoutReader) Read(p []byte) (int, error) {
+	if len(sr.pending) > 0 {
+		n := copy(p, sr.pending)
+		sr.pending = sr.pending[n:]
+		return n, nil
+	}
+	if sr.err != nil {
+		return 0, sr.err
+	}
+	if sr.idleTimeout > 0 {
+		_ = sr.conn.Conn.SetDeadline(time.Now().Add(sr.idleTimeout))
+	}
+
+	for sr.remaining == 0 {
+		if sr.padding > 0 {
+			if _, err := io.CopyN(io.Discard, sr.conn.Conn, int64(sr.padding)); err != nil {
+				return 0, sr.fail(fmt.Errorf("could not read record padding: %w", err))
+			}
+			sr.padding = 0
+		}
+
+		header := FCgiRecord{}
+		if err := binary.Read(sr.conn.Conn, binary.BigEndian, &header); err != nil {
+			return 0, sr.fail(fmt.Errorf("could not read record header: %w", err))
+		}
+		if err := validateRecord(header, sr.requestId); err != nil {
+			return 0, sr.fail(err)
+		}
+
+		switch header.Type {
+		case FCGI_STDOUT:
+			if sr.awaiting {
+				sr.awaiting = false
+				_ = sr.conn.Conn.SetReadDeadline(sr.deadline)
+			}
+			sr.remaining, sr.padding = int(header.ContentLength), int(header.PaddingLength)
+			if header.ContentLength == 0 {
+				// the response is complete, the rest of the request is read by Close
+				if _, err := io.CopyN(io.Discard, sr.conn.Conn, int64(sr.padding)); err != nil {
+					return 0, sr.fail(fmt.Errorf("could not read record padding: %w", err))
+				}
+				sr.padding = 0
+				sr.finished = true
+				sr.err = io.EOF
+				return 0, io.EOF
+			}
+		case FCGI_STDERR:
+			content := make([]byte, int(header.ContentLength)+int(header.PaddingLength))
+			if _, err := io.ReadFull(sr.conn.Conn, content); err != nil {
+				return 0, sr.fail(fmt.Errorf("could not read record body: %w", err))
+			}
+			sr.stderr = appendStderr(sr.stderr, content[:header.ContentLength])
+		case FCGI_END_REQUEST:
+			content := make([]byte, int(header.ContentLength)+int(header.PaddingLength))
+			if _, err := io.ReadFull(sr.conn.Conn, content); err != nil {
+				return 0, sr.fail(fmt.Errorf("could not read record body: %w", err))
+			}
+			sr.done = true
+			if err := endRequestError(content[:header.ContentLength]); err != nil {
+				return 0, sr.fail(err)
+			}
+			sr.err = io.EOF
+			return 0, io.EOF
+		}
+	}
+
+	if len(p) > sr.remaining {
+		p = p[:sr.remaining]
+	}
+	n, err := sr.conn.Conn.Read(p)
+	sr.remaining -= n
+	if err != nil {
+		return n, sr.fail(fmt.Errorf("could not read record body: %w", err))
+	}
+	return n, nil
+}
+
+func (sr *fcgiStdoutReader) fail(err error) error {
+	sr.err = err
+	return err
+}
+
+// Close returns the connection to the pool, it is replaced when the response was not read completely.
+// When the response is complete but the request didn't end yet, the connection is returned once it ends.
+func (sr *fcgiStdoutReader) Close() error {
+	sr.closeOnce.Do(func() {
+		if !sr.done && sr.finished {
+			go sr.client.finishRequest(sr.conn, sr.requestId, time.Now())
+			return
+		}
+		if !sr.done {
+			if errors.Is(sr.err, ErrFpmProtocol) {
+				sr.client.logger.Errorf("FPM connection %d replaced: %s", sr.conn.id, sr.err)
+			}
+			sr.conn.dirty = true
+		}
+		sr.client.release(sr.conn)
+	})
+	return nil
+}
+
+// cgiHeadersEnd returns position after the empty line ending CGI headers
+func cgiHeadersEnd(stdout []byte) (int, bool) {
+	if end := bytes.Index(stdout, []byte("\r\n\r\n")); end >= 0 {
+		return end + 4, true
+	}
+	if end := bytes.Index(stdout, []byte("\n\n")); end >= 0 {
+		return end + 2, true
+	}
+	return 0, false
+}
+
+// parseCgiHeaders parses CGI headers to response without body
+func parseCgiHeaders(head []byte) (*http.Response, error) {
+	response, err := http.ReadResponse(bufio.NewReader(io.MultiReader(
+		strings.NewReader("HTTP/1.0 200 OK\r\n"),
+		bytes.NewReader(head),
+		strings.NewReader("\r\n"), // response without body might miss the empty line
+	)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response as http response: %w", err)
+	}
+	if err := parseCgiStatus(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// bufferedBody is response body read completely from FPM, Execute takes its data without copying
+type bufferedBody struct {
+	*bytes.Reader
+	data   []byte
+	stderr []byte
+}
+
+func (bb bufferedBody) Close() error {
+	return nil
+}
+
+// parseCgiStatus applies Status header, reason phrase is optional ("Status: 404" and "Status: 404 Not Found" are both valid)
+func parseCgiStatus(httpResponse *http.Response) error {
+	status := strings.TrimSpace(httpResponse.Header.Get("Status"))
+	if status == "" {
+		return nil
+	}
+	codeString, reason, _ := strings.Cut(status, " ")
+	code, err := strconv.Atoi(codeString)
+	if err != nil || code < 100 || code > 999 {
+		return fmt.Errorf("could not parse status code %q", status)
+	}
+	if strings.TrimSpace(reason) == "" {
+		reason = http.StatusText(code)
+	}
+	httpResponse.StatusCode = code
+	httpResponse.Status = fmt.Sprintf("%d %s", code, strings.TrimSpace(reason))
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FeatureStreaming       = "streaming"
+	FeatureStrictCgiParams = "strict_cgi_params"
+)
+
+// knownFeatures are behavioral changes which can be shipped dark and enabled per deployment by --feature.
+// A feature is removed from the list once its behavior becomes the default (or is dropped).
+var knownFeatures = map[string]string{
+	FeatureStreaming:       fmt.Sprintf("stream request and response bodies, same as --%s", Streaming),
+	FeatureStrictCgiParams: "pass CONTENT_TYPE and CONTENT_LENGTH params only when they have a value (RFC 3875)",
+}
+
+// Features holds state of every known feature, features are disabled unless enabled by --feature
+type Features map[string]bool
+
+// ParseFeatures parses "name=true" and "name=false" definitions, "name" alone enables the feature.
+// Unknown names are rejected, so a typo doesn't silently keep the feature disabled.
+func ParseFeatures(definitions []string) (Features, error) {
+	features := Features{}
+	for name := range knownFeatures {
+		features[name] = false
+	}
+	for _, definition := range definitions {
+		name, value, found := strings.Cut(definition, "=")
+		name = strings.TrimSpace(name)
+		if _, known := knownFeatures[name]; !known {
+			return nil, fmt.Errorf("unknown feature %q, known features are %s", name, strings.Join(featureNames(), ", "))
+		}
+		enabled := true
+		if found {
+			var err error
+			if enabled, err = strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid value of feature %s: %q", name, value)
+			}
+		}
+		features[name] = enabled
+	}
+	return features, nil
+}
+
+// Enabled reports whether the feature is on, it's safe to call on nil Features
+func (f Features) Enabled(name string) bool {
+	return f[name]
+}
+
+// String lists all features with their state sorted by name, e.g. "streaming=false,strict_cgi_params=true"
+func (f Features) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%t", name, f[name]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func featureNames() []string {
+	names := make([]string, 0, len(knownFeatures))
+	for name := range knownFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// results of forward auth requests, used as metrics label
+const (
+	AuthResultAllowed = "allowed"
+	AuthResultDenied  = "denied"
+	AuthResultError   = "error"
+
+	maxAuthBodySize = 1 << 20
+)
+
+// authHopHeaders describe the connection to the auth service, they are not copied to the client
+var authHopHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"transfer-encoding": true,
+	"content-length":    true,
+}
+
+// ForwardAuth asks an external service (oauth2-proxy, Authelia, ...) whether the request may reach PHP.
+// The service gets the request headers and X-Forwarded-Method/Proto/Host/Uri/For. On 2xx the request continues
+// with selected headers of the auth response, any other response is returned to the client (login redirect, 401).
+type ForwardAuth struct {
+	url    string
+	client *http.Client
+
+	config  *Config
+	monitor *Monitor
+}
+
+func NewForwardAuth(config *Config, monitor *Monitor) (*ForwardAuth, error) {
+	if config.AuthUrl != "" {
+		parsed, err := url.Parse(config.AuthUrl)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid %s %q, use http(s)://host/path", AuthUrl, config.AuthUrl)
+		}
+	}
+	return &ForwardAuth{
+		url: config.AuthUrl,
+		client: &http.Client{
+			Timeout: config.AuthTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse // redirects (e.g. to login page) are for the client
+			},
+		},
+		config:  config,
+		monitor: monitor,
+	}, nil
+}
+
+// Enabled reports whether auth service is configured
+func (fa *ForwardAuth) Enabled() bool {
+	return fa.url != ""
+}
+
+// Protects reports whether the request must be authorized, all paths are protected without --auth-prefix
+func (fa *ForwardAuth) Protects(request *http.Request) bool {
+	if len(fa.config.AuthPrefixes) == 0 {
+		return true
+	}
+	_, found := matchPrefix(request.URL.Path, fa.config.AuthPrefixes)
+	return found
+}
+
+// Check sends the request headers to the auth service, the returned response has its body read
+func (fa *ForwardAuth) Check(request *http.Request) (*http.Response, []byte, error) {
+	authRequest, err := http.NewRequestWithContext(request.Context(), http.MethodGet, fa.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	authRequest.Header = request.Header.Clone()
+	authRequest.Header.Del("Content-Length")
+	authRequest.Header.Del("Content-Type")
+
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+	authRequest.Header.Set("X-Forwarded-Method", request.Method)
+	authRequest.Header.Set("X-Forwarded-Proto", proto)
+	authRequest.Header.Set("X-Forwarded-Host", request.Host)
+	authRequest.Header.Set("X-Forwarded-Uri", request.URL.RequestURI())
+	if ip, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		authRequest.Header.Set("X-Forwarded-For", appendForwarded(request.Header.Get("X-Forwarded-For"), ip))
+	}
+
+	response, err := fa.client.Do(authRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxAuthBodySize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read auth response: %w", err)
+	}
+	return response, body, nil
+}
+
+// forwardAuthMiddleware lets only requests authorized by the auth service through
+func (hs *HttpServer) forwardAuthMiddleware(next http.Handler) http.Handler {
+	if !hs.forwardAuth.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// clients must not be able to send headers of the auth response themselves
+		for _, name := range hs.config.AuthResponseHeaders {
+			r.Header.Del(name)
+		}
+		if !hs.forwardAuth.Protects(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		response, body, err := hs.forwardAuth.Check(r)
+		if err != nil {
+			hs.monitor.AuthRequestsCounter.WithLabelValues(hs.config.App, AuthResultError).Inc()
+			hs.WriteError(w, r, fmt.Errorf("forward auth failed: %w", err), start)
+			return
+		}
+
+		if response.StatusCode >= 200 && response.StatusCode < 300 {
+			hs.monitor.AuthRequestsCounter.WithLabelValues(hs.config.App, AuthResultAllowed).Inc()
+			for _, name := range hs.config.AuthResponseHeaders {
+				for _, value := range response.Header.Values(name) {
+					r.Header.Add(name, value)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		hs.monitor.AuthRequestsCounter.WithLabelValues(hs.config.App, AuthResultDenied).Inc()
+		for name, values := range response.Header {
+			if authHopHeaders[strings.ToLower(name)] {
+				continue
+			}
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+		w.WriteHeader(response.StatusCode)
+		if _, err := w.Write(body); err != nil {
+			hs.logger.Debugf("could not write auth response: %s", err)
+		}
+		hs.observeProxyError(r, response.StatusCode, start)
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// forwarded header styles
+const (
+	ForwardedXForwarded = "x-forwarded" // X-Forwarded-For, -Proto, -Host, -Port
+	ForwardedRfc7239    = "rfc7239"     // Forwarded (RFC 7239)
+	ForwardedBoth       = "both"
+	ForwardedOff        = "off" // headers are passed as received
+)
+
+var xForwardedParams = []string{
+	"HTTP_X_FORWARDED_FOR",
+	"HTTP_X_FORWARDED_PROTO",
+	"HTTP_X_FORWARDED_HOST",
+	"HTTP_X_FORWARDED_PORT",
+}
+
+func validateForwardedStyle(style string) error {
+	switch style {
+	case ForwardedXForwarded, ForwardedRfc7239, ForwardedBoth, ForwardedOff:
+		return nil
+	}
+	return fmt.Errorf(
+		"invalid forwarded style %q, use %q, %q, %q or %q",
+		style, ForwardedXForwarded, ForwardedRfc7239, ForwardedBoth, ForwardedOff,
+	)
+}
+
+// TrustedProxySet holds proxies whose forwarded headers are trusted
+type TrustedProxySet struct {
+	networks []*net.IPNet
+	unix     bool // peers of unix socket listeners, they have no IP address
+}
+
+// Empty reports whether no proxy is trusted
+func (tp TrustedProxySet) Empty() bool {
+	return len(tp.networks) == 0 && !tp.unix
+}
+
+// parseTrustedProxies parses IP addresses, CIDR ranges and "unix" standing for peers of unix socket listeners
+func parseTrustedProxies(definitions []string) (TrustedProxySet, error) {
+	var proxies TrustedProxySet
+	for _, definition := range definitions {
+		if definition == unixPeerHost {
+			proxies.unix = true
+			continue
+		}
+		if !strings.Contains(definition, "/") {
+			if ip := net.ParseIP(definition); ip != nil && ip.To4() != nil {
+				definition += "/32"
+			} else {
+				definition += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(definition)
+		if err != nil {
+			return TrustedProxySet{}, fmt.Errorf("invalid trusted proxy %q: %w", definition, err)
+		}
+		proxies.networks = append(proxies.networks, network)
+	}
+	return proxies, nil
+}
+
+// trustedPeer reports whether forwarded headers sent by the peer can be trusted
+func (pb *ParamsBuilder) trustedPeer(peer string) bool {
+	return trustedAddress(pb.trustedProxies, peer)
+}
+
+// trustedAddress reports whether the address belongs to a trusted proxy
+func trustedAddress(trustedProxies TrustedProxySet, address string) bool {
+	if address == unixPeerHost {
+		return trustedProxies.unix
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp returns address of the client behind trusted proxies. X-Forwarded-For (or Forwarded without it)
+// is walked from the right, the first address not belonging to a trusted proxy is the client - addresses
+// on the left could be sent by the client itself. The peer is returned when it's not a trusted proxy.
+func clientIp(request *http.Request, trustedProxies TrustedProxySet) string {
+	client, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+
+	hops := forwardedFor(request.Header)
+	for i := len(hops) - 1; i >= 0 && trustedAddress(trustedProxies, client); i-- {
+		client = hops[i]
+	}
+	return client
+}
+
+// forwardedFor returns addresses from X-Forwarded-For, or for= parameters of Forwarded, in order of hops
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, node, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if !found || !strings.EqualFold(name, "for") {
+					continue
+				}
+				node = strings.Trim(node, `"`)
+				if host, _, err := net.SplitHostPort(node); err == nil {
+					node = host
+				}
+				hops = append(hops, strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+			}
+		}
+	}
+	return hops
+}
+
+// setForwardedParams generates forwarded headers for PHP.
+// Headers received from trusted proxies are extended by this hop, headers received from anyone else are replaced,
+// so clients can't spoof their address or scheme.
+func (pb *ParamsBuilder) setForwardedParams(request *http.Request, params map[string]string) {
+	style := pb.config.Forwarded
+	if style == ForwardedOff {
+		return
+	}
+
+	peer, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return // internal request
+	}
+	trusted := pb.trustedPeer(peer)
+	if !trusted {
+		delete(params, "HTTP_FORWARDED")
+		for _, name := range xForwardedParams {
+			delete(params, name)
+		}
+	}
+
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+	port := pb.serverPort(request)
+
+	if style == ForwardedXForwarded || style == ForwardedBoth {
+		params["HTTP_X_FORWARDED_FOR"] = appendForwarded(params["HTTP_X_FORWARDED_FOR"], peer)
+		setIfMissing(params, "HTTP_X_FORWARDED_PROTO", proto)
+		setIfMissing(params, "HTTP_X_FORWARDED_HOST", request.Host)
+		setIfMissing(params, "HTTP_X_FORWARDED_PORT", port)
+	} else {
+		for _, name := range xForwardedParams {
+			delete(params, name)
+		}
+	}
+
+	if style == ForwardedRfc7239 || style == ForwardedBoth {
+		element := fmt.Sprintf("for=%s;proto=%s", forwardedNode(peer), proto)
+		if request.Host != "" {
+			element += fmt.Sprintf(";host=%s", forwardedValue(request.Host))
+		}
+		params["HTTP_FORWARDED"] = appendForwarded(params["HTTP_FORWARDED"], element)
+	} else {
+		delete(params, "HTTP_FORWARDED")
+	}
+}
+
+func appendForwarded(existing string, value string) string {
+	if existing == "" {
+		return value
+	}
+	return existing + ", " + value
+}
+
+func setIfMissing(params map[string]string, name string, value string) {
+	if params[name] == "" {
+		params[name] = value
+	}
+}
+
+// forwardedNode formats node identifier, IPv6 addresses must be bracketed and quoted (RFC 7239, section 6)
+func forwardedNode(ip string) string {
+	if ip == unixPeerHost {
+		return "unknown" // unix socket peer has no IP address
+	}
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf(`"[%s]"`, ip)
+	}
+	return ip
+}
+
+// forwardedValue quotes value which is not a valid token
+func forwardedValue(value string) string {
+	if strings.ContainsAny(value, `:[]"; ,=`) {
+		return strconv.Quote(value)
+	}
+	return value
+}
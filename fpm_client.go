@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
@@ -10,10 +11,13 @@ import (
 )
 
 type FpmClient struct {
-	fCgiClient *FCgiClient
-	config     *Config
-	monitor    *Monitor
-	logger     *logrus.Logger
+	fCgiClient    *FCgiClient
+	paramsBuilder *ParamsBuilder
+	priorities    *PriorityClasses
+	dumper        *ExchangeDumper
+	config        *Config
+	monitor       *Monitor
+	logger        *logrus.Logger
 }
 
 // ResponseData struct contains encapsulated data from fpm response
@@ -22,88 +26,278 @@ type ResponseData struct {
 	Headers map[string][]string
 	Body    []byte
 	Route   string // parse route from FPM response header X-App-Route
+
+	FpmDuration time.Duration // time spent in FPM including waiting for a free connection
+
+	Stream       io.ReadCloser `json:"-"` // body read from FPM while it's written to the client, Body is empty then
+	StreamedSize int64         `json:"-"` // number of body bytes read from Stream
+
+	Stderr []byte `json:"-"` // messages written to FCGI_STDERR, in streaming mode only those sent before the headers
+}
+
+// Clone returns deep copy of the response, so it can be modified without affecting the original
+func (rd *ResponseData) Clone() *ResponseData {
+	return &ResponseData{
+		Status:  rd.Status,
+		Headers: http.Header(rd.Headers).Clone(),
+		Body:    append([]byte(nil), rd.Body...),
+		Route:   rd.Route,
+
+		FpmDuration: rd.FpmDuration,
+	}
 }
 
-func NewFpmClient(fCgiClient *FCgiClient, config *Config, monitor *Monitor, logger *logrus.Logger) *FpmClient {
+func NewFpmClient(
+	fCgiClient *FCgiClient,
+	paramsBuilder *ParamsBuilder,
+	priorities *PriorityClasses,
+	dumper *ExchangeDumper,
+	config *Config,
+	monitor *Monitor,
+	logger *logrus.Logger,
+) *FpmClient {
 	return &FpmClient{
-		fCgiClient: fCgiClient,
-		config:     config,
-		monitor:    monitor,
-		logger:     logger,
+		fCgiClient:    fCgiClient,
+		paramsBuilder: paramsBuilder,
+		priorities:    priorities,
+		dumper:        dumper,
+		config:        config,
+		monitor:       monitor,
+		logger:        logger,
 	}
 }
 
-func (fpm *FpmClient) Call(request *http.Request) (*ResponseData, error) {
-	requestBody, err := io.ReadAll(request.Body)
-	if err != nil {
-		return nil, fmt.Errorf("could not read request body: %w", err)
-	}
-
-	params := map[string]string{
-		"SCRIPT_FILENAME": fpm.config.IndexFile,
-		"SERVER_SOFTWARE": "gophpfpm/1.0.0",
-		"SERVER_NAME":     request.Host,
-		"SERVER_PORT":     fmt.Sprintf("%d", fpm.config.Port),
-		"REQUEST_URI":     request.URL.RequestURI(),
-		"QUERY_STRING":    request.URL.Query().Encode(),
-		"REQUEST_METHOD":  request.Method,
-		"CONTENT_TYPE":    request.Header.Get("Content-type"),
-	}
-	// propagate http request headers through params
-	for name, headers := range request.Header {
-		for _, header := range headers {
-			h := strings.ToLower(name)
-			// do not propagate protected headers
-			_, found := protectedHeadersInbound[h]
-			if !found {
-				params[fmt.Sprintf("HTTP_%s", strings.ToUpper(name))] = header
-			}
+// Call sends the request to FPM and reads the whole response, local redirects are followed within the deadline
+func (fpm *FpmClient) Call(request *http.Request, deadline time.Time) (*ResponseData, error) {
+	dumped := fpm.dumper.Matches(request)
+
+	var fpmReq FCgiRequest
+	if threshold := fpm.config.RequestStreamThreshold; threshold > 0 && request.ContentLength > threshold && !dumped {
+		// large body is sent to FPM as it's read from the client, the exchange dump needs it in memory
+		params := fpm.paramsBuilder.Build(request, int(request.ContentLength), nil)
+		fpmReq = fpm.NewRequest(params, nil)
+		fpmReq.BodyReader = request.Body
+	} else {
+		requestBody, err := io.ReadAll(request.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read request body: %w", err)
 		}
+		params := fpm.paramsBuilder.Build(request, len(requestBody), nil)
+		fpmReq = fpm.NewRequest(params, requestBody)
 	}
+	fpmReq.Deadline = deadline
+	fpmReq.Priority = fpm.priorities.Resolve(request.URL.Path)
+	fpmReq.ClientKey = fairQueueKey(request, fpm.config.FairQueueKey)
+	fpmReq.Context = request.Context()
+	fpmReq.FirstByteTimeout = fpm.config.FpmFirstByteTimeout
 
-	fpmReq := fpm.fCgiClient.NewRequest(params, nil)
-	// set request body
-	if len(requestBody) > 0 {
-		fpmReq.Body = requestBody
+	if dumped {
+		fpmReq.Exchange = NewExchange(request.Header.Get(RequestIdHeader))
+		defer fpm.dumper.Write(fpmReq.Exchange)
 	}
 
+	response, err := fpm.Execute(fpmReq)
+	for redirects := 0; err == nil; redirects++ {
+		target, local := applyRedirectPolicy(fpm.config.RedirectPolicy, response)
+		if !local {
+			break
+		}
+		if redirects >= maxLocalRedirects {
+			return nil, fmt.Errorf("too many local redirects, last one to %s", target)
+		}
+
+		fpm.logger.Debugf("local redirect %s -> %s", request.URL.RequestURI(), target)
+		response, err = fpm.Execute(fpm.localRedirectRequest(request, target, fpmReq))
+	}
+
+	return response, err
+}
+
+// localRedirectRequest creates GET request for the local redirect target like it was requested by the client,
+// it's limited by the same deadline and first byte timeout as the original request
+func (fpm *FpmClient) localRedirectRequest(request *http.Request, target string, previous FCgiRequest) FCgiRequest {
+	_, query, _ := strings.Cut(target, "?")
+	params := fpm.paramsBuilder.Build(request, 0, map[string]string{
+		"REQUEST_METHOD": http.MethodGet,
+		"REQUEST_URI":    target,
+		"QUERY_STRING":   query,
+		"CONTENT_TYPE":   "",
+		"CONTENT_LENGTH": "",
+		"REDIRECT_URL":   request.URL.Path,
+	})
+
+	fpmReq := fpm.NewRequest(params, nil)
+	fpmReq.Priority = previous.Priority
+	fpmReq.ClientKey = previous.ClientKey
+	fpmReq.Context = previous.Context
+	fpmReq.Deadline = previous.Deadline
+	fpmReq.FirstByteTimeout = previous.FirstByteTimeout
+	return fpmReq
+}
+
+// NewRequest creates FastCGI request from already prepared params and body
+func (fpm *FpmClient) NewRequest(params map[string]string, body []byte) FCgiRequest {
+	return fpm.fCgiClient.NewRequest(params, body)
+}
+
+// Execute sends the request to FPM
+func (fpm *FpmClient) Execute(fpmReq FCgiRequest) (*ResponseData, error) {
+	method := fpmReq.Params["REQUEST_METHOD"]
+
 	start := time.Now()
 	fpmResp, err := fpm.fCgiClient.SendRequest(fpmReq)
 	if err != nil {
-		fpm.monitor.FmpDurationHistogram.
-			WithLabelValues(
-				fpm.config.App,
-				TypeFpm,
-				request.Method,
-				fmt.Sprintf("%d", 0),
-				"",
-			).
-			Observe(float64(time.Since(start)))
-		return nil, fmt.Errorf("could not call FPM: %w", err)
+		return nil, fpm.failure(method, start, err)
+	}
+	route := fpmResp.Header.Get("X-App-Route")
+	fpmDuration := time.Since(start)
+	fpm.observe(method, fpmResp.StatusCode, route, fpmDuration)
+
+	// the body is already in memory, it's not copied again
+	var body, stderr []byte
+	if buffered, ok := fpmResp.Body.(bufferedBody); ok {
+		body, stderr = buffered.data, buffered.stderr
+		if fpmResp.ContentLength > int64(len(body)) {
+			return nil, fmt.Errorf("could not read response body: %w", io.ErrUnexpectedEOF)
+		}
+	} else if body, err = io.ReadAll(fpmResp.Body); err != nil {
+		return nil, fmt.Errorf("could not read response body: %w", err)
+	}
+
+	response := &ResponseData{
+		Status:  fpmResp.StatusCode,
+		Headers: fpmResp.Header,
+		Body:    body,
+		Route:   route,
+		Stderr:  stderr,
+
+		FpmDuration: fpmDuration,
+	}
+	if err := fpm.applyStatusPolicy(response, fpmResp.Status); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Stream sends the request with streamed body and returns the response as soon as its headers arrive.
+// Response body must be read from Stream and closed, the FPM connection is held till then.
+// Local redirects can't be detected without reading the body, so they are sent to the client.
+func (fpm *FpmClient) Stream(request *http.Request, body *StreamBody, deadline time.Time) (*ResponseData, error) {
+	params := fpm.paramsBuilder.Build(request, int(body.Length), nil)
+
+	fpmReq := fpm.NewRequest(params, nil)
+	fpmReq.BodyReader = body.Reader
+	fpmReq.Deadline = deadline
+	fpmReq.Priority = fpm.priorities.Resolve(request.URL.Path)
+	fpmReq.ClientKey = fairQueueKey(request, fpm.config.FairQueueKey)
+	fpmReq.Context = request.Context()
+	fpmReq.FirstByteTimeout = fpm.config.FpmFirstByteTimeout
+
+	method := params["REQUEST_METHOD"]
+	start := time.Now()
+	fpmResp, err := fpm.fCgiClient.StreamRequest(fpmReq, fpm.config.StreamBufferSize)
+	if err != nil {
+		return nil, fpm.failure(method, start, err)
 	}
 	route := fpmResp.Header.Get("X-App-Route")
+	fpmDuration := time.Since(start) // time to headers
+	fpm.observe(method, fpmResp.StatusCode, route, fpmDuration)
+
+	response := &ResponseData{
+		Status:  fpmResp.StatusCode,
+		Headers: fpmResp.Header,
+		Route:   route,
+
+		FpmDuration: fpmDuration,
+
+		Stream: fpmResp.Body,
+	}
+	if stream, ok := fpmResp.Body.(*fcgiStdoutReader); ok {
+		response.Stderr = stream.stderr
+	}
+	if err := fpm.applyStatusPolicy(response, fpmResp.Status); err != nil {
+		_ = fpmResp.Body.Close()
+		return nil, err
+	}
+	policy := fpm.config.RedirectPolicy
+	if policy == RedirectPolicyLocal {
+		policy = RedirectPolicyClient
+	}
+	applyRedirectPolicy(policy, response)
+
+	return response, nil
+}
+
+// observe records duration of successful FPM request
+func (fpm *FpmClient) observe(method string, status int, route string, duration time.Duration) {
 	fpm.monitor.FmpDurationHistogram.
 		WithLabelValues(
 			fpm.config.App,
 			TypeFpm,
-			request.Method,
-			fmt.Sprintf("%d", fpmResp.StatusCode),
+			method,
+			fmt.Sprintf("%d", status),
 			route,
 		).
+		Observe(duration.Seconds())
+}
+
+// failure records failed FPM request and wraps its error
+func (fpm *FpmClient) failure(method string, start time.Time, err error) error {
+	fpm.monitor.FmpDurationHistogram.
+		WithLabelValues(
+			fpm.config.App,
+			TypeFpm,
+			method,
+			fmt.Sprintf("%d", 0),
+			"",
+		).
 		Observe(time.Since(start).Seconds())
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		fpm.monitor.ShedRequestsCounter.WithLabelValues(fpm.config.App, ShedReasonQueueFull).Inc()
+	case errors.Is(err, ErrQueueTimeout):
+		fpm.monitor.ShedRequestsCounter.WithLabelValues(fpm.config.App, ShedReasonQueueTimeout).Inc()
+	case errors.Is(err, ErrPoolSaturated):
+		fpm.monitor.ShedRequestsCounter.WithLabelValues(fpm.config.App, ShedReasonPriority).Inc()
+	}
+	if errors.Is(err, ErrFpmProtocol) {
+		fpm.monitor.ProtocolErrorsCounter.WithLabelValues(fpm.config.App).Inc()
+	}
+	if errors.Is(err, ErrRequestAborted) {
+		fpm.monitor.AbortedRequestsCounter.WithLabelValues(fpm.config.App).Inc()
+	}
+	if errors.Is(err, ErrFirstByteTimeout) {
+		fpm.monitor.FirstByteTimeoutsCounter.WithLabelValues(fpm.config.App).Inc()
+	}
+	var statusErr *ProtocolStatusError
+	if errors.As(err, &statusErr) {
+		fpm.monitor.RejectedRequestsCounter.WithLabelValues(fpm.config.App, protocolStatusName(statusErr.ProtocolStatus)).Inc()
+	}
+	return fmt.Errorf("could not call FPM: %w", err)
+}
 
-	// read data from response
-	body, err := io.ReadAll(fpmResp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("could not read response body: %w", err)
+// Backpressure returns state of the FPM pool announced to clients whose requests were shed.
+// Retry-After grows with the number of requests queued per connection.
+func (fpm *FpmClient) Backpressure() BackpressureState {
+	size := fpm.fCgiClient.Size()
+	busy := fpm.fCgiClient.Busy()
+	waiting := fpm.fCgiClient.Waiting()
+
+	queued := 1.0
+	if size > 0 {
+		queued += float64(waiting) / float64(size)
 	}
 
-	return &ResponseData{
-		Status:  fpmResp.StatusCode,
-		Headers: fpmResp.Header,
-		Body:    body,
-		Route:   route,
-	}, nil
+	remaining := size - busy
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return BackpressureState{
+		Limit:      size,
+		Remaining:  remaining,
+		RetryAfter: time.Duration(queued * float64(fpm.config.RetryAfter)),
+	}
 }
 
 func (fpm *FpmClient) Close() {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// FpmHealthChecker periodically checks idle FPM connections and replaces dead ones (see FCgiClient.CheckIdle)
+type FpmHealthChecker struct {
+	fCgiClient *FCgiClient
+	config     *Config
+	logger     *logrus.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewFpmHealthChecker(fCgiClient *FCgiClient, config *Config, logger *logrus.Logger) *FpmHealthChecker {
+	return &FpmHealthChecker{
+		fCgiClient: fCgiClient,
+		config:     config,
+		logger:     logger,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Enabled reports whether --fpm-health-interval is set
+func (hc *FpmHealthChecker) Enabled() bool {
+	return hc.config.FpmHealthInterval > 0
+}
+
+func (hc *FpmHealthChecker) Start() {
+	if !hc.Enabled() {
+		close(hc.done)
+		return
+	}
+	go hc.run()
+}
+
+func (hc *FpmHealthChecker) Stop() {
+	close(hc.stop)
+	<-hc.done
+}
+
+func (hc *FpmHealthChecker) run() {
+	defer close(hc.done)
+
+	ticker := time.NewTicker(hc.config.FpmHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hc.stop:
+			return
+		case <-ticker.C:
+		}
+
+		checked, replaced := hc.fCgiClient.CheckIdle()
+		if replaced > 0 {
+			hc.logger.Infof("FPM health check replaced %d of %d idle connections", replaced, checked)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// reasons of FPM failing to run the script, used as metrics label
+const (
+	ScriptErrorUnknown      = "script_unknown"
+	ScriptErrorAccessDenied = "access_denied"
+)
+
+// scriptErrors are messages FPM writes to stderr when it can't run the script, it answers with its own
+// plain text page ("File not found.", "Access denied.") then
+var scriptErrors = []struct {
+	message []byte
+	reason  string
+	status  int
+}{
+	{[]byte("Primary script unknown"), ScriptErrorUnknown, http.StatusNotFound},
+	{[]byte("(see security.limit_extensions)"), ScriptErrorAccessDenied, http.StatusForbidden},
+}
+
+// scriptError recognizes responses generated by FPM itself because the script couldn't be run,
+// found is false for responses of PHP scripts
+func scriptError(response *ResponseData) (reason string, status int, found bool) {
+	if len(response.Stderr) == 0 || response.Status < http.StatusBadRequest {
+		return "", 0, false
+	}
+	for _, scriptErr := range scriptErrors {
+		if bytes.Contains(response.Stderr, scriptErr.message) {
+			return scriptErr.reason, scriptErr.status, true
+		}
+	}
+	return "", 0, false
+}
+
+// writeScriptError replaces FPM's plain text page with the proxy error page when FPM couldn't run the script,
+// false is returned when the response comes from PHP and must be written as it is
+func (hs *HttpServer) writeScriptError(writer http.ResponseWriter, request *http.Request, response *ResponseData, start time.Time) bool {
+	reason, status, found := scriptError(response)
+	if !found {
+		return false
+	}
+	hs.monitor.ScriptErrorsCounter.WithLabelValues(hs.config.App, reason).Inc()
+	hs.logger.WithFields(logrus.Fields{
+		"uri":    request.URL.RequestURI(),
+		"reason": reason,
+		"stderr": string(bytes.TrimSpace(response.Stderr)),
+	}).Warnf("FPM could not run %s, check --%s and the FPM pool config", hs.config.IndexFile, ParamIndex)
+	hs.accessLogger.LogFpm(request, response)
+	hs.writeProxyError(writer, request, status, start)
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// durationMatchTolerance is the allowed difference between request duration measured by the proxy and by FPM
+const durationMatchTolerance = 50 * time.Millisecond
+
+// FpmStatus is the full status page of FPM pool (pm.status_path?json&full)
+type FpmStatus struct {
+	Pool            string       `json:"pool"`
+	ProcessManager  string       `json:"process manager"`
+	ActiveProcesses int          `json:"active processes"`
+	IdleProcesses   int          `json:"idle processes"`
+	TotalProcesses  int          `json:"total processes"`
+	Processes       []FpmProcess `json:"processes"`
+}
+
+// FpmProcess is one FPM worker, request fields describe the current or the last served request
+type FpmProcess struct {
+	Pid             int    `json:"pid"`
+	State           string `json:"state"`
+	Requests        int    `json:"requests"`
+	RequestDuration int64  `json:"request duration"` // microseconds
+	RequestMethod   string `json:"request method"`
+	RequestUri      string `json:"request uri"`
+}
+
+// FpmStatusReader reads FPM status page through the pool
+type FpmStatusReader struct {
+	fpmClient *FpmClient
+	config    *Config
+}
+
+func NewFpmStatusReader(config *Config, fpmClient *FpmClient) *FpmStatusReader {
+	return &FpmStatusReader{
+		fpmClient: fpmClient,
+		config:    config,
+	}
+}
+
+// Enabled reports whether FPM status path is configured
+func (sr *FpmStatusReader) Enabled() bool {
+	return sr.config.FpmStatusPath != ""
+}
+
+// Fetch returns current state of the FPM pool
+func (sr *FpmStatusReader) Fetch() (*FpmStatus, error) {
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"REQUEST_METHOD":    http.MethodGet,
+		"SCRIPT_FILENAME":   sr.config.FpmStatusPath,
+		"SCRIPT_NAME":       sr.config.FpmStatusPath,
+		"REQUEST_URI":       sr.config.FpmStatusPath + "?json&full",
+		"QUERY_STRING":      "json&full",
+		"SERVER_SOFTWARE":   "gophpfpm/" + Version,
+	}
+	response, err := sr.fpmClient.Execute(sr.fpmClient.NewRequest(params, nil))
+	if err != nil {
+		return nil, err
+	}
+	if response.Status != http.StatusOK {
+		return nil, fmt.Errorf("FPM status page responded with %d", response.Status)
+	}
+
+	var status FpmStatus
+	if err := json.Unmarshal(response.Body, &status); err != nil {
+		return nil, fmt.Errorf("could not parse FPM status page: %w", err)
+	}
+	return &status, nil
+}
+
+// FindWorker returns PID of the idle worker whose last request matches method, query string and duration.
+// FPM reports script name instead of the original uri, so the match is accepted only when it's unique.
+func (status *FpmStatus) FindWorker(method string, query string, duration time.Duration) (int, bool) {
+	pid, matches := 0, 0
+	for _, process := range status.Processes {
+		if process.State != "Idle" || process.RequestMethod != method {
+			continue
+		}
+		_, processQuery, _ := strings.Cut(process.RequestUri, "?")
+		if processQuery != query {
+			continue
+		}
+		// FPM measures only processing, the proxy measures also waiting for a connection and transfer
+		processDuration := time.Duration(process.RequestDuration) * time.Microsecond
+		if processDuration > duration+durationMatchTolerance || processDuration < duration-duration/10-durationMatchTolerance {
+			continue
+		}
+		pid = process.Pid
+		matches++
+	}
+	return pid, matches == 1
+}
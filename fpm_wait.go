@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+const (
+	fpmWaitInitialBackoff = 100 * time.Millisecond
+	fpmWaitMaxBackoff     = 5 * time.Second
+)
+
+// waitForFpm dials FPM with exponential backoff till it accepts a connection or --fpm-wait elapses.
+// FPM running as a sidecar may start later than the proxy, its socket doesn't exist yet then.
+func waitForFpm(dial func() (net.Conn, error), config *Config, logger *log.Logger) error {
+	network, address := config.FpmNetwork()
+	deadline := time.Now().Add(config.FpmWait)
+	backoff := fpmWaitInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		conn, err := dial()
+		if err == nil {
+			_ = conn.Close()
+			if attempt > 1 {
+				logger.Infof("FPM %s %s is available after %d attempts", network, address, attempt)
+			}
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("FPM %s %s is not available after %s: %w", network, address, config.FpmWait, err)
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		logger.Infof("FPM %s %s is not available yet, retrying in %s: %s", network, address, backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > fpmWaitMaxBackoff {
+			backoff = fpmWaitMaxBackoff
+		}
+	}
+}
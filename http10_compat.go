@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// http10Compat reports whether the request comes from HTTP/1.0 client served in compatibility mode.
+// Such clients get buffered responses with Content-Length, never a streamed body.
+func (hs *HttpServer) http10Compat(request *http.Request) bool {
+	return hs.config.Http10Compat && request.ProtoMajor == 1 && request.ProtoMinor == 0
+}
+
+// applyHttp10Compat sets Content-Length of the complete body and removes headers listed by --http10-strip-header
+func (hs *HttpServer) applyHttp10Compat(request *http.Request, header http.Header, status int, body []byte) {
+	if request.Method != http.MethodHead && bodyAllowedForStatus(status) {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	for _, name := range hs.config.Http10StripHeaders {
+		header.Del(name)
+	}
+}
+
+// headerSize returns size of the header block as it's sent to the client, without the status line
+func headerSize(header http.Header) int {
+	size := 2 // empty line
+	for name, values := range header {
+		for _, value := range values {
+			size += len(name) + len(value) + 4 // ": " and CRLF
+		}
+	}
+	return size
+}
+
+// exceedsHeaderBudget replaces response with 502 when its headers are larger than --response-header-budget,
+// clients with small fixed buffers (embedded devices, strict intermediaries) would fail on them anyway
+func (hs *HttpServer) exceedsHeaderBudget(writer http.ResponseWriter, request *http.Request, start time.Time) bool {
+	budget := hs.config.ResponseHeaderBudget
+	if budget <= 0 {
+		return false
+	}
+	size := headerSize(writer.Header())
+	if size <= budget {
+		return false
+	}
+
+	hs.logger.Warnf("response headers of %s %s have %d bytes, over the budget of %d bytes", request.Method, request.URL.Path, size, budget)
+	for name := range writer.Header() {
+		if name != RequestIdHeader {
+			writer.Header().Del(name)
+		}
+	}
+	hs.WriteStatus(writer, request, http.StatusBadGateway, fmt.Errorf("response headers have %d bytes, budget is %d bytes", size, budget), start)
+	return true
+}
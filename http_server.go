@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -16,13 +22,36 @@ import (
 type HttpServer struct {
 	Port int
 
-	router       *http.ServeMux
-	fpmClient    *FpmClient
-	srv          *http.Server
-	config       *Config
-	accessLogger *AccessLogger
-	monitor      *Monitor
-	logger       *logrus.Logger
+	router        *http.ServeMux
+	statics       atomic.Pointer[http.ServeMux] // static folders, replaced by SIGHUP reload
+	fpmClient     *FpmClient
+	compressor    *ResponseCompressor
+	subFilter     *SubFilter
+	assetManifest *AssetManifest
+	cache         *ResponseCache
+	idempotency   *IdempotencyStore
+	costSampler   *CostSampler
+	faultInjector *FaultInjector
+	abBuckets     *AbBuckets
+	rateLimiter   *RateLimiter
+	timeouts      *TimeoutPolicy
+	tenants       *Tenants
+	indexWatcher  *IndexWatcher
+	forwardAuth   *ForwardAuth
+	bodyScanner   *BodyScanner
+	fallbacks     *FallbackPages
+	accessRules   *AccessRules
+	bandwidth     *BandwidthShaper
+	drain         *DrainTracker
+	srv           *http.Server            // serves all handlers, template of servers of other handler sets
+	handlers      map[string]http.Handler // handler sets of listeners
+	config        *Config
+	accessLogger  *AccessLogger
+	monitor       *Monitor
+	adminServer   *AdminServer
+	logger        *logrus.Logger
+
+	shutdownHooks []func()
 }
 
 // LoggingResponseWriter is a wrapper around an http.ResponseWriter that
@@ -43,31 +72,136 @@ func (lrw *LoggingResponseWriter) WriteHeader(code int) {
 	lrw.statusCode = code
 }
 
+// Flush sends buffered data to the client, streamed responses depend on it
+func (lrw *LoggingResponseWriter) Flush() {
+	if flusher, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func NewHttpServer(
 	config *Config,
 	fpmClient *FpmClient,
+	compressor *ResponseCompressor,
+	subFilter *SubFilter,
+	assetManifest *AssetManifest,
+	cache *ResponseCache,
+	idempotency *IdempotencyStore,
+	costSampler *CostSampler,
+	faultInjector *FaultInjector,
+	abBuckets *AbBuckets,
+	rateLimiter *RateLimiter,
+	timeouts *TimeoutPolicy,
+	tenants *Tenants,
+	indexWatcher *IndexWatcher,
+	forwardAuth *ForwardAuth,
+	bodyScanner *BodyScanner,
+	fallbacks *FallbackPages,
+	accessRules *AccessRules,
+	bandwidth *BandwidthShaper,
+	drain *DrainTracker,
+	tlsConfig *tls.Config,
 	accessLogger *AccessLogger,
 	monitor *Monitor,
+	adminServer *AdminServer,
 	logger *logrus.Logger,
 ) *HttpServer {
 	router := http.NewServeMux()
 
-	return &HttpServer{
-		Port:      config.Port,
-		router:    router,
-		fpmClient: fpmClient,
+	hs := &HttpServer{
+		Port:          config.Port,
+		router:        router,
+		fpmClient:     fpmClient,
+		compressor:    compressor,
+		subFilter:     subFilter,
+		assetManifest: assetManifest,
+		cache:         cache,
+		idempotency:   idempotency,
+		costSampler:   costSampler,
+		faultInjector: faultInjector,
+		abBuckets:     abBuckets,
+		rateLimiter:   rateLimiter,
+		timeouts:      timeouts,
+		tenants:       tenants,
+		indexWatcher:  indexWatcher,
+		forwardAuth:   forwardAuth,
+		bodyScanner:   bodyScanner,
+		fallbacks:     fallbacks,
+		accessRules:   accessRules,
+		bandwidth:     bandwidth,
+		drain:         drain,
 		srv: &http.Server{
-			Addr:    fmt.Sprintf(":%d", config.Port),
 			Handler: router,
 		},
 		config:       config,
 		accessLogger: accessLogger,
 		monitor:      monitor,
+		adminServer:  adminServer,
 		logger:       logger,
 	}
+	if tlsConfig != nil {
+		configureTls(hs.srv, tlsConfig)
+	}
+	if config.Streaming || len(config.StreamPrefixes) > 0 {
+		monitor.StreamThresholdGauge.WithLabelValues(config.App).Set(float64(config.StreamThreshold))
+	}
+	for name, enabled := range config.Features {
+		monitor.FeaturesInfo.WithLabelValues(config.App, name, strconv.FormatBool(enabled)).Set(1)
+	}
+	return hs
 }
 
 func (hs *HttpServer) PrepareServer() {
+	hs.srv.ConnState = hs.trackConnState
+	hs.srv.ErrorLog = hs.serverErrorLog()
+
+	if err := hs.SetStaticFolders(hs.config.StaticFolders); err != nil {
+		hs.logger.Fatalf("%s", err)
+	}
+
+	// prometheus metrics handler
+	metrics := promhttp.HandlerFor(
+		hs.monitor.Registry,
+		promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+			Registry:          hs.monitor.Registry,
+		},
+	)
+
+	if hs.config.ReadinessPath != "" {
+		hs.router.HandleFunc(hs.config.ReadinessPath, hs.handleReadiness)
+	}
+
+	// default route to handle anything else
+	hs.router.Handle("/", hs.staticMiddleware(requestIdMiddleware(hs.tenants.Middleware(hs.accessRulesMiddleware(hs.rateLimitMiddleware(hs.abBuckets.Middleware(hs.optionsMiddleware(hs.forwardAuthMiddleware(hs.csrfMiddleware(hs.bodyScanMiddleware(http.HandlerFunc(hs.handleFpm))))))))))))
+
+	all := http.NewServeMux()
+	all.Handle("/metrics", metrics)
+	all.Handle("/", hs.router)
+
+	// internal endpoints are not drained nor shaped, like on the admin port
+	internal := http.NewServeMux()
+	internal.Handle("/metrics", metrics)
+	internal.Handle("/admin/", hs.adminServer.router)
+	if hs.config.ReadinessPath != "" {
+		internal.HandleFunc(hs.config.ReadinessPath, hs.handleReadiness)
+	}
+
+	hs.handlers = map[string]http.Handler{
+		HandlersAll:      hs.publicHandler(all),
+		HandlersPublic:   hs.publicHandler(hs.router),
+		HandlersInternal: internal,
+	}
+	hs.srv.Handler = hs.handlers[HandlersAll]
+}
+
+// publicHandler wraps handler with middlewares applied to all public requests
+func (hs *HttpServer) publicHandler(handler http.Handler) http.Handler {
+	return hs.drain.Middleware(hs.bandwidth.Middleware(basePathMiddleware(hs.config.BasePath, hs.assetManifest.Middleware(handler))))
+}
+
+// SetStaticFolders replaces static folder mounts, requests already being served finish with the old ones
+func (hs *HttpServer) SetStaticFolders(staticFolders []string) error {
 	staticMiddleWare := func(endpointPrefix string, next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
@@ -85,156 +219,449 @@ func (hs *HttpServer) PrepareServer() {
 		})
 	}
 
-	for _, staticFolder := range hs.config.StaticFolders {
+	statics := http.NewServeMux()
+	for _, staticFolder := range staticFolders {
 		parts := strings.Split(staticFolder, ":")
 		if len(parts) != 2 {
-			hs.logger.Fatalf("invalid static folder definition: %s", staticFolder)
+			return fmt.Errorf("invalid static folder definition: %s", staticFolder)
 		}
 		fs := http.FileServer(http.Dir(parts[0]))
 		prefix := fmt.Sprintf("%s/", parts[1])
-		hs.router.Handle(prefix, staticMiddleWare(prefix, http.StripPrefix(parts[1], fs)))
+		statics.Handle(prefix, staticMiddleWare(prefix, http.StripPrefix(parts[1], fs)))
 	}
+	hs.statics.Store(statics)
+	return nil
+}
 
-	// prometheus metrics handler
-	hs.router.Handle("/metrics", promhttp.HandlerFor(
-		hs.monitor.Registry,
-		promhttp.HandlerOpts{
-			EnableOpenMetrics: true,
-			Registry:          hs.monitor.Registry,
-		},
-	))
+// staticMiddleware serves requests matching a static folder, others are passed to PHP
+func (hs *HttpServer) staticMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, pattern := hs.statics.Load().Handler(r); pattern != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	// default route to handle anything else
-	hs.router.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
-		start := time.Now()
+// handleReadiness answers 200 when requests can be served, 503 otherwise (e.g. the index file is missing)
+func (hs *HttpServer) handleReadiness(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	if err := hs.indexWatcher.Err(); err != nil {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(writer, err)
+		return
+	}
+	_, _ = fmt.Fprintln(writer, "ready")
+}
 
-		var err error
-		var fpmErr error
-		var fpmResponse *ResponseData
+// handleFpm passes the request to PHP-FPM and writes its response
+func (hs *HttpServer) handleFpm(writer http.ResponseWriter, request *http.Request) {
+	if err := hs.indexWatcher.Err(); err != nil {
+		if !hs.writeFallback(writer, request, err, time.Now()) {
+			hs.WriteStatus(writer, request, http.StatusServiceUnavailable, err, time.Now())
+		}
+		return
+	}
+	if _, streamed := matchPrefix(request.URL.Path, hs.config.StreamPrefixes); (streamed || hs.config.Streaming) && !hs.http10Compat(request) {
+		hs.handleFpmStream(writer, request)
+		return
+	}
 
-		worker, cancel := context.WithCancel(context.Background())
-		ctx, _ := context.WithTimeout(context.Background(), hs.config.Timeout)
-		go func() {
-			fpmResponse, fpmErr = hs.fpmClient.Call(request)
-			cancel()
-		}()
+	start := time.Now()
+	sample := hs.costSampler.Start()
 
-		select {
-		case <-ctx.Done():
-			// timeout hit - return 408 and stop processing
-			hs.WriteTimeout(writer, request, fmt.Errorf("timeout"), start)
-			return
-		case <-worker.Done():
-			// everything is fine
-			// fpmResponse variable is set
-		}
+	err := decompressRequestBody(request, hs.config.MaxDecompressedSize)
+	if err != nil {
+		hs.WriteStatus(writer, request, decompressionErrorStatus(err), err, start)
+		return
+	}
 
-		if fpmErr != nil {
-			hs.WriteError(writer, request, fmt.Errorf("could not call FPM: %s\n", fpmErr), start)
-			return
-		}
+	if cached, found := hs.cache.Get(request); found {
+		writer.Header().Set("X-Cache", "HIT")
+		hs.writeResponse(writer, request, cached, start)
+		return
+	}
 
-		if fpmResponse == nil {
-			// should never happen
-			// just to be completely sure
-			hs.WriteError(writer, request, fmt.Errorf("FPM response is nil"), start)
+	idempotencyKey, idempotent := hs.idempotency.Key(request)
+	if idempotent {
+		replay, err := hs.idempotency.Begin(idempotencyKey, request)
+		switch {
+		case errors.Is(err, ErrIdempotencyInFlight):
+			hs.WriteStatus(writer, request, http.StatusConflict, err, start)
+			return
+		case errors.Is(err, ErrIdempotencyMismatch):
+			hs.WriteStatus(writer, request, http.StatusUnprocessableEntity, err, start)
+			return
+		case err != nil:
+			hs.WriteStatus(writer, request, http.StatusBadRequest, err, start)
+			return
+		case replay != nil:
+			writer.Header().Set(IdempotentReplayedHeader, "true")
+			hs.writeResponse(writer, request, replay, start)
 			return
 		}
+		// the key is released when the request fails before FPM responds
+		defer hs.idempotency.Release(idempotencyKey)
+	}
 
-		hs.accessLogger.LogFpm(request, fpmResponse)
+	fault := hs.faultInjector.Decide()
+	if fault.Drop {
+		// aborts the handler and closes the client connection without response
+		panic(http.ErrAbortHandler)
+	}
 
-		for name, headers := range fpmResponse.Headers {
-			for _, header := range headers {
-				_, found := protectedHeadersOutbound[strings.ToLower(name)]
-				if !found {
-					writer.Header().Add(name, header)
-				}
-			}
-		}
+	var fpmErr error
+	var fpmResponse *ResponseData
 
-		writer.WriteHeader(fpmResponse.Status)
-		_, err = writer.Write(fpmResponse.Body)
-		if err != nil {
-			// should not happen
-			hs.logger.Errorf("could not write response body: %s\n", err)
+	timeout := hs.timeouts.Resolve(request.Method, request.URL.Path)
+	worker, cancel := context.WithCancel(context.Background())
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), timeout.Timeout)
+	defer cancelTimeout()
+	deadline, _ := ctx.Deadline()
+	if hs.config.DeadlineHint {
+		setDeadlineHint(request, deadline)
+	}
+	// FPM request is aborted when the client disconnects or the handler returns before it's finished (timeout)
+	call, abortCall := context.WithCancel(request.Context())
+	defer abortCall()
+	go func() {
+		time.Sleep(fault.Latency)
+		if fault.ErrorStatus != 0 {
+			fpmResponse, fpmErr = nil, errInjectedFault
+			cancel()
 			return
 		}
+		fpmResponse, fpmErr = hs.fpmClient.Call(request.WithContext(call), deadline)
+		cancel()
+	}()
 
-		hs.monitor.HttpDurationHistogram.
-			WithLabelValues(
-				hs.config.App,
-				TypeHttp,
-				request.Method,
-				fmt.Sprintf("%d", fpmResponse.Status),
-				fpmResponse.Route,
-			).
-			Observe(time.Since(start).Seconds())
-	})
+	select {
+	case <-ctx.Done():
+		// timeout hit - return timeout status and stop processing
+		hs.monitor.TimeoutsCounter.WithLabelValues(hs.config.App, timeout.Route).Inc()
+		hs.WriteTimeout(writer, request, fmt.Errorf("timeout after %s", timeout.Timeout), start)
+		return
+	case <-worker.Done():
+		// everything is fine
+		// fpmResponse variable is set
+	}
+
+	if hs.writeFallback(writer, request, fpmErr, start) {
+		return
+	}
+
+	if errors.Is(fpmErr, ErrPoolSaturated) {
+		hs.fpmClient.Backpressure().WriteHeaders(writer.Header())
+		hs.WriteStatus(writer, request, http.StatusServiceUnavailable, fpmErr, start)
+		return
+	}
+
+	if errors.Is(fpmErr, ErrFpmProtocol) {
+		hs.WriteStatus(writer, request, http.StatusBadGateway, fpmErr, start)
+		return
+	}
+
+	if errors.Is(fpmErr, ErrRequestAborted) {
+		hs.WriteStatus(writer, request, StatusClientClosedRequest, fpmErr, start)
+		return
+	}
+
+	if errors.Is(fpmErr, ErrInformationalStatus) {
+		hs.WriteStatus(writer, request, hs.config.InformationalStatus, fpmErr, start)
+		return
+	}
+
+	if errors.Is(fpmErr, ErrFirstByteTimeout) {
+		hs.monitor.TimeoutsCounter.WithLabelValues(hs.config.App, timeout.Route).Inc()
+		hs.WriteTimeout(writer, request, fpmErr, start)
+		return
+	}
+
+	var statusErr *ProtocolStatusError
+	if errors.As(fpmErr, &statusErr) {
+		hs.WriteStatus(writer, request, statusErr.HttpStatus(), fpmErr, start)
+		return
+	}
+
+	if errors.Is(fpmErr, errInjectedFault) {
+		hs.WriteStatus(writer, request, fault.ErrorStatus, fpmErr, start)
+		return
+	}
+
+	if fpmErr != nil {
+		hs.WriteError(writer, request, fmt.Errorf("could not call FPM: %s\n", fpmErr), start)
+		return
+	}
+
+	if fpmResponse == nil {
+		// should never happen
+		// just to be completely sure
+		hs.WriteError(writer, request, fmt.Errorf("FPM response is nil"), start)
+		return
+	}
+
+	if hs.writeScriptError(writer, request, fpmResponse, start) {
+		return
+	}
+	hs.logStderr(request, fpmResponse)
+
+	if idempotent {
+		hs.idempotency.Finish(idempotencyKey, fpmResponse)
+	}
+
+	if hs.cache.Enabled() {
+		hs.cache.Store(request, fpmResponse)
+		writer.Header().Set("X-Cache", "MISS")
+	}
+
+	if hs.config.StderrInResponse {
+		attachStderr(fpmResponse)
+	}
+	hs.writeResponse(writer, request, fpmResponse, start)
+	hs.costSampler.Record(sample, fpmResponse)
 }
 
-func (hs *HttpServer) WriteError(writer http.ResponseWriter, request *http.Request, err error, start time.Time) {
-	hs.logger.Errorf("server error: %s\n", err)
-	writer.WriteHeader(http.StatusInternalServerError)
-	_, writeError := writer.Write([]byte("Internal server error"))
-	if writeError != nil {
+// writeResponse writes FPM response to the client
+func (hs *HttpServer) writeResponse(writer http.ResponseWriter, request *http.Request, fpmResponse *ResponseData, start time.Time) {
+	hs.accessLogger.LogFpm(request, fpmResponse)
+
+	if !bodyAllowedForStatus(fpmResponse.Status) {
+		// PHP may echo a body to 304 or 204, it must not reach the client, Content-Length would not match
+		fpmResponse.Body = nil
+		delete(fpmResponse.Headers, "Content-Length")
+	}
+	hs.applyDefaultType(request, fpmResponse)
+
+	hs.subFilter.Apply(request, fpmResponse)
+	if hs.config.JsonMinify {
+		minifyJson(request, fpmResponse)
+	}
+	if hs.config.DefaultCharset != "" {
+		setDefaultCharset(fpmResponse, hs.config.DefaultCharset)
+	}
+	err := hs.compressor.Compress(request, fpmResponse)
+	if err != nil {
+		// response is sent uncompressed
+		hs.logger.Errorf("could not compress response: %s\n", err)
+	}
+
+	if hs.config.Etag {
+		// computed over the compressed body, every encoding is a different representation
+		setEtag(request, fpmResponse, hs.config.EtagMaxSize)
+		if notModified(request, fpmResponse) {
+			fpmResponse.Status = http.StatusNotModified
+			fpmResponse.Body = nil
+		}
+	}
+
+	hs.writeHeaders(writer, fpmResponse)
+	if hs.http10Compat(request) {
+		hs.applyHttp10Compat(request, writer.Header(), fpmResponse.Status, fpmResponse.Body)
+	}
+	if hs.exceedsHeaderBudget(writer, request, start) {
+		return
+	}
+
+	if fpmResponse.Status >= http.StatusInternalServerError {
+		hs.monitor.RecentErrors.Add(request, fpmResponse.Status, "FPM responded with error status")
+	}
+
+	writer.WriteHeader(fpmResponse.Status)
+	_, err = writer.Write(fpmResponse.Body)
+	if err != nil {
 		// should not happen
 		hs.logger.Errorf("could not write response body: %s\n", err)
+		return
 	}
+
 	hs.monitor.HttpDurationHistogram.
 		WithLabelValues(
 			hs.config.App,
 			TypeHttp,
 			request.Method,
-			fmt.Sprintf("%d", http.StatusInternalServerError),
-			"",
+			fmt.Sprintf("%d", fpmResponse.Status),
+			fpmResponse.Route,
 		).
 		Observe(time.Since(start).Seconds())
 }
 
+// applyDefaultType sets configured Content-Type to responses without one
+func (hs *HttpServer) applyDefaultType(request *http.Request, fpmResponse *ResponseData) {
+	if hasContentType(fpmResponse) || !bodyAllowedForStatus(fpmResponse.Status) {
+		return
+	}
+	if hs.config.StrictContentType {
+		hs.logger.Warnf("FPM response without Content-Type: %s %s\n", request.Method, request.URL.Path)
+	}
+	if hs.config.DefaultType != "" {
+		http.Header(fpmResponse.Headers).Set("Content-Type", hs.config.DefaultType)
+	}
+}
+
+// writeHeaders copies FPM response headers to the client except the protected ones
+func (hs *HttpServer) writeHeaders(writer http.ResponseWriter, fpmResponse *ResponseData) {
+	if hs.config.SecurityHeaders {
+		writeSecurityHeaders(writer.Header(), fpmResponse)
+	}
+
+	for name, headers := range fpmResponse.Headers {
+		for _, header := range headers {
+			_, found := protectedHeadersOutbound[strings.ToLower(name)]
+			if !found {
+				writer.Header().Add(name, header)
+			}
+		}
+	}
+}
+
+func (hs *HttpServer) WriteError(writer http.ResponseWriter, request *http.Request, err error, start time.Time) {
+	hs.logger.Errorf("server error: %s\n", err)
+	hs.monitor.RecentErrors.Add(request, http.StatusInternalServerError, err.Error())
+	hs.writeProxyError(writer, request, http.StatusInternalServerError, start)
+}
+
+func (hs *HttpServer) WriteStatus(writer http.ResponseWriter, request *http.Request, status int, err error, start time.Time) {
+	hs.logger.Debugf("request rejected with %d: %s\n", status, err)
+	if status >= http.StatusInternalServerError {
+		hs.monitor.RecentErrors.Add(request, status, err.Error())
+	}
+	hs.writeProxyError(writer, request, status, start)
+}
+
+// WriteTimeout writes response to request which hit its timeout, status and body are configurable
 func (hs *HttpServer) WriteTimeout(writer http.ResponseWriter, request *http.Request, err error, start time.Time) {
 	hs.logger.Infof("request timeout")
-	writer.WriteHeader(http.StatusRequestTimeout)
-	_, writeError := writer.Write([]byte("timeout"))
-	if writeError != nil {
+	status := hs.config.TimeoutStatus
+	hs.monitor.RecentErrors.Add(request, status, err.Error())
+	if hs.config.TimeoutBody == nil {
+		hs.writeProxyError(writer, request, status, start)
+		return
+	}
+	if err := writeStaticBody(writer, status, hs.config.TimeoutBody); err != nil {
+		hs.logger.Errorf("could not write response body: %s\n", err)
+	}
+	hs.observeProxyError(request, status, start)
+}
+
+// writeProxyError writes error generated by the proxy itself and observes request duration
+func (hs *HttpServer) writeProxyError(writer http.ResponseWriter, request *http.Request, status int, start time.Time) {
+	if err := writeErrorBody(writer, request, status); err != nil {
 		// should not happen
 		hs.logger.Errorf("could not write response body: %s\n", err)
 	}
+	hs.observeProxyError(request, status, start)
+}
+
+func (hs *HttpServer) observeProxyError(request *http.Request, status int, start time.Time) {
 	hs.monitor.HttpDurationHistogram.
 		WithLabelValues(
 			hs.config.App,
 			TypeHttp,
 			request.Method,
-			fmt.Sprintf("%d", http.StatusRequestTimeout),
+			fmt.Sprintf("%d", status),
 			"",
 		).
 		Observe(time.Since(start).Seconds())
 }
 
+// OnShutdown registers hook called after the server stops accepting requests, before FPM connections are closed
+func (hs *HttpServer) OnShutdown(hook func()) {
+	hs.shutdownHooks = append(hs.shutdownHooks, hook)
+}
+
 func (hs *HttpServer) StartServer() {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		if err := hs.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			hs.logger.Infof("listen: %s\n", err)
+	// decided once, serving plain HTTP sets up TLSConfig for HTTP/2 which must not switch other listeners to TLS
+	useTls := hs.srv.TLSConfig != nil
+	servers := map[string]*http.Server{HandlersAll: hs.srv}
+	for _, listener := range hs.config.Listeners {
+		srv, found := servers[listener.Handlers]
+		if !found {
+			srv = hs.newListenerServer(listener.Handlers)
+			servers[listener.Handlers] = srv
 		}
-	}()
+		l, err := listen(listener, hs.config.ListenSocketMode)
+		if err != nil {
+			hs.logger.Fatalf("could not listen on %s: %s", listener, err)
+		}
+		go func() {
+			serve := srv.Serve
+			if useTls {
+				serve = func(l net.Listener) error { return srv.ServeTLS(l, "", "") }
+			}
+			if err := serve(l); err != nil && err != http.ErrServerClosed {
+				hs.logger.Infof("listen: %s\n", err)
+			}
+		}()
+		hs.logger.Infof("Listening on %s (%s handlers)", listener, listener.Handlers)
+	}
 	hs.logger.Info("Server Started")
+	logBanner(hs.config, collectRuntimeInfo(hs.config, hs.fpmClient.fCgiClient))
+
+	if hs.adminServer.Enabled() {
+		hs.adminServer.Start()
+	}
 
 	<-done
 	hs.logger.Info("Server Stopped")
+	hs.drain.Begin(hs.config.ShutdownTimeout)
+	hs.logger.Infof("Draining %d requests in flight, drain window is %s", hs.drain.InFlight(), hs.config.ShutdownTimeout)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), hs.config.ShutdownTimeout)
 	defer func() {
 		// extra handling here
 		cancel()
 	}()
 
-	if err := hs.srv.Shutdown(ctx); err != nil {
+	// all listeners stop accepting at once and share the drain window
+	var wg sync.WaitGroup
+	var errs []error
+	var errsMutex sync.Mutex
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				errsMutex.Lock()
+				errs = append(errs, err)
+				errsMutex.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
 		hs.logger.Fatalf("Server Shutdown Failed:%+v", err)
 	}
 
+	if hs.adminServer.Enabled() {
+		if err := hs.adminServer.Shutdown(ctx); err != nil {
+			hs.logger.Errorf("Admin Server Shutdown Failed:%+v", err)
+		}
+	}
+
+	for _, hook := range hs.shutdownHooks {
+		hook()
+	}
+
 	hs.fpmClient.Close()
 
 	hs.logger.Info("Server Exited Properly")
 }
+
+// listenAddresses joins bind addresses with the port, IPv6 literals may be written with or without brackets
+func listenAddresses(bindAddresses []string, port int) []string {
+	if len(bindAddresses) == 0 {
+		return []string{fmt.Sprintf(":%d", port)}
+	}
+
+	addresses := make([]string, 0, len(bindAddresses))
+	for _, address := range bindAddresses {
+		address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		addresses = append(addresses, net.JoinHostPort(address, strconv.Itoa(port)))
+	}
+	return addresses
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+// must panics when the component of the test could not be created
+func must[T any](value T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// newTestConfig loads the config from flags like the root command, the socket of the mock FPM is added to them
+func newTestConfig(tb testing.TB, fpm *mockFpm, args ...string) *Config {
+	tb.Helper()
+	config := loadTestConfig(tb, fpm, args...)
+	if err := config.Validate(); err != nil {
+		tb.Fatalf("invalid config: %s", err)
+	}
+	return config
+}
+
+// loadTestConfig is newTestConfig without validation
+func loadTestConfig(tb testing.TB, fpm *mockFpm, args ...string) *Config {
+	tb.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	cmd := &cobra.Command{}
+	DefineParams(cmd)
+	set := cmd.PersistentFlags()
+	args = append([]string{"--" + ParamSocket, fpm.socket, "--" + ParamIndex, "/app/index.php", "--" + FpmPoolSize, "4"}, args...)
+	if err := set.Parse(args); err != nil {
+		tb.Fatalf("could not parse flags: %s", err)
+	}
+	return must(LoadConfig(set, logger))
+}
+
+// newTestServer wires the server like the root command and serves all handlers on a loopback port, background
+// workers (scheduler, cache warmer, health checks) are not started
+func newTestServer(tb testing.TB, fpm *mockFpm, args ...string) *httptest.Server {
+	tb.Helper()
+	svr := newTestHttpServer(tb, fpm, args...)
+	server := httptest.NewUnstartedServer(svr.handlers[HandlersAll])
+	server.Config.ConnState = svr.srv.ConnState
+	server.Start()
+	tb.Cleanup(server.Close)
+	return server
+}
+
+// newTestHttpServer wires the server like the root command, its components can be reached by tests
+func newTestHttpServer(tb testing.TB, fpm *mockFpm, args ...string) *HttpServer {
+	tb.Helper()
+	config := newTestConfig(tb, fpm, args...)
+	logger := config.logger
+
+	monitor := NewMonitor(logger)
+	fCgiClient := must(NewFCgiClient(config, monitor, logger))
+	tb.Cleanup(fCgiClient.Close)
+	paramsBuilder := must(NewParamsBuilder(config))
+	priorities := must(NewPriorityClasses(config))
+	fpmClient := NewFpmClient(fCgiClient, paramsBuilder, priorities, NewExchangeDumper(config, logger), config, monitor, logger)
+	accessSink := must(NewAccessSink(config, monitor, logger))
+	accessLogger := must(NewAccessLogger(config, accessSink, NewFpmStatusReader(config, fpmClient), logger))
+	redisStore := NewRedisStore(config, monitor, logger)
+	cache := NewResponseCache(must(NewCacheStorage(config, redisStore, logger)), config, monitor, logger)
+	costSampler := NewCostSampler(config)
+	faultInjector := NewFaultInjector(config, monitor)
+	timeouts := must(NewTimeoutPolicy(config, monitor))
+	drainTracker := NewDrainTracker(config, monitor)
+	certificates := must(NewCertificateReloader(config, monitor, logger))
+
+	adminSvr := NewAdminServer(config, fpmClient, paramsBuilder, cache, costSampler, faultInjector, timeouts, drainTracker, monitor, logger)
+	adminSvr.PrepareServer()
+	svr := NewHttpServer(
+		config, fpmClient,
+		must(NewResponseCompressor(config)),
+		must(NewSubFilter(config)),
+		must(NewAssetManifest(config)),
+		cache,
+		NewIdempotencyStore(redisStore, config),
+		costSampler, faultInjector,
+		must(NewAbBuckets(config)),
+		must(NewRateLimiter(redisStore, config)),
+		timeouts,
+		must(NewTenants(config, monitor)),
+		NewIndexWatcher(config, monitor, logger),
+		must(NewForwardAuth(config, monitor)),
+		must(NewBodyScanner(config, monitor)),
+		must(NewFallbackPages(config)),
+		must(NewAccessRules(config, monitor)),
+		must(NewBandwidthShaper(config)),
+		drainTracker,
+		must(NewTlsConfig(config, certificates)),
+		accessLogger, monitor, adminSvr, logger,
+	)
+	svr.PrepareServer()
+	return svr
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencySweepInterval = time.Minute
+	idempotencyMaxKeyLength  = 255
+)
+
+var (
+	// redisReleasePending deletes the key only when it still holds the pending marker of the request
+	redisReleasePending = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+	ErrIdempotencyInFlight = errors.New("request with the same idempotency key is in progress")
+	ErrIdempotencyMismatch = errors.New("idempotency key was used for a different request")
+)
+
+// IdempotencyStore remembers the first response for each Idempotency-Key and replays it to retries,
+// so the request is processed by PHP only once. With Redis the entries are shared by all replicas,
+// local entries are used only while Redis is unavailable.
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	remote    map[string]string // keys in progress stored in Redis -> pending marker
+	lastSweep time.Time
+
+	redis  *RedisStore // nil when state is local
+	config *Config
+}
+
+// redisIdempotencyEntry is the JSON value of the key in Redis, Response is nil while the request is in progress
+type redisIdempotencyEntry struct {
+	Fingerprint string                   `json:"fingerprint"`
+	Nonce       string                   `json:"nonce,omitempty"`
+	Response    *redisIdempotentResponse `json:"response,omitempty"`
+}
+
+type redisIdempotentResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body"`
+	Route   string              `json:"route"`
+}
+
+type idempotencyEntry struct {
+	fingerprint string        // method, uri and body of the first request
+	response    *ResponseData // nil while the first request is in progress
+	expires     time.Time
+}
+
+func NewIdempotencyStore(redisStore *RedisStore, config *Config) *IdempotencyStore {
+	return &IdempotencyStore{
+		entries:   map[string]*idempotencyEntry{},
+		remote:    map[string]string{},
+		lastSweep: time.Now(),
+		redis:     redisStore,
+		config:    config,
+	}
+}
+
+// Key returns store key of the request when it is POST with Idempotency-Key header to a configured prefix
+func (is *IdempotencyStore) Key(request *http.Request) (string, bool) {
+	if request.Method != http.MethodPost {
+		return "", false
+	}
+	key := request.Header.Get(IdempotencyKeyHeader)
+	if key == "" || len(key) > idempotencyMaxKeyLength {
+		return "", false
+	}
+	if _, found := matchPrefix(request.URL.Path, is.config.IdempotencyPrefixes); !found {
+		return "", false
+	}
+	return request.URL.Path + "\x00" + key, true
+}
+
+// Begin returns stored response for a retry. When the key is new, the request is marked in progress and nil
+// is returned - Finish or Release must follow.
+func (is *IdempotencyStore) Begin(key string, request *http.Request) (*ResponseData, error) {
+	fingerprint, err := requestFingerprint(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if is.redis.Available() {
+		response, err := is.beginRedis(key, fingerprint)
+		if err == nil || errors.Is(err, ErrIdempotencyInFlight) || errors.Is(err, ErrIdempotencyMismatch) {
+			return response, err
+		}
+		is.redis.Failed(RedisStateIdempotency, err)
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	is.sweep()
+
+	entry, found := is.entries[key]
+	if !found || time.Now().After(entry.expires) {
+		is.entries[key] = &idempotencyEntry{
+			fingerprint: fingerprint,
+			expires:     time.Now().Add(is.config.IdempotencyTtl),
+		}
+		return nil, nil
+	}
+	if entry.fingerprint != fingerprint {
+		return nil, ErrIdempotencyMismatch
+	}
+	if entry.response == nil {
+		return nil, ErrIdempotencyInFlight
+	}
+	return entry.response.Clone(), nil
+}
+
+// Finish stores the response of the request in progress
+func (is *IdempotencyStore) Finish(key string, response *ResponseData) {
+	if pending, found := is.takeRemote(key); found {
+		is.finishRedis(key, pending, response)
+		return
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if entry, found := is.entries[key]; found && entry.response == nil {
+		entry.response = response.Clone()
+	}
+}
+
+// Release forgets the key when the request did not finish (proxy error, timeout), so it can be retried
+func (is *IdempotencyStore) Release(key string) {
+	if pending, found := is.takeRemote(key); found {
+		is.releaseRedis(key, pending)
+		return
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if entry, found := is.entries[key]; found && entry.response == nil {
+		delete(is.entries, key)
+	}
+}
+
+// takeRemote returns and forgets pending marker of the key in progress stored in Redis
+func (is *IdempotencyStore) takeRemote(key string) (string, bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	pending, found := is.remote[key]
+	delete(is.remote, key)
+	return pending, found
+}
+
+// beginRedis marks the key in progress in Redis or returns the stored response
+func (is *IdempotencyStore) beginRedis(key string, fingerprint string) (*ResponseData, error) {
+	ctx, cancel := is.redis.Context()
+	defer cancel()
+	redisKey := is.redis.Key("idempotency", key)
+
+	// the nonce makes the pending marker unique, so only its owner can release it
+	pending, err := json.Marshal(redisIdempotencyEntry{Fingerprint: fingerprint, Nonce: generateRequestId()})
+	if err != nil {
+		return nil, err
+	}
+	created, err := is.redis.client.SetNX(ctx, redisKey, pending, is.config.IdempotencyTtl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		is.mu.Lock()
+		is.remote[key] = string(pending)
+		is.mu.Unlock()
+		return nil, nil
+	}
+
+	value, err := is.redis.client.Get(ctx, redisKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrIdempotencyInFlight // expired just now, the client retries
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry redisIdempotencyEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return nil, err
+	}
+	if entry.Fingerprint != fingerprint {
+		return nil, ErrIdempotencyMismatch
+	}
+	if entry.Response == nil {
+		return nil, ErrIdempotencyInFlight
+	}
+	return &ResponseData{
+		Status:  entry.Response.Status,
+		Headers: entry.Response.Headers,
+		Body:    entry.Response.Body,
+		Route:   entry.Response.Route,
+	}, nil
+}
+
+// finishRedis replaces the pending marker with the response
+func (is *IdempotencyStore) finishRedis(key string, pending string, response *ResponseData) {
+	var entry redisIdempotencyEntry
+	if err := json.Unmarshal([]byte(pending), &entry); err != nil {
+		return
+	}
+	entry.Nonce = ""
+	entry.Response = &redisIdempotentResponse{
+		Status:  response.Status,
+		Headers: response.Headers,
+		Body:    response.Body,
+		Route:   response.Route,
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := is.redis.Context()
+	defer cancel()
+	if err := is.redis.client.SetXX(ctx, is.redis.Key("idempotency", key), value, is.config.IdempotencyTtl).Err(); err != nil {
+		is.redis.Failed(RedisStateIdempotency, err)
+	}
+}
+
+// releaseRedis removes the pending marker of the request
+func (is *IdempotencyStore) releaseRedis(key string, pending string) {
+	ctx, cancel := is.redis.Context()
+	defer cancel()
+	if err := redisReleasePending.Run(ctx, is.redis.client, []string{is.redis.Key("idempotency", key)}, pending).Err(); err != nil && !errors.Is(err, redis.Nil) {
+		is.redis.Failed(RedisStateIdempotency, err)
+	}
+}
+
+// sweep removes expired entries, caller must hold the lock
+func (is *IdempotencyStore) sweep() {
+	if time.Since(is.lastSweep) < idempotencySweepInterval {
+		return
+	}
+	is.lastSweep = time.Now()
+	for key, entry := range is.entries {
+		if entry.response != nil && time.Now().After(entry.expires) {
+			delete(is.entries, key)
+		}
+	}
+}
+
+// requestFingerprint hashes method, uri and body, the body is restored for FPM
+func requestFingerprint(request *http.Request) (string, error) {
+	hash := sha256.New()
+	hash.Write([]byte(request.Method + " " + request.URL.RequestURI() + "\n"))
+	if request.Body != nil {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			return "", err
+		}
+		_ = request.Body.Close()
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var ErrIndexFileMissing = errors.New("index file is missing")
+
+// IndexWatcher periodically checks the index file exists. When it vanishes (bad deploy, unmounted volume),
+// requests are rejected with 503 and readiness fails instead of PHP answering "Primary script unknown".
+// The proxy must see the file under the same path as FPM, so the check is disabled unless
+// --index-check-interval is set.
+type IndexWatcher struct {
+	missing atomic.Bool
+	modTime time.Time // last seen modification time, used only by the checking goroutine
+
+	config  *Config
+	monitor *Monitor
+	logger  *logrus.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewIndexWatcher(config *Config, monitor *Monitor, logger *logrus.Logger) *IndexWatcher {
+	return &IndexWatcher{
+		config:  config,
+		monitor: monitor,
+		logger:  logger,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Enabled reports whether the index file is checked
+func (iw *IndexWatcher) Enabled() bool {
+	return iw.config.IndexCheckInterval > 0
+}
+
+// Start checks the index file right away and then on the interval
+func (iw *IndexWatcher) Start() {
+	if !iw.Enabled() {
+		close(iw.done)
+		return
+	}
+	iw.check()
+	go iw.run()
+}
+
+func (iw *IndexWatcher) Stop() {
+	if iw.Enabled() {
+		close(iw.stop)
+	}
+	<-iw.done
+}
+
+// Err returns ErrIndexFileMissing while the index file is missing, nil otherwise
+func (iw *IndexWatcher) Err() error {
+	if iw.missing.Load() {
+		return fmt.Errorf("%w: %s", ErrIndexFileMissing, iw.config.IndexFile)
+	}
+	return nil
+}
+
+func (iw *IndexWatcher) run() {
+	defer close(iw.done)
+
+	ticker := time.NewTicker(iw.config.IndexCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-iw.stop:
+			return
+		case <-ticker.C:
+		}
+		iw.check()
+	}
+}
+
+// check stats the index file, changes of its state are logged once
+func (iw *IndexWatcher) check() {
+	info, err := os.Stat(iw.config.IndexFile)
+	if err == nil && info.IsDir() {
+		err = fmt.Errorf("%s is a directory", iw.config.IndexFile)
+	}
+
+	if err != nil {
+		if !iw.missing.Swap(true) {
+			iw.logger.Errorf("Index file is missing, requests are rejected until it returns: %s", err)
+		}
+		iw.monitor.IndexFileGauge.WithLabelValues(iw.config.App).Set(0)
+		return
+	}
+
+	if iw.missing.Swap(false) {
+		iw.logger.Infof("Index file %s is back, requests are accepted again", iw.config.IndexFile)
+	} else if !iw.modTime.IsZero() && !info.ModTime().Equal(iw.modTime) {
+		iw.logger.WithField("modified", info.ModTime().Format(time.RFC3339)).Infof("Index file %s changed", iw.config.IndexFile)
+	}
+	iw.modTime = info.ModTime()
+	iw.monitor.IndexFileGauge.WithLabelValues(iw.config.App).Set(1)
+}
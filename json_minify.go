@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// charsetTypes are mime types which get the default charset when PHP doesn't set any
+var charsetTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+}
+
+// minifyJson strips insignificant whitespace from JSON responses of PHP APIs which pretty-print by default.
+// Invalid JSON and bodies compressed by PHP are left untouched.
+func minifyJson(request *http.Request, response *ResponseData) {
+	headers := http.Header(response.Headers)
+	if request.Method == http.MethodHead || len(response.Body) == 0 {
+		return
+	}
+	if !isJsonMimeType(responseMimeType(headers)) {
+		return
+	}
+	if encoding := headers.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return
+	}
+
+	var compacted bytes.Buffer
+	compacted.Grow(len(response.Body))
+	if err := json.Compact(&compacted, response.Body); err != nil {
+		return
+	}
+	if compacted.Len() < len(response.Body) {
+		response.Body = compacted.Bytes()
+		headers.Del("Content-Length")
+		headers.Del("ETag") // body differs from the one PHP tagged
+	}
+}
+
+// isJsonMimeType matches application/json and structured syntax suffix types like application/problem+json
+func isJsonMimeType(mimeType string) bool {
+	return mimeType == "application/json" || strings.HasSuffix(mimeType, "+json")
+}
+
+// setDefaultCharset adds charset parameter to textual responses without one
+func setDefaultCharset(response *ResponseData, charset string) {
+	headers := http.Header(response.Headers)
+	mediaType, params, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil || params["charset"] != "" {
+		return
+	}
+	if !strings.HasPrefix(mediaType, "text/") && !containsString(charsetTypes, mediaType) && !isJsonMimeType(mediaType) {
+		return
+	}
+
+	params["charset"] = charset
+	headers.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+}
+
+// hasContentType reports whether the response has Content-Type or does not need one (no body allowed)
+func hasContentType(response *ResponseData) bool {
+	if response.Status == http.StatusNoContent || response.Status == http.StatusNotModified {
+		return true
+	}
+	return http.Header(response.Headers).Get("Content-Type") != ""
+}
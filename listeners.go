@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handler sets served by listeners, see --listen
+const (
+	HandlersAll      = "all"      // requests to PHP, static files, readiness and metrics
+	HandlersPublic   = "public"   // requests to PHP, static files and readiness
+	HandlersInternal = "internal" // metrics, readiness and admin endpoints
+)
+
+// Listener is an address the server listens on with handler set served there. Public traffic and internal
+// endpoints may be split to different ports, e.g. only the internal one is reachable by Prometheus.
+type Listener struct {
+	Network  string // tcp or unix
+	Address  string // host:port or path of the socket
+	Handlers string
+}
+
+// String returns the address as written in --listen
+func (l Listener) String() string {
+	if l.Network == "unix" {
+		return "unix:" + l.Address
+	}
+	return l.Address
+}
+
+// parseListener parses host:port[=handlers] or unix:/path[=handlers] and returns the listener with its port,
+// unix sockets have no port
+func parseListener(definition string) (Listener, int, error) {
+	address, handlers, found := strings.Cut(definition, "=")
+	if !found {
+		handlers = HandlersAll
+	}
+	if handlers != HandlersAll && handlers != HandlersPublic && handlers != HandlersInternal {
+		return Listener{}, 0, fmt.Errorf("invalid %s %q, handlers must be %s, %s or %s", Listen, definition, HandlersAll, HandlersPublic, HandlersInternal)
+	}
+	if path, unix := strings.CutPrefix(address, "unix:"); unix {
+		if !strings.HasPrefix(path, "/") {
+			return Listener{}, 0, fmt.Errorf("invalid %s %q, socket path must be absolute", Listen, definition)
+		}
+		return Listener{Network: "unix", Address: path, Handlers: handlers}, 0, nil
+	}
+	_, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return Listener{}, 0, fmt.Errorf("invalid %s %q, use host:port[=handlers] or unix:/path[=handlers]: %w", Listen, definition, err)
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port < 1 || port > 65535 {
+		return Listener{}, 0, fmt.Errorf("invalid %s %q, port must be between 1 and 65535", Listen, definition)
+	}
+	return Listener{Network: "tcp", Address: address, Handlers: handlers}, port, nil
+}
+
+// isLoopback reports whether the host is reachable only from this machine, empty host means all interfaces
+func isLoopback(host string) bool {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hostOf returns host of host:port address
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// listen opens the listener, unix socket left behind by a crashed process is replaced
+func listen(listener Listener, socketMode os.FileMode) (net.Listener, error) {
+	if listener.Network != "unix" {
+		return net.Listen(listener.Network, listener.Address)
+	}
+
+	if err := removeStaleSocket(listener.Address); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", listener.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(listener.Address, socketMode); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("could not set permissions of %s: %w", listener.Address, err)
+	}
+	return unixPeerListener{l}, nil
+}
+
+// removeStaleSocket removes socket file nobody listens on, other files and sockets in use are kept
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is used by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// unixPeerHost is the address of unix socket peers, they have no IP address
+const unixPeerHost = "unix"
+
+// unixPeerListener reports peers of the unix socket as unixPeerHost. They are local processes (nginx, haproxy),
+// but not necessarily the trusted ones connecting over loopback, they are trusted only by --trusted-proxy unix.
+type unixPeerListener struct {
+	net.Listener
+}
+
+func (l unixPeerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixPeerConn{conn}, nil
+}
+
+type unixPeerConn struct {
+	net.Conn
+}
+
+func (c unixPeerConn) RemoteAddr() net.Addr {
+	return unixPeerAddr{}
+}
+
+type unixPeerAddr struct{}
+
+func (unixPeerAddr) Network() string {
+	return "unix"
+}
+
+// String is host:port like TCP addresses have, handlers split RemoteAddr of requests
+func (unixPeerAddr) String() string {
+	return unixPeerHost + ":0"
+}
+
+// newListenerServer creates server of a handler set, it shares TLS and connection tracking with the main one
+func (hs *HttpServer) newListenerServer(handlers string) *http.Server {
+	srv := &http.Server{
+		Handler:      hs.handlers[handlers],
+		TLSNextProto: hs.srv.TLSNextProto,
+		ConnState:    hs.srv.ConnState,
+		ErrorLog:     hs.srv.ErrorLog,
+	}
+	if hs.srv.TLSConfig != nil {
+		srv.TLSConfig = hs.srv.TLSConfig.Clone()
+	}
+	return srv
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log formats
+const (
+	LogFormatJson = "json"
+	LogFormatText = "text"
+)
+
+// log outputs
+const (
+	LogOutputStdout   = "stdout"
+	LogOutputSyslog   = "syslog"
+	LogOutputJournald = "journald"
+)
+
+const (
+	journaldSocket = "/run/systemd/journal/socket"
+	syslogFacility = 3 // daemon
+	// structured data id, 32473 is the private enterprise number reserved for documentation
+	syslogSdId = "fields@32473"
+)
+
+// configureLogOutput sends access and error logs to syslog or journald instead of stdout
+func configureLogOutput(logger *logrus.Logger, config *Config) error {
+	var hook logrus.Hook
+	switch config.LogOutput {
+	case LogOutputStdout:
+		return nil
+	case LogOutputSyslog:
+		syslogHook, err := newSyslogHook(config.SyslogAddress, config.App)
+		if err != nil {
+			return err
+		}
+		hook = syslogHook
+	case LogOutputJournald:
+		journaldHook, err := newJournaldHook(config.App)
+		if err != nil {
+			return err
+		}
+		hook = journaldHook
+	default:
+		return fmt.Errorf("invalid log output %q, use %q, %q or %q", config.LogOutput, LogOutputStdout, LogOutputSyslog, LogOutputJournald)
+	}
+
+	logger.AddHook(hook)
+	logger.SetOutput(io.Discard)
+	return nil
+}
+
+// syslogSeverity maps logrus levels to syslog severities (RFC 5424, section 6.2.1)
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// sortedFields returns entry fields sorted by name, so the output is stable
+func sortedFields(entry *logrus.Entry) []string {
+	names := make([]string, 0, len(entry.Data))
+	for name := range entry.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// syslogHook sends log entries in RFC 5424 format over UDP, TCP (octet counting framing) or unix socket
+type syslogHook struct {
+	mu       sync.Mutex
+	network  string
+	address  string
+	conn     net.Conn
+	hostname string
+	app      string
+}
+
+// newSyslogHook creates hook for address in format udp://host:port, tcp://host:port or unix:///dev/log
+func newSyslogHook(address string, app string) (*syslogHook, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %w", address, err)
+	}
+
+	hook := &syslogHook{app: app}
+	switch u.Scheme {
+	case "udp", "tcp":
+		hook.network, hook.address = u.Scheme, u.Host
+	case "unix":
+		hook.network, hook.address = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("invalid syslog address %q, use udp://, tcp:// or unix://", address)
+	}
+
+	hook.hostname, _ = os.Hostname()
+	if hook.hostname == "" {
+		hook.hostname = "-"
+	}
+	if err := hook.connect(); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	message := h.format(entry)
+	if h.network == "tcp" {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn != nil {
+		if _, err := h.conn.Write(message); err == nil {
+			return nil
+		}
+		_ = h.conn.Close()
+		h.conn = nil
+	}
+	// reconnect once, e.g. after syslog server restart
+	if err := h.connect(); err != nil {
+		return err
+	}
+	_, err := h.conn.Write(message)
+	return err
+}
+
+// connect dials the syslog server, caller must hold the lock (or be the constructor)
+func (h *syslogHook) connect() error {
+	conn, err := net.DialTimeout(h.network, h.address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("could not connect to syslog %s: %w", h.address, err)
+	}
+	h.conn = conn
+	return nil
+}
+
+// format creates RFC 5424 message, entry fields are sent as structured data
+func (h *syslogHook) format(entry *logrus.Entry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ",
+		syslogFacility*8+syslogSeverity(entry.Level),
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		h.hostname,
+		h.app,
+		os.Getpid(),
+	)
+
+	if len(entry.Data) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[" + syslogSdId)
+		for _, name := range sortedFields(entry) {
+			fmt.Fprintf(&b, ` %s="%s"`, syslogParamName(name), syslogParamValue(fmt.Sprint(entry.Data[name])))
+		}
+		b.WriteString("]")
+	}
+
+	b.WriteString(" ")
+	b.WriteString(entry.Message)
+	return b.Bytes()
+}
+
+// syslogParamName keeps only characters allowed in SD-NAME
+func syslogParamName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// syslogParamValue escapes characters which must be escaped in PARAM-VALUE
+func syslogParamValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// journaldHook sends log entries to journald using its native protocol, entry fields become journal fields
+type journaldHook struct {
+	conn *net.UnixConn
+	app  string
+}
+
+func newJournaldHook(app string) (*journaldHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to journald: %w", err)
+	}
+	return &journaldHook{conn: conn, app: app}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	writeJournalField(&b, "PRIORITY", fmt.Sprintf("%d", syslogSeverity(entry.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", h.app)
+	for _, name := range sortedFields(entry) {
+		writeJournalField(&b, journalFieldName(name), fmt.Sprint(entry.Data[name]))
+	}
+
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+// writeJournalField writes field in journald native format, multiline values use binary length-prefixed form
+func writeJournalField(b *bytes.Buffer, name string, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteString("=")
+		b.WriteString(value)
+		b.WriteString("\n")
+		return
+	}
+	b.WriteString("\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteString("\n")
+}
+
+// journalFieldName converts field name to journald format (uppercase letters, digits and underscores)
+func journalFieldName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	// fields starting with underscore are trusted fields set by journald itself
+	return "GOPHPFPM_" + strings.TrimLeft(name, "_")
+}
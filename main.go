@@ -3,6 +3,7 @@ package main
 import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"os"
 )
 
 var (
@@ -14,6 +15,8 @@ var (
 	protectedHeadersOutbound = map[string]bool{
 		"x-powered-by": true,
 		"x-app-route":  true,
+		"x-cache-tags": true,
+		"status":       true,
 	}
 )
 
@@ -31,31 +34,177 @@ func main() {
 			if err != nil {
 				logger.Fatalf("could not load config: %s", err)
 			}
-			logger.SetLevel(log.InfoLevel)
-			if config.Verbose {
-				logger.SetLevel(log.DebugLevel)
+			if err := config.Validate(); err != nil {
+				logger.Fatalf("invalid config: %s", err)
+			}
+			configureLogger(logger, config)
+			if err := configureLogOutput(logger, config); err != nil {
+				logger.Fatalf("could not configure log output: %s", err)
 			}
 
-			fCgiClient, err := NewFCgiClient(config, logger)
+			monitor := NewMonitor(logger)
+			fCgiClient, err := NewFCgiClient(config, monitor, logger)
 			if err != nil {
 				logger.Fatalf("could not create FPM client: %s", err)
 			}
 
-			accessLogger := NewAccessLogger(config, logger)
-			monitor := NewMonitor(logger)
-			fpmClient := NewFpmClient(fCgiClient, config, monitor, logger)
-			svr := NewHttpServer(config, fpmClient, accessLogger, monitor, logger)
+			compressor, err := NewResponseCompressor(config)
+			if err != nil {
+				logger.Fatalf("could not create response compressor: %s", err)
+			}
+			subFilter, err := NewSubFilter(config)
+			if err != nil {
+				logger.Fatalf("could not create sub filter: %s", err)
+			}
+			assetManifest, err := NewAssetManifest(config)
+			if err != nil {
+				logger.Fatalf("could not create asset manifest: %s", err)
+			}
+
+			accessSink, err := NewAccessSink(config, monitor, logger)
+			if err != nil {
+				logger.Fatalf("could not create access sink: %s", err)
+			}
+			paramsBuilder, err := NewParamsBuilder(config)
+			if err != nil {
+				logger.Fatalf("could not create params builder: %s", err)
+			}
+			priorities, err := NewPriorityClasses(config)
+			if err != nil {
+				logger.Fatalf("could not create priority classes: %s", err)
+			}
+			dumper := NewExchangeDumper(config, logger)
+			fpmClient := NewFpmClient(fCgiClient, paramsBuilder, priorities, dumper, config, monitor, logger)
+			accessLogger, err := NewAccessLogger(config, accessSink, NewFpmStatusReader(config, fpmClient), logger)
+			if err != nil {
+				logger.Fatalf("could not create access logger: %s", err)
+			}
+			redisStore := NewRedisStore(config, monitor, logger)
+			cacheStorage, err := NewCacheStorage(config, redisStore, logger)
+			if err != nil {
+				logger.Fatalf("could not create cache storage: %s", err)
+			}
+			cache := NewResponseCache(cacheStorage, config, monitor, logger)
+			idempotency := NewIdempotencyStore(redisStore, config)
+			costSampler := NewCostSampler(config)
+			faultInjector := NewFaultInjector(config, monitor)
+			abBuckets, err := NewAbBuckets(config)
+			if err != nil {
+				logger.Fatalf("could not create A/B buckets: %s", err)
+			}
+			rateLimiter, err := NewRateLimiter(redisStore, config)
+			if err != nil {
+				logger.Fatalf("could not create rate limiter: %s", err)
+			}
+			timeouts, err := NewTimeoutPolicy(config, monitor)
+			if err != nil {
+				logger.Fatalf("could not create timeout policy: %s", err)
+			}
+			tenants, err := NewTenants(config, monitor)
+			if err != nil {
+				logger.Fatalf("could not create tenants: %s", err)
+			}
+			indexWatcher := NewIndexWatcher(config, monitor, logger)
+			forwardAuth, err := NewForwardAuth(config, monitor)
+			if err != nil {
+				logger.Fatalf("could not create forward auth: %s", err)
+			}
+			bodyScanner, err := NewBodyScanner(config, monitor)
+			if err != nil {
+				logger.Fatalf("could not create body scanner: %s", err)
+			}
+			fallbacks, err := NewFallbackPages(config)
+			if err != nil {
+				logger.Fatalf("could not create fallback pages: %s", err)
+			}
+			accessRules, err := NewAccessRules(config, monitor)
+			if err != nil {
+				logger.Fatalf("could not create access rules: %s", err)
+			}
+			bandwidth, err := NewBandwidthShaper(config)
+			if err != nil {
+				logger.Fatalf("could not create bandwidth shaper: %s", err)
+			}
+			certificates, err := NewCertificateReloader(config, monitor, logger)
+			if err != nil {
+				logger.Fatalf("could not load TLS certificate: %s", err)
+			}
+			tlsConfig, err := NewTlsConfig(config, certificates)
+			if err != nil {
+				logger.Fatalf("could not create TLS config: %s", err)
+			}
+			drainTracker := NewDrainTracker(config, monitor)
+			adminSvr := NewAdminServer(config, fpmClient, paramsBuilder, cache, costSampler, faultInjector, timeouts, drainTracker, monitor, logger)
+			adminSvr.PrepareServer()
+			svr := NewHttpServer(config, fpmClient, compressor, subFilter, assetManifest, cache, idempotency, costSampler, faultInjector, abBuckets, rateLimiter, timeouts, tenants, indexWatcher, forwardAuth, bodyScanner, fallbacks, accessRules, bandwidth, drainTracker, tlsConfig, accessLogger, monitor, adminSvr, logger)
 			svr.PrepareServer()
 
+			scheduler, err := NewScheduler(config, fpmClient, paramsBuilder, monitor, logger)
+			if err != nil {
+				logger.Fatalf("could not create scheduler: %s", err)
+			}
+			svr.OnShutdown(scheduler.Stop)
+
+			cacheWarmer, err := NewCacheWarmer(config, fpmClient, paramsBuilder, cache, monitor, logger)
+			if err != nil {
+				logger.Fatalf("could not create cache warmer: %s", err)
+			}
+			svr.OnShutdown(cacheWarmer.Stop)
+
+			saturationWatcher := NewSaturationWatcher(fCgiClient, config, monitor, logger)
+			svr.OnShutdown(saturationWatcher.Stop)
+			healthChecker := NewFpmHealthChecker(fCgiClient, config, logger)
+			svr.OnShutdown(healthChecker.Stop)
+			configReloader := NewConfigReloader(os.Args[1:], cmd.PersistentFlags(), svr, fCgiClient, accessLogger, certificates, config, monitor, logger)
+			svr.OnShutdown(configReloader.Stop)
+			svr.OnShutdown(certificates.Stop)
+			svr.OnShutdown(indexWatcher.Stop)
+			svr.OnShutdown(accessSink.Stop)
+			svr.OnShutdown(accessLogger.Close)
+			svr.OnShutdown(redisStore.Close)
+
 			config.LogConfig()
+			if config.Preflight {
+				RunPreflight(fCgiClient, fpmClient, paramsBuilder, config, logger)
+			}
+			if bootGate := NewBootGate(fpmClient, paramsBuilder, config, logger); bootGate.Enabled() {
+				if err := bootGate.Run(); err != nil {
+					logger.Fatalf("could not boot: %s", err)
+				}
+			}
+			scheduler.Start()
+			cacheWarmer.Start()
+			saturationWatcher.Start()
+			healthChecker.Start()
+			indexWatcher.Start()
+			certificates.Start()
+			accessSink.Start()
+			configReloader.Start()
 			svr.StartServer()
 		},
 	}
 
 	DefineParams(rootCmd)
+	rootCmd.AddCommand(NewReplayCommand(logger))
+	rootCmd.AddCommand(NewRoutesCommand(logger))
+	rootCmd.AddCommand(NewProfileCommand(logger))
+	rootCmd.AddCommand(NewConfigCommand(logger))
+	rootCmd.AddCommand(NewDoctorCommand(logger))
+	rootCmd.AddCommand(NewValidateCommand(logger))
 	if err := rootCmd.Execute(); err != nil {
 		logger.Fatalf("could not run root command")
 	}
 	return
 
 }
+
+// configureLogger sets logger according to loaded config
+func configureLogger(logger *log.Logger, config *Config) {
+	logger.SetLevel(log.InfoLevel)
+	if config.LogFormat == LogFormatText {
+		logger.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	}
+	if config.Verbose {
+		logger.SetLevel(log.DebugLevel)
+	}
+}
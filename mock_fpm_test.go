@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// mockFpmRequest is a request received by mockFpm, stdin is valid only until the responder returns
+type mockFpmRequest struct {
+	id     uint16
+	params map[string]string
+	stdin  []byte
+}
+
+// mockFpmResponder answers the request by writing records, the connection is kept open for the next request
+// unless the responder closes it
+type mockFpmResponder func(w *mockFpmWriter, request mockFpmRequest)
+
+// mockFpm is FastCGI responder on a unix socket, it answers GET_VALUES with FCGI_MAX_CONNS 1024
+type mockFpm struct {
+	socket    string
+	listener  net.Listener
+	responder mockFpmResponder
+
+	accepted atomic.Int32 // connections accepted so far
+	requests atomic.Int32 // requests answered so far
+
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+// startMockFpm listens on a socket in a temporary directory, it's stopped with the test
+func startMockFpm(tb testing.TB, responder mockFpmResponder) *mockFpm {
+	tb.Helper()
+	socket := filepath.Join(tb.TempDir(), "fpm.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		tb.Fatalf("could not start mock FPM: %s", err)
+	}
+	fpm := &mockFpm{socket: socket, listener: listener, responder: responder}
+	go fpm.serve()
+	tb.Cleanup(fpm.Close)
+	return fpm
+}
+
+// mockFpmStdout answers every request with the stdout (CGI headers and body) and END_REQUEST
+func mockFpmStdout(stdout string) mockFpmResponder {
+	return func(w *mockFpmWriter, request mockFpmRequest) {
+		w.Stdout(stdout)
+		w.End(0, FCGI_REQUEST_COMPLETE)
+	}
+}
+
+func (fpm *mockFpm) serve() {
+	for {
+		conn, err := fpm.listener.Accept()
+		if err != nil {
+			return
+		}
+		fpm.accepted.Add(1)
+		fpm.mutex.Lock()
+		fpm.conns = append(fpm.conns, conn)
+		fpm.mutex.Unlock()
+		go fpm.handle(conn)
+	}
+}
+
+// CloseConnections closes all accepted connections, like FPM restarting its workers
+func (fpm *mockFpm) CloseConnections() {
+	fpm.mutex.Lock()
+	defer fpm.mutex.Unlock()
+	for _, conn := range fpm.conns {
+		_ = conn.Close()
+	}
+	fpm.conns = nil
+}
+
+func (fpm *mockFpm) Close() {
+	_ = fpm.listener.Close()
+	fpm.CloseConnections()
+}
+
+func (fpm *mockFpm) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	w := &mockFpmWriter{conn: conn}
+	var params, stdin bytes.Buffer
+	var content []byte
+	for {
+		var header FCgiRecord
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			return
+		}
+		if length := int(header.ContentLength) + int(header.PaddingLength); cap(content) < length {
+			content = make([]byte, length)
+		} else {
+			content = content[:length]
+		}
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return
+		}
+		content = content[:header.ContentLength]
+
+		switch header.Type {
+		case FCGI_GET_VALUES:
+			var values bytes.Buffer
+			writeNameValue(&values, FCGI_MAX_CONNS, "1024")
+			w.record(FCGI_GET_VALUES_RESULT, 0, values.Bytes())
+		case FCGI_BEGIN_REQUEST:
+			params.Reset()
+			stdin.Reset()
+		case FCGI_PARAMS:
+			params.Write(content)
+		case FCGI_STDIN:
+			if len(content) > 0 {
+				stdin.Write(content)
+				continue
+			}
+			values, err := readNameValues(params.Bytes())
+			if err != nil {
+				return
+			}
+			w.requestId = header.RequestId
+			fpm.responder(w, mockFpmRequest{id: header.RequestId, params: values, stdin: stdin.Bytes()})
+			fpm.requests.Add(1)
+		}
+		if w.closed {
+			return
+		}
+	}
+}
+
+// mockFpmWriter writes records of the current request, write errors are ignored, the client sees them
+type mockFpmWriter struct {
+	conn      net.Conn
+	requestId uint16
+	closed    bool
+}
+
+func (w *mockFpmWriter) record(recordType byte, requestId uint16, content []byte) {
+	var header [fcgiHeaderLength]byte
+	buffers := appendRecord(make(net.Buffers, 0, 3), &header, requestId, recordType, content)
+	_, _ = buffers.WriteTo(w.conn)
+}
+
+// stream writes the content split to records of the maximal length
+func (w *mockFpmWriter) stream(recordType byte, content string) {
+	for len(content) > fcgiMaxContentLength {
+		w.record(recordType, w.requestId, []byte(content[:fcgiMaxContentLength]))
+		content = content[fcgiMaxContentLength:]
+	}
+	if len(content) > 0 {
+		w.record(recordType, w.requestId, []byte(content))
+	}
+}
+
+// Stdout writes the content as FCGI_STDOUT records, the stream stays open
+func (w *mockFpmWriter) Stdout(content string) {
+	w.stream(FCGI_STDOUT, content)
+}
+
+// Stderr writes the content as FCGI_STDERR records
+func (w *mockFpmWriter) Stderr(content string) {
+	w.stream(FCGI_STDERR, content)
+}
+
+// End closes the stdout stream and ends the request
+func (w *mockFpmWriter) End(appStatus uint32, protocolStatus byte) {
+	w.record(FCGI_STDOUT, w.requestId, nil)
+	w.EndRequest(appStatus, protocolStatus)
+}
+
+// EndRequest writes only the END_REQUEST record
+func (w *mockFpmWriter) EndRequest(appStatus uint32, protocolStatus byte) {
+	var content [8]byte
+	binary.BigEndian.PutUint32(content[:4], appStatus)
+	content[4] = protocolStatus
+	w.record(FCGI_END_REQUEST, w.requestId, content[:])
+}
+
+// Close closes the connection after the responder returns
+func (w *mockFpmWriter) Close() {
+	w.closed = true
+}
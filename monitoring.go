@@ -8,10 +8,21 @@ import (
 const (
 	TypeHttp = "http"
 	TypeFpm  = "fpm"
+
+	ShedReasonPriority     = "priority"
+	ShedReasonRateLimit    = "rate_limit"
+	ShedReasonQueueFull    = "queue_full"
+	ShedReasonQueueTimeout = "queue_timeout"
+
+	BodyDirectionRequest  = "request"
+	BodyDirectionResponse = "response"
+	BodyModeBuffered      = "buffered"
+	BodyModeStreamed      = "streamed"
 )
 
 var (
-	buckets = []float64{0.010, 0.025, 0.050, 0.100, 0.250, 0.500, 1.000, 2.500, 5.000, 10.000}
+	buckets     = []float64{0.010, 0.025, 0.050, 0.100, 0.250, 0.500, 1.000, 2.500, 5.000, 10.000}
+	waitBuckets = []float64{0.001, 0.005, 0.010, 0.025, 0.050, 0.100, 0.250, 0.500, 1.000, 2.500, 5.000}
 )
 
 type Monitor struct {
@@ -19,6 +30,58 @@ type Monitor struct {
 
 	HttpDurationHistogram *prometheus.HistogramVec
 	FmpDurationHistogram  *prometheus.HistogramVec
+
+	ScheduledRequestsCounter *prometheus.CounterVec
+	SaturationGauge          *prometheus.GaugeVec
+	PoolSizeGauge            *prometheus.GaugeVec
+	PoolBusyGauge            *prometheus.GaugeVec
+	PoolOverflowGauge        *prometheus.GaugeVec
+	EphemeralConnsCounter    *prometheus.CounterVec
+	PoolWaitingGauge         *prometheus.GaugeVec
+	PoolWaitHistogram        *prometheus.HistogramVec
+	ShedRequestsCounter      *prometheus.CounterVec
+	CacheRequestsCounter     *prometheus.CounterVec
+
+	OpenConnectionsGauge      *prometheus.GaugeVec
+	ConnectionsCounter        *prometheus.CounterVec
+	TlsHandshakeErrorsCounter *prometheus.CounterVec
+
+	AccessEventsDroppedCounter *prometheus.CounterVec
+	ChaosFaultsCounter         *prometheus.CounterVec
+	ProtocolErrorsCounter      *prometheus.CounterVec
+	AbortedRequestsCounter     *prometheus.CounterVec
+	FirstByteTimeoutsCounter   *prometheus.CounterVec
+	FpmReconnectsCounter       *prometheus.CounterVec
+	ScriptErrorsCounter        *prometheus.CounterVec
+	RejectedRequestsCounter    *prometheus.CounterVec
+
+	RouteTimeoutGauge *prometheus.GaugeVec
+	TimeoutsCounter   *prometheus.CounterVec
+
+	RedisFallbacksCounter *prometheus.CounterVec
+
+	BodyModeCounter      *prometheus.CounterVec
+	BodySizeHistogram    *prometheus.HistogramVec
+	StreamThresholdGauge *prometheus.GaugeVec
+
+	FeaturesInfo *prometheus.GaugeVec
+
+	TenantDurationHistogram *prometheus.HistogramVec
+
+	IndexFileGauge *prometheus.GaugeVec
+
+	AuthRequestsCounter        *prometheus.CounterVec
+	BodyScansCounter           *prometheus.CounterVec
+	ConfigReloadsCounter       *prometheus.CounterVec
+	FallbackResponsesCounter   *prometheus.CounterVec
+	AccessRuleDecisionsCounter *prometheus.CounterVec
+	TlsReloadsCounter          *prometheus.CounterVec
+	TlsCertExpiryGauge         *prometheus.GaugeVec
+
+	InFlightRequestsGauge *prometheus.GaugeVec
+	DrainDeadlineGauge    *prometheus.GaugeVec
+
+	RecentErrors *RecentErrors // latest errors shown in the dashboard
 }
 
 func NewMonitor(logger *logrus.Logger) *Monitor {
@@ -36,10 +99,221 @@ func NewMonitor(logger *logrus.Logger) *Monitor {
 			Help:    "Duration of the php fpm request",
 			Buckets: buckets,
 		}, []string{"app", "type", "method", "fpm_code", "endpoint"}),
+
+		ScheduledRequestsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scheduled_requests_total",
+			Help: "Number of scheduled internal requests",
+		}, []string{"app", "uri", "result"}),
+		SaturationGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gophpfpm_saturation",
+			Help: "FPM pool saturation - (busy connections + waiting requests) / pool size",
+		}, []string{"app"}),
+		PoolSizeGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "fpm_pool_size",
+			Help: "Number of connections in the FPM pool",
+		}, []string{"app"}),
+		PoolBusyGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "fpm_pool_busy_connections",
+			Help: "Number of FPM connections currently used by requests",
+		}, []string{"app"}),
+		PoolOverflowGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "fpm_pool_overflow_connections",
+			Help: "Number of overflow FPM connections dialed above the pool size (--fpm-pool-burst)",
+		}, []string{"app"}),
+		EphemeralConnsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fpm_ephemeral_connections_total",
+			Help: "Number of single-use FPM connections dialed for requests close to their wait deadline (--fpm-overflow-max)",
+		}, []string{"app", "priority"}),
+		PoolWaitingGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "fpm_pool_waiting_requests",
+			Help: "Number of requests currently waiting for a free FPM connection",
+		}, []string{"app"}),
+		PoolWaitHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "fpm_pool_wait_seconds",
+			Help:    "Time requests spent waiting for a free FPM connection",
+			Buckets: waitBuckets,
+		}, []string{"app", "priority"}),
+		ShedRequestsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shed_requests_total",
+			Help: "Number of requests rejected by the proxy to protect FPM",
+		}, []string{"app", "reason"}),
+		CacheRequestsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cache_requests_total",
+			Help: "Number of response cache lookups by result",
+		}, []string{"app", "result"}),
+
+		OpenConnectionsGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "http_open_connections",
+			Help: "Number of currently open client connections",
+		}, []string{"app"}),
+		ConnectionsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_connections_total",
+			Help: "Number of accepted client connections",
+		}, []string{"app"}),
+		TlsHandshakeErrorsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_tls_handshake_errors_total",
+			Help: "Number of failed TLS handshakes with clients",
+		}, []string{"app"}),
+
+		AccessEventsDroppedCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "access_events_dropped_total",
+			Help: "Number of access events which were not delivered to the access sink",
+		}, []string{"app", "reason"}),
+		ChaosFaultsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chaos_faults_total",
+			Help: "Number of faults injected to requests",
+		}, []string{"app", "fault"}),
+		ProtocolErrorsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fpm_protocol_errors_total",
+			Help: "Number of FastCGI protocol violations after which FPM connection was replaced",
+		}, []string{"app"}),
+		AbortedRequestsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fpm_aborted_requests_total",
+			Help: "Number of FPM requests aborted because the client disconnected or the request timed out",
+		}, []string{"app"}),
+		FirstByteTimeoutsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fpm_first_byte_timeouts_total",
+			Help: "Number of FPM requests without any output within --fpm-first-byte-timeout",
+		}, []string{"app"}),
+		FpmReconnectsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fpm_reconnects_total",
+			Help: "Number of healthy FPM connections replaced by reason (recycled, rotated, retried, unhealthy)",
+		}, []string{"app", "reason"}),
+		ScriptErrorsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fpm_script_errors_total",
+			Help: "Number of requests FPM couldn't run the script for (script_unknown, access_denied)",
+		}, []string{"app", "reason"}),
+		RejectedRequestsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fpm_rejected_requests_total",
+			Help: "Number of requests FPM ended without running them, by protocol status of FCGI_END_REQUEST",
+		}, []string{"app", "protocol_status"}),
+
+		RouteTimeoutGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "route_timeout_seconds",
+			Help: "Effective request timeout of a route before method factors",
+		}, []string{"app", "route", "source"}),
+		TimeoutsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_timeouts_total",
+			Help: "Number of requests which hit their timeout by timeout route",
+		}, []string{"app", "route"}),
+
+		RedisFallbacksCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redis_fallbacks_total",
+			Help: "Number of Redis failures after which local state was used",
+		}, []string{"app", "state"}),
+
+		BodyModeCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "body_mode_total",
+			Help: "Number of bodies buffered or streamed in streaming mode by direction",
+		}, []string{"app", "direction", "mode"}),
+		BodySizeHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "body_size_bytes",
+			Help:    "Size of request and response bodies in streaming mode",
+			Buckets: prometheus.ExponentialBuckets(1<<10, 4, 10), // 1KB - 256MB
+		}, []string{"app", "direction"}),
+		StreamThresholdGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "stream_threshold_bytes",
+			Help: "Bodies up to this size are buffered in streaming mode, 0 means all bodies are streamed",
+		}, []string{"app"}),
+
+		FeaturesInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "features_info",
+			Help: "State of features which can be switched by --feature, the value is always 1",
+		}, []string{"app", "feature", "enabled"}),
+
+		TenantDurationHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tenant_request_duration_seconds",
+			Help:    "Duration of requests by tenant, tenants over the label limit are reported as other",
+			Buckets: buckets,
+		}, []string{"app", "tenant", "method", "code_class"}),
+
+		IndexFileGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "index_file_present",
+			Help: "Whether the index file exists (1) or is missing (0), reported only with --index-check-interval",
+		}, []string{"app"}),
+
+		AuthRequestsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "forward_auth_requests_total",
+			Help: "Number of forward auth requests by result (allowed, denied, error)",
+		}, []string{"app", "result"}),
+		BodyScansCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "body_scans_total",
+			Help: "Number of scanned request bodies by result (clean, rejected, error, skipped)",
+		}, []string{"app", "result"}),
+		ConfigReloadsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Number of config reloads triggered by SIGHUP by result (success, error)",
+		}, []string{"app", "result"}),
+		FallbackResponsesCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fallback_responses_total",
+			Help: "Number of fallback pages served because FPM was unavailable, by route prefix",
+		}, []string{"app", "route"}),
+		TlsReloadsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tls_certificate_reloads_total",
+			Help: "Number of TLS certificate reloads after file change or SIGHUP by result (success, error)",
+		}, []string{"app", "result"}),
+		TlsCertExpiryGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tls_certificate_expiry_timestamp_seconds",
+			Help: "Unix time when the served TLS certificate expires",
+		}, []string{"app"}),
+		AccessRuleDecisionsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "access_rule_decisions_total",
+			Help: "Number of access rule decisions by rule (position in --access-rule) and action",
+		}, []string{"app", "rule", "action"}),
+
+		InFlightRequestsGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of requests currently in progress",
+		}, []string{"app"}),
+		DrainDeadlineGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gophpfpm_drain_deadline_timestamp_seconds",
+			Help: "Unix time when the drain window of graceful shutdown ends, reported only during shutdown",
+		}, []string{"app"}),
+
+		RecentErrors: NewRecentErrors(recentErrorsSize),
 	}
 
 	reg.MustRegister(monitor.HttpDurationHistogram)
 	reg.MustRegister(monitor.FmpDurationHistogram)
+	reg.MustRegister(monitor.ScheduledRequestsCounter)
+	reg.MustRegister(monitor.SaturationGauge)
+	reg.MustRegister(monitor.PoolSizeGauge)
+	reg.MustRegister(monitor.PoolBusyGauge)
+	reg.MustRegister(monitor.PoolOverflowGauge)
+	reg.MustRegister(monitor.EphemeralConnsCounter)
+	reg.MustRegister(monitor.PoolWaitingGauge)
+	reg.MustRegister(monitor.PoolWaitHistogram)
+	reg.MustRegister(monitor.ShedRequestsCounter)
+	reg.MustRegister(monitor.CacheRequestsCounter)
+	reg.MustRegister(monitor.OpenConnectionsGauge)
+	reg.MustRegister(monitor.ConnectionsCounter)
+	reg.MustRegister(monitor.TlsHandshakeErrorsCounter)
+	reg.MustRegister(monitor.AccessEventsDroppedCounter)
+	reg.MustRegister(monitor.ChaosFaultsCounter)
+	reg.MustRegister(monitor.ProtocolErrorsCounter)
+	reg.MustRegister(monitor.AbortedRequestsCounter)
+	reg.MustRegister(monitor.FirstByteTimeoutsCounter)
+	reg.MustRegister(monitor.FpmReconnectsCounter)
+	reg.MustRegister(monitor.ScriptErrorsCounter)
+	reg.MustRegister(monitor.RejectedRequestsCounter)
+	reg.MustRegister(monitor.RouteTimeoutGauge)
+	reg.MustRegister(monitor.TimeoutsCounter)
+	reg.MustRegister(monitor.RedisFallbacksCounter)
+	reg.MustRegister(monitor.BodyModeCounter)
+	reg.MustRegister(monitor.BodySizeHistogram)
+	reg.MustRegister(monitor.StreamThresholdGauge)
+	reg.MustRegister(monitor.FeaturesInfo)
+	reg.MustRegister(monitor.TenantDurationHistogram)
+	reg.MustRegister(monitor.IndexFileGauge)
+	reg.MustRegister(monitor.AuthRequestsCounter)
+	reg.MustRegister(monitor.BodyScansCounter)
+	reg.MustRegister(monitor.ConfigReloadsCounter)
+	reg.MustRegister(monitor.FallbackResponsesCounter)
+	reg.MustRegister(monitor.AccessRuleDecisionsCounter)
+	reg.MustRegister(monitor.TlsReloadsCounter)
+	reg.MustRegister(monitor.TlsCertExpiryGauge)
+	reg.MustRegister(monitor.InFlightRequestsGauge)
+	reg.MustRegister(monitor.DrainDeadlineGauge)
 
 	logger.Debugf("Monitor initialized")
 
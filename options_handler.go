@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// optionsMiddleware answers OPTIONS requests for configured prefixes directly without invoking FPM.
+// Browser CORS preflights are answered according to the CORS configuration.
+func (hs *HttpServer) optionsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		prefix, found := matchPrefix(r.URL.Path, hs.config.OptionsPrefixes)
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		w.Header().Set("Allow", hs.config.OptionsAllow)
+		hs.writeCorsPreflight(w, r)
+		w.WriteHeader(http.StatusNoContent)
+
+		hs.monitor.HttpDurationHistogram.
+			WithLabelValues(
+				hs.config.App,
+				TypeHttp,
+				r.Method,
+				fmt.Sprintf("%d", http.StatusNoContent),
+				fmt.Sprintf("%s<options>", prefix),
+			).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// writeCorsPreflight sets CORS headers when the request is a preflight from an allowed origin
+func (hs *HttpServer) writeCorsPreflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	requestMethod := r.Header.Get("Access-Control-Request-Method")
+	if origin == "" || requestMethod == "" {
+		return // not a preflight request
+	}
+
+	w.Header().Add("Vary", "Origin")
+	if !containsString(hs.config.CorsOrigins, "*") && !containsString(hs.config.CorsOrigins, origin) {
+		return // origin not allowed - browser will block the request
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", hs.config.OptionsAllow)
+	if requestHeaders := r.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+	}
+	if hs.config.CorsCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if hs.config.CorsMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(hs.config.CorsMaxAge.Seconds())))
+	}
+}
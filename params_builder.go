@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ParamsBuilder maps HTTP request to FastCGI params following CGI/1.1 (RFC 3875) meta-variables.
+//
+// Mapping rules:
+//   - every request header becomes HTTP_<NAME> param, name is upper-cased and "-" is replaced by "_"
+//   - multiple values of the same header are joined by ", " (Cookie values by "; ")
+//   - protected inbound headers (Content-Type, Content-Length) are never mapped to HTTP_* params,
+//     they are passed as CONTENT_TYPE and CONTENT_LENGTH instead
+//   - headers matching drop patterns are removed, renamed headers are mapped under their new name
+//   - headers which could spoof other params are dropped: names with underscores (X_Forwarded_For would
+//     become the same param as X-Forwarded-For) and Proxy header (httpoxy)
+//   - forwarded headers (X-Forwarded-*, Forwarded) are extended by this hop when received from trusted proxies,
+//     otherwise they are replaced
+//   - params set by the proxy always win over params derived from headers
+//   - SSL_* params are filled from headers of TLS terminating load balancer (--ssl-header), only from trusted proxies
+//   - overrides passed to Build win over everything
+//   - with strict_cgi_params feature, empty CONTENT_TYPE and CONTENT_LENGTH are not passed at all
+type ParamsBuilder struct {
+	config *Config
+
+	dropPatterns []string          // lower-cased header name patterns
+	renames      map[string]string // lower-cased original name -> new name
+
+	trustedProxies TrustedProxySet
+	sslHeaders     []sslHeader
+}
+
+func NewParamsBuilder(config *Config) (*ParamsBuilder, error) {
+	var dropPatterns []string
+	for _, pattern := range config.DropHeaders {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid drop header pattern %q: %w", pattern, err)
+		}
+		dropPatterns = append(dropPatterns, pattern)
+	}
+
+	renames := map[string]string{}
+	for _, definition := range config.RenameHeaders {
+		from, to, found := strings.Cut(definition, ":")
+		if !found || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid rename header definition: %s", definition)
+		}
+		renames[strings.ToLower(from)] = to
+	}
+
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	sslHeaders, err := parseSslHeaders(config.SslHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if len(sslHeaders) > 0 && trustedProxies.Empty() {
+		return nil, fmt.Errorf("--%s requires --%s, the headers are accepted only from trusted proxies", SslHeaders, TrustedProxies)
+	}
+
+	return &ParamsBuilder{
+		config: config,
+
+		dropPatterns: dropPatterns,
+		renames:      renames,
+
+		trustedProxies: trustedProxies,
+		sslHeaders:     sslHeaders,
+	}, nil
+}
+
+// Build creates FastCGI params for the request.
+// contentLength is the length of the body sent to FPM (might differ from the original request after decompression).
+func (pb *ParamsBuilder) Build(request *http.Request, contentLength int, overrides map[string]string) map[string]string {
+	params := map[string]string{}
+
+	// propagate http request headers through params
+	for name, values := range request.Header {
+		// do not propagate protected headers
+		if _, found := protectedHeadersInbound[strings.ToLower(name)]; found {
+			continue
+		}
+		if pb.shouldDrop(name) {
+			continue
+		}
+		if renamed, found := pb.renames[strings.ToLower(name)]; found {
+			name = renamed
+		}
+		separator := ", "
+		if strings.EqualFold(name, "Cookie") {
+			separator = "; "
+		}
+		params[headerParamName(name)] = strings.Join(values, separator)
+	}
+	// Go moves Host header out of request headers
+	if request.Host != "" {
+		params["HTTP_HOST"] = request.Host
+	}
+	pb.setForwardedParams(request, params)
+
+	// params set by the proxy
+	for name, value := range pb.serverParams(request, contentLength) {
+		params[name] = value
+	}
+	pb.setSslParams(request, params)
+	pb.setClientCertParams(request, params)
+
+	for name, value := range overrides {
+		params[name] = value
+	}
+
+	if pb.config.Features.Enabled(FeatureStrictCgiParams) {
+		// RFC 3875: the variables are NULL (not set) when the request has no body
+		for _, name := range []string{"CONTENT_TYPE", "CONTENT_LENGTH"} {
+			if params[name] == "" {
+				delete(params, name)
+			}
+		}
+	}
+
+	return params
+}
+
+func (pb *ParamsBuilder) serverParams(request *http.Request, contentLength int) map[string]string {
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SCRIPT_FILENAME":   pb.config.IndexFile,
+		"SCRIPT_NAME":       "/" + path.Base(pb.config.IndexFile),
+		"SERVER_SOFTWARE":   "gophpfpm/" + Version,
+		"SERVER_PROTOCOL":   request.Proto,
+		"SERVER_NAME":       hostWithoutPort(request.Host),
+		"SERVER_PORT":       pb.serverPort(request),
+		"REQUEST_URI":       request.URL.RequestURI(),
+		"QUERY_STRING":      request.URL.RawQuery,
+		"REQUEST_METHOD":    request.Method,
+		"CONTENT_TYPE":      request.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    "",
+	}
+
+	if contentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.Itoa(contentLength)
+	}
+
+	if host, port, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		params["REMOTE_ADDR"] = host
+		params["REMOTE_PORT"] = port
+	}
+
+	if request.TLS != nil {
+		params["HTTPS"] = "on"
+		params["REQUEST_SCHEME"] = "https"
+	} else {
+		params["REQUEST_SCHEME"] = "http"
+	}
+
+	return params
+}
+
+// serverPort returns port of the listener which received the request. Unix sockets have no port, the port of Host
+// header or the default one of the scheme is used then. Internal requests have no listener and get --port.
+func (pb *ParamsBuilder) serverPort(request *http.Request) string {
+	addr, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return strconv.Itoa(pb.config.Port)
+	}
+	if _, port, err := net.SplitHostPort(addr.String()); err == nil && addr.Network() != "unix" {
+		return port
+	}
+	if _, port, err := net.SplitHostPort(request.Host); err == nil {
+		return port
+	}
+	if request.TLS != nil {
+		return "443"
+	}
+	return "80"
+}
+
+// shouldDrop reports whether the header must not be passed to PHP
+func (pb *ParamsBuilder) shouldDrop(name string) bool {
+	lower := strings.ToLower(name)
+	if lower == "proxy" {
+		return true // https://httpoxy.org
+	}
+	if !pb.config.AllowUnderscoreHeaders && strings.Contains(lower, "_") {
+		return true
+	}
+	for _, pattern := range pb.dropPatterns {
+		if matched, _ := path.Match(pattern, lower); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// headerParamName converts HTTP header name to CGI param name, e.g. "X-Request-Id" -> "HTTP_X_REQUEST_ID"
+func headerParamName(name string) string {
+	return "HTTP_" + strings.ReplaceAll(strings.ToUpper(name), "-", "_")
+}
+
+// hostWithoutPort strips port from the host header value
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
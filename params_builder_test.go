@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// paramsCase describes request received by the proxy and params expected in FastCGI request, absent params
+// must not be passed at all
+type paramsCase struct {
+	name      string
+	configure func(config *Config)
+	method    string
+	target    string
+	remote    string
+	header    http.Header
+	tls       bool
+	local     net.Addr // address of the listener which received the request, nil for internal requests
+	overrides map[string]string
+
+	want   map[string]string
+	absent []string
+}
+
+func testParamsConfig() *Config {
+	return &Config{
+		Port:          8080,
+		IndexFile:     "/app/public/index.php",
+		Forwarded:     ForwardedXForwarded,
+		TlsClientAuth: ClientAuthNone,
+		Features:      Features{},
+	}
+}
+
+func (c paramsCase) request() *http.Request {
+	method := c.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	target := c.target
+	if target == "" {
+		target = "http://example.com/"
+	}
+	request := httptest.NewRequest(method, target, nil)
+	if c.remote != "" {
+		request.RemoteAddr = c.remote
+	}
+	for name, values := range c.header {
+		request.Header[name] = values
+	}
+	if !c.tls {
+		request.TLS = nil
+	} else if request.TLS == nil {
+		request.TLS = &tls.ConnectionState{}
+	}
+	if c.local != nil {
+		request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, c.local))
+	}
+	return request
+}
+
+func runParamsCases(t *testing.T, cases []paramsCase) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := testParamsConfig()
+			if c.configure != nil {
+				c.configure(config)
+			}
+			pb, err := NewParamsBuilder(config)
+			if err != nil {
+				t.Fatalf("could not create params builder: %s", err)
+			}
+			params := pb.Build(c.request(), 0, c.overrides)
+			for name, value := range c.want {
+				if got, found := params[name]; !found || got != value {
+					t.Errorf("%s = %q (set %t), want %q", name, got, found, value)
+				}
+			}
+			for _, name := range c.absent {
+				if got, found := params[name]; found {
+					t.Errorf("%s = %q, want it not set", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParamsBuilderScript(t *testing.T) {
+	runParamsCases(t, []paramsCase{
+		{
+			name:   "front controller",
+			target: "http://example.com/blog/post?id=1&sort=asc",
+			want: map[string]string{
+				"GATEWAY_INTERFACE": "CGI/1.1",
+				"SCRIPT_FILENAME":   "/app/public/index.php",
+				"SCRIPT_NAME":       "/index.php",
+				"REQUEST_URI":       "/blog/post?id=1&sort=asc",
+				"QUERY_STRING":      "id=1&sort=asc",
+				"REQUEST_METHOD":    "GET",
+				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"SERVER_NAME":       "example.com",
+				"SERVER_SOFTWARE":   "gophpfpm/" + Version,
+				"HTTP_HOST":         "example.com",
+			},
+			absent: []string{"PATH_INFO", "PATH_TRANSLATED"},
+		},
+		{
+			name:   "script in path is routed by the front controller",
+			target: "http://example.com/index.php/admin/users",
+			want: map[string]string{
+				"SCRIPT_FILENAME": "/app/public/index.php",
+				"SCRIPT_NAME":     "/index.php",
+				"REQUEST_URI":     "/index.php/admin/users",
+			},
+			absent: []string{"PATH_INFO"},
+		},
+		{
+			name:      "nested index file",
+			configure: func(config *Config) { config.IndexFile = "/srv/app/web/app.php" },
+			target:    "http://example.com/",
+			want: map[string]string{
+				"SCRIPT_FILENAME": "/srv/app/web/app.php",
+				"SCRIPT_NAME":     "/app.php",
+				"REQUEST_URI":     "/",
+				"QUERY_STRING":    "",
+			},
+		},
+		{
+			name:   "PATH_INFO header is not the param",
+			header: http.Header{"Path-Info": {"/etc/passwd"}},
+			want:   map[string]string{"HTTP_PATH_INFO": "/etc/passwd"},
+			absent: []string{"PATH_INFO"},
+		},
+		{
+			name:   "host with port",
+			target: "http://example.com:8000/",
+			want: map[string]string{
+				"SERVER_NAME": "example.com",
+				"HTTP_HOST":   "example.com:8000",
+			},
+		},
+		{
+			name:   "client address",
+			remote: "192.0.2.10:51234",
+			want: map[string]string{
+				"REMOTE_ADDR": "192.0.2.10",
+				"REMOTE_PORT": "51234",
+			},
+		},
+		{
+			name:      "overrides win",
+			target:    "http://example.com/a?b=c",
+			overrides: map[string]string{"REQUEST_URI": "/internal", "GOPHPFPM_SCHEDULED": "1"},
+			want: map[string]string{
+				"REQUEST_URI":        "/internal",
+				"QUERY_STRING":       "b=c",
+				"GOPHPFPM_SCHEDULED": "1",
+			},
+		},
+		{
+			name:   "empty body params",
+			method: http.MethodGet,
+			want: map[string]string{
+				"CONTENT_TYPE":   "",
+				"CONTENT_LENGTH": "",
+			},
+		},
+		{
+			name:      "strict params without body",
+			configure: func(config *Config) { config.Features = Features{FeatureStrictCgiParams: true} },
+			absent:    []string{"CONTENT_TYPE", "CONTENT_LENGTH"},
+		},
+	})
+}
+
+func TestParamsBuilderContentLength(t *testing.T) {
+	pb, err := NewParamsBuilder(testParamsConfig())
+	if err != nil {
+		t.Fatalf("could not create params builder: %s", err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "http://example.com/upload", nil)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Content-Length", "999")
+
+	params := pb.Build(request, 42, nil)
+	if params["CONTENT_LENGTH"] != "42" {
+		t.Errorf("CONTENT_LENGTH = %q, want length of the body sent to FPM", params["CONTENT_LENGTH"])
+	}
+	if params["CONTENT_TYPE"] != "application/json" {
+		t.Errorf("CONTENT_TYPE = %q, want application/json", params["CONTENT_TYPE"])
+	}
+	for _, name := range []string{"HTTP_CONTENT_TYPE", "HTTP_CONTENT_LENGTH"} {
+		if _, found := params[name]; found {
+			t.Errorf("%s is set, protected headers are passed only as CGI params", name)
+		}
+	}
+}
+
+func TestParamsBuilderBasePath(t *testing.T) {
+	cases := []struct {
+		name     string
+		basePath string
+		target   string
+		header   http.Header
+		uri      string
+		prefix   string // empty means the header is not passed
+	}{
+		{name: "stripped", basePath: "/shop", target: "/shop/cart?item=1", uri: "/cart?item=1", prefix: "/shop"},
+		{name: "root of base path", basePath: "/shop", target: "/shop", uri: "/", prefix: "/shop"},
+		{name: "normalized", basePath: "shop/", target: "/shop/cart", uri: "/cart", prefix: "/shop"},
+		{name: "outside", basePath: "/shop", target: "/shopping", uri: "/shopping"},
+		{name: "spoofed prefix", basePath: "/shop", target: "/metrics", header: http.Header{"X-Forwarded-Prefix": {"/evil"}}, uri: "/metrics"},
+		{name: "spoofed prefix replaced", basePath: "/shop", target: "/shop/a", header: http.Header{"X-Forwarded-Prefix": {"/evil"}}, uri: "/a", prefix: "/shop"},
+		{name: "disabled", target: "/shop/cart", uri: "/shop/cart"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := testParamsConfig()
+			config.BasePath = c.basePath
+			pb, err := NewParamsBuilder(config)
+			if err != nil {
+				t.Fatalf("could not create params builder: %s", err)
+			}
+
+			var params map[string]string
+			handler := basePathMiddleware(c.basePath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				params = pb.Build(r, 0, nil)
+			}))
+			request := httptest.NewRequest(http.MethodGet, c.target, nil)
+			for name, values := range c.header {
+				request.Header[name] = values
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			if params["REQUEST_URI"] != c.uri {
+				t.Errorf("REQUEST_URI = %q, want %q", params["REQUEST_URI"], c.uri)
+			}
+			if params["SCRIPT_NAME"] != "/index.php" {
+				t.Errorf("SCRIPT_NAME = %q, want /index.php", params["SCRIPT_NAME"])
+			}
+			if prefix, found := params["HTTP_X_FORWARDED_PREFIX"]; prefix != c.prefix || found != (c.prefix != "") {
+				t.Errorf("HTTP_X_FORWARDED_PREFIX = %q (set %t), want %q", prefix, found, c.prefix)
+			}
+		})
+	}
+}
+
+func TestParamsBuilderHttps(t *testing.T) {
+	trusted := func(config *Config) {
+		config.TrustedProxies = []string{"10.0.0.0/8"}
+		config.SslHeaders = []string{"HTTPS:X-Forwarded-Ssl"}
+	}
+	runParamsCases(t, []paramsCase{
+		{
+			name:   "plain http",
+			want:   map[string]string{"REQUEST_SCHEME": "http", "HTTP_X_FORWARDED_PROTO": "http"},
+			absent: []string{"HTTPS"},
+		},
+		{
+			name: "tls",
+			tls:  true,
+			want: map[string]string{"HTTPS": "on", "REQUEST_SCHEME": "https", "HTTP_X_FORWARDED_PROTO": "https"},
+		},
+		{
+			name:      "tls terminated by trusted proxy",
+			configure: trusted,
+			remote:    "10.0.0.1:4000",
+			header:    http.Header{"X-Forwarded-Ssl": {"on"}, "X-Forwarded-Proto": {"https"}},
+			want:      map[string]string{"HTTPS": "on", "REQUEST_SCHEME": "https", "HTTP_X_FORWARDED_PROTO": "https"},
+		},
+		{
+			name:      "tls terminated by trusted proxy turned off",
+			configure: trusted,
+			remote:    "10.0.0.1:4000",
+			header:    http.Header{"X-Forwarded-Ssl": {"off"}},
+			want:      map[string]string{"REQUEST_SCHEME": "http"},
+			absent:    []string{"HTTPS"},
+		},
+		{
+			name:      "spoofed by client",
+			configure: trusted,
+			remote:    "192.0.2.1:4000",
+			header:    http.Header{"X-Forwarded-Ssl": {"on"}, "X-Forwarded-Proto": {"https"}},
+			want:      map[string]string{"REQUEST_SCHEME": "http", "HTTP_X_FORWARDED_PROTO": "http"},
+			absent:    []string{"HTTPS", "HTTP_X_FORWARDED_SSL"},
+		},
+	})
+}
+
+func TestParamsBuilderForwarded(t *testing.T) {
+	trusted := func(style string) func(config *Config) {
+		return func(config *Config) {
+			config.Forwarded = style
+			config.TrustedProxies = []string{"10.0.0.0/8"}
+		}
+	}
+	header := http.Header{
+		"X-Forwarded-For":   {"203.0.113.7"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"shop.example.com"},
+		"X-Forwarded-Port":  {"443"},
+		"Forwarded":         {"for=203.0.113.7;proto=https"},
+	}
+	runParamsCases(t, []paramsCase{
+		{
+			name:   "without forwarded headers",
+			remote: "192.0.2.1:4000",
+			local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080},
+			want: map[string]string{
+				"HTTP_X_FORWARDED_FOR":   "192.0.2.1",
+				"HTTP_X_FORWARDED_PROTO": "http",
+				"HTTP_X_FORWARDED_HOST":  "example.com",
+				"HTTP_X_FORWARDED_PORT":  "8080",
+			},
+			absent: []string{"HTTP_FORWARDED"},
+		},
+		{
+			name:   "replaced from untrusted peer",
+			remote: "192.0.2.1:4000",
+			local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080},
+			header: header,
+			want: map[string]string{
+				"HTTP_X_FORWARDED_FOR":   "192.0.2.1",
+				"HTTP_X_FORWARDED_PROTO": "http",
+				"HTTP_X_FORWARDED_HOST":  "example.com",
+				"HTTP_X_FORWARDED_PORT":  "8080",
+			},
+			absent: []string{"HTTP_FORWARDED"},
+		},
+		{
+			name:      "extended from trusted peer",
+			configure: trusted(ForwardedXForwarded),
+			remote:    "10.0.0.1:4000",
+			header:    header,
+			want: map[string]string{
+				"HTTP_X_FORWARDED_FOR":   "203.0.113.7, 10.0.0.1",
+				"HTTP_X_FORWARDED_PROTO": "https",
+				"HTTP_X_FORWARDED_HOST":  "shop.example.com",
+				"HTTP_X_FORWARDED_PORT":  "443",
+			},
+			absent: []string{"HTTP_FORWARDED"},
+		},
+		{
+			name:      "rfc 7239 from trusted peer",
+			configure: trusted(ForwardedRfc7239),
+			remote:    "10.0.0.1:4000",
+			header:    header,
+			want:      map[string]string{"HTTP_FORWARDED": "for=203.0.113.7;proto=https, for=10.0.0.1;proto=http;host=example.com"},
+			absent:    []string{"HTTP_X_FORWARDED_FOR", "HTTP_X_FORWARDED_PROTO", "HTTP_X_FORWARDED_HOST", "HTTP_X_FORWARDED_PORT"},
+		},
+		{
+			name: "unix peer is not trusted by loopback",
+			configure: func(config *Config) {
+				config.Forwarded = ForwardedBoth
+				config.TrustedProxies = []string{"127.0.0.1", "::1"}
+			},
+			remote: unixPeerAddr{}.String(),
+			header: header,
+			want: map[string]string{
+				"REMOTE_ADDR":          "unix",
+				"HTTP_X_FORWARDED_FOR": "unix",
+				"HTTP_FORWARDED":       "for=unknown;proto=http;host=example.com",
+			},
+		},
+		{
+			name: "unix peer trusted explicitly",
+			configure: func(config *Config) {
+				config.Forwarded = ForwardedXForwarded
+				config.TrustedProxies = []string{"unix"}
+			},
+			remote: unixPeerAddr{}.String(),
+			header: header,
+			want: map[string]string{
+				"HTTP_X_FORWARDED_FOR":   "203.0.113.7, unix",
+				"HTTP_X_FORWARDED_PROTO": "https",
+			},
+		},
+		{
+			name:      "rfc 7239 ipv6 peer",
+			configure: func(config *Config) { config.Forwarded = ForwardedRfc7239 },
+			remote:    "[2001:db8::1]:4000",
+			want:      map[string]string{"HTTP_FORWARDED": `for="[2001:db8::1]";proto=http;host=example.com`},
+		},
+		{
+			name:      "both from untrusted peer",
+			configure: func(config *Config) { config.Forwarded = ForwardedBoth },
+			remote:    "192.0.2.1:4000",
+			header:    header,
+			want: map[string]string{
+				"HTTP_X_FORWARDED_FOR": "192.0.2.1",
+				"HTTP_FORWARDED":       "for=192.0.2.1;proto=http;host=example.com",
+			},
+		},
+		{
+			name:      "off passes headers as received",
+			configure: func(config *Config) { config.Forwarded = ForwardedOff },
+			remote:    "192.0.2.1:4000",
+			header:    header,
+			want: map[string]string{
+				"HTTP_X_FORWARDED_FOR":  "203.0.113.7",
+				"HTTP_X_FORWARDED_PORT": "443",
+				"HTTP_FORWARDED":        "for=203.0.113.7;proto=https",
+			},
+		},
+	})
+}
+
+func TestParamsBuilderHeaders(t *testing.T) {
+	runParamsCases(t, []paramsCase{
+		{
+			name: "mapped",
+			header: http.Header{
+				"X-Request-Id": {"abc"},
+				"Accept":       {"text/html", "application/json"},
+				"Cookie":       {"a=1", "b=2"},
+			},
+			want: map[string]string{
+				"HTTP_X_REQUEST_ID": "abc",
+				"HTTP_ACCEPT":       "text/html, application/json",
+				"HTTP_COOKIE":       "a=1; b=2",
+			},
+		},
+		{
+			name:   "httpoxy",
+			header: http.Header{"Proxy": {"http://evil.example.com"}},
+			absent: []string{"HTTP_PROXY"},
+		},
+		{
+			name:   "underscores dropped",
+			header: http.Header{"X_Custom": {"spoofed"}, "X-Custom": {"real"}},
+			want:   map[string]string{"HTTP_X_CUSTOM": "real"},
+		},
+		{
+			name:   "underscore spoofing forwarded header",
+			remote: "192.0.2.1:4000",
+			header: http.Header{"X_Forwarded_For": {"203.0.113.7"}},
+			want:   map[string]string{"HTTP_X_FORWARDED_FOR": "192.0.2.1"},
+		},
+		{
+			name:      "underscores allowed",
+			configure: func(config *Config) { config.AllowUnderscoreHeaders = true },
+			header:    http.Header{"X_Custom": {"value"}},
+			want:      map[string]string{"HTTP_X_CUSTOM": "value"},
+		},
+		{
+			name:      "drop patterns",
+			configure: func(config *Config) { config.DropHeaders = []string{"X-Debug-*", "authorization"} },
+			header: http.Header{
+				"X-Debug-Token": {"secret"},
+				"Authorization": {"Bearer secret"},
+				"X-Debugger":    {"kept"},
+			},
+			want:   map[string]string{"HTTP_X_DEBUGGER": "kept"},
+			absent: []string{"HTTP_X_DEBUG_TOKEN", "HTTP_AUTHORIZATION"},
+		},
+		{
+			name:      "renamed",
+			configure: func(config *Config) { config.RenameHeaders = []string{"X-Legacy-User:X-User"} },
+			header:    http.Header{"X-Legacy-User": {"alice"}},
+			want:      map[string]string{"HTTP_X_USER": "alice"},
+			absent:    []string{"HTTP_X_LEGACY_USER"},
+		},
+		{
+			name:   "headers can't override server params",
+			header: http.Header{"Server-Name": {"evil"}, "Remote-Addr": {"203.0.113.7"}},
+			remote: "192.0.2.1:4000",
+			want: map[string]string{
+				"SERVER_NAME":      "example.com",
+				"REMOTE_ADDR":      "192.0.2.1",
+				"HTTP_SERVER_NAME": "evil",
+			},
+		},
+	})
+}
+
+func TestParamsBuilderServerPort(t *testing.T) {
+	unix := &net.UnixAddr{Net: "unix", Name: "/run/gophpfpm/http.sock"}
+	runParamsCases(t, []paramsCase{
+		{
+			name:  "tcp listener",
+			local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080},
+			want:  map[string]string{"SERVER_PORT": "8080", "HTTP_X_FORWARDED_PORT": "8080"},
+		},
+		{
+			name:  "second listener",
+			local: &net.TCPAddr{IP: net.IPv6loopback, Port: 8443},
+			want:  map[string]string{"SERVER_PORT": "8443", "HTTP_X_FORWARDED_PORT": "8443"},
+		},
+		{
+			name:      "listener differs from --port",
+			configure: func(config *Config) { config.Port = 9000 },
+			local:     &net.TCPAddr{IP: net.IPv4zero, Port: 8081},
+			want:      map[string]string{"SERVER_PORT": "8081"},
+		},
+		{
+			name:   "unix socket with port in host",
+			target: "http://example.com:8000/",
+			local:  unix,
+			want:   map[string]string{"SERVER_PORT": "8000", "HTTP_X_FORWARDED_PORT": "8000"},
+		},
+		{
+			name:  "unix socket",
+			local: unix,
+			want:  map[string]string{"SERVER_PORT": "80"},
+		},
+		{
+			name:  "unix socket with tls",
+			local: unix,
+			tls:   true,
+			want:  map[string]string{"SERVER_PORT": "443"},
+		},
+		{
+			name: "internal request",
+			want: map[string]string{"SERVER_PORT": "8080"},
+		},
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import "strings"
+
+// matchPrefix returns the longest prefix matching the path
+func matchPrefix(path string, prefixes []string) (string, bool) {
+	best := ""
+	found := false
+	for _, prefix := range prefixes {
+		if pathHasPrefix(path, prefix) && len(prefix) >= len(best) {
+			best = prefix
+			found = true
+		}
+	}
+	return best, found
+}
+
+// pathHasPrefix reports whether the path is inside the prefix respecting path segments,
+// so "/api" matches "/api" and "/api/users" but not "/apiary"
+func pathHasPrefix(path string, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// maxStderrSize limits stderr kept per request, PHP can write a lot of notices in a loop
+const maxStderrSize = 64 << 10
+
+// appendStderr appends content of stderr record, stderr over maxStderrSize is dropped
+func appendStderr(stderr []byte, content []byte) []byte {
+	if len(stderr)+len(content) > maxStderrSize {
+		content = content[:maxStderrSize-len(stderr)]
+	}
+	return append(stderr, content...)
+}
+
+// logStderr logs warnings and errors PHP wrote to stderr (display_errors=stderr, error_log to stderr),
+// they would be invisible otherwise
+func (hs *HttpServer) logStderr(request *http.Request, response *ResponseData) {
+	stderr := response.Stderr
+	if len(stderr) > maxStderrSize {
+		stderr = stderr[:maxStderrSize]
+	}
+	if stderr = bytes.TrimSpace(stderr); len(stderr) == 0 {
+		return
+	}
+	hs.logger.WithFields(logrus.Fields{
+		"method":     request.Method,
+		"uri":        request.URL.RequestURI(),
+		"request_id": request.Header.Get(RequestIdHeader),
+		"status":     response.Status,
+		"stderr":     string(stderr),
+	}).Warn("PHP stderr")
+}
+
+// attachStderr appends stderr to body of 5xx responses, so developers see PHP errors in the browser.
+// The body is changed before compression, Content-Length set by PHP is dropped.
+func attachStderr(response *ResponseData) {
+	if response.Status < http.StatusInternalServerError || len(response.Stderr) == 0 {
+		return
+	}
+	http.Header(response.Headers).Del("Content-Length")
+	body := make([]byte, 0, len(response.Body)+len(response.Stderr)+16)
+	body = append(body, response.Body...)
+	body = append(body, "\n\nPHP stderr:\n"...)
+	response.Body = append(body, response.Stderr...)
+}
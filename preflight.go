@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// RunPreflight sends one internal request to the index file and logs what PHP reported.
+// It gives operators immediate confirmation that the proxy and FPM pairing works after deploys.
+func RunPreflight(
+	fCgiClient *FCgiClient,
+	fpmClient *FpmClient,
+	paramsBuilder *ParamsBuilder,
+	config *Config,
+	logger *logrus.Logger,
+) {
+	fields := logrus.Fields{
+		"uri": config.PreflightUri,
+	}
+
+	values, err := fCgiClient.GetValues(FCGI_MAX_CONNS, FCGI_MAX_REQS, FCGI_MPXS_CONNS)
+	if err != nil {
+		fields["get_values_error"] = err.Error()
+	}
+	for name, value := range values {
+		fields[name] = value
+	}
+
+	request, err := http.NewRequest(http.MethodGet, config.PreflightUri, nil)
+	if err != nil {
+		logger.WithFields(fields).Errorf("FPM preflight failed: invalid uri: %s", err)
+		return
+	}
+	request.Host = "localhost"
+	params := paramsBuilder.Build(request, 0, map[string]string{"GOPHPFPM_PREFLIGHT": "1"})
+
+	start := time.Now()
+	fpmReq := fpmClient.NewRequest(params, nil)
+	fpmReq.Priority = PriorityHigh
+	response, err := fpmClient.Execute(fpmReq)
+	fields["duration"] = time.Since(start).String()
+	if err != nil {
+		logger.WithFields(fields).Errorf("FPM preflight failed: %s", err)
+		return
+	}
+
+	// X-Powered-By is stripped from client responses, but it's the easiest way to see PHP version
+	fields["php_version"] = http.Header(response.Headers).Get("X-Powered-By")
+	fields["status"] = response.Status
+	fields["size"] = len(response.Body)
+
+	entry := logger.WithFields(fields)
+	if response.Status >= 500 {
+		entry.Warn("FPM preflight finished with server error")
+		return
+	}
+	entry.Info("FPM preflight")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priority of the request when waiting for a free FPM connection
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityLow
+)
+
+var (
+	// priorityOrder in which waiting requests get free connections
+	priorityOrder = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+	priorityNames = map[Priority]string{
+		PriorityHigh:   "high",
+		PriorityNormal: "normal",
+		PriorityLow:    "low",
+	}
+)
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+// PriorityClasses assigns priority to requests by route prefix
+type PriorityClasses struct {
+	prefixes   []string
+	priorities map[string]Priority
+}
+
+func NewPriorityClasses(config *Config) (*PriorityClasses, error) {
+	pc := &PriorityClasses{
+		priorities: map[string]Priority{},
+	}
+
+	for _, definition := range config.Priorities {
+		name, prefix, found := strings.Cut(definition, ":")
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid priority definition: %s", definition)
+		}
+		priority, err := parsePriority(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority definition %s: %w", definition, err)
+		}
+		pc.prefixes = append(pc.prefixes, prefix)
+		pc.priorities[prefix] = priority
+	}
+
+	return pc, nil
+}
+
+// Resolve returns priority of the longest matching prefix
+func (pc *PriorityClasses) Resolve(path string) Priority {
+	prefix, found := matchPrefix(path, pc.prefixes)
+	if !found {
+		return PriorityNormal
+	}
+	return pc.priorities[prefix]
+}
+
+func parsePriority(name string) (Priority, error) {
+	for priority, priorityName := range priorityNames {
+		if strings.EqualFold(name, priorityName) {
+			return priority, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q", name)
+}
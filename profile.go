@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/pflag"
+	"sort"
+	"strings"
+)
+
+// profiles are presets of flag values, flags set explicitly always override the profile
+var profiles = map[string]map[string]string{
+	"dev": {
+		ParamVerbose:     "true",
+		LogFormat:        LogFormatText,
+		Cache:            "false",
+		NegativeCacheTtl: "0s",
+		Timeout:          "5m",
+	},
+	"prod": {
+		ParamVerbose:        "false",
+		LogFormat:           LogFormatJson,
+		Compression:         "true",
+		SecurityHeaders:     "true",
+		Timeout:             "30s",
+		MaxDecompressedSize: fmt.Sprintf("%d", 8<<20),
+	},
+}
+
+// applyProfile sets values of the selected profile to flags which were not set explicitly
+func applyProfile(set *pflag.FlagSet) error {
+	name := ignoreError(set.GetString(Profile))
+	if name == "" {
+		return nil
+	}
+
+	profile, found := profiles[name]
+	if !found {
+		return fmt.Errorf("unknown profile %q, use one of: %s", name, strings.Join(profileNames(), ", "))
+	}
+	for flag, value := range profile {
+		if set.Changed(flag) {
+			continue
+		}
+		if err := set.Set(flag, value); err != nil {
+			return fmt.Errorf("could not apply profile %q to %q: %w", name, flag, err)
+		}
+	}
+	return nil
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
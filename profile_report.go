@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+const maxProfileDuration = 5 * time.Minute
+
+// PoolSnapshot is the state of the FPM pool when the profile was captured
+type PoolSnapshot struct {
+	Size       int     `json:"size"`
+	Busy       int     `json:"busy"`
+	Waiting    int     `json:"waiting"`
+	Saturation float64 `json:"saturation"`
+	Goroutines int     `json:"goroutines"`
+	GoVersion  string  `json:"go_version"`
+	CapturedAt string  `json:"captured_at"`
+	Duration   string  `json:"duration"`
+}
+
+// writeProfileReport captures CPU profile for the duration, then heap and goroutine profiles,
+// metrics and pool state, and writes everything as tar.gz archive
+func writeProfileReport(w io.Writer, duration time.Duration, fCgiClient *FCgiClient, monitor *Monitor) error {
+	var cpu bytes.Buffer
+	if err := pprof.StartCPUProfile(&cpu); err != nil {
+		return fmt.Errorf("could not start CPU profile: %w", err)
+	}
+	time.Sleep(duration)
+	pprof.StopCPUProfile()
+
+	files := map[string][]byte{"cpu.pprof": cpu.Bytes()}
+
+	var heap bytes.Buffer
+	runtime.GC() // up-to-date heap statistics
+	if err := pprof.WriteHeapProfile(&heap); err != nil {
+		return fmt.Errorf("could not write heap profile: %w", err)
+	}
+	files["heap.pprof"] = heap.Bytes()
+
+	var goroutines bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&goroutines, 1); err != nil {
+		return fmt.Errorf("could not write goroutine profile: %w", err)
+	}
+	files["goroutines.txt"] = goroutines.Bytes()
+
+	metrics, err := monitor.Registry.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %w", err)
+	}
+	var metricsText bytes.Buffer
+	encoder := expfmt.NewEncoder(&metricsText, expfmt.FmtText)
+	for _, family := range metrics {
+		if err := encoder.Encode(family); err != nil {
+			return fmt.Errorf("could not encode metrics: %w", err)
+		}
+	}
+	files["metrics.txt"] = metricsText.Bytes()
+
+	size := fCgiClient.pool.Size()
+	busy := fCgiClient.Busy()
+	waiting := fCgiClient.Waiting()
+	pool, err := json.MarshalIndent(PoolSnapshot{
+		Size:       size,
+		Busy:       busy,
+		Waiting:    waiting,
+		Saturation: float64(busy+waiting) / float64(size),
+		Goroutines: runtime.NumGoroutine(),
+		GoVersion:  runtime.Version(),
+		CapturedAt: time.Now().Format(time.RFC3339),
+		Duration:   duration.String(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode pool state: %w", err)
+	}
+	files["pool.json"] = pool
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	for _, name := range []string{"cpu.pprof", "heap.pprof", "goroutines.txt", "metrics.txt", "pool.json"} {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(files[name])),
+			ModTime: time.Now(),
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return fmt.Errorf("could not write archive: %w", err)
+		}
+		if _, err := archive.Write(files[name]); err != nil {
+			return fmt.Errorf("could not write archive: %w", err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("could not write archive: %w", err)
+	}
+	return gz.Close()
+}
+
+// NewProfileCommand creates command downloading profile report from the admin API of a running server
+func NewProfileCommand(logger *log.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Capture profile report of a running server",
+		Long:  `Capture CPU and heap profiles, metrics and FPM pool state of a running server via admin API into a single tar.gz file, which can be attached to issues.`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := LoadConfig(cmd.Flags(), logger)
+			if err != nil {
+				logger.Fatalf("could not load config: %s", err)
+			}
+			if config.AdminPort == 0 {
+				logger.Fatalf("required flag(s) %q not set", AdminPort)
+			}
+			duration, err := cmd.Flags().GetDuration("duration")
+			if err != nil {
+				logger.Fatalf("could not load %q: %s", "duration", err)
+			}
+			output := ignoreError(cmd.Flags().GetString("output"))
+
+			url := fmt.Sprintf("http://%s/admin/profile?duration=%s", config.AdminDialAddress(), duration)
+			request, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				logger.Fatalf("could not create request: %s", err)
+			}
+			if config.AdminToken != "" {
+				request.Header.Set("Authorization", "Bearer "+config.AdminToken)
+			}
+
+			logger.Infof("Capturing profile for %s", duration)
+			client := &http.Client{Timeout: duration + time.Minute}
+			response, err := client.Do(request)
+			if err != nil {
+				logger.Fatalf("could not capture profile: %s", err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(response.Body)
+				logger.Fatalf("could not capture profile: status %d: %s", response.StatusCode, body)
+			}
+
+			file, err := os.Create(output)
+			if err != nil {
+				logger.Fatalf("could not create output file: %s", err)
+			}
+			defer file.Close()
+			if _, err := io.Copy(file, response.Body); err != nil {
+				logger.Fatalf("could not write output file: %s", err)
+			}
+			logger.Infof("Profile report written to %s", output)
+		},
+	}
+	cmd.Flags().Duration("duration", 30*time.Second, "Duration of CPU profile")
+	cmd.Flags().StringP("output", "o", "gophpfpm-profile.tar.gz", "Output file")
+	return cmd
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitKeyIp     = "ip"
+	RateLimitKeyHeader = "header:"
+	RateLimitKeyCookie = "cookie:"
+	RateLimitKeyPath   = "path:"
+)
+
+var (
+	errRateLimited = errors.New("rate limit exceeded")
+
+	// redisTokenBucket refills and takes a token atomically, Redis clock is used so replicas agree on time.
+	// KEYS[1] is the bucket, ARGV[1] number of requests and ARGV[2] period in microseconds.
+	redisTokenBucket = redis.NewScript(`
+local now = redis.call('TIME')
+local nowUs = tonumber(now[1]) * 1000000 + tonumber(now[2])
+local burst = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1])
+if tokens == nil then
+	tokens = burst
+else
+	tokens = math.min(burst, tokens + (nowUs - tonumber(state[2])) * burst / period)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(nowUs))
+redis.call('PEXPIRE', KEYS[1], math.ceil(period / 1000))
+return {allowed, tostring(tokens)}
+`)
+)
+
+// rate allows burst requests at once, refilled evenly over the period
+type rate struct {
+	burst  int
+	period time.Duration
+}
+
+func (r rate) perSecond() float64 {
+	return float64(r.burst) / r.period.Seconds()
+}
+
+// tokenBucket of one key, entries are kept in the LRU list
+type tokenBucket struct {
+	key    string
+	rate   rate
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits requests with token buckets keyed by request attributes (client IP, headers, cookies,
+// leading path segments), so multi-tenant applications can enforce per-tenant quotas. Buckets are kept
+// in an LRU with bounded size - an evicted key starts again with a full bucket. With Redis the buckets are shared
+// by all replicas, the local buckets are used only while Redis is unavailable.
+type RateLimiter struct {
+	keyParts       []string
+	rate           rate
+	overrides      map[string]rate
+	trustedProxies TrustedProxySet // the ip key is the client behind them
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List // most recently used at front
+
+	redis  *RedisStore // nil when state is local
+	config *Config
+}
+
+func NewRateLimiter(redisStore *RedisStore, config *Config) (*RateLimiter, error) {
+	rl := &RateLimiter{
+		overrides: map[string]rate{},
+		buckets:   map[string]*list.Element{},
+		lru:       list.New(),
+		redis:     redisStore,
+		config:    config,
+	}
+	if config.RateLimit == "" {
+		return rl, nil
+	}
+
+	var err error
+	if rl.rate, err = parseRate(config.RateLimit); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", RateLimit, err)
+	}
+	if rl.keyParts, err = parseRateLimitKey(config.RateLimitKey); err != nil {
+		return nil, err
+	}
+	if rl.trustedProxies, err = parseTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	for _, definition := range config.RateLimitOverrides {
+		key, value, found := strings.Cut(definition, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid rate limit override definition: %s", definition)
+		}
+		override, err := parseRate(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit override definition %s: %w", definition, err)
+		}
+		rl.overrides[key] = override
+	}
+	if config.RateLimitMaxKeys <= 0 {
+		return nil, fmt.Errorf("%s must be positive", RateLimitMaxKeys)
+	}
+
+	return rl, nil
+}
+
+// parseRate parses rate in format requests/period, e.g. 100/m, 10/s or 500/10m
+func parseRate(value string) (rate, error) {
+	count, period, found := strings.Cut(value, "/")
+	if !found {
+		return rate{}, fmt.Errorf("rate %q must be in format requests/period, e.g. 100/m", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst <= 0 {
+		return rate{}, fmt.Errorf("number of requests in rate %q must be positive", value)
+	}
+
+	var duration time.Duration
+	switch period {
+	case "s":
+		duration = time.Second
+	case "m":
+		duration = time.Minute
+	case "h":
+		duration = time.Hour
+	default:
+		duration, err = time.ParseDuration(period)
+		if err != nil || duration <= 0 {
+			return rate{}, fmt.Errorf("invalid period of rate %q", value)
+		}
+	}
+	return rate{burst: burst, period: duration}, nil
+}
+
+// parseRateLimitKey validates parts of the key joined with +, e.g. header:X-Tenant-Id+path:1
+func parseRateLimitKey(key string) ([]string, error) {
+	parts := strings.Split(key, "+")
+	for _, part := range parts {
+		switch {
+		case part == RateLimitKeyIp:
+		case strings.HasPrefix(part, RateLimitKeyHeader) && len(part) > len(RateLimitKeyHeader):
+		case strings.HasPrefix(part, RateLimitKeyCookie) && len(part) > len(RateLimitKeyCookie):
+		case strings.HasPrefix(part, RateLimitKeyPath):
+			if segments, err := strconv.Atoi(strings.TrimPrefix(part, RateLimitKeyPath)); err != nil || segments <= 0 {
+				return nil, fmt.Errorf("invalid rate limit key %q, path must be followed by number of segments", part)
+			}
+		default:
+			return nil, fmt.Errorf("invalid rate limit key %q, use %q, %q, %q or %q", part,
+				RateLimitKeyIp, RateLimitKeyHeader+"X-Api-Key", RateLimitKeyCookie+"tenant", RateLimitKeyPath+"2")
+		}
+	}
+	return parts, nil
+}
+
+// Enabled reports whether rate limiting is configured
+func (rl *RateLimiter) Enabled() bool {
+	return rl.config.RateLimit != ""
+}
+
+// Key returns the rate limit key of the request, values of key parts are joined with |, missing attributes are empty
+func (rl *RateLimiter) Key(request *http.Request) string {
+	values := make([]string, 0, len(rl.keyParts))
+	for _, part := range rl.keyParts {
+		switch {
+		case part == RateLimitKeyIp:
+			values = append(values, clientIp(request, rl.trustedProxies))
+		case strings.HasPrefix(part, RateLimitKeyHeader):
+			values = append(values, request.Header.Get(strings.TrimPrefix(part, RateLimitKeyHeader)))
+		case strings.HasPrefix(part, RateLimitKeyCookie):
+			value := ""
+			if cookie, err := request.Cookie(strings.TrimPrefix(part, RateLimitKeyCookie)); err == nil {
+				value = cookie.Value
+			}
+			values = append(values, value)
+		case strings.HasPrefix(part, RateLimitKeyPath):
+			segments, _ := strconv.Atoi(strings.TrimPrefix(part, RateLimitKeyPath))
+			values = append(values, leadingSegments(request.URL.Path, segments))
+		}
+	}
+	return strings.Join(values, "|")
+}
+
+// leadingSegments returns the first n segments of the path, e.g. /api/acme for /api/acme/orders and n=2
+func leadingSegments(path string, n int) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", n+1)
+	if len(segments) > n {
+		segments = segments[:n]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// rateOf returns rate of the key
+func (rl *RateLimiter) rateOf(key string) rate {
+	if r, found := rl.overrides[key]; found {
+		return r
+	}
+	return rl.rate
+}
+
+// Allow takes a token from the bucket of the key, state describes the bucket for rate limit headers
+func (rl *RateLimiter) Allow(key string) (bool, BackpressureState) {
+	if rl.redis.Available() {
+		allowed, state, err := rl.allowRedis(key)
+		if err == nil {
+			return allowed, state
+		}
+		rl.redis.Failed(RedisStateRateLimit, err)
+	}
+	return rl.allowLocal(key)
+}
+
+// allowRedis takes a token from the bucket shared by all replicas
+func (rl *RateLimiter) allowRedis(key string) (bool, BackpressureState, error) {
+	r := rl.rateOf(key)
+	ctx, cancel := rl.redis.Context()
+	defer cancel()
+
+	result, err := redisTokenBucket.Run(ctx, rl.redis.client, []string{rl.redis.Key("rate", key)}, r.burst, r.period.Microseconds()).Slice()
+	if err != nil {
+		return false, BackpressureState{}, err
+	}
+	if len(result) != 2 {
+		return false, BackpressureState{}, fmt.Errorf("unexpected token bucket result: %v", result)
+	}
+	allowed, _ := result[0].(int64)
+	tokens, err := strconv.ParseFloat(fmt.Sprint(result[1]), 64)
+	if err != nil {
+		return false, BackpressureState{}, fmt.Errorf("unexpected token bucket result: %v", result)
+	}
+
+	return allowed == 1, r.state(tokens), nil
+}
+
+// state returns rate limit headers of a bucket with the number of tokens left
+func (r rate) state(tokens float64) BackpressureState {
+	state := BackpressureState{Limit: r.burst, Remaining: int(tokens)}
+	if tokens < 1 {
+		state.RetryAfter = time.Duration((1 - tokens) / r.perSecond() * float64(time.Second))
+	}
+	return state
+}
+
+// allowLocal takes a token from the bucket of this replica
+func (rl *RateLimiter) allowLocal(key string) (bool, BackpressureState) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	var bucket *tokenBucket
+	if element, found := rl.buckets[key]; found {
+		rl.lru.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+		elapsed := now.Sub(bucket.last).Seconds()
+		bucket.tokens = math.Min(float64(bucket.rate.burst), bucket.tokens+elapsed*bucket.rate.perSecond())
+		bucket.last = now
+	} else {
+		r := rl.rateOf(key)
+		bucket = &tokenBucket{key: key, rate: r, tokens: float64(r.burst), last: now}
+		for rl.lru.Len() >= rl.config.RateLimitMaxKeys {
+			evicted := rl.lru.Back()
+			rl.lru.Remove(evicted)
+			delete(rl.buckets, evicted.Value.(*tokenBucket).key)
+		}
+		rl.buckets[key] = rl.lru.PushFront(bucket)
+	}
+
+	if bucket.tokens < 1 {
+		return false, bucket.rate.state(bucket.tokens)
+	}
+	bucket.tokens--
+	return true, bucket.rate.state(bucket.tokens)
+}
+
+// rateLimitMiddleware rejects requests over the quota of their key with 429
+func (hs *HttpServer) rateLimitMiddleware(next http.Handler) http.Handler {
+	if !hs.rateLimiter.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		allowed, state := hs.rateLimiter.Allow(hs.rateLimiter.Key(r))
+		if !allowed {
+			hs.monitor.ShedRequestsCounter.WithLabelValues(hs.config.App, ShedReasonRateLimit).Inc()
+			state.WriteHeaders(w.Header())
+			hs.WriteStatus(w, r, http.StatusTooManyRequests, errRateLimited, start)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	RedisStateRateLimit   = "rate_limit"
+	RedisStateIdempotency = "idempotency"
+	RedisStateCache       = "cache"
+
+	// redisRetryInterval is how long the local fallback is used after Redis failed
+	redisRetryInterval = 5 * time.Second
+)
+
+// RedisStore shares rate limit, idempotency and response cache state between proxy replicas.
+// When Redis fails, callers fall back to their local state and Redis is not used for redisRetryInterval,
+// so an outage costs a single timeout instead of one per request.
+type RedisStore struct {
+	client *redis.Client
+
+	mu        sync.Mutex
+	downUntil time.Time
+
+	config  *Config
+	monitor *Monitor
+	logger  *logrus.Logger
+}
+
+// NewRedisStore creates the store, nil is returned when Redis is not configured
+func NewRedisStore(config *Config, monitor *Monitor, logger *logrus.Logger) *RedisStore {
+	if config.RedisAddress == "" {
+		return nil
+	}
+	return &RedisStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:         config.RedisAddress,
+			Password:     config.RedisPassword,
+			DB:           config.RedisDb,
+			DialTimeout:  config.RedisTimeout,
+			ReadTimeout:  config.RedisTimeout,
+			WriteTimeout: config.RedisTimeout,
+			MaxRetries:   -1, // the local fallback is used instead
+		}),
+		config:  config,
+		monitor: monitor,
+		logger:  logger,
+	}
+}
+
+// Available reports whether Redis should be used, it's safe to call on nil store
+func (rs *RedisStore) Available() bool {
+	if rs == nil {
+		return false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return time.Now().After(rs.downUntil)
+}
+
+// Key returns Redis key with the configured prefix
+func (rs *RedisStore) Key(kind string, key string) string {
+	return rs.config.RedisPrefix + kind + ":" + key
+}
+
+// Context returns context limiting one Redis operation
+func (rs *RedisStore) Context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), rs.config.RedisTimeout)
+}
+
+// Failed switches the store to the local fallback, state is the name of the state which failed
+func (rs *RedisStore) Failed(state string, err error) {
+	rs.monitor.RedisFallbacksCounter.WithLabelValues(rs.config.App, state).Inc()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if time.Now().After(rs.downUntil) {
+		rs.logger.Warnf("Redis failed, using local %s state for %s: %s", state, redisRetryInterval, err)
+	}
+	rs.downUntil = time.Now().Add(redisRetryInterval)
+}
+
+// Close closes connections to Redis
+func (rs *RedisStore) Close() {
+	if rs == nil {
+		return
+	}
+	if err := rs.client.Close(); err != nil {
+		rs.logger.Errorf("could not close Redis client: %s", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// NewReplayCommand creates command re-sending an exchange recorded by ExchangeDumper to FPM
+func NewReplayCommand(logger *log.Logger) *cobra.Command {
+	return &cobra.Command{
+		Use:   "replay <file>",
+		Short: "Re-send recorded FastCGI exchange to PHP-FPM",
+		Long:  `Re-send FastCGI exchange recorded with --dump-dir to PHP-FPM and print raw stdout and stderr of the response.`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := LoadConfig(cmd.Flags(), logger)
+			if err != nil {
+				logger.Fatalf("could not load config: %s", err)
+			}
+			configureLogger(logger, config)
+			if err := config.ValidateFpm(); err != nil {
+				logger.Fatalf("invalid config: %s", err)
+			}
+			config.FpmPoolSize = 1
+			config.FpmPoolAuto = false
+
+			recorded, err := LoadExchange(args[0])
+			if err != nil {
+				logger.Fatalf("could not load exchange: %s", err)
+			}
+
+			fCgiClient, err := NewFCgiClient(config, NewMonitor(logger), logger)
+			if err != nil {
+				logger.Fatalf("could not create FPM client: %s", err)
+			}
+			defer fCgiClient.Close()
+
+			fpmReq := fCgiClient.NewRequest(recorded.Params, recorded.Stdin)
+			fpmReq.Exchange = NewExchange(recorded.RequestId)
+			_, err = fCgiClient.SendRequest(fpmReq)
+			if err != nil {
+				// raw output is still useful when it's not a valid HTTP response
+				logger.Errorf("could not replay exchange: %s", err)
+			}
+
+			_, _ = os.Stdout.Write(fpmReq.Exchange.Stdout)
+			_, _ = os.Stderr.Write(fpmReq.Exchange.Stderr)
+		},
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedContentEncoding = errors.New("unsupported content encoding")
+	ErrDecompressedBodyTooLarge   = errors.New("decompressed request body is too large")
+)
+
+// decompressRequestBody replaces gzip encoded request body with the decompressed one.
+// PHP applications rarely handle compressed request bodies themselves, other encodings are passed to PHP as they are.
+// Decompressed size is limited to protect the proxy from decompression bombs.
+func decompressRequestBody(request *http.Request, limit int64) error {
+	encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding")))
+	if encoding != "gzip" && encoding != "x-gzip" {
+		return nil // nothing to do
+	}
+
+	reader, err := gzip.NewReader(request.Body)
+	if err != nil {
+		return fmt.Errorf("could not create gzip reader: %w", err)
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	// read one byte over the limit to detect oversized bodies
+	body, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return fmt.Errorf("could not decompress request body: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return ErrDecompressedBodyTooLarge
+	}
+
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	request.ContentLength = int64(len(body))
+	request.Header.Del("Content-Encoding")
+	request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
+
+// decompressionErrorStatus maps decompression error to HTTP status code
+func decompressionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnsupportedContentEncoding):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrDecompressedBodyTooLarge), errors.Is(err, ErrSpooledBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
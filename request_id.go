@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	RequestIdHeader = "X-Request-Id"
+)
+
+// requestIdMiddleware makes sure every request has an ID.
+// ID sent by the client (or load balancer) is kept, so it's possible to correlate logs across services.
+// PHP receives the ID as HTTP_X_REQUEST_ID param and the client in X-Request-Id response header.
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if requestId == "" {
+			requestId = generateRequestId()
+			r.Header.Set(RequestIdHeader, requestId)
+		}
+		w.Header().Set(RequestIdHeader, requestId)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func generateRequestId() string {
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	return hex.EncodeToString(token)
+}
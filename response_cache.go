@@ -0,0 +1,241 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CacheResultHit         = "hit"
+	CacheResultNegativeHit = "negative_hit"
+	CacheResultMiss        = "miss"
+	CacheResultBypass      = "bypass"
+	CacheResultError       = "error"
+
+	CacheTagsHeader = "X-Cache-Tags"
+)
+
+// CacheEntry is a cached FPM response
+type CacheEntry struct {
+	Key      string
+	Uri      string
+	Tags     []string
+	Expires  time.Time
+	Negative bool // 404/410 response
+	Response *ResponseData
+}
+
+// ResponseCache is a cache of FPM responses kept in the configured storage (memory, disk or Redis).
+// Only responses explicitly marked as cacheable by PHP (Cache-Control: public, max-age/s-maxage) are stored.
+// PHP can tag responses with X-Cache-Tags header and purge them later via admin API.
+// Negative cache stores 404/410 responses for a short time, so scanners and broken links
+// repeatedly hitting nonexistent paths don't consume FPM workers.
+type ResponseCache struct {
+	storage CacheStorage
+
+	config  *Config
+	monitor *Monitor
+	logger  *logrus.Logger
+}
+
+func NewResponseCache(storage CacheStorage, config *Config, monitor *Monitor, logger *logrus.Logger) *ResponseCache {
+	return &ResponseCache{
+		storage: storage,
+		config:  config,
+		monitor: monitor,
+		logger:  logger,
+	}
+}
+
+// Enabled reports whether the cache or the negative cache is turned on
+func (rc *ResponseCache) Enabled() bool {
+	return rc.config.Cache || rc.config.NegativeCacheTtl > 0
+}
+
+// Get returns copy of the cached response for the request
+func (rc *ResponseCache) Get(request *http.Request) (*ResponseData, bool) {
+	if !rc.Enabled() {
+		return nil, false
+	}
+	if !cacheableRequest(request) {
+		rc.monitor.CacheRequestsCounter.WithLabelValues(rc.config.App, CacheResultBypass).Inc()
+		return nil, false
+	}
+
+	key := cacheKey(request)
+	entry, err := rc.storage.Get(key)
+	if err != nil {
+		rc.logger.Debugf("could not read cache entry: %s", err)
+		rc.monitor.CacheRequestsCounter.WithLabelValues(rc.config.App, CacheResultError).Inc()
+		return nil, false
+	}
+	if entry == nil {
+		rc.monitor.CacheRequestsCounter.WithLabelValues(rc.config.App, CacheResultMiss).Inc()
+		return nil, false
+	}
+
+	if time.Now().After(entry.Expires) {
+		if err := rc.storage.Delete(key); err != nil {
+			rc.logger.Debugf("could not delete expired cache entry: %s", err)
+		}
+		rc.monitor.CacheRequestsCounter.WithLabelValues(rc.config.App, CacheResultMiss).Inc()
+		return nil, false
+	}
+
+	result := CacheResultHit
+	if entry.Negative {
+		result = CacheResultNegativeHit
+	}
+	rc.monitor.CacheRequestsCounter.WithLabelValues(rc.config.App, result).Inc()
+	return entry.Response.Clone(), true
+}
+
+// Store saves the response when both request and response are cacheable.
+// It returns true when the response was stored.
+func (rc *ResponseCache) Store(request *http.Request, response *ResponseData) bool {
+	if !rc.Enabled() || request.Method != http.MethodGet || !cacheableRequest(request) {
+		return false
+	}
+
+	ttl, negative := rc.responseTtl(response)
+	if ttl <= 0 || len(response.Body) > rc.config.CacheMaxBodySize {
+		return false
+	}
+
+	entry := &CacheEntry{
+		Key:      cacheKey(request),
+		Uri:      request.URL.RequestURI(),
+		Tags:     parseCacheTags(http.Header(response.Headers).Get(CacheTagsHeader)),
+		Expires:  time.Now().Add(ttl),
+		Negative: negative,
+		Response: response.Clone(),
+	}
+
+	if err := rc.storage.Set(entry); err != nil {
+		rc.logger.Debugf("could not store cache entry: %s", err)
+		return false
+	}
+	return true
+}
+
+// PurgeTag removes all entries tagged by the tag, returns number of removed entries
+func (rc *ResponseCache) PurgeTag(tag string) (int, error) {
+	return rc.storage.PurgeTag(tag)
+}
+
+// PurgeUri removes all entries of the uri (path with query) regardless of host, returns number of removed entries
+func (rc *ResponseCache) PurgeUri(uri string) (int, error) {
+	return rc.storage.PurgeUri(uri)
+}
+
+// Len returns number of cached entries
+func (rc *ResponseCache) Len() int {
+	return rc.storage.Len()
+}
+
+// responseTtl returns for how long the response can be cached and whether it's a negative entry
+func (rc *ResponseCache) responseTtl(response *ResponseData) (time.Duration, bool) {
+	if response.Status == http.StatusNotFound || response.Status == http.StatusGone {
+		if rc.config.NegativeCacheTtl <= 0 || !storableResponse(response) {
+			return 0, true
+		}
+		return rc.config.NegativeCacheTtl, true
+	}
+
+	if !rc.config.Cache {
+		return 0, false
+	}
+	return cacheableResponseTtl(response), false
+}
+
+func cacheKey(request *http.Request) string {
+	key := request.Host + request.URL.RequestURI()
+	if bucket := request.Header.Get(AbBucketHeader); bucket != "" {
+		key += "#" + bucket // every A/B bucket can get a different response
+	}
+	return key
+}
+
+// cacheableRequest reports whether the request can be served from the cache.
+// Requests with credentials are never cached to avoid leaking private pages.
+func cacheableRequest(request *http.Request) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	if request.Header.Get("Authorization") != "" || request.Header.Get("Cookie") != "" {
+		return false
+	}
+	return !strings.Contains(strings.ToLower(request.Header.Get("Cache-Control")), "no-cache")
+}
+
+// storableResponse reports whether the response can be shared between clients at all
+func storableResponse(response *ResponseData) bool {
+	headers := http.Header(response.Headers)
+	if len(headers.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	if encoding := headers.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false // encoded by PHP for Accept-Encoding of this client, the key doesn't include it
+	}
+	for _, vary := range headers.Values("Vary") {
+		for _, v := range strings.Split(vary, ",") {
+			if v = strings.TrimSpace(v); v != "" && !strings.EqualFold(v, "Accept-Encoding") {
+				return false // responses varying by other headers are not supported
+			}
+		}
+	}
+	for _, directive := range strings.Split(strings.ToLower(headers.Get("Cache-Control")), ",") {
+		switch strings.TrimSpace(directive) {
+		case "no-store", "private":
+			return false
+		}
+	}
+	return true
+}
+
+// cacheableResponseTtl returns for how long the response can be cached, zero means not cacheable
+func cacheableResponseTtl(response *ResponseData) time.Duration {
+	if response.Status != http.StatusOK || !storableResponse(response) {
+		return 0
+	}
+
+	headers := http.Header(response.Headers)
+
+	public := false
+	maxAge := -1
+	sharedMaxAge := -1
+	for _, directive := range strings.Split(strings.ToLower(headers.Get("Cache-Control")), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "public":
+			public = true
+		case "max-age":
+			maxAge = ignoreError(strconv.Atoi(value))
+		case "s-maxage":
+			sharedMaxAge = ignoreError(strconv.Atoi(value))
+		}
+	}
+
+	if !public {
+		return 0
+	}
+	if sharedMaxAge >= 0 {
+		return time.Duration(sharedMaxAge) * time.Second
+	}
+	if maxAge > 0 {
+		return time.Duration(maxAge) * time.Second
+	}
+	return 0
+}
+
+// parseCacheTags parses comma or space separated list of tags
+func parseCacheTags(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCacheEncodedResponse(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte("hello"))
+	_ = gz.Close()
+	// PHP compresses the response itself according to Accept-Encoding
+	fpm := startMockFpm(t, func(w *mockFpmWriter, request mockFpmRequest) {
+		headers := "Content-Type: text/plain\r\nCache-Control: public, max-age=60\r\nVary: Accept-Encoding\r\n"
+		if strings.Contains(request.params["HTTP_ACCEPT_ENCODING"], "gzip") {
+			w.Stdout(headers + "Content-Encoding: gzip\r\n\r\n" + compressed.String())
+		} else {
+			w.Stdout(headers + "\r\nhello")
+		}
+		w.End(0, FCGI_REQUEST_COMPLETE)
+	})
+	server := newTestServer(t, fpm, "--"+Cache)
+	// the transport would add Accept-Encoding and decompress the response otherwise
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	cases := []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+		cache          string
+	}{
+		{acceptEncoding: "gzip", encoding: "gzip", body: compressed.String(), cache: "MISS"}, // not stored
+		{acceptEncoding: "", encoding: "", body: "hello", cache: "MISS"},
+		{acceptEncoding: "", encoding: "", body: "hello", cache: "HIT"},
+		{acceptEncoding: "gzip", encoding: "", body: "hello", cache: "HIT"}, // identity is acceptable for everyone
+	}
+	for i, c := range cases {
+		request := must(http.NewRequest(http.MethodGet, server.URL+"/page", nil))
+		if c.acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+		response := must(client.Do(request))
+		body, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+
+		if got := response.Header.Get("Content-Encoding"); got != c.encoding {
+			t.Errorf("request %d: Content-Encoding = %q, want %q", i, got, c.encoding)
+		}
+		if string(body) != c.body {
+			t.Errorf("request %d: body = %q, want %q", i, body, c.body)
+		}
+		if got := response.Header.Get("X-Cache"); got != c.cache {
+			t.Errorf("request %d: X-Cache = %q, want %q", i, got, c.cache)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+var (
+	// supportedEncodings in order of preference
+	supportedEncodings = []string{EncodingBrotli, EncodingGzip}
+)
+
+// ResponseCompressor compresses FPM responses according to client Accept-Encoding.
+// Responses already compressed by PHP (e.g. zlib.output_compression) are never compressed again.
+type ResponseCompressor struct {
+	config *Config
+
+	types map[string][]string // mime type -> allowed encodings
+}
+
+func NewResponseCompressor(config *Config) (*ResponseCompressor, error) {
+	types := map[string][]string{}
+	for _, definition := range config.CompressionTypes {
+		mimeType, encodings, found := strings.Cut(definition, ":")
+		mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+		if !found {
+			types[mimeType] = supportedEncodings
+			continue
+		}
+
+		var allowed []string
+		for _, encoding := range strings.Split(encodings, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != EncodingBrotli && encoding != EncodingGzip {
+				return nil, fmt.Errorf("unsupported encoding %q in compression type definition: %s", encoding, definition)
+			}
+			allowed = append(allowed, encoding)
+		}
+		types[mimeType] = allowed
+	}
+
+	return &ResponseCompressor{
+		config: config,
+		types:  types,
+	}, nil
+}
+
+// Compress compresses response body in place if the negotiation allows it
+func (rc *ResponseCompressor) Compress(request *http.Request, response *ResponseData) error {
+	encoding := rc.negotiate(request, response, len(response.Body))
+	if encoding == "" {
+		return nil
+	}
+
+	body, err := compressBody(encoding, response.Body)
+	if err != nil {
+		return fmt.Errorf("could not compress response body: %w", err)
+	}
+
+	response.Body = body
+	headers := http.Header(response.Headers)
+	headers.Set("Content-Encoding", encoding)
+	headers.Del("Content-Length")
+
+	return nil
+}
+
+// StreamEncoding returns encoding of the streamed response and sets its headers, empty string means no compression.
+// Size of the body is not known in advance, so the minimum size applies only to responses with Content-Length.
+func (rc *ResponseCompressor) StreamEncoding(request *http.Request, response *ResponseData) string {
+	size := -1
+	if contentLength, err := strconv.Atoi(http.Header(response.Headers).Get("Content-Length")); err == nil {
+		size = contentLength
+	}
+
+	encoding := rc.negotiate(request, response, size)
+	if encoding != "" {
+		headers := http.Header(response.Headers)
+		headers.Set("Content-Encoding", encoding)
+		headers.Del("Content-Length")
+	}
+	return encoding
+}
+
+// negotiate selects encoding of the response, size -1 means unknown size
+func (rc *ResponseCompressor) negotiate(request *http.Request, response *ResponseData, size int) string {
+	if !rc.config.Compression {
+		return ""
+	}
+
+	headers := http.Header(response.Headers)
+	if request.Method == http.MethodHead || !bodyAllowedForStatus(response.Status) {
+		return ""
+	}
+
+	encodings, found := rc.types[responseMimeType(headers)]
+	if !found {
+		return "" // mime type is not compressible
+	}
+
+	// response differs by Accept-Encoding from now on
+	addVary(headers, "Accept-Encoding")
+
+	encoding := headers.Get("Content-Encoding")
+	if encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return "" // already compressed by PHP
+	}
+
+	if size >= 0 && size < rc.config.CompressionMinSize {
+		return ""
+	}
+
+	return negotiateEncoding(request.Header.Get("Accept-Encoding"), encodings)
+}
+
+// negotiateEncoding selects the best encoding accepted by the client
+func negotiateEncoding(acceptEncoding string, allowed []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if key, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(key) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		accepted[name] = q
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, encoding := range supportedEncodings {
+		if !containsString(allowed, encoding) {
+			continue
+		}
+		q, found := accepted[encoding]
+		if !found {
+			q, found = accepted["*"]
+		}
+		if found && q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+// streamEncoder compresses data written to it, Flush writes pending data to the underlying writer
+type streamEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(encoding string, w io.Writer) (streamEncoder, error) {
+	switch encoding {
+	case EncodingBrotli:
+		return brotli.NewWriter(w), nil
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+}
+
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := newEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// responseMimeType returns lower-cased mime type without parameters
+func responseMimeType(headers http.Header) string {
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(mediaType)
+}
+
+// addVary adds value to Vary header if it's not already present
+func addVary(headers http.Header, value string) {
+	for _, vary := range headers.Values("Vary") {
+		for _, v := range strings.Split(vary, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.EqualFold(v, value) {
+				return
+			}
+		}
+	}
+	headers.Add("Vary", value)
+}
+
+// bodyAllowedForStatus reports whether a given response status code permits a body
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent:
+		return false
+	case status == http.StatusResetContent:
+		return false // RFC 9110 section 15.3.6, unlike net/http
+	case status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// compressionTestTypes allow both encodings for HTML and CSS, only gzip for JSON and only br for SVG, PNG is not
+// compressible
+var compressionTestTypes = []string{"text/html", "application/json:gzip", "image/svg+xml: br ", "text/css:gzip,br"}
+
+func newTestCompressor(t *testing.T, minSize int) *ResponseCompressor {
+	t.Helper()
+	compressor, err := NewResponseCompressor(&Config{
+		Compression:        true,
+		CompressionTypes:   compressionTestTypes,
+		CompressionMinSize: minSize,
+	})
+	if err != nil {
+		t.Fatalf("could not create compressor: %s", err)
+	}
+	return compressor
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	// encoding selected for the response types of compressionTestTypes
+	cases := []struct {
+		accept string
+		html   string // br and gzip allowed
+		json   string // gzip allowed
+		svg    string // br allowed
+	}{
+		{accept: "", html: "", json: "", svg: ""},
+		{accept: "gzip", html: "gzip", json: "gzip", svg: ""},
+		{accept: "br", html: "br", json: "", svg: "br"},
+		{accept: "gzip, deflate, br", html: "br", json: "gzip", svg: "br"},
+		{accept: "GZIP, BR", html: "br", json: "gzip", svg: "br"},
+		{accept: "deflate, identity", html: "", json: "", svg: ""},
+		{accept: "gzip;q=1.0, br;q=0.5", html: "gzip", json: "gzip", svg: "br"},
+		{accept: "gzip;q=0.5, br;q=0.5", html: "br", json: "gzip", svg: "br"},
+		{accept: "gzip; q=0.8, br ; q=0.9", html: "br", json: "gzip", svg: "br"},
+		{accept: "br;q=0, gzip", html: "gzip", json: "gzip", svg: ""},
+		{accept: "gzip;q=0, br;q=0", html: "", json: "", svg: ""},
+		{accept: "*", html: "br", json: "gzip", svg: "br"},
+		{accept: "*;q=0.1, gzip;q=0.5", html: "gzip", json: "gzip", svg: "br"},
+		{accept: "*;q=0", html: "", json: "", svg: ""},
+		{accept: "*;q=0, gzip", html: "gzip", json: "gzip", svg: ""},
+		{accept: "br;q=invalid", html: "br", json: "", svg: "br"},
+		{accept: "br;level=5", html: "br", json: "", svg: "br"},
+	}
+
+	types := []struct {
+		name      string
+		mediaType string
+	}{
+		{name: "html", mediaType: "text/html; charset=utf-8"},
+		{name: "json", mediaType: "application/json"},
+		{name: "svg", mediaType: "IMAGE/SVG+XML"},
+		{name: "css", mediaType: "text/css"},
+		{name: "png", mediaType: "image/png"},
+		{name: "invalid", mediaType: "text/html; charset"},
+		{name: "missing"},
+	}
+
+	compressor := newTestCompressor(t, 0)
+	for _, c := range cases {
+		for _, responseType := range types {
+			t.Run(responseType.name+"/"+c.accept, func(t *testing.T) {
+				want := ""
+				switch responseType.name {
+				case "html", "css":
+					want = c.html
+				case "json":
+					want = c.json
+				case "svg":
+					want = c.svg
+				}
+
+				request := httptest.NewRequest(http.MethodGet, "/", nil)
+				request.Header.Set("Accept-Encoding", c.accept)
+				response := &ResponseData{Status: http.StatusOK, Headers: map[string][]string{}}
+				if responseType.mediaType != "" {
+					response.Headers["Content-Type"] = []string{responseType.mediaType}
+				}
+				if got := compressor.negotiate(request, response, 10); got != want {
+					t.Errorf("encoding = %q, want %q", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestCompressionMinSize(t *testing.T) {
+	cases := []struct {
+		name          string
+		minSize       int
+		size          int
+		contentLength string // streamed responses know the size only from Content-Length
+		compressed    bool
+		streamed      bool
+	}{
+		{name: "below", minSize: 1024, size: 1023},
+		{name: "equal", minSize: 1024, size: 1024, compressed: true, streamed: true},
+		{name: "above", minSize: 1024, size: 4096, compressed: true, streamed: true},
+		{name: "empty without minimum", minSize: 0, size: 0, compressed: true, streamed: true},
+		{name: "streamed below", minSize: 1024, size: 100, contentLength: "100"},
+		{name: "streamed without content length", minSize: 1024, size: 100, contentLength: "-", streamed: true},
+		{name: "streamed invalid content length", minSize: 1024, size: 100, contentLength: "x", streamed: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			compressor := newTestCompressor(t, c.minSize)
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Accept-Encoding", "gzip")
+
+			newResponse := func() *ResponseData {
+				headers := map[string][]string{"Content-Type": {"text/html"}}
+				switch c.contentLength {
+				case "":
+					headers["Content-Length"] = []string{strconv.Itoa(c.size)}
+				case "-":
+				default:
+					headers["Content-Length"] = []string{c.contentLength}
+				}
+				return &ResponseData{Status: http.StatusOK, Headers: headers, Body: bytes.Repeat([]byte("a"), c.size)}
+			}
+
+			if c.contentLength == "" {
+				response := newResponse()
+				if err := compressor.Compress(request, response); err != nil {
+					t.Fatalf("could not compress: %s", err)
+				}
+				if got := http.Header(response.Headers).Get("Content-Encoding"); (got == EncodingGzip) != c.compressed {
+					t.Errorf("buffered Content-Encoding = %q, want compressed %t", got, c.compressed)
+				}
+			}
+
+			response := newResponse()
+			if got := compressor.StreamEncoding(request, response); (got == EncodingGzip) != c.streamed {
+				t.Errorf("streamed encoding = %q, want compressed %t", got, c.streamed)
+			}
+		})
+	}
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	cases := []struct {
+		name       string
+		method     string
+		status     int
+		encoding   string // Content-Encoding set by PHP
+		disabled   bool
+		compressed bool
+		vary       bool // Vary: Accept-Encoding is added
+	}{
+		{name: "compressed", method: http.MethodGet, status: http.StatusOK, compressed: true, vary: true},
+		{name: "identity", method: http.MethodGet, status: http.StatusOK, encoding: "identity", compressed: true, vary: true},
+		{name: "compressed by php", method: http.MethodGet, status: http.StatusOK, encoding: "gzip", vary: true},
+		{name: "head", method: http.MethodHead, status: http.StatusOK},
+		{name: "no content", method: http.MethodGet, status: http.StatusNoContent},
+		{name: "not modified", method: http.MethodGet, status: http.StatusNotModified},
+		{name: "informational", method: http.MethodGet, status: http.StatusEarlyHints},
+		{name: "error", method: http.MethodGet, status: http.StatusInternalServerError, compressed: true, vary: true},
+		{name: "disabled", method: http.MethodGet, status: http.StatusOK, disabled: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			compressor := newTestCompressor(t, 0)
+			compressor.config.Compression = !c.disabled
+			request := httptest.NewRequest(c.method, "/", nil)
+			request.Header.Set("Accept-Encoding", "br")
+			headers := map[string][]string{"Content-Type": {"text/html"}}
+			if c.encoding != "" {
+				headers["Content-Encoding"] = []string{c.encoding}
+			}
+			response := &ResponseData{Status: c.status, Headers: headers, Body: []byte("<p>hello</p>")}
+
+			if err := compressor.Compress(request, response); err != nil {
+				t.Fatalf("could not compress: %s", err)
+			}
+			if got := http.Header(response.Headers).Get("Content-Encoding"); (got == EncodingBrotli) != c.compressed {
+				t.Errorf("Content-Encoding = %q, want compressed %t", got, c.compressed)
+			}
+			if c.encoding == "gzip" && http.Header(response.Headers).Get("Content-Encoding") != "gzip" {
+				t.Errorf("encoding set by PHP was changed")
+			}
+			if got := http.Header(response.Headers).Get("Vary") == "Accept-Encoding"; got != c.vary {
+				t.Errorf("Vary: Accept-Encoding added %t, want %t", got, c.vary)
+			}
+		})
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	body := strings.Repeat("<p>compressible response</p>", 200)
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		EncodingGzip: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		EncodingBrotli: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+	}
+	for encoding, decoder := range decoders {
+		t.Run(encoding, func(t *testing.T) {
+			compressor := newTestCompressor(t, 1024)
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Accept-Encoding", encoding)
+			response := &ResponseData{
+				Status: http.StatusOK,
+				Headers: map[string][]string{
+					"Content-Type":   {"text/html"},
+					"Content-Length": {strconv.Itoa(len(body))},
+					"Vary":           {"Cookie"},
+				},
+				Body: []byte(body),
+			}
+			if err := compressor.Compress(request, response); err != nil {
+				t.Fatalf("could not compress: %s", err)
+			}
+
+			headers := http.Header(response.Headers)
+			if headers.Get("Content-Encoding") != encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", headers.Get("Content-Encoding"), encoding)
+			}
+			if headers.Get("Content-Length") != "" {
+				t.Errorf("Content-Length of the uncompressed body is kept")
+			}
+			if vary := headers.Values("Vary"); len(vary) != 2 || vary[1] != "Accept-Encoding" {
+				t.Errorf("Vary = %v, want Accept-Encoding added", vary)
+			}
+			reader, err := decoder(bytes.NewReader(response.Body))
+			if err != nil {
+				t.Fatalf("could not decode: %s", err)
+			}
+			decoded, err := io.ReadAll(reader)
+			if err != nil || string(decoded) != body {
+				t.Errorf("decoded body differs (%d bytes, %v)", len(decoded), err)
+			}
+		})
+	}
+}
+
+func TestNewResponseCompressorInvalidEncoding(t *testing.T) {
+	for _, definition := range []string{"text/html:deflate", "text/html:gzip,zstd", "text/html:"} {
+		if _, err := NewResponseCompressor(&Config{CompressionTypes: []string{definition}}); err == nil {
+			t.Errorf("%q was accepted", definition)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// RouteEntry is one rule of the resolved routing table
+type RouteEntry struct {
+	Order   int    `json:"order"`
+	Match   string `json:"match"`
+	Handler string `json:"handler"`
+	Target  string `json:"target"`
+	Note    string `json:"note,omitempty"`
+}
+
+// BuildRoutingTable resolves configured routing rules in the order they are evaluated for an incoming request
+func BuildRoutingTable(config *Config) ([]RouteEntry, error) {
+	var routes []RouteEntry
+	add := func(match string, handler string, target string, note string) {
+		routes = append(routes, RouteEntry{
+			Order:   len(routes) + 1,
+			Match:   match,
+			Handler: handler,
+			Target:  target,
+			Note:    note,
+		})
+	}
+
+	if config.BasePath != "" {
+		add(config.BasePath+"/*", "strip prefix", "/*", "prefix passed to PHP in "+ForwardedPrefixHeader)
+	}
+
+	// static mounts and metrics are matched by the router (longest prefix wins) before anything else
+	var mounts [][]string
+	for _, staticFolder := range config.Reloadable().StaticFolders {
+		parts := strings.Split(staticFolder, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid static folder definition: %s", staticFolder)
+		}
+		mounts = append(mounts, parts)
+	}
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return len(mounts[i][1]) > len(mounts[j][1])
+	})
+	for _, mount := range mounts {
+		add(mount[1]+"/*", "static", mount[0], "")
+	}
+	add("/metrics", "metrics", "prometheus", "")
+
+	for _, prefix := range config.OptionsPrefixes {
+		note := ""
+		if len(config.CorsOrigins) > 0 {
+			note = "CORS preflight"
+		}
+		add("OPTIONS "+prefix, "options", "proxy", note)
+	}
+
+	if config.Cache || config.NegativeCacheTtl > 0 {
+		add("GET, HEAD /*", "cache", "response cache", "responses marked as public by PHP")
+	}
+
+	priorities, err := NewPriorityClasses(config)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := append([]string(nil), priorities.prefixes...)
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+	for _, prefix := range prefixes {
+		add(prefix, "fpm", config.IndexFile, fmt.Sprintf("priority %s", priorities.priorities[prefix]))
+	}
+	add("/*", "fpm", config.IndexFile, fmt.Sprintf("priority %s", PriorityNormal))
+
+	if config.AdminPort > 0 {
+		for _, script := range config.AdminScripts {
+			add(config.AdminAddress()+"/admin/script", "admin", script, "requires admin token")
+		}
+	}
+
+	return routes, nil
+}
+
+// NewRoutesCommand creates command printing the resolved routing table without starting the server
+func NewRoutesCommand(logger *log.Logger) *cobra.Command {
+	return &cobra.Command{
+		Use:   "routes",
+		Short: "Print resolved routing table",
+		Long:  `Print routing rules resolved from the flags in evaluation order, so it's possible to verify precedence without sending test traffic.`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := LoadConfig(cmd.Flags(), logger)
+			if err != nil {
+				logger.Fatalf("could not load config: %s", err)
+			}
+
+			routes, err := BuildRoutingTable(config)
+			if err != nil {
+				logger.Fatalf("could not build routing table: %s", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "#\tMATCH\tHANDLER\tTARGET\tNOTE")
+			for _, route := range routes {
+				_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", route.Order, route.Match, route.Handler, route.Target, route.Note)
+			}
+			_ = w.Flush()
+		},
+	}
+}
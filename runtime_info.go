@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/spf13/pflag"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Version of the proxy, set at build time by -ldflags "-X main.Version=1.2.3"
+var Version = "1.0.0"
+
+var startedAt = time.Now()
+
+// RuntimeInfo describes the running proxy, fleet tooling uses it to inventory proxies and detect config drift
+type RuntimeInfo struct {
+	Version       string          `json:"version"`
+	GoVersion     string          `json:"go_version"`
+	App           string          `json:"app"`
+	ConfigHash    string          `json:"config_hash"`
+	Features      map[string]bool `json:"features"`
+	Pool          PoolInfo        `json:"pool"`
+	Listeners     []string        `json:"listeners"`
+	Tls           bool            `json:"tls"`
+	AdminListener string          `json:"admin_listener,omitempty"`
+	StartedAt     time.Time       `json:"started_at"`
+	UptimeSeconds float64         `json:"uptime_seconds"`
+}
+
+// PoolInfo describes FPM pool configuration and its current usage
+type PoolInfo struct {
+	Network  string `json:"network"`
+	Address  string `json:"address"`
+	Size     int    `json:"size"`
+	Auto     bool   `json:"auto"`
+	Reserved int    `json:"reserved"`
+	Busy     int    `json:"busy"`
+	Waiting  int    `json:"waiting"`
+}
+
+func collectRuntimeInfo(config *Config, fCgiClient *FCgiClient) RuntimeInfo {
+	network, address := config.FpmNetwork()
+	info := RuntimeInfo{
+		Version:    Version,
+		GoVersion:  runtime.Version(),
+		App:        config.App,
+		ConfigHash: config.Hash,
+		Features:   config.Features,
+		Pool: PoolInfo{
+			Network:  network,
+			Address:  address,
+			Size:     config.Reloadable().FpmPoolSize,
+			Auto:     config.FpmPoolAuto,
+			Reserved: config.FpmReservedConnections,
+			Busy:     fCgiClient.Busy(),
+			Waiting:  fCgiClient.Waiting(),
+		},
+		Listeners:     config.ListenAddresses(),
+		Tls:           config.TlsCert != "",
+		StartedAt:     startedAt,
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+	}
+	if config.AdminPort > 0 {
+		info.AdminListener = config.AdminAddress()
+	}
+	return info
+}
+
+// logBanner logs summary of the running proxy once it listens
+func logBanner(config *Config, info RuntimeInfo) {
+	scheme := "http"
+	if info.Tls {
+		scheme = "https"
+	}
+	config.logger.Infof(
+		"gophpfpm %s (%s) serving %s on %s (%s), FPM %s %s with pool of %d, config %s",
+		info.Version, info.GoVersion, info.App, strings.Join(info.Listeners, ", "), scheme,
+		info.Pool.Network, info.Pool.Address, info.Pool.Size, info.ConfigHash[:12],
+	)
+}
+
+// configHash returns hash of all flag values including defaults, proxies started with the same configuration
+// have the same hash
+func configHash(set *pflag.FlagSet) string {
+	hash := sha256.New()
+	set.VisitAll(func(flag *pflag.Flag) {
+		_, _ = fmt.Fprintf(hash, "%s=%s\n", flag.Name, flag.Value.String())
+	})
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// SaturationWatcher periodically computes pool saturation and warns when it stays above threshold.
+// Saturation is (busy connections + waiting requests) / pool size, so value above 1 means requests are queuing.
+type SaturationWatcher struct {
+	fCgiClient *FCgiClient
+	config     *Config
+	monitor    *Monitor
+	logger     *logrus.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewSaturationWatcher(fCgiClient *FCgiClient, config *Config, monitor *Monitor, logger *logrus.Logger) *SaturationWatcher {
+	return &SaturationWatcher{
+		fCgiClient: fCgiClient,
+		config:     config,
+		monitor:    monitor,
+		logger:     logger,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (sw *SaturationWatcher) Start() {
+	go sw.run()
+}
+
+func (sw *SaturationWatcher) Stop() {
+	close(sw.stop)
+	<-sw.done
+}
+
+// Saturation returns current saturation of the FPM pool
+func (sw *SaturationWatcher) Saturation() float64 {
+	size := sw.fCgiClient.Size()
+	if size == 0 {
+		return 0
+	}
+	return float64(sw.fCgiClient.Busy()+sw.fCgiClient.Waiting()) / float64(size)
+}
+
+func (sw *SaturationWatcher) run() {
+	defer close(sw.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var saturatedSince time.Time
+	var lastWarning time.Time
+	for {
+		select {
+		case <-sw.stop:
+			return
+		case <-ticker.C:
+		}
+
+		saturation := sw.Saturation()
+		sw.monitor.SaturationGauge.WithLabelValues(sw.config.App).Set(saturation)
+
+		if sw.config.SaturationThreshold <= 0 || saturation < sw.config.SaturationThreshold {
+			if !lastWarning.IsZero() {
+				sw.logger.WithField("saturation", saturation).Info("FPM pool saturation recovered")
+			}
+			saturatedSince = time.Time{}
+			lastWarning = time.Time{}
+			continue
+		}
+
+		if saturatedSince.IsZero() {
+			saturatedSince = time.Now()
+		}
+
+		// warn once per saturation duration while saturation is sustained
+		if time.Since(saturatedSince) >= sw.config.SaturationDuration && time.Since(lastWarning) >= sw.config.SaturationDuration {
+			lastWarning = time.Now()
+			sw.logger.WithFields(logrus.Fields{
+				"saturation": saturation,
+				"busy":       sw.fCgiClient.Busy(),
+				"waiting":    sw.fCgiClient.Waiting(),
+				"pool_size":  sw.fCgiClient.Size(),
+				"since":      saturatedSince.Format(time.RFC3339),
+			}).Warn("FPM pool is saturated, consider raising pm.max_children and pool size")
+		}
+	}
+}
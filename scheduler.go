@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduledJob is a periodic internal request to the PHP application
+type ScheduledJob struct {
+	Interval time.Duration
+	Uri      string
+}
+
+// Scheduler periodically issues internal requests through the FPM pool.
+// It replaces separate cron containers for lightweight scheduled PHP work.
+type Scheduler struct {
+	jobs []ScheduledJob
+
+	fpmClient     *FpmClient
+	paramsBuilder *ParamsBuilder
+	config        *Config
+	monitor       *Monitor
+	logger        *logrus.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewScheduler(
+	config *Config,
+	fpmClient *FpmClient,
+	paramsBuilder *ParamsBuilder,
+	monitor *Monitor,
+	logger *logrus.Logger,
+) (*Scheduler, error) {
+	var jobs []ScheduledJob
+	for _, definition := range config.Schedules {
+		interval, uri, found := strings.Cut(definition, ":")
+		if !found || !strings.HasPrefix(uri, "/") {
+			return nil, fmt.Errorf("invalid schedule definition: %s", definition)
+		}
+		duration, err := time.ParseDuration(interval)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid schedule interval %q: %s", interval, definition)
+		}
+		jobs = append(jobs, ScheduledJob{
+			Interval: duration,
+			Uri:      uri,
+		})
+	}
+
+	return &Scheduler{
+		jobs: jobs,
+
+		fpmClient:     fpmClient,
+		paramsBuilder: paramsBuilder,
+		config:        config,
+		monitor:       monitor,
+		logger:        logger,
+
+		stop: make(chan struct{}),
+	}, nil
+}
+
+// Start runs every job in its own goroutine
+func (s *Scheduler) Start() {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.run(job)
+	}
+	if len(s.jobs) > 0 {
+		s.logger.Debugf("Scheduler started with %d jobs", len(s.jobs))
+	}
+}
+
+// Stop stops all jobs and waits for running requests to finish
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *Scheduler) run(job ScheduledJob) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.execute(job)
+		}
+	}
+}
+
+func (s *Scheduler) execute(job ScheduledJob) {
+	request, err := http.NewRequest(http.MethodGet, job.Uri, nil)
+	if err != nil {
+		s.logger.Errorf("scheduler: could not create request %s: %s", job.Uri, err)
+		return
+	}
+	request.Host = "localhost"
+
+	// params can't be spoofed by clients unlike headers
+	params := s.paramsBuilder.Build(request, 0, map[string]string{"GOPHPFPM_SCHEDULED": "1"})
+
+	start := time.Now()
+	response, err := s.fpmClient.Execute(s.fpmClient.NewRequest(params, nil))
+	if err != nil {
+		s.monitor.ScheduledRequestsCounter.WithLabelValues(s.config.App, job.Uri, "error").Inc()
+		s.logger.WithField("uri", job.Uri).Errorf("scheduler: request failed: %s", err)
+		return
+	}
+
+	s.monitor.ScheduledRequestsCounter.WithLabelValues(s.config.App, job.Uri, fmt.Sprintf("%d", response.Status)).Inc()
+	entry := s.logger.WithFields(logrus.Fields{
+		"uri":      job.Uri,
+		"status":   response.Status,
+		"duration": time.Since(start).String(),
+	})
+	if response.Status >= 400 {
+		entry.Warn("scheduled request failed")
+		return
+	}
+	entry.Info("scheduled request")
+}
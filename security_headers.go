@@ -0,0 +1,19 @@
+package main
+
+import "net/http"
+
+// securityHeaders are sent when PHP doesn't set them itself
+var securityHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "SAMEORIGIN",
+	"Referrer-Policy":        "strict-origin-when-cross-origin",
+}
+
+// writeSecurityHeaders adds default security headers missing in the FPM response
+func writeSecurityHeaders(header http.Header, response *ResponseData) {
+	for name, value := range securityHeaders {
+		if http.Header(response.Headers).Get(name) == "" {
+			header.Set(name, value)
+		}
+	}
+}
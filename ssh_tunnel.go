@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sshDialTimeout = 10 * time.Second
+
+// SshTunnel forwards connections to FPM socket (or TCP address) on a remote host over SSH.
+// One SSH connection is shared by all FPM connections, it is re-established when it dies.
+type SshTunnel struct {
+	address       string
+	remoteNetwork string
+	remoteAddress string
+	clientConfig  *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+
+	logger *log.Logger
+}
+
+func NewSshTunnel(config *Config, logger *log.Logger) (*SshTunnel, error) {
+	user, address, found := strings.Cut(config.SshHost, "@")
+	if !found || user == "" || address == "" {
+		return nil, fmt.Errorf("invalid ssh host %q, expected user@host[:port]", config.SshHost)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	if config.SshKey == "" {
+		return nil, fmt.Errorf("required flag(s) %q not set", SshKey)
+	}
+	key, err := os.ReadFile(config.SshKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not read ssh key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ssh key: %w", err)
+	}
+
+	if config.SshKnownHosts == "" {
+		return nil, fmt.Errorf("required flag(s) %q not set", SshKnownHosts)
+	}
+	hostKeyCallback, err := knownhosts.New(config.SshKnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("could not load ssh known hosts: %w", err)
+	}
+
+	remoteNetwork, remoteAddress := config.FpmNetwork()
+	return &SshTunnel{
+		address:       address,
+		remoteNetwork: remoteNetwork,
+		remoteAddress: remoteAddress,
+		clientConfig: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sshDialTimeout,
+		},
+		logger: logger,
+	}, nil
+}
+
+// Dial opens connection to the remote FPM socket, SSH connection is (re-)established when needed
+func (t *SshTunnel) Dial() (net.Conn, error) {
+	client, err := t.sshClient()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial(t.remoteNetwork, t.remoteAddress)
+	if err == nil {
+		return conn, nil
+	}
+
+	// SSH connection might be broken without being noticed yet - try once again with a new one
+	t.logger.Warnf("could not open FPM socket through ssh tunnel, reconnecting: %s", err)
+	t.drop(client)
+	if client, err = t.sshClient(); err != nil {
+		return nil, err
+	}
+	conn, err = client.Dial(t.remoteNetwork, t.remoteAddress)
+	if err != nil {
+		return nil, fmt.Errorf("could not open FPM socket through ssh tunnel: %w", err)
+	}
+	return conn, nil
+}
+
+// Close closes the SSH connection and all connections forwarded through it
+func (t *SshTunnel) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		_ = t.client.Close()
+		t.client = nil
+	}
+}
+
+func (t *SshTunnel) sshClient() (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	client, err := ssh.Dial("tcp", t.address, t.clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not establish ssh tunnel to %s: %w", t.address, err)
+	}
+	t.logger.Infof("SSH tunnel to %s established", t.address)
+	t.client = client
+
+	go func() {
+		err := client.Wait()
+		if t.drop(client) {
+			t.logger.Warnf("SSH tunnel to %s closed: %v", t.address, err)
+		}
+	}()
+
+	return client, nil
+}
+
+// drop forgets the SSH connection, so the next Dial establishes a new one
+func (t *SshTunnel) drop(client *ssh.Client) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != client {
+		return false // already replaced
+	}
+	_ = client.Close()
+	t.client = nil
+	return true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// sslTimeLayout is the format of SSL_CLIENT_V_START and SSL_CLIENT_V_END used by Apache mod_ssl
+const sslTimeLayout = "Jan _2 15:04:05 2006 GMT"
+
+// sslHeader maps header set by TLS terminating load balancer to SSL_* param
+type sslHeader struct {
+	param  string
+	header string
+}
+
+// parseSslHeaders parses definitions in format "SSL_CLIENT_CERT:X-SSL-Client-Cert"
+func parseSslHeaders(definitions []string) ([]sslHeader, error) {
+	headers := make([]sslHeader, 0, len(definitions))
+	for _, definition := range definitions {
+		param, header, found := strings.Cut(definition, ":")
+		if !found || header == "" || (!strings.HasPrefix(param, "SSL_") && param != "HTTPS") {
+			return nil, fmt.Errorf("invalid ssl header definition %q, use %q", definition, "SSL_CLIENT_CERT:X-SSL-Client-Cert")
+		}
+		headers = append(headers, sslHeader{param: param, header: header})
+	}
+	return headers, nil
+}
+
+// setSslParams fills SSL_* params from headers of TLS terminating load balancer, so PHP sees the same params
+// as behind Apache or nginx terminating TLS itself. The headers are trusted only from trusted proxies,
+// anyone else could present any certificate. Params not set by the load balancer are derived from the certificate.
+func (pb *ParamsBuilder) setSslParams(request *http.Request, params map[string]string) {
+	if len(pb.sslHeaders) == 0 {
+		return
+	}
+	peer, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil || !pb.trustedPeer(peer) {
+		for _, header := range pb.sslHeaders {
+			delete(params, headerParamName(header.header)) // spoofed by the client
+		}
+		return
+	}
+
+	for _, header := range pb.sslHeaders {
+		value := request.Header.Get(header.header)
+		if value == "" {
+			continue
+		}
+		switch header.param {
+		case "HTTPS":
+			if !strings.EqualFold(value, "off") {
+				params["HTTPS"] = "on"
+				params["REQUEST_SCHEME"] = "https"
+			}
+		case "SSL_CLIENT_CERT":
+			cert, err := decodeClientCert(value)
+			if err != nil {
+				continue // not passed at all rather than passed in unexpected format
+			}
+			for name, value := range clientCertParams(cert) {
+				setIfMissing(params, name, value)
+			}
+		default:
+			params[header.param] = value
+		}
+	}
+}
+
+// setClientCertParams passes client certificate verified in TLS handshake of the proxy (--tls-client-auth).
+// SSL_CLIENT_VERIFY is SUCCESS with a verified certificate and NONE without one, certificates which fail
+// the verification never get here, the handshake is rejected. A verified certificate replaces params from
+// --ssl-header, without one they are kept (trusted proxy re-encrypting the connection).
+func (pb *ParamsBuilder) setClientCertParams(request *http.Request, params map[string]string) {
+	if pb.config.TlsClientAuth == ClientAuthNone || request.TLS == nil {
+		return
+	}
+	if len(request.TLS.VerifiedChains) == 0 || len(request.TLS.PeerCertificates) == 0 {
+		setIfMissing(params, "SSL_CLIENT_VERIFY", "NONE")
+		return
+	}
+	for name, value := range clientCertParams(request.TLS.PeerCertificates[0]) {
+		params[name] = value
+	}
+	params["SSL_CLIENT_VERIFY"] = "SUCCESS"
+}
+
+// decodeClientCert decodes certificate sent by load balancer, it can be PEM (optionally URL encoded,
+// nginx $ssl_client_escaped_cert, AWS ALB) or base64 encoded DER (HAProxy, Traefik)
+func decodeClientCert(value string) (*x509.Certificate, error) {
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		value = unescaped
+	}
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		return x509.ParseCertificate(block.Bytes)
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("certificate is neither PEM nor base64 encoded DER: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// clientCertParams returns SSL_CLIENT_* params of the certificate in format of Apache mod_ssl
+func clientCertParams(cert *x509.Certificate) map[string]string {
+	params := map[string]string{
+		"SSL_CLIENT_CERT":     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		"SSL_CLIENT_S_DN":     cert.Subject.String(),
+		"SSL_CLIENT_I_DN":     cert.Issuer.String(),
+		"SSL_CLIENT_M_SERIAL": strings.ToUpper(cert.SerialNumber.Text(16)),
+		"SSL_CLIENT_V_START":  cert.NotBefore.UTC().Format(sslTimeLayout),
+		"SSL_CLIENT_V_END":    cert.NotAfter.UTC().Format(sslTimeLayout),
+	}
+	if cert.Subject.CommonName != "" {
+		params["SSL_CLIENT_S_DN_CN"] = cert.Subject.CommonName
+	}
+	if cert.Issuer.CommonName != "" {
+		params["SSL_CLIENT_I_DN_CN"] = cert.Issuer.CommonName
+	}
+	return params
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrInformationalStatus means PHP set 1xx status, FastCGI can't carry interim responses nor upgrade the connection
+var ErrInformationalStatus = errors.New("FPM responded with informational status")
+
+// applyStatusPolicy checks status set by PHP. A 1xx status (including 101 Switching Protocols) is an error answered
+// with --informational-status. net/http always writes the standard reason phrase (or "status code N" for unknown
+// codes), a custom one is passed in --status-reason-header. Bodies of 204, 205 and 304 are dropped when written.
+func (fpm *FpmClient) applyStatusPolicy(response *ResponseData, statusLine string) error {
+	if response.Status < 200 {
+		return fmt.Errorf("%w %d", ErrInformationalStatus, response.Status)
+	}
+
+	if fpm.config.StatusReasonHeader == "" {
+		return nil
+	}
+	_, reason, _ := strings.Cut(statusLine, " ")
+	if reason = strings.TrimSpace(reason); reason != "" && reason != http.StatusText(response.Status) {
+		http.Header(response.Headers).Set(fpm.config.StatusReasonHeader, reason)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// statusFpm sets the Status header from the X-Php-Status request header and always echoes a body
+func statusFpm(w *mockFpmWriter, request mockFpmRequest) {
+	head := "Content-Type: text/plain\r\n"
+	if status := request.params["HTTP_X_PHP_STATUS"]; status != "" {
+		head += "Status: " + status + "\r\n"
+	}
+	w.Stdout(head + "\r\nbody from php")
+	w.End(0, FCGI_REQUEST_COMPLETE)
+}
+
+func TestStatusConformance(t *testing.T) {
+	cases := []struct {
+		phpStatus string // Status header set by PHP
+		status    int
+		body      bool   // body from PHP is relayed
+		reason    string // value of --status-reason-header
+	}{
+		{phpStatus: "", status: 200, body: true},
+		{phpStatus: "100 Continue", status: 599},
+		{phpStatus: "101 Switching Protocols", status: 599},
+		{phpStatus: "103", status: 599},
+		{phpStatus: "200 OK", status: 200, body: true},
+		{phpStatus: "201 Created", status: 201, body: true},
+		{phpStatus: "204", status: 204},
+		{phpStatus: "204 No Content", status: 204},
+		{phpStatus: "205 Reset Content", status: 205},
+		{phpStatus: "206 Partial Content", status: 206, body: true},
+		{phpStatus: "304 Not Modified", status: 304},
+		{phpStatus: "404 Not Found", status: 404, body: true},
+		{phpStatus: "404 Page Gone", status: 404, body: true, reason: "Page Gone"},
+		{phpStatus: "418", status: 418, body: true},
+		{phpStatus: "418 I'm a teapot", status: 418, body: true},
+		{phpStatus: "451 Unavailable For Legal Reasons", status: 451, body: true},
+		{phpStatus: "499 Client Closed Request", status: 499, body: true, reason: "Client Closed Request"},
+		{phpStatus: "599 Origin Down", status: 599, body: true, reason: "Origin Down"},
+		{phpStatus: "599", status: 599, body: true},
+	}
+
+	for _, mode := range []string{"buffered", "streamed"} {
+		args := []string{"--" + InformationalStatus, "599", "--" + StatusReasonHeader, "X-Status-Reason"}
+		if mode == "streamed" {
+			args = append(args, "--"+Streaming)
+		}
+		server := newTestServer(t, startMockFpm(t, statusFpm), args...)
+
+		for _, c := range cases {
+			t.Run(mode+"/"+c.phpStatus, func(t *testing.T) {
+				request, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+				request.Header.Set("X-Php-Status", c.phpStatus)
+				response, err := http.DefaultClient.Do(request)
+				if err != nil {
+					t.Fatalf("request failed: %s", err)
+				}
+				defer response.Body.Close()
+				body, _ := io.ReadAll(response.Body)
+
+				if response.StatusCode != c.status {
+					t.Errorf("status = %d, want %d", response.StatusCode, c.status)
+				}
+				if got := string(body) == "body from php"; got != c.body {
+					t.Errorf("body %q relayed %t, want %t", body, got, c.body)
+				}
+				if !c.body && strings.Contains(string(body), "body from php") {
+					t.Errorf("forbidden body relayed: %q", body)
+				}
+				if !c.body && response.StatusCode < 599 && response.ContentLength > 0 {
+					t.Errorf("Content-Length = %d for status without body", response.ContentLength)
+				}
+				if got := response.Header.Get("X-Status-Reason"); got != c.reason {
+					t.Errorf("X-Status-Reason = %q, want %q", got, c.reason)
+				}
+			})
+		}
+	}
+}
+
+func TestStatusReasonHeaderDisabled(t *testing.T) {
+	server := newTestServer(t, startMockFpm(t, statusFpm))
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	request.Header.Set("X-Php-Status", "599 Origin Down")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 599 || response.Status != "599 status code 599" {
+		t.Errorf("status line = %q", response.Status)
+	}
+	for name := range response.Header {
+		if strings.Contains(strings.ToLower(name), "reason") {
+			t.Errorf("reason phrase passed in %s", name)
+		}
+	}
+
+	request.Header.Set("X-Php-Status", "101 Switching Protocols")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusBadGateway {
+		t.Errorf("1xx status = %d, want default %d", response.StatusCode, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrSpooledBodyTooLarge means request body of unknown length exceeded --stream-spool-max-size
+var ErrSpooledBodyTooLarge = errors.New("spooled request body is too large")
+
+// StreamBody is request body sent to FPM in streaming mode
+type StreamBody struct {
+	Reader io.Reader
+	Length int64
+
+	spool *os.File // temporary file holding body of unknown length
+}
+
+// NewStreamBody prepares request body for streaming. PHP requires CONTENT_LENGTH, so bodies of unknown length
+// (chunked or gzip encoded) are spooled to a temporary file instead of memory. Spooled size is limited to protect
+// the disk, decompressed size also by decompressedLimit to protect the proxy from decompression bombs.
+// Bodies with other encodings than gzip are passed to PHP as they are.
+func NewStreamBody(request *http.Request, spoolLimit int64, decompressedLimit int64) (*StreamBody, error) {
+	var reader io.Reader = request.Body
+	limit, tooLarge := spoolLimit, ErrSpooledBodyTooLarge
+	encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding")))
+	decompressed := encoding == "gzip" || encoding == "x-gzip"
+	if decompressed {
+		gz, err := gzip.NewReader(request.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not create gzip reader: %w", err)
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		reader = gz
+		if decompressedLimit < limit {
+			limit, tooLarge = decompressedLimit, ErrDecompressedBodyTooLarge
+		}
+	} else if request.ContentLength >= 0 {
+		return &StreamBody{Reader: request.Body, Length: request.ContentLength}, nil
+	}
+
+	spool, err := os.CreateTemp("", "gophpfpm-body-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create spool file: %w", err)
+	}
+	_ = os.Remove(spool.Name()) // the file is deleted when closed
+	body := &StreamBody{Reader: spool, spool: spool}
+
+	// read one byte over the limit to detect oversized bodies
+	if body.Length, err = io.Copy(spool, io.LimitReader(reader, limit+1)); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("could not read request body: %w", err)
+	}
+	if body.Length > limit {
+		body.Close()
+		return nil, tooLarge
+	}
+	if decompressed {
+		request.Header.Del("Content-Encoding")
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("could not rewind spool file: %w", err)
+	}
+	return body, nil
+}
+
+// Buffer reads body up to the limit to memory, so FPM connection isn't held while the client sends it.
+// False is returned when the body is larger and it stays streamed.
+func (sb *StreamBody) Buffer(limit int64) (bool, error) {
+	if sb.Length > limit {
+		return false, nil
+	}
+	data := make([]byte, sb.Length)
+	if _, err := io.ReadFull(sb.Reader, data); err != nil {
+		return false, fmt.Errorf("could not read request body: %w", err)
+	}
+	sb.Close()
+	sb.spool = nil
+	sb.Reader = bytes.NewReader(data)
+	return true, nil
+}
+
+// Close removes the spool file
+func (sb *StreamBody) Close() {
+	if sb.spool != nil {
+		_ = sb.spool.Close()
+	}
+}
+
+// handleFpmStream passes the request to PHP-FPM and copies its response to the client using fixed-size buffers,
+// memory used by a request doesn't depend on the size of its body or response
+func (hs *HttpServer) handleFpmStream(writer http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	sample := hs.costSampler.Start()
+
+	body, err := NewStreamBody(request, hs.config.StreamSpoolMaxSize, hs.config.MaxDecompressedSize)
+	if err != nil {
+		hs.WriteStatus(writer, request, decompressionErrorStatus(err), err, start)
+		return
+	}
+	defer body.Close()
+
+	requestMode := BodyModeStreamed
+	if hs.config.StreamThreshold > 0 {
+		buffered, err := body.Buffer(int64(hs.config.StreamThreshold))
+		if err != nil {
+			hs.WriteStatus(writer, request, http.StatusBadRequest, err, start)
+			return
+		}
+		if buffered {
+			requestMode = BodyModeBuffered
+		}
+	}
+	hs.monitor.BodyModeCounter.WithLabelValues(hs.config.App, BodyDirectionRequest, requestMode).Inc()
+	hs.monitor.BodySizeHistogram.WithLabelValues(hs.config.App, BodyDirectionRequest).Observe(float64(body.Length))
+
+	timeout := hs.timeouts.Resolve(request.Method, request.URL.Path)
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), timeout.Timeout)
+	defer cancelTimeout()
+	deadline, _ := ctx.Deadline()
+	if hs.config.DeadlineHint {
+		setDeadlineHint(request, deadline)
+	}
+
+	fault := hs.faultInjector.Decide()
+	if fault.Drop {
+		// aborts the handler and closes the client connection without response
+		panic(http.ErrAbortHandler)
+	}
+
+	// FPM request is aborted when the client disconnects or the handler returns before the headers arrive
+	call, abortCall := context.WithCancel(request.Context())
+	defer abortCall()
+
+	type result struct {
+		response *ResponseData
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		time.Sleep(fault.Latency)
+		if fault.ErrorStatus != 0 {
+			results <- result{nil, errInjectedFault}
+			return
+		}
+		response, err := hs.fpmClient.Stream(request.WithContext(call), body, deadline)
+		results <- result{response, err}
+	}()
+
+	var fpm result
+	select {
+	case <-ctx.Done():
+		go func() {
+			// response arriving after the timeout is never read, its connection is replaced
+			if late := <-results; late.response != nil {
+				_ = late.response.Stream.Close()
+			}
+		}()
+		hs.monitor.TimeoutsCounter.WithLabelValues(hs.config.App, timeout.Route).Inc()
+		hs.WriteTimeout(writer, request, fmt.Errorf("timeout after %s", timeout.Timeout), start)
+		return
+	case fpm = <-results:
+	}
+
+	if hs.writeFallback(writer, request, fpm.err, start) {
+		return
+	}
+
+	if errors.Is(fpm.err, os.ErrDeadlineExceeded) {
+		hs.monitor.TimeoutsCounter.WithLabelValues(hs.config.App, timeout.Route).Inc()
+		hs.WriteTimeout(writer, request, fpm.err, start)
+		return
+	}
+	if errors.Is(fpm.err, ErrRequestAborted) {
+		hs.WriteStatus(writer, request, StatusClientClosedRequest, fpm.err, start)
+		return
+	}
+	if errors.Is(fpm.err, ErrPoolSaturated) {
+		hs.fpmClient.Backpressure().WriteHeaders(writer.Header())
+		hs.WriteStatus(writer, request, http.StatusServiceUnavailable, fpm.err, start)
+		return
+	}
+	if errors.Is(fpm.err, ErrFpmProtocol) {
+		hs.WriteStatus(writer, request, http.StatusBadGateway, fpm.err, start)
+		return
+	}
+	if errors.Is(fpm.err, ErrInformationalStatus) {
+		hs.WriteStatus(writer, request, hs.config.InformationalStatus, fpm.err, start)
+		return
+	}
+	var statusErr *ProtocolStatusError
+	if errors.As(fpm.err, &statusErr) {
+		hs.WriteStatus(writer, request, statusErr.HttpStatus(), fpm.err, start)
+		return
+	}
+	if errors.Is(fpm.err, errInjectedFault) {
+		hs.WriteStatus(writer, request, fault.ErrorStatus, fpm.err, start)
+		return
+	}
+	if fpm.err != nil {
+		hs.WriteError(writer, request, fmt.Errorf("could not call FPM: %s\n", fpm.err), start)
+		return
+	}
+
+	stream := fpm.response.Stream
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	if hs.writeScriptError(writer, request, fpm.response, start) {
+		return
+	}
+	defer func() {
+		// stderr written while the body was streamed
+		if sr, ok := stream.(*fcgiStdoutReader); ok {
+			fpm.response.Stderr = sr.stderr
+		}
+		hs.logStderr(request, fpm.response)
+	}()
+
+	if hs.config.StreamThreshold > 0 {
+		buffered, err := bufferResponse(fpm.response, hs.config.StreamThreshold)
+		if err != nil {
+			hs.WriteError(writer, request, fmt.Errorf("could not read FPM response: %s\n", err), start)
+			return
+		}
+		if buffered {
+			hs.monitor.BodyModeCounter.WithLabelValues(hs.config.App, BodyDirectionResponse, BodyModeBuffered).Inc()
+			hs.monitor.BodySizeHistogram.WithLabelValues(hs.config.App, BodyDirectionResponse).Observe(float64(len(fpm.response.Body)))
+			hs.writeResponse(writer, request, fpm.response, start)
+			hs.costSampler.Record(sample, fpm.response)
+			return
+		}
+	}
+	hs.monitor.BodyModeCounter.WithLabelValues(hs.config.App, BodyDirectionResponse, BodyModeStreamed).Inc()
+	hs.writeStreamResponse(writer, request, fpm.response, start)
+	hs.monitor.BodySizeHistogram.WithLabelValues(hs.config.App, BodyDirectionResponse).Observe(float64(fpm.response.StreamedSize))
+	hs.costSampler.Record(sample, fpm.response)
+}
+
+// bufferResponse reads response body up to the limit. When the body fits, it's moved to Body and true is returned,
+// otherwise the part read is put back in front of Stream.
+func bufferResponse(response *ResponseData, limit int) (bool, error) {
+	data, err := io.ReadAll(io.LimitReader(response.Stream, int64(limit)+1))
+	if err != nil {
+		return false, err
+	}
+	if len(data) <= limit {
+		response.Body = data
+		response.Stream = nil
+		return true, nil
+	}
+	response.Stream = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), response.Stream), response.Stream}
+	return false, nil
+}
+
+// writeStreamResponse writes headers and copies the body as it arrives from FPM, compressing it on the fly
+func (hs *HttpServer) writeStreamResponse(writer http.ResponseWriter, request *http.Request, fpmResponse *ResponseData, start time.Time) {
+	hs.applyDefaultType(request, fpmResponse)
+	if hs.config.DefaultCharset != "" {
+		setDefaultCharset(fpmResponse, hs.config.DefaultCharset)
+	}
+
+	var out io.Writer = writer
+	var encoder streamEncoder
+	if encoding := hs.compressor.StreamEncoding(request, fpmResponse); encoding != "" {
+		encoder, _ = newEncoder(encoding, writer) // encoding is always supported
+		out = encoder
+	}
+
+	hs.writeHeaders(writer, fpmResponse)
+	if hs.exceedsHeaderBudget(writer, request, start) {
+		return
+	}
+	if fpmResponse.Status >= http.StatusInternalServerError {
+		hs.monitor.RecentErrors.Add(request, fpmResponse.Status, "FPM responded with error status")
+	}
+	writer.WriteHeader(fpmResponse.Status)
+
+	if request.Method == http.MethodHead || !bodyAllowedForStatus(fpmResponse.Status) {
+		out = io.Discard // body is not allowed, but it must be read till the end of the response
+		encoder = nil
+	}
+
+	flusher, _ := writer.(http.Flusher)
+	buf := make([]byte, hs.config.StreamBufferSize)
+	for {
+		n, err := fpmResponse.Stream.Read(buf)
+		if n > 0 {
+			fpmResponse.StreamedSize += int64(n)
+			if _, err := out.Write(buf[:n]); err != nil {
+				hs.logger.Debugf("could not write response body, client is gone: %s\n", err)
+				return // connection is replaced as the response was not read completely
+			}
+			if encoder != nil {
+				_ = encoder.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// headers were already sent, the client gets truncated response
+			hs.logger.Errorf("could not stream response body: %s\n", err)
+			hs.monitor.RecentErrors.Add(request, fpmResponse.Status, err.Error())
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if encoder != nil {
+		if err := encoder.Close(); err != nil {
+			hs.logger.Debugf("could not write response body, client is gone: %s\n", err)
+		}
+	}
+
+	hs.accessLogger.LogFpm(request, fpmResponse)
+	hs.monitor.HttpDurationHistogram.
+		WithLabelValues(
+			hs.config.App,
+			TypeHttp,
+			request.Method,
+			fmt.Sprintf("%d", fpmResponse.Status),
+			fpmResponse.Route,
+		).
+		Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewStreamBodyLimits(t *testing.T) {
+	gzipped := func(size int) []byte {
+		var buffer bytes.Buffer
+		gz := gzip.NewWriter(&buffer)
+		_, _ = gz.Write(bytes.Repeat([]byte("a"), size))
+		_ = gz.Close()
+		return buffer.Bytes()
+	}
+	cases := []struct {
+		name              string
+		body              []byte
+		encoding          string
+		chunked           bool
+		spoolLimit        int64
+		decompressedLimit int64
+		length            int64
+		err               error
+	}{
+		{name: "content length above limits is not spooled", body: bytes.Repeat([]byte("a"), 200), spoolLimit: 100, decompressedLimit: 100, length: 200},
+		{name: "chunked", body: bytes.Repeat([]byte("a"), 100), chunked: true, spoolLimit: 100, decompressedLimit: 10, length: 100},
+		{name: "chunked above spool limit", body: bytes.Repeat([]byte("a"), 101), chunked: true, spoolLimit: 100, decompressedLimit: 1000, err: ErrSpooledBodyTooLarge},
+		{name: "gzip", body: gzipped(100), encoding: "gzip", spoolLimit: 100, decompressedLimit: 100, length: 100},
+		{name: "gzip above decompressed limit", body: gzipped(101), encoding: "gzip", spoolLimit: 1000, decompressedLimit: 100, err: ErrDecompressedBodyTooLarge},
+		{name: "gzip above spool limit", body: gzipped(101), encoding: "gzip", spoolLimit: 100, decompressedLimit: 1000, err: ErrSpooledBodyTooLarge},
+		{name: "other encoding is passed as it is", body: bytes.Repeat([]byte("a"), 50), encoding: "zstd", spoolLimit: 100, decompressedLimit: 10, length: 50},
+		{name: "other encoding above spool limit", body: bytes.Repeat([]byte("a"), 101), encoding: "zstd", spoolLimit: 100, decompressedLimit: 1000, err: ErrSpooledBodyTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(c.body))
+			if c.chunked {
+				request.ContentLength = -1
+			}
+			if c.encoding != "" {
+				request.ContentLength = -1
+				request.Header.Set("Content-Encoding", c.encoding)
+			}
+
+			body, err := NewStreamBody(request, c.spoolLimit, c.decompressedLimit)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("error = %v, want %v", err, c.err)
+			}
+			if err != nil {
+				if status := decompressionErrorStatus(err); status != http.StatusRequestEntityTooLarge {
+					t.Errorf("status = %d, want 413", status)
+				}
+				return
+			}
+			defer body.Close()
+			data, _ := io.ReadAll(body.Reader)
+			if body.Length != c.length || int64(len(data)) != c.length {
+				t.Errorf("length = %d (read %d), want %d", body.Length, len(data), c.length)
+			}
+			encoding := c.encoding
+			if encoding == "gzip" {
+				encoding = "" // removed from decompressed body
+			}
+			if got := request.Header.Get("Content-Encoding"); got != encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, encoding)
+			}
+		})
+	}
+}
+
+func TestStreamingServerSpoolLimit(t *testing.T) {
+	fpm := startMockFpm(t, mockFpmStdout("Content-Type: text/plain\r\n\r\nok"))
+	server := newTestServer(t, fpm, "--"+Streaming, "--"+StreamSpoolMaxSize, "1024")
+
+	for size, status := range map[int]int{1024: http.StatusOK, 1025: http.StatusRequestEntityTooLarge} {
+		// io.MultiReader hides the length, the body is sent chunked
+		body := io.MultiReader(strings.NewReader(strings.Repeat("a", size)))
+		response, err := http.Post(server.URL+"/upload", "text/plain", body)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode != status {
+			t.Errorf("%d bytes: status = %d, want %d", size, response.StatusCode, status)
+		}
+	}
+	if got := fpm.requests.Load(); got != 1 {
+		t.Errorf("FPM got %d requests, want 1", got)
+	}
+}
+
+func TestStreamingFaultsAndCost(t *testing.T) {
+	fpm := startMockFpm(t, mockFpmStdout("Content-Type: text/plain\r\n\r\nok"))
+	svr := newTestHttpServer(t, fpm, "--"+Streaming, "--"+Chaos, "--"+CostSampleRate, "1")
+	server := httptest.NewServer(svr.handlers[HandlersAll])
+	t.Cleanup(server.Close)
+
+	get := func() int {
+		response, err := http.Get(server.URL + "/")
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		_ = response.Body.Close()
+		return response.StatusCode
+	}
+
+	if status := get(); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	samples := 0
+	for _, cost := range svr.costSampler.Report() {
+		samples += cost.Samples
+	}
+	if samples != 1 {
+		t.Errorf("%d cost samples, want 1", samples)
+	}
+
+	if err := svr.faultInjector.Configure(ChaosSettings{ErrorPercent: 100, ErrorStatus: http.StatusServiceUnavailable}); err != nil {
+		t.Fatalf("could not configure faults: %s", err)
+	}
+	if status := get(); status != http.StatusServiceUnavailable {
+		t.Errorf("status with injected error = %d, want 503", status)
+	}
+	if got := fpm.requests.Load(); got != 1 {
+		t.Errorf("FPM got %d requests, want 1", got)
+	}
+
+	if err := svr.faultInjector.Configure(ChaosSettings{DropPercent: 100}); err != nil {
+		t.Fatalf("could not configure faults: %s", err)
+	}
+	if _, err := http.Get(server.URL + "/"); err == nil {
+		t.Errorf("dropped request got response")
+	}
+}
+
+func TestStreamingConfigConflicts(t *testing.T) {
+	fpm := &mockFpm{socket: "fpm.socket"}
+	cases := map[string][]string{
+		"cache":                     {"--" + Streaming, "--" + Cache},
+		"etag":                      {"--" + Streaming, "--" + Etag},
+		"sub filter":                {"--" + Streaming, "--" + SubFilters, "a=b"},
+		"idempotency":               {"--" + Streaming, "--" + IdempotencyPrefixes, "/api"},
+		"idempotency on stream":     {"--" + StreamPrefixes, "/api/export", "--" + IdempotencyPrefixes, "/api"},
+		"stream inside idempotency": {"--" + StreamPrefixes, "/api", "--" + IdempotencyPrefixes, "/api/orders"},
+		"spool max size":            {"--" + Streaming, "--" + StreamSpoolMaxSize, "0"},
+	}
+	for name, args := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := loadTestConfig(t, fpm, args...).Validate(); err == nil {
+				t.Errorf("%v was accepted", args)
+			}
+		})
+	}
+
+	config := newTestConfig(t, fpm, "--"+StreamPrefixes, "/download", "--"+IdempotencyPrefixes, "/api", "--"+Cache)
+	if len(config.StreamPrefixes) != 1 {
+		t.Errorf("stream prefix was not loaded")
+	}
+}
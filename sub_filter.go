@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const subFilterSeparator = "=>"
+
+// SubFilter replaces strings in response bodies (like nginx sub_filter), e.g. to inject analytics snippet
+// before </body> or to rewrite absolute URLs. Only configured mime types up to the size limit are modified,
+// bodies compressed by PHP are never touched.
+type SubFilter struct {
+	replacer *strings.Replacer
+	config   *Config
+}
+
+func NewSubFilter(config *Config) (*SubFilter, error) {
+	sf := &SubFilter{config: config}
+	if len(config.SubFilters) == 0 {
+		return sf, nil
+	}
+
+	var pairs []string
+	for _, definition := range config.SubFilters {
+		find, replace, found := strings.Cut(definition, subFilterSeparator)
+		if !found || find == "" {
+			return nil, fmt.Errorf("invalid sub filter definition: %s", definition)
+		}
+		pairs = append(pairs, find, replace)
+	}
+	sf.replacer = strings.NewReplacer(pairs...)
+
+	return sf, nil
+}
+
+// Apply replaces configured strings in the response body
+func (sf *SubFilter) Apply(request *http.Request, response *ResponseData) {
+	if sf.replacer == nil || request.Method == http.MethodHead || len(response.Body) == 0 {
+		return
+	}
+
+	headers := http.Header(response.Headers)
+	if len(response.Body) > sf.config.SubFilterMaxSize {
+		return
+	}
+	if encoding := headers.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return
+	}
+	if !containsString(sf.config.SubFilterTypes, responseMimeType(headers)) {
+		return
+	}
+
+	body := sf.replacer.Replace(string(response.Body))
+	if body != string(response.Body) {
+		response.Body = []byte(body)
+		headers.Del("Content-Length")
+		headers.Del("ETag") // body differs from the one PHP tagged
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TenantSourceHeader    = "header:"
+	TenantSourceSubdomain = "subdomain"
+	TenantSourcePath      = "path:"
+
+	TenantNone  = "none"  // label of requests without tenant
+	TenantOther = "other" // label of tenants over --tenant-max-labels
+
+	tenantMaxLength = 64
+)
+
+type tenantContextKey struct{}
+
+// Tenants extracts tenant (customer) identifier of multi-tenant applications from a header, subdomain
+// or path segment. The identifier is added to access log and used as metrics label. The first
+// --tenant-max-labels tenants get their own label, the rest is reported as "other", so a flood of
+// made up identifiers can't blow up metrics cardinality.
+type Tenants struct {
+	source  string
+	header  string
+	segment int
+
+	mu     sync.Mutex
+	labels map[string]struct{}
+
+	config  *Config
+	monitor *Monitor
+}
+
+func NewTenants(config *Config, monitor *Monitor) (*Tenants, error) {
+	t := &Tenants{
+		source:  config.TenantSource,
+		labels:  map[string]struct{}{},
+		config:  config,
+		monitor: monitor,
+	}
+	switch {
+	case config.TenantSource == "" || config.TenantSource == TenantSourceSubdomain:
+	case strings.HasPrefix(config.TenantSource, TenantSourceHeader) && len(config.TenantSource) > len(TenantSourceHeader):
+		t.header = strings.TrimPrefix(config.TenantSource, TenantSourceHeader)
+	case strings.HasPrefix(config.TenantSource, TenantSourcePath):
+		segment, err := strconv.Atoi(strings.TrimPrefix(config.TenantSource, TenantSourcePath))
+		if err != nil || segment < 1 {
+			return nil, fmt.Errorf("invalid tenant path segment in %q, segments are numbered from 1", config.TenantSource)
+		}
+		t.segment = segment
+	default:
+		return nil, fmt.Errorf("invalid tenant source %q, use %sName, %s or %sN", config.TenantSource, TenantSourceHeader, TenantSourceSubdomain, TenantSourcePath)
+	}
+	if config.TenantSource != "" && config.TenantMaxLabels < 1 {
+		return nil, fmt.Errorf("%s must be positive", TenantMaxLabels)
+	}
+	return t, nil
+}
+
+// Enabled reports whether tenant source is configured
+func (t *Tenants) Enabled() bool {
+	return t.source != ""
+}
+
+// Resolve returns tenant of the request, empty string when the request has none
+func (t *Tenants) Resolve(request *http.Request) string {
+	var tenant string
+	switch {
+	case t.header != "":
+		tenant = strings.TrimSpace(request.Header.Get(t.header))
+	case t.segment > 0:
+		segments := strings.Split(strings.TrimPrefix(request.URL.Path, "/"), "/")
+		if len(segments) >= t.segment {
+			tenant = segments[t.segment-1]
+		}
+	case t.source == TenantSourceSubdomain:
+		host := hostWithoutPort(request.Host)
+		if net.ParseIP(host) == nil && strings.Count(host, ".") >= 2 {
+			tenant = strings.ToLower(host[:strings.Index(host, ".")])
+		}
+	}
+	if len(tenant) > tenantMaxLength {
+		tenant = tenant[:tenantMaxLength]
+	}
+	return tenant
+}
+
+// Label returns metrics label of the tenant
+func (t *Tenants) Label(tenant string) string {
+	if tenant == "" {
+		return TenantNone
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, found := t.labels[tenant]; found {
+		return tenant
+	}
+	if len(t.labels) >= t.config.TenantMaxLabels {
+		return TenantOther
+	}
+	t.labels[tenant] = struct{}{}
+	return tenant
+}
+
+// Middleware resolves tenant of the request and observes the request duration by tenant
+func (t *Tenants) Middleware(next http.Handler) http.Handler {
+	if !t.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tenant := t.Resolve(r)
+		lrw := NewLoggingResponseWriter(w)
+		next.ServeHTTP(lrw, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant)))
+
+		status := lrw.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		t.monitor.TenantDurationHistogram.
+			WithLabelValues(t.config.App, t.Label(tenant), r.Method, fmt.Sprintf("%dxx", status/100)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// tenantOf returns tenant resolved by Tenants middleware
+func tenantOf(request *http.Request) string {
+	tenant, _ := request.Context().Value(tenantContextKey{}).(string)
+	return tenant
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TimeoutSourceDefault  = "default"
+	TimeoutSourceConfig   = "config"
+	TimeoutSourceOverride = "override"
+)
+
+// TimeoutOverride raises or lowers timeout of a route at runtime, e.g. during an incident
+type TimeoutOverride struct {
+	Prefix  string     `json:"prefix"`
+	Timeout string     `json:"timeout"`
+	Ttl     string     `json:"ttl,omitempty"`     // override is removed after ttl, empty means until removed
+	Expires *time.Time `json:"expires,omitempty"` // computed from ttl
+
+	timeout time.Duration
+}
+
+// ResolvedTimeout is the timeout of one request and where it comes from
+type ResolvedTimeout struct {
+	Timeout time.Duration
+	Route   string // matched prefix, "default" when no route matches
+	Source  string
+}
+
+// TimeoutRoute is one entry of the effective timeout table
+type TimeoutRoute struct {
+	Prefix  string     `json:"prefix"`
+	Timeout string     `json:"timeout"`
+	Source  string     `json:"source"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// TimeoutPolicySnapshot describes the effective timeout policy
+type TimeoutPolicySnapshot struct {
+	Default string             `json:"default"`
+	Methods map[string]float64 `json:"methods"`
+	Routes  []TimeoutRoute     `json:"routes"`
+}
+
+// TimeoutPolicy resolves request timeouts. The longest matching route prefix wins, admin overrides win over
+// configured routes with the same prefix and requests without a matching route use the global --timeout.
+// The route timeout is then multiplied by the factor of the request method.
+type TimeoutPolicy struct {
+	defaultTimeout time.Duration
+	routes         map[string]time.Duration
+	methods        map[string]float64
+
+	mu        sync.RWMutex
+	prefixes  []string
+	overrides map[string]*TimeoutOverride
+
+	config  *Config
+	monitor *Monitor
+}
+
+func NewTimeoutPolicy(config *Config, monitor *Monitor) (*TimeoutPolicy, error) {
+	tp := &TimeoutPolicy{
+		defaultTimeout: config.Timeout,
+		routes:         map[string]time.Duration{},
+		methods:        map[string]float64{},
+		overrides:      map[string]*TimeoutOverride{},
+		config:         config,
+		monitor:        monitor,
+	}
+
+	for _, definition := range config.RouteTimeouts {
+		value, prefix, found := strings.Cut(definition, ":")
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid route timeout definition: %s", definition)
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid route timeout definition %s: timeout must be a positive duration", definition)
+		}
+		tp.routes[prefix] = timeout
+	}
+
+	for _, definition := range config.MethodTimeoutFactors {
+		method, value, found := strings.Cut(definition, ":")
+		if !found || method == "" {
+			return nil, fmt.Errorf("invalid method timeout factor definition: %s", definition)
+		}
+		factor, err := strconv.ParseFloat(value, 64)
+		if err != nil || factor <= 0 {
+			return nil, fmt.Errorf("invalid method timeout factor definition %s: factor must be a positive number", definition)
+		}
+		tp.methods[strings.ToUpper(method)] = factor
+	}
+
+	tp.rebuild()
+	return tp, nil
+}
+
+// Resolve returns timeout of the request
+func (tp *TimeoutPolicy) Resolve(method string, path string) ResolvedTimeout {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+
+	resolved := ResolvedTimeout{
+		Timeout: tp.defaultTimeout,
+		Route:   TimeoutSourceDefault,
+		Source:  TimeoutSourceDefault,
+	}
+	if prefix, found := matchPrefix(path, tp.prefixes); found {
+		resolved.Route = prefix
+		resolved.Timeout, resolved.Source = tp.routeTimeout(prefix)
+	}
+
+	if factor, found := tp.methods[strings.ToUpper(method)]; found {
+		resolved.Timeout = time.Duration(float64(resolved.Timeout) * factor)
+	}
+	return resolved
+}
+
+// routeTimeout returns timeout of the prefix, caller must hold the lock
+func (tp *TimeoutPolicy) routeTimeout(prefix string) (time.Duration, string) {
+	if override, found := tp.overrides[prefix]; found {
+		return override.timeout, TimeoutSourceOverride
+	}
+	return tp.routes[prefix], TimeoutSourceConfig
+}
+
+// Override sets runtime timeout of the route prefix
+func (tp *TimeoutPolicy) Override(override TimeoutOverride) (*TimeoutOverride, error) {
+	if !strings.HasPrefix(override.Prefix, "/") {
+		return nil, fmt.Errorf("prefix must start with /")
+	}
+	timeout, err := time.ParseDuration(override.Timeout)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout %q", override.Timeout)
+	}
+	override.timeout = timeout
+	override.Expires = nil
+
+	if override.Ttl != "" {
+		ttl, err := time.ParseDuration(override.Ttl)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q", override.Ttl)
+		}
+		expires := time.Now().Add(ttl)
+		override.Expires = &expires
+
+		stored := &override
+		time.AfterFunc(ttl, func() {
+			tp.mu.Lock()
+			defer tp.mu.Unlock()
+			// the override could be replaced in the meantime
+			if tp.overrides[override.Prefix] == stored {
+				delete(tp.overrides, override.Prefix)
+				tp.rebuild()
+			}
+		})
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.overrides[override.Prefix] = &override
+	tp.rebuild()
+
+	return &override, nil
+}
+
+// RemoveOverride removes runtime timeout of the route prefix, empty prefix removes all overrides
+func (tp *TimeoutPolicy) RemoveOverride(prefix string) bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	if prefix == "" {
+		removed := len(tp.overrides) > 0
+		tp.overrides = map[string]*TimeoutOverride{}
+		tp.rebuild()
+		return removed
+	}
+
+	if _, found := tp.overrides[prefix]; !found {
+		return false
+	}
+	delete(tp.overrides, prefix)
+	tp.rebuild()
+	return true
+}
+
+// Snapshot returns the effective timeout table
+func (tp *TimeoutPolicy) Snapshot() TimeoutPolicySnapshot {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+
+	snapshot := TimeoutPolicySnapshot{
+		Default: tp.defaultTimeout.String(),
+		Methods: tp.methods,
+		Routes:  []TimeoutRoute{},
+	}
+	for _, prefix := range tp.prefixes {
+		timeout, source := tp.routeTimeout(prefix)
+		route := TimeoutRoute{
+			Prefix:  prefix,
+			Timeout: timeout.String(),
+			Source:  source,
+		}
+		if source == TimeoutSourceOverride {
+			route.Expires = tp.overrides[prefix].Expires
+		}
+		snapshot.Routes = append(snapshot.Routes, route)
+	}
+	return snapshot
+}
+
+// rebuild refreshes sorted prefixes and the timeout gauge, caller must hold the lock
+func (tp *TimeoutPolicy) rebuild() {
+	prefixes := make([]string, 0, len(tp.routes)+len(tp.overrides))
+	for prefix := range tp.routes {
+		prefixes = append(prefixes, prefix)
+	}
+	for prefix := range tp.overrides {
+		if _, found := tp.routes[prefix]; !found {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	tp.prefixes = prefixes
+
+	tp.monitor.RouteTimeoutGauge.Reset()
+	tp.monitor.RouteTimeoutGauge.WithLabelValues(tp.config.App, TimeoutSourceDefault, TimeoutSourceDefault).
+		Set(tp.defaultTimeout.Seconds())
+	for _, prefix := range prefixes {
+		timeout, source := tp.routeTimeout(prefix)
+		tp.monitor.RouteTimeoutGauge.WithLabelValues(tp.config.App, prefix, source).Set(timeout.Seconds())
+	}
+}
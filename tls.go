@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// client certificate policies, see --tls-client-auth
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+var (
+	tlsClientAuths = map[string]tls.ClientAuthType{
+		ClientAuthNone:     tls.NoClientCert,
+		ClientAuthOptional: tls.VerifyClientCertIfGiven,
+		ClientAuthRequire:  tls.RequireAndVerifyClientCert,
+	}
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	tlsCurves = map[string]tls.CurveID{
+		"x25519": tls.X25519,
+		"p256":   tls.CurveP256,
+		"p384":   tls.CurveP384,
+		"p521":   tls.CurveP521,
+	}
+)
+
+// NewTlsConfig creates TLS configuration of the main server, nil is returned when TLS is disabled.
+// Cipher suites and curves left empty use Go defaults, which are kept up to date with current recommendations.
+// The certificate is taken from the reloader on every handshake, so renewed certificates apply without restart.
+func NewTlsConfig(config *Config, certificates *CertificateReloader) (*tls.Config, error) {
+	clientAuth, found := tlsClientAuths[config.TlsClientAuth]
+	if !found {
+		return nil, fmt.Errorf("unsupported %s %q, expected one of %s, %s, %s", TlsClientAuth, config.TlsClientAuth, ClientAuthNone, ClientAuthOptional, ClientAuthRequire)
+	}
+	if !certificates.Enabled() {
+		if clientAuth != tls.NoClientCert || config.TlsClientCa != "" {
+			return nil, fmt.Errorf("%s and %s require TLS, set %s and %s", TlsClientAuth, TlsClientCa, TlsCert, TlsKey)
+		}
+		return nil, nil
+	}
+	clientCas, err := loadClientCas(config, clientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion, found := tlsVersions[config.TlsMinVersion]
+	if !found {
+		return nil, fmt.Errorf("unsupported TLS version %q, expected one of 1.0, 1.1, 1.2, 1.3", config.TlsMinVersion)
+	}
+
+	cipherSuites, err := parseCipherSuites(config.TlsCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	var curves []tls.CurveID
+	for _, name := range config.TlsCurves {
+		curve, found := tlsCurves[strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "-", ""))]
+		if !found {
+			return nil, fmt.Errorf("unsupported TLS curve %q, expected one of X25519, P256, P384, P521", name)
+		}
+		curves = append(curves, curve)
+	}
+
+	var alpn []string
+	for _, protocol := range config.TlsAlpn {
+		protocol = strings.TrimSpace(protocol)
+		if protocol != "h2" && protocol != "http/1.1" {
+			return nil, fmt.Errorf("unsupported ALPN protocol %q, expected h2 or http/1.1", protocol)
+		}
+		alpn = append(alpn, protocol)
+	}
+	if len(alpn) == 0 {
+		return nil, fmt.Errorf("%s must contain at least one protocol", TlsAlpn)
+	}
+	if containsString(alpn, "h2") && len(cipherSuites) > 0 && minVersion < tls.VersionTLS13 &&
+		!containsCipherSuite(cipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) &&
+		!containsCipherSuite(cipherSuites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		return nil, fmt.Errorf("h2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 cipher suite")
+	}
+
+	return &tls.Config{
+		GetCertificate:         certificates.GetCertificate,
+		MinVersion:             minVersion,
+		CipherSuites:           cipherSuites,
+		CurvePreferences:       curves,
+		SessionTicketsDisabled: !config.TlsSessionTickets,
+		NextProtos:             alpn,
+		ClientAuth:             clientAuth,
+		ClientCAs:              clientCas,
+	}, nil
+}
+
+// loadClientCas loads CAs client certificates are verified against, system roots are never used for clients
+func loadClientCas(config *Config, clientAuth tls.ClientAuthType) (*x509.CertPool, error) {
+	if clientAuth == tls.NoClientCert {
+		if config.TlsClientCa != "" {
+			return nil, fmt.Errorf("%s is set but %s is %s", TlsClientCa, TlsClientAuth, ClientAuthNone)
+		}
+		return nil, nil
+	}
+	if config.TlsClientCa == "" {
+		return nil, fmt.Errorf("%s %s requires %s", TlsClientAuth, config.TlsClientAuth, TlsClientCa)
+	}
+
+	bundle, err := os.ReadFile(config.TlsClientCa)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", config.TlsClientCa)
+	}
+	return pool, nil
+}
+
+// parseCipherSuites translates IANA cipher suite names, suites with known security issues are rejected
+func parseCipherSuites(names []string) ([]uint16, error) {
+	supported := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		supported[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		id, found := supported[name]
+		if !found {
+			return nil, fmt.Errorf("unsupported or insecure TLS cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+func containsCipherSuite(suites []uint16, suite uint16) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+// configureTls enables TLS on the server, HTTP/2 is disabled when it's not allowed by ALPN configuration
+func configureTls(srv *http.Server, tlsConfig *tls.Config) {
+	srv.TLSConfig = tlsConfig
+	if !containsString(tlsConfig.NextProtos, "h2") {
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+}
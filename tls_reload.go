@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertificateReloader serves the TLS certificate and replaces it when --tls-cert or --tls-key files change
+// (cert-manager, certbot renewals) or on SIGHUP. Handshakes in progress keep the previous certificate, an invalid
+// pair (e.g. the key is not written yet) is not applied and the current certificate is served until the next check.
+type CertificateReloader struct {
+	certificate atomic.Pointer[tls.Certificate]
+	mutex       sync.Mutex   // serializes reloads of the file check and SIGHUP
+	modTimes    [2]time.Time // modification times of the certificate and key seen by the last reload
+
+	config  *Config
+	monitor *Monitor
+	logger  *logrus.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewCertificateReloader(config *Config, monitor *Monitor, logger *logrus.Logger) (*CertificateReloader, error) {
+	cr := &CertificateReloader{
+		config:  config,
+		monitor: monitor,
+		logger:  logger,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if config.TlsCert == "" && config.TlsKey == "" {
+		return cr, nil
+	}
+	if config.TlsCert == "" || config.TlsKey == "" {
+		return nil, fmt.Errorf("both %s and %s must be set", TlsCert, TlsKey)
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Enabled reports whether TLS is configured
+func (cr *CertificateReloader) Enabled() bool {
+	return cr.config.TlsCert != ""
+}
+
+// Start checks the files on the interval, SIGHUP reloads work without it
+func (cr *CertificateReloader) Start() {
+	if !cr.Enabled() || cr.config.TlsReloadInterval == 0 {
+		close(cr.done)
+		return
+	}
+	go cr.run()
+}
+
+func (cr *CertificateReloader) Stop() {
+	if cr.Enabled() && cr.config.TlsReloadInterval > 0 {
+		close(cr.stop)
+	}
+	<-cr.done
+}
+
+// GetCertificate returns the current certificate, it's used as tls.Config.GetCertificate
+func (cr *CertificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.certificate.Load(), nil
+}
+
+func (cr *CertificateReloader) run() {
+	defer close(cr.done)
+
+	ticker := time.NewTicker(cr.config.TlsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cr.stop:
+			return
+		case <-ticker.C:
+		}
+		if !cr.changed() {
+			continue
+		}
+		if err := cr.Reload(); err != nil {
+			cr.logger.Errorf("could not reload TLS certificate, the current one is served: %s", err)
+		}
+	}
+}
+
+// changed reports whether the certificate or key file was modified since the last reload, invalid files are
+// tried again only after they change
+func (cr *CertificateReloader) changed() bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	for i, modTime := range cr.statFiles() {
+		if !modTime.Equal(cr.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// statFiles returns modification times of the certificate and key, zero time for missing files
+func (cr *CertificateReloader) statFiles() [2]time.Time {
+	var modTimes [2]time.Time
+	for i, path := range []string{cr.config.TlsCert, cr.config.TlsKey} {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// Reload loads the certificate and key, the current certificate is kept when they are not valid
+func (cr *CertificateReloader) Reload() error {
+	if err := cr.load(); err != nil {
+		cr.monitor.TlsReloadsCounter.WithLabelValues(cr.config.App, ReloadResultError).Inc()
+		return err
+	}
+	cr.monitor.TlsReloadsCounter.WithLabelValues(cr.config.App, ReloadResultSuccess).Inc()
+	return nil
+}
+
+func (cr *CertificateReloader) load() error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	cr.modTimes = cr.statFiles()
+
+	certificate, err := tls.LoadX509KeyPair(cr.config.TlsCert, cr.config.TlsKey)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("could not parse TLS certificate: %w", err)
+	}
+	certificate.Leaf = leaf
+
+	previous := cr.certificate.Swap(&certificate)
+	cr.monitor.TlsCertExpiryGauge.WithLabelValues(cr.config.App).Set(float64(leaf.NotAfter.Unix()))
+	if previous != nil {
+		cr.logger.Infof("TLS certificate reloaded, %s valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"net"
+	"os"
+	"time"
+)
+
+// Validate checks the configuration without starting the server or talking to FPM, it's meant for CI pipelines.
+// Unlike Run it doesn't execute the index file, the socket is only connected to verify it's accessible.
+func (d *Doctor) Validate() []DoctorCheck {
+	d.checks = nil
+
+	if err := d.config.Validate(); err != nil {
+		d.report("config", DoctorFail, err.Error(), "fix the flag, see gophpfpm --help")
+		return d.checks
+	}
+	d.report("config", DoctorPass, "flags are valid", "")
+
+	d.checkDefinitions()
+	d.checkStaticFolders()
+	d.checkSocketFile()
+	d.checkIndexReadable()
+	d.checkPorts()
+
+	return d.checks
+}
+
+// checkDefinitions parses values the server parses at startup (routes, rules, certificates, ...)
+func (d *Doctor) checkDefinitions() {
+	monitor := NewMonitor(d.logger)
+	constructors := []func() error{
+		func() error { _, err := NewParamsBuilder(d.config); return err },
+		func() error { _, err := NewPriorityClasses(d.config); return err },
+		func() error { _, err := NewResponseCompressor(d.config); return err },
+		func() error { _, err := NewSubFilter(d.config); return err },
+		func() error { _, err := NewAssetManifest(d.config); return err },
+		func() error { _, err := NewAbBuckets(d.config); return err },
+		func() error { _, err := NewTimeoutPolicy(d.config, monitor); return err },
+		func() error { _, err := NewTenants(d.config, monitor); return err },
+		func() error { _, err := NewForwardAuth(d.config, monitor); return err },
+		func() error { _, err := NewBodyScanner(d.config, monitor); return err },
+		func() error { _, err := NewFallbackPages(d.config); return err },
+		func() error { _, err := NewAccessRules(d.config, monitor); return err },
+		func() error { _, err := NewBandwidthShaper(d.config); return err },
+		func() error {
+			certificates, err := NewCertificateReloader(d.config, monitor, d.logger)
+			if err != nil {
+				return err
+			}
+			_, err = NewTlsConfig(d.config, certificates)
+			return err
+		},
+	}
+
+	var errs []error
+	for _, constructor := range constructors {
+		if err := constructor(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		d.report("definitions", DoctorFail, errors.Join(errs...).Error(), "fix the flag value, see gophpfpm --help for the format")
+		return
+	}
+	d.report("definitions", DoctorPass, "routes, rules and files are valid", "")
+}
+
+// checkSocketFile verifies the unix socket exists and the proxy user may connect to it
+func (d *Doctor) checkSocketFile() {
+	network, target := d.config.FpmNetwork()
+	if network != "unix" || d.config.SshHost != "" {
+		d.report("socket", DoctorSkip, fmt.Sprintf("FPM listens on %s %s, run gophpfpm doctor to check it", network, target), "")
+		return
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		d.report("socket", DoctorFail, err.Error(), "start PHP-FPM and check its listen directive matches --"+ParamSocket)
+		return
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		d.report("socket", DoctorFail, fmt.Sprintf("%s is not a unix socket", target), "point --"+ParamSocket+" to the FPM pool listen socket")
+		return
+	}
+	conn, err := net.DialTimeout(network, target, time.Second)
+	if err != nil {
+		d.report("socket", DoctorFail, err.Error(), "check the proxy user may connect (listen.owner, listen.group, listen.mode in the pool config)")
+		return
+	}
+	_ = conn.Close()
+	d.report("socket", DoctorPass, fmt.Sprintf("%s is accessible", target), "")
+}
+
+// checkIndexReadable verifies the index file is readable, FPM on another host (TCP, SSH) may see other files
+func (d *Doctor) checkIndexReadable() {
+	network, _ := d.config.FpmNetwork()
+	remote := network != "unix" || d.config.SshHost != ""
+
+	file, err := os.Open(d.config.IndexFile)
+	if err == nil {
+		_ = file.Close()
+		d.report("index file", DoctorPass, fmt.Sprintf("%s is readable", d.config.IndexFile), "")
+		return
+	}
+	if remote && errors.Is(err, os.ErrNotExist) {
+		d.report("index file", DoctorWarn, err.Error(), "FPM runs elsewhere, make sure the path exists as seen by FPM")
+		return
+	}
+	d.report("index file", DoctorFail, err.Error(), "--"+ParamIndex+" must be a readable PHP script")
+}
+
+// NewValidateCommand creates command checking the configuration, it exits with status 1 when any check fails
+func NewValidateCommand(logger *log.Logger) *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate",
+		Short: "Check the configuration without starting the server",
+		Long:  `Check flags and the --config file (unknown keys, formats of definitions), static folders, FPM socket permissions, index file readability and port availability without starting the server. It exits with status 1 on failure, so CI pipelines can reject bad configs.`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetLevel(log.FatalLevel)
+
+			var checks []DoctorCheck
+			config, err := LoadConfig(cmd.Flags(), logger)
+			if err != nil {
+				checks = []DoctorCheck{{Name: "config", Status: DoctorFail, Detail: err.Error(), Hint: "fix the flag or the config file"}}
+			} else {
+				checks = NewDoctor(config, logger).Validate()
+			}
+
+			if failed := printDoctorReport(checks); failed > 0 {
+				fmt.Printf("\n%d check(s) failed\n", failed)
+				os.Exit(1)
+			}
+		},
+	}
+}